@@ -1,15 +1,26 @@
 package main
 
 import (
+	"fmt"
 	"os"
 	"os/signal"
 	"syscall"
 
 	"github.com/sayan-biswas/file-store/pkg/server/server"
+	"github.com/spf13/pflag"
 )
 
 func main() {
 
+	// run a subcommand against the running server
+	if pflag.NArg() > 0 {
+		if err := server.Command(pflag.Args()); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// start server in a separate Go routine
 	go server.Start()
 
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var bucket = &cobra.Command{
+	Use:   "bucket",
+	Long:  "Manage the buckets of store",
+	Short: "Buckets",
+}
+
+var bucketList = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Long:    "List the buckets of store",
+	Short:   "List buckets",
+	Args:    cobra.NoArgs,
+	Run:     listBuckets,
+}
+
+var bucketCreate = &cobra.Command{
+	Use:   "create",
+	Long:  "Create an empty bucket",
+	Short: "Create bucket",
+	Args:  cobra.ExactArgs(1),
+	Run:   createBucket,
+}
+
+var bucketDelete = &cobra.Command{
+	Use:     "delete",
+	Aliases: []string{"rm"},
+	Long:    "Delete a bucket with all its files",
+	Short:   "Delete bucket",
+	Args:    cobra.ExactArgs(1),
+	Run:     deleteBucket,
+}
+
+func init() {
+	store.AddCommand(bucket)
+	bucket.AddCommand(bucketList, bucketCreate, bucketDelete)
+}
+
+func listBuckets(cmd *cobra.Command, args []string) {
+	storeURL, err := url.Parse(storeConfig.URL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	storeURL.Path = "buckets"
+	req, err := http.NewRequest(http.MethodGet, storeURL.String(), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stdout, res.Status)
+		return
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	type Bucket struct {
+		Name    string
+		Created time.Time
+	}
+	var buckets []Bucket
+	if err := json.Unmarshal(body, &buckets); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "%-20s %s \n", "BUCKET", "CREATED")
+	fmt.Fprintf(os.Stdout, "%-20s %s \n", "------", "-------")
+	for _, bucket := range buckets {
+		fmt.Fprintf(os.Stdout, "%-20s %s \n", bucket.Name, bucket.Created.Local().Format("2006-01-02 15:04:05"))
+	}
+}
+
+func createBucket(cmd *cobra.Command, args []string) {
+	res, err := bucketRequest(http.MethodPut, args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusCreated:
+		fmt.Fprintf(os.Stdout, "%s - Created successfully\n", args[0])
+	case http.StatusConflict:
+		fmt.Fprintf(os.Stdout, "%s - Bucket exists\n", args[0])
+	case http.StatusBadRequest:
+		reason, _ := io.ReadAll(res.Body)
+		fmt.Fprintf(os.Stdout, "%s - %s\n", args[0], reason)
+	default:
+		fmt.Fprintln(os.Stdout, res.Status)
+	}
+}
+
+func deleteBucket(cmd *cobra.Command, args []string) {
+	res, err := bucketRequest(http.MethodDelete, args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusNoContent:
+		fmt.Fprintf(os.Stdout, "%s - Deleted successfully\n", args[0])
+	case http.StatusNotFound:
+		fmt.Fprintf(os.Stdout, "%s - Bucket not found\n", args[0])
+	default:
+		fmt.Fprintln(os.Stdout, res.Status)
+	}
+}
+
+func bucketRequest(method string, name string) (*http.Response, error) {
+	storeURL, err := url.Parse(storeConfig.URL)
+	if err != nil {
+		return nil, err
+	}
+	storeURL.Path = "buckets/" + name
+	req, err := http.NewRequest(method, storeURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
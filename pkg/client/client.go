@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"time"
@@ -16,8 +17,39 @@ var store = &cobra.Command{
 }
 
 var storeConfig Config
+
+// Bucket set by the --bucket flag, over the bucket of the config
+var bucketFlag string
+
+func init() {
+	store.PersistentFlags().StringVar(&bucketFlag, "bucket", "", "bucket of the files, default from the config")
+}
+
+// Returns the path of an endpoint of the files of the store, in the bucket
+// of the flag or the config
+func storePath(path string) string {
+	bucket := storeConfig.Bucket
+	if bucketFlag != "" {
+		bucket = bucketFlag
+	}
+	if bucket == "" {
+		return "store" + path
+	}
+	return "buckets/" + bucket + "/store" + path
+}
+
+// Number of files uploaded at the same time
+const uploads = 4
+
+// Uploads and downloads are streamed, so only connecting and waiting for
+// the response are limited in time
 var client = &http.Client{
-	Timeout: time.Second * 10,
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: time.Second * 10}).DialContext,
+		TLSHandshakeTimeout:   time.Second * 10,
+		ResponseHeaderTimeout: time.Second * 10,
+	},
 }
 
 func Execute() {
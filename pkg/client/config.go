@@ -12,13 +12,15 @@ import (
 
 type Config struct {
 	URL string
+	// Bucket of the files, the whole store when empty
+	Bucket string `json:",omitempty"`
 }
 
 const fingerprint string = "703273357638792F"
 
 var config = &cobra.Command{
 	Use:   "config",
-	Long:  "Configure store URL",
+	Long:  "Configure store URL and default bucket",
 	Short: "Configure store",
 	Args:  cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
@@ -34,9 +36,11 @@ func init() {
 }
 
 func setConfig() error {
-	var storeURL string
+	var storeURL, bucket string
 	fmt.Printf("Store URL: ")
 	fmt.Scanln(&storeURL)
+	fmt.Printf("Bucket (empty for none): ")
+	fmt.Scanln(&bucket)
 	res, err := client.Get(storeURL)
 	if err != nil {
 		return err
@@ -47,7 +51,7 @@ func setConfig() error {
 	if fingerprint != res.Header.Get("Store") {
 		return errors.New("invalid Store URL")
 	}
-	configJSON, err := json.Marshal(&Config{URL: storeURL})
+	configJSON, err := json.Marshal(&Config{URL: storeURL, Bucket: bucket})
 	if err != nil {
 		return err
 	}
@@ -29,7 +29,7 @@ func wordCount(cmd *cobra.Command, args []string) {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
-	storeURL.Path = "store/count"
+	storeURL.Path = storePath("/count")
 
 	req, err := http.NewRequest(http.MethodGet, storeURL.String(), nil)
 	if err != nil {
@@ -0,0 +1,84 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	store.AddCommand(du)
+}
+
+var du = &cobra.Command{
+	Use:   "du",
+	Long:  "Display the space used by the store against its quotas",
+	Short: "Disk usage",
+	Args:  cobra.NoArgs,
+	Run:   diskUsage,
+}
+
+func diskUsage(cmd *cobra.Command, args []string) {
+	storeURL, err := url.Parse(storeConfig.URL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	storeURL.Path = "store/usage"
+
+	req, err := http.NewRequest(http.MethodGet, storeURL.String(), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stdout, res.Status)
+		return
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	type Quota struct {
+		Used  int64
+		Limit int64
+	}
+	var usage struct {
+		PhysicalBytes Quota
+		LogicalBytes  Quota
+		Files         Quota
+		MaxFileSize   int64
+	}
+	if err := json.Unmarshal(body, &usage); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "Physical: %s\n", quotaUsage(usage.PhysicalBytes.Used, usage.PhysicalBytes.Limit))
+	fmt.Fprintf(os.Stdout, "Logical:  %s\n", quotaUsage(usage.LogicalBytes.Used, usage.LogicalBytes.Limit))
+	fmt.Fprintf(os.Stdout, "Files:    %s\n", quotaUsage(usage.Files.Used, usage.Files.Limit))
+	if usage.MaxFileSize > 0 {
+		fmt.Fprintf(os.Stdout, "Max file size: %d\n", usage.MaxFileSize)
+	}
+}
+
+func quotaUsage(used int64, limit int64) string {
+	if limit == 0 {
+		return fmt.Sprintf("%d (no limit)", used)
+	}
+	return fmt.Sprintf("%d of %d (%.1f%%)", used, limit, float64(used)*100/float64(limit))
+}
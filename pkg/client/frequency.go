@@ -36,7 +36,7 @@ func wordFrequency(cmd *cobra.Command, args []string) {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
-	storeURL.Path = "store/frequency"
+	storeURL.Path = storePath("/frequency")
 	values := storeURL.Query()
 	values.Add("order", order)
 	values.Add("limit", strconv.Itoa(limit))
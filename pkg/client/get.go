@@ -6,7 +6,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"path"
+	"path/filepath"
 
 	"github.com/spf13/cobra"
 )
@@ -32,7 +32,7 @@ func getFile(cmd *cobra.Command, args []string) {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
-	storeURL.Path = "store"
+	storeURL.Path = storePath("")
 	values := storeURL.Query()
 	values.Add("file", args[0])
 	storeURL.RawQuery = values.Encode()
@@ -53,7 +53,13 @@ func getFile(cmd *cobra.Command, args []string) {
 		return
 	}
 
-	file, err := os.Create(path.Join(location, args[0]))
+	// files in directories of the store are saved in the same directories
+	filePath := filepath.Join(location, filepath.FromSlash(args[0]))
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	file, err := os.Create(filePath)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return
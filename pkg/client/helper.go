@@ -1,20 +1,31 @@
 package client
 
 import (
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+// Time to live of the uploaded files, set by the --ttl flag of add and
+// update
+var uploadTTL time.Duration
+
 func checkFile(fileName string) (bool, error) {
 	storeURL, err := url.Parse(storeConfig.URL)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return false, err
 	}
-	storeURL.Path = "store/check/file"
+	storeURL.Path = storePath("/check/file")
 	values := storeURL.Query()
 	values.Add("file", fileName)
 	storeURL.RawQuery = values.Encode()
@@ -40,7 +51,7 @@ func checkSHA(SHA []byte) (bool, error) {
 		fmt.Fprintln(os.Stderr, err)
 		return false, err
 	}
-	storeURL.Path = "store/check/sha"
+	storeURL.Path = storePath("/check/sha")
 	values := storeURL.Query()
 	values.Add("sha", hex.EncodeToString(SHA))
 	storeURL.RawQuery = values.Encode()
@@ -59,3 +70,116 @@ func checkSHA(SHA []byte) (bool, error) {
 	}
 	return false, nil
 }
+
+// Local file and its name in the store
+type localFile struct {
+	path string
+	name string
+}
+
+// Returns the files at a path, every file under it for a directory, with
+// their names in the store. Paths under the working directory keep their
+// relative path, other paths keep the path from their last element.
+func localFiles(root string) ([]localFile, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	base := filepath.Dir(abs)
+	if wd, err := os.Getwd(); err == nil {
+		if rel, err := filepath.Rel(wd, abs); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			base = wd
+		}
+	}
+	files := []localFile{}
+	err = filepath.Walk(abs, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(base, filePath)
+		if err != nil {
+			return err
+		}
+		files = append(files, localFile{path: filePath, name: filepath.ToSlash(name)})
+		return nil
+	})
+	return files, err
+}
+
+// Compute the SHA of a file and rewind it
+func fileSHA(file *os.File) ([]byte, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
+
+// Upload a file as a multipart form streamed from the file, without holding
+// it in memory. When the store already has the data only the SHA is sent.
+func upload(method string, file *os.File, fileName string, SHA []byte, SHAExists bool) (*http.Response, error) {
+	storeURL, err := url.Parse(storeConfig.URL)
+	if err != nil {
+		return nil, err
+	}
+	storeURL.Path = storePath("")
+
+	reader, pipe := io.Pipe()
+	writer := multipart.NewWriter(pipe)
+	go func() {
+		pipe.CloseWithError(writeUpload(writer, file, fileName, SHA, SHAExists))
+	}()
+
+	req, err := http.NewRequest(method, storeURL.String(), reader)
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return client.Do(req)
+}
+
+// Write the form fields and the file of an upload
+func writeUpload(writer *multipart.Writer, file *os.File, fileName string, SHA []byte, SHAExists bool) error {
+	ioWriter, err := writer.CreateFormField("name")
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(ioWriter, fileName); err != nil {
+		return err
+	}
+	ioWriter, err = writer.CreateFormField("SHA")
+	if err != nil {
+		return err
+	}
+	if SHAExists {
+		if _, err := ioWriter.Write(SHA); err != nil {
+			return err
+		}
+	}
+	if uploadTTL > 0 {
+		ioWriter, err = writer.CreateFormField("ttl")
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(ioWriter, uploadTTL.String()); err != nil {
+			return err
+		}
+	}
+	ioWriter, err = writer.CreateFormFile("file", path.Base(fileName))
+	if err != nil {
+		return err
+	}
+	if !SHAExists {
+		if _, err := io.Copy(ioWriter, file); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var history = &cobra.Command{
+	Use:   "history",
+	Long:  "List the versions of a file in store",
+	Short: "File versions",
+	Args:  cobra.ExactArgs(1),
+	Run:   listVersions,
+}
+
+func init() {
+	store.AddCommand(history)
+}
+
+func listVersions(cmd *cobra.Command, args []string) {
+	storeURL, err := url.Parse(storeConfig.URL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	storeURL.Path = storePath("/versions")
+	values := storeURL.Query()
+	values.Add("file", args[0])
+	storeURL.RawQuery = values.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, storeURL.String(), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stdout, res.Status)
+		return
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	type Version struct {
+		Version uint64
+		SHA     string
+		Size    int64
+		Time    time.Time
+	}
+	var versions []Version
+	if err := json.Unmarshal(body, &versions); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "%-8s %-20s %10s %s \n", "VERSION", "TIME", "BYTES", "SHA")
+	fmt.Fprintf(os.Stdout, "%-8s %-20s %10s %s \n", "-------", "----", "-----", "---")
+	for _, version := range versions {
+		fmt.Fprintf(os.Stdout, "%-8d %-20s %10d %.12s \n", version.Version,
+			version.Time.Local().Format("2006-01-02 15:04:05"), version.Size, version.SHA)
+	}
+}
@@ -8,24 +8,43 @@ import (
 	"net/url"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
-var details bool
+var (
+	details   bool
+	recursive bool
+	prefix    string
+	glob      string
+	sortBy    string
+	reverse   bool
+	listLimit int
+)
+
+// Number of files read per request, the pages are read until the end of the
+// list or the limit
+const listPage = 1000
 
 var list = &cobra.Command{
 	Use:     "list",
 	Aliases: []string{"ls"},
-	Long:    "List files from store",
+	Long:    "List files from store, in the root or the given directory",
 	Short:   "List files",
-	Args:    cobra.NoArgs,
+	Args:    cobra.MaximumNArgs(1),
 	Run:     listFiles,
 }
 
 func init() {
 	store.AddCommand(list)
 	list.Flags().BoolVarP(&details, "details", "d", false, "details = true | false")
+	list.Flags().BoolVarP(&recursive, "recursive", "r", false, "list the files of sub directories")
+	list.Flags().StringVarP(&prefix, "prefix", "p", "", "only the files whose name starts with the prefix")
+	list.Flags().StringVarP(&glob, "glob", "g", "", "only the files whose base name matches the pattern, ex: '*.txt'")
+	list.Flags().StringVarP(&sortBy, "sort", "s", "name", "sort by name | size | words | modified")
+	list.Flags().BoolVar(&reverse, "reverse", false, "sort in descending order")
+	list.Flags().IntVarP(&listLimit, "limit", "n", 0, "maximum number of files, 0 for all")
 }
 
 func listFiles(cmd *cobra.Command, args []string) {
@@ -34,60 +53,101 @@ func listFiles(cmd *cobra.Command, args []string) {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
-	storeURL.Path = "store/list"
+	storeURL.Path = storePath("/list")
 	values := storeURL.Query()
 	values.Add("details", strconv.FormatBool(details))
-	storeURL.RawQuery = values.Encode()
+	values.Add("recursive", strconv.FormatBool(recursive))
+	values.Add("prefix", prefix)
+	values.Add("glob", glob)
+	values.Add("sort", sortBy)
+	values.Add("reverse", strconv.FormatBool(reverse))
+	if len(args) > 0 {
+		values.Add("dir", args[0])
+	}
+
+	if details {
+		fmt.Fprintf(os.Stdout, "%-20s %10s %10s %-20s %s \n", "FILE NAME", "BYTES", "WORDS", "MODIFIED", "EXPIRES")
+		fmt.Fprintf(os.Stdout, "%-20s %10s %10s %-20s %s \n", "---------", "-----", "-----", "--------", "-------")
+	} else {
+		fmt.Fprintf(os.Stdout, "%s \n", "FILE NAME")
+		fmt.Fprintf(os.Stdout, "%s \n", "---------")
+	}
+	for listed := 0; listLimit == 0 || listed < listLimit; {
+		page := listPage
+		if listLimit > 0 && listLimit-listed < page {
+			page = listLimit - listed
+		}
+		values.Set("limit", strconv.Itoa(page))
+		storeURL.RawQuery = values.Encode()
+		count, next, err := printFiles(storeURL.String())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		listed += count
+		if next == "" {
+			return
+		}
+		values.Set("after", next)
+	}
+}
 
-	req, err := http.NewRequest(http.MethodGet, storeURL.String(), nil)
+// Print a page of the list, returns the number of files and the cursor of
+// the next page
+func printFiles(endpoint string) (int, string, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
+		return 0, "", err
 	}
 
 	res, err := client.Do(req)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
+		return 0, "", err
 	}
+	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		fmt.Fprintln(os.Stdout, res.StatusCode)
-		return
+		reason, _ := io.ReadAll(res.Body)
+		return 0, "", fmt.Errorf("%s %s", res.Status, reason)
 	}
-	defer res.Body.Close()
 
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
+		return 0, "", err
 	}
+	next := res.Header.Get("X-Store-Next")
 
 	type File struct {
 		Name      string
 		SHA       string
 		Size      int64
 		WordCount int64
+		Expires   *time.Time
+		Modified  *time.Time
 	}
 
 	if details {
 		var files []File
 		if err := json.Unmarshal(body, &files); err != nil {
-			fmt.Fprintln(os.Stderr, err)
+			return 0, "", err
 		}
-		fmt.Fprintf(os.Stdout, "%-20s %10s %10s \n", "FILE NAME", "BYTES", "WORDS")
-		fmt.Fprintf(os.Stdout, "%-20s %10s %10s \n", "---------", "-----", "-----")
 		for _, file := range files {
-			fmt.Fprintf(os.Stdout, "%-20s %10d %10d \n", file.Name, file.Size, file.WordCount)
-		}
-	} else {
-		var files []string
-		if err := json.Unmarshal(body, &files); err != nil {
-			fmt.Fprintln(os.Stderr, err)
-		}
-		fmt.Fprintf(os.Stdout, "%s \n", "FILE NAME")
-		fmt.Fprintf(os.Stdout, "%s \n", "---------")
-		for _, file := range files {
-			fmt.Fprintf(os.Stdout, "%s \n", file)
+			modified, expires := "-", "-"
+			if file.Modified != nil {
+				modified = file.Modified.Local().Format("2006-01-02 15:04:05")
+			}
+			if file.Expires != nil {
+				expires = file.Expires.Local().Format(time.RFC3339)
+			}
+			fmt.Fprintf(os.Stdout, "%-20s %10d %10d %-20s %s \n", file.Name, file.Size, file.WordCount, modified, expires)
 		}
+		return len(files), next, nil
+	}
+	var files []string
+	if err := json.Unmarshal(body, &files); err != nil {
+		return 0, "", err
+	}
+	for _, file := range files {
+		fmt.Fprintf(os.Stdout, "%s \n", file)
 	}
+	return len(files), next, nil
 }
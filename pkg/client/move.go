@@ -0,0 +1,76 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	store.AddCommand(move, copyFile)
+}
+
+var move = &cobra.Command{
+	Use:     "mv",
+	Aliases: []string{"rename"},
+	Long:    "Rename a file in store, without sending its data",
+	Short:   "Rename file",
+	Args:    cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		sendMove("/rename", "Renamed", http.StatusOK, args)
+	},
+}
+
+var copyFile = &cobra.Command{
+	Use:     "cp",
+	Aliases: []string{"copy"},
+	Long:    "Copy a file in store, without sending its data",
+	Short:   "Copy file",
+	Args:    cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		sendMove("/copy", "Copied", http.StatusCreated, args)
+	},
+}
+
+// Rename or copy the file of the first argument to the second one
+func sendMove(path string, done string, status int, args []string) {
+	storeURL, err := url.Parse(storeConfig.URL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	storeURL.Path = storePath(path)
+	values := storeURL.Query()
+	values.Add("file", args[0])
+	values.Add("to", args[1])
+	storeURL.RawQuery = values.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, storeURL.String(), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case status:
+		fmt.Fprintf(os.Stdout, "%s - %s to %s\n", args[0], done, args[1])
+	case http.StatusNotFound:
+		fmt.Fprintf(os.Stdout, "%s - File not found\n", args[0])
+	case http.StatusConflict:
+		fmt.Fprintf(os.Stdout, "%s - File already exists\n", args[1])
+	case http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage:
+		reason, _ := io.ReadAll(res.Body)
+		fmt.Fprintf(os.Stdout, "%s - %s\n", args[1], reason)
+	default:
+		fmt.Fprintln(os.Stdout, res.Status)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/user"
 
 	"github.com/spf13/cobra"
 )
@@ -28,7 +29,7 @@ func removeFile(cmd *cobra.Command, args []string) {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
-	storeURL.Path = "store"
+	storeURL.Path = storePath("")
 	values := storeURL.Query()
 	values.Add("file", args[0])
 	storeURL.RawQuery = values.Encode()
@@ -38,6 +39,10 @@ func removeFile(cmd *cobra.Command, args []string) {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
+	// recorded by the server as the one who removed the file
+	if current, err := user.Current(); err == nil {
+		req.Header.Set("X-Store-User", current.Username)
+	}
 	res, err := client.Do(req)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
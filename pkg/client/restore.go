@@ -0,0 +1,57 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+
+	"github.com/spf13/cobra"
+)
+
+var restore = &cobra.Command{
+	Use:   "restore",
+	Long:  "Restore a previous version of a file in store",
+	Short: "Restore file version",
+	Args:  cobra.ExactArgs(2),
+	Run:   restoreVersion,
+}
+
+func init() {
+	store.AddCommand(restore)
+}
+
+func restoreVersion(cmd *cobra.Command, args []string) {
+	if _, err := strconv.ParseUint(args[1], 10, 64); err != nil {
+		fmt.Fprintln(os.Stderr, "invalid version", args[1])
+		return
+	}
+	storeURL, err := url.Parse(storeConfig.URL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	storeURL.Path = storePath("/restore")
+	values := storeURL.Query()
+	values.Add("file", args[0])
+	values.Add("version", args[1])
+	storeURL.RawQuery = values.Encode()
+
+	req, err := http.NewRequest(http.MethodPost, storeURL.String(), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stdout, res.Status)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "%s - Restored version %s\n", args[0], args[1])
+}
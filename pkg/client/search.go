@@ -0,0 +1,80 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var search = &cobra.Command{
+	Use:   "search",
+	Long:  "Search the text of the files in store",
+	Short: "Search files",
+	Args:  cobra.MinimumNArgs(1),
+	Run:   searchFiles,
+}
+
+var searchLimit int
+
+func init() {
+	search.Flags().IntVarP(&searchLimit, "limit", "n", 20, "Maximum number of results")
+	store.AddCommand(search)
+}
+
+func searchFiles(cmd *cobra.Command, args []string) {
+	storeURL, err := url.Parse(storeConfig.URL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	storeURL.Path = storePath("/search")
+	values := storeURL.Query()
+	values.Add("q", strings.Join(args, " "))
+	values.Add("limit", strconv.Itoa(searchLimit))
+	storeURL.RawQuery = values.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, storeURL.String(), nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stdout, res.Status)
+		return
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	type Result struct {
+		Name    string
+		Score   float64
+		Snippet string
+	}
+	var results []Result
+	if err := json.Unmarshal(body, &results); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	for _, result := range results {
+		fmt.Fprintf(os.Stdout, "%s (%.2f)\n", result.Name, result.Score)
+		fmt.Fprintf(os.Stdout, "    %s\n", result.Snippet)
+	}
+}
@@ -0,0 +1,181 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var purgeAll bool
+
+var trash = &cobra.Command{
+	Use:   "trash",
+	Long:  "Manage the files removed from store",
+	Short: "Removed files",
+}
+
+var trashList = &cobra.Command{
+	Use:     "list",
+	Aliases: []string{"ls"},
+	Long:    "List the files in the trash bin of store",
+	Short:   "List removed files",
+	Args:    cobra.NoArgs,
+	Run:     listTrash,
+}
+
+var trashRestore = &cobra.Command{
+	Use:   "restore",
+	Long:  "Restore a removed file, the most recently removed one unless an ID is given",
+	Short: "Restore removed file",
+	Args:  cobra.RangeArgs(1, 2),
+	Run:   restoreTrash,
+}
+
+var trashPurge = &cobra.Command{
+	Use:   "purge",
+	Long:  "Remove files from the trash bin for good, every entry of the file unless an ID is given",
+	Short: "Purge removed files",
+	Args:  cobra.RangeArgs(0, 2),
+	Run:   purgeTrash,
+}
+
+func init() {
+	store.AddCommand(trash)
+	trash.AddCommand(trashList, trashRestore, trashPurge)
+	trashPurge.Flags().BoolVarP(&purgeAll, "all", "a", false, "purge the whole trash bin")
+}
+
+// Returns the URL of a trash endpoint for a file and an optional ID, or for
+// the whole trash bin
+func trashURL(path string, args []string, all bool) (string, error) {
+	storeURL, err := url.Parse(storeConfig.URL)
+	if err != nil {
+		return "", err
+	}
+	storeURL.Path = path
+	values := storeURL.Query()
+	if len(args) > 0 {
+		values.Add("file", args[0])
+	}
+	if len(args) > 1 {
+		if _, err := strconv.ParseUint(args[1], 10, 64); err != nil {
+			return "", fmt.Errorf("invalid id %s", args[1])
+		}
+		values.Add("id", args[1])
+	}
+	if all {
+		values.Add("all", "true")
+	}
+	storeURL.RawQuery = values.Encode()
+	return storeURL.String(), nil
+}
+
+func listTrash(cmd *cobra.Command, args []string) {
+	endpoint, err := trashURL(storePath("/trash"), nil, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stdout, res.Status)
+		return
+	}
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	type Trashed struct {
+		Name      string
+		ID        uint64
+		Size      int64
+		Deleted   time.Time
+		DeletedBy string
+	}
+	var files []Trashed
+	if err := json.Unmarshal(body, &files); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Fprintf(os.Stdout, "%-20s %-20s %-20s %10s %s \n", "FILE NAME", "ID", "DELETED", "BYTES", "DELETED BY")
+	fmt.Fprintf(os.Stdout, "%-20s %-20s %-20s %10s %s \n", "---------", "--", "-------", "-----", "----------")
+	for _, file := range files {
+		fmt.Fprintf(os.Stdout, "%-20s %-20d %-20s %10d %s \n", file.Name, file.ID,
+			file.Deleted.Local().Format("2006-01-02 15:04:05"), file.Size, file.DeletedBy)
+	}
+}
+
+func restoreTrash(cmd *cobra.Command, args []string) {
+	endpoint, err := trashURL(storePath("/trash/restore"), args, false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		fmt.Fprintf(os.Stdout, "%s - Restored successfully\n", args[0])
+	case http.StatusConflict:
+		fmt.Fprintf(os.Stdout, "%s - A file with the same name exists\n", args[0])
+	default:
+		fmt.Fprintln(os.Stdout, res.Status)
+	}
+}
+
+func purgeTrash(cmd *cobra.Command, args []string) {
+	if purgeAll == (len(args) > 0) {
+		fmt.Fprintln(os.Stderr, "give a file name, or --all to purge the whole trash bin")
+		return
+	}
+	endpoint, err := trashURL(storePath("/trash"), args, purgeAll)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	req, err := http.NewRequest(http.MethodDelete, endpoint, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		fmt.Fprintln(os.Stdout, res.Status)
+		return
+	}
+	fmt.Fprintln(os.Stdout, "Trash purged successfully!")
+}
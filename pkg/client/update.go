@@ -1,21 +1,17 @@
 package client
 
 import (
-	"bytes"
-	"crypto/sha256"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"net/http"
-	"net/url"
 	"os"
-	"path"
 	"sync"
 
 	"github.com/spf13/cobra"
 )
 
 func init() {
+	update.Flags().DurationVar(&uploadTTL, "ttl", 0, "Time after which the files are removed, they no longer expire without it (ex: 24h)")
 	store.AddCommand(update)
 }
 
@@ -29,14 +25,26 @@ var update = &cobra.Command{
 
 func updateFile(cmd *cobra.Command, args []string) {
 	wg := &sync.WaitGroup{}
+	slots := make(chan struct{}, uploads)
 	for _, arg := range args {
-		wg.Add(1)
-		go storeUpdate(arg, wg)
+		files, err := localFiles(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		for _, file := range files {
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(file localFile) {
+				defer func() { <-slots }()
+				storeUpdate(file.path, file.name, wg)
+			}(file)
+		}
 	}
 	wg.Wait()
 }
 
-func storeUpdate(filePath string, wg *sync.WaitGroup) {
+func storeUpdate(filePath string, fileName string, wg *sync.WaitGroup) {
 	defer wg.Done()
 	file, err := os.Open(filePath)
 	if err != nil {
@@ -44,72 +52,31 @@ func storeUpdate(filePath string, wg *sync.WaitGroup) {
 		return
 	}
 	defer file.Close()
-	fileName := path.Base(file.Name())
+	SHA, err := fileSHA(file)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
-	data, err := io.ReadAll(file)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
-	}
-
-	SHA256 := sha256.Sum256(data)
-	SHA := SHA256[:]
 	SHAExists, err := checkSHA(SHA)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
 
-	var byteReader *bytes.Reader
-	var ioWriter io.Writer
-	body := &bytes.Buffer{}
-	writer := multipart.NewWriter(body)
-	defer writer.Close()
-	if SHAExists {
-		data = nil
-	} else {
-		SHA = nil
-	}
-	byteReader = bytes.NewReader(SHA)
-	ioWriter, _ = writer.CreateFormField("SHA")
-	if _, err := io.Copy(ioWriter, byteReader); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
-	}
-	byteReader = bytes.NewReader(data)
-	ioWriter, _ = writer.CreateFormFile("file", fileName)
-	if _, err := io.Copy(ioWriter, byteReader); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
-	}
-
-	writer.Close()
-
-	storeURL, err := url.Parse(storeConfig.URL)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
-	}
-	storeURL.Path = "store"
-	req, err := http.NewRequest(http.MethodPut, storeURL.String(), bytes.NewReader(body.Bytes()))
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		return
-	}
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	res, err := client.Do(req)
+	res, err := upload(http.MethodPut, file, fileName, SHA, SHAExists)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return
 	}
+	defer res.Body.Close()
 	switch res.StatusCode {
 	case http.StatusOK:
 		fmt.Fprintf(os.Stdout, "%s - Updated successfully\n", fileName)
 	case http.StatusCreated:
 		fmt.Fprintf(os.Stdout, "%s - Added successfully\n", fileName)
+	case http.StatusRequestEntityTooLarge, http.StatusInsufficientStorage:
+		reason, _ := io.ReadAll(res.Body)
+		fmt.Fprintf(os.Stdout, "%s - Failed to upload: %s\n", fileName, reason)
 	default:
 		fmt.Fprintf(os.Stdout, "%s - Failed to upload\n", fileName)
 	}
@@ -0,0 +1,121 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var watch = &cobra.Command{
+	Use:   "watch",
+	Long:  "Print the changes of the files in store as they happen, reconnecting after a lost connection",
+	Short: "Watch changes",
+	Args:  cobra.NoArgs,
+	Run:   watchFiles,
+}
+
+var watchAfter uint64
+
+// Time to wait before reconnecting
+const watchRetry = 2 * time.Second
+
+func init() {
+	watch.Flags().Uint64Var(&watchAfter, "after", 0, "Sequence number to resume from, default from now on")
+	store.AddCommand(watch)
+}
+
+// Change of a file, as sent by the server
+type watchEvent struct {
+	Sequence uint64
+	Type     string
+	Name     string
+	From     string
+	SHA      string
+	Time     time.Time
+}
+
+func watchFiles(cmd *cobra.Command, args []string) {
+	storeURL, err := url.Parse(storeConfig.URL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	storeURL.Path = storePath("/watch")
+	last := ""
+	if cmd.Flags().Changed("after") {
+		last = strconv.FormatUint(watchAfter, 10)
+	}
+	for {
+		req, err := http.NewRequest(http.MethodGet, storeURL.String(), nil)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		req.Header.Set("Accept", "text/event-stream")
+		if last != "" {
+			req.Header.Set("Last-Event-ID", last)
+		}
+		res, err := client.Do(req)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			time.Sleep(watchRetry)
+			continue
+		}
+		switch res.StatusCode {
+		case http.StatusOK:
+		case http.StatusGone:
+			reason, _ := io.ReadAll(res.Body)
+			res.Body.Close()
+			fmt.Fprintf(os.Stdout, "%s - %s\n", last, reason)
+			return
+		default:
+			res.Body.Close()
+			fmt.Fprintln(os.Stdout, res.Status)
+			return
+		}
+		last = readEvents(res.Body, last)
+		res.Body.Close()
+		fmt.Fprintln(os.Stderr, "Connection lost, reconnecting")
+		time.Sleep(watchRetry)
+	}
+}
+
+// Print the events of a stream until it ends, returns the ID of the last
+// event read
+func readEvents(body io.Reader, last string) string {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			last = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			var event watchEvent
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				continue
+			}
+			printEvent(&event)
+		}
+	}
+	return last
+}
+
+func printEvent(event *watchEvent) {
+	name := event.Name
+	if event.From != "" {
+		name = event.From + " -> " + event.Name
+	}
+	fmt.Fprintf(os.Stdout, "%d\t%s\t%-6s\t%s\t%s\n",
+		event.Sequence, event.Time.Local().Format(time.RFC3339), event.Type, name, event.SHA)
+}
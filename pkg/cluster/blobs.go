@@ -0,0 +1,357 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/sayan-biswas/file-store/pkg/database"
+)
+
+// The data of a write is staged as a file named by its SHA on the leader
+// and on as many other nodes as it takes to reach the replicas, before the
+// write is committed. A node applying the write takes the data from its
+// staged file. When the data was not staged there, the file is recorded as
+// missing, and written once its data is fetched from a node that has it, so
+// that applying a command never waits on other nodes. Staged files that were
+// never used are removed after a day.
+
+// Staged files older than this are removed
+const stagedAge = 24 * time.Hour
+
+// Interval between two removals of the old staged files
+const stagedSweepInterval = time.Hour
+
+// Interval between two attempts to fetch the data of the missing files
+const missingInterval = 5 * time.Second
+
+// File of the log whose data the node does not have yet
+type missingFile struct {
+	SHA string
+	// IDs of the nodes that had the data when it was written
+	Holders []string `json:",omitempty"`
+	// expiry time of the file in nanoseconds, 0 when it does not expire
+	Expires int64 `json:",omitempty"`
+}
+
+type writeFunc func(name string, SHA []byte, reader io.Reader) error
+
+func (n *Node) stagedPath(sha string) string {
+	return filepath.Join(n.staging, sha)
+}
+
+// Stage data sent with a SHA, failing with database.ErrSHAMismatch when
+// the data does not match it. Data is written to a temporary file first, so
+// staged files are always complete.
+func (n *Node) Stage(SHA []byte, reader io.Reader) error {
+	sum, path, err := n.stage(reader)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(SHA, sum) {
+		os.Remove(path)
+		return database.ErrSHAMismatch
+	}
+	return nil
+}
+
+// Stage data, returns its SHA and the staged file
+func (n *Node) stage(reader io.Reader) ([]byte, string, error) {
+	file, err := os.CreateTemp(n.staging, ".upload-*")
+	if err != nil {
+		return nil, "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), reader)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, "", err
+	}
+	sum := hash.Sum(nil)
+	path := n.stagedPath(hex.EncodeToString(sum))
+	if err := os.Rename(file.Name(), path); err != nil {
+		os.Remove(file.Name())
+		return nil, "", err
+	}
+	return sum, path, nil
+}
+
+// Copy the staged data of a SHA to other nodes until the replicas are
+// reached, returns the IDs of the nodes that have it
+func (n *Node) replicate(sha string) ([]string, error) {
+	holders := []string{n.config.NodeID}
+	for _, peer := range n.config.Peers {
+		if len(holders) >= n.config.Replicas {
+			break
+		}
+		if peer.ID == n.config.NodeID {
+			continue
+		}
+		if err := n.push(peer, sha); err != nil {
+			continue
+		}
+		holders = append(holders, peer.ID)
+	}
+	if len(holders) < n.config.Replicas {
+		return nil, database.ErrNoQuorum
+	}
+	return holders, nil
+}
+
+// Send the staged data of a SHA to a node
+func (n *Node) push(peer Peer, sha string) error {
+	file, err := os.Open(n.stagedPath(sha))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	req, err := http.NewRequest(http.MethodPost, peer.URL+"/cluster/blob?sha="+sha, file)
+	if err != nil {
+		return err
+	}
+	if n.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.config.Token)
+	}
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		return fmt.Errorf("%s answered %s to the data of %s", peer.ID, res.Status, sha)
+	}
+	return nil
+}
+
+// Add or update a file with the data of a SHA, from the store or the
+// staged file, or else record it as missing
+func (n *Node) put(name string, file missingFile, op string) error {
+	sha := file.SHA
+	SHA, err := hex.DecodeString(sha)
+	if err != nil {
+		return err
+	}
+	if err := n.clearMissing(name); err != nil {
+		return err
+	}
+	write := n.writer(op, file.Expires)
+	err = write(name, SHA, bytes.NewReader(nil))
+	if err != database.ErrMissingData {
+		return err
+	}
+	if staged, err := os.Open(n.stagedPath(sha)); err == nil {
+		err = write(name, SHA, staged)
+		staged.Close()
+		if err == nil {
+			os.Remove(n.stagedPath(sha))
+		}
+		if err != database.ErrSHAMismatch {
+			return err
+		}
+	}
+	return n.setMissing(name, file)
+}
+
+// Returns the write of an add or an update, of a file expiring at a time in
+// nanoseconds unless it is 0
+func (n *Node) writer(op string, expires int64) writeFunc {
+	if expires == 0 {
+		if op == opAdd {
+			return n.store.AddStream
+		}
+		return n.store.UpdateStream
+	}
+	// a file of a snapshot that already expired is removed by the expiry
+	// sweeper, and before any command on it is applied
+	return func(name string, SHA []byte, reader io.Reader) error {
+		if op == opAdd {
+			return n.store.AddStreamExpiring(name, SHA, reader, time.Unix(0, expires))
+		}
+		return n.store.UpdateStreamExpiring(name, SHA, reader, time.Unix(0, expires))
+	}
+}
+
+// Returns a time in nanoseconds, 0 for nil
+func nanoseconds(t *time.Time) int64 {
+	if t == nil {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+// Record a file as missing, and wake the fetching of the missing data up
+func (n *Node) setMissing(name string, file missingFile) error {
+	if err := n.logs.setMissing(name, file); err != nil {
+		return err
+	}
+	n.missing[name] = file
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (n *Node) clearMissing(name string) error {
+	if _, ok := n.missing[name]; !ok {
+		return nil
+	}
+	if err := n.logs.deleteMissing(name); err != nil {
+		return err
+	}
+	delete(n.missing, name)
+	return nil
+}
+
+// Fetch the data of the missing files from the other nodes until the node
+// is closed
+func (n *Node) runMissing() {
+	ticker := time.NewTicker(missingInterval)
+	defer ticker.Stop()
+	for {
+		n.fetchMissing()
+		select {
+		case <-n.closed:
+			return
+		case <-n.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Fetch the data of the missing files, and write the files that still have
+// the same SHA once it is staged. Files whose data no node has are tried
+// again later.
+func (n *Node) fetchMissing() {
+	n.applyLock.Lock()
+	files := make(map[string]missingFile, len(n.missing))
+	for name, file := range n.missing {
+		files[name] = file
+	}
+	n.applyLock.Unlock()
+	for name, file := range files {
+		SHA, err := hex.DecodeString(file.SHA)
+		if err != nil {
+			continue
+		}
+		// the other nodes removed the file when it expired
+		if file.Expires != 0 && time.Now().UnixNano() >= file.Expires {
+			n.applyLock.Lock()
+			if current, ok := n.missing[name]; ok && current.SHA == file.SHA {
+				n.clearMissing(name)
+			}
+			n.applyLock.Unlock()
+			continue
+		}
+		if _, err := os.Stat(n.stagedPath(file.SHA)); err != nil && !n.store.SHAExists(SHA) {
+			if err := n.fetch(SHA, file.Holders); err != nil {
+				continue
+			}
+		}
+		n.applyLock.Lock()
+		if current, ok := n.missing[name]; ok && current.SHA == file.SHA {
+			n.put(name, file, opUpdate)
+		}
+		n.applyLock.Unlock()
+	}
+}
+
+// Returns the other nodes, the holders of some data first
+func (n *Node) peersByHolders(holders []string) []Peer {
+	var first, rest []Peer
+	for _, peer := range n.config.Peers {
+		if peer.ID == n.config.NodeID {
+			continue
+		}
+		held := false
+		for _, id := range holders {
+			held = held || id == peer.ID
+		}
+		if held {
+			first = append(first, peer)
+		} else {
+			rest = append(rest, peer)
+		}
+	}
+	return append(first, rest...)
+}
+
+// Stage the data of a SHA read from the first node that has it
+func (n *Node) fetch(SHA []byte, holders []string) error {
+	err := badger.ErrKeyNotFound
+	for _, peer := range n.peersByHolders(holders) {
+		select {
+		case <-n.closed:
+			return err
+		default:
+		}
+		if err = n.fetchFrom(peer, SHA); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func (n *Node) fetchFrom(peer Peer, SHA []byte) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-n.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	blobURL := peer.URL + "/store/blob?" + url.Values{"sha": {hex.EncodeToString(SHA)}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, blobURL, nil)
+	if err != nil {
+		return err
+	}
+	if n.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+n.config.Token)
+	}
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s to the data of %x", peer.ID, res.Status, SHA)
+	}
+	return n.Stage(SHA, res.Body)
+}
+
+// Remove the staged files older than a day
+func (n *Node) runStagedSweep() {
+	ticker := time.NewTicker(stagedSweepInterval)
+	defer ticker.Stop()
+	for {
+		entries, _ := os.ReadDir(n.staging)
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err == nil && time.Since(info.ModTime()) > stagedAge {
+				os.Remove(filepath.Join(n.staging, entry.Name()))
+			}
+		}
+		select {
+		case <-n.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,292 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/sayan-biswas/file-store/pkg/database"
+)
+
+// A cluster is a fixed set of nodes, each one a store server, that agree on
+// the names of the files and the SHA of their data through Raft. Writes are
+// made on the leader, which copies their data to as many nodes as the
+// replicas before committing them, and are applied to the store of every
+// node. Reads are served by every node from its own store. With a majority
+// of the nodes up, a leader is elected and writes go on.
+
+// Node of a cluster
+type Peer struct {
+	ID string
+	// host:port of the Raft traffic
+	Address string
+	// URL of the store server of the node
+	URL string
+}
+
+type Config struct {
+	// ID of this node, one of the peers
+	NodeID string
+	// every node of the cluster, this one included
+	Peers []Peer
+	// directory of the Raft log, snapshots and staged data
+	Path string
+	// number of nodes that have the data of a write before it is committed
+	Replicas int
+	// admin token of the servers, sent with the data copied to or fetched
+	// from other nodes
+	Token string
+	// Raft logs, discarded when nil
+	LogOutput io.Writer
+	// interval between two checks for a snapshot, commands applied before a
+	// snapshot is taken and commands kept after it, 0 for the Raft defaults
+	SnapshotInterval  time.Duration
+	SnapshotThreshold uint64
+	TrailingLogs      uint64
+}
+
+var (
+	ErrNoLeader     = errors.New("cluster has no leader")
+	ErrClusterStore = errors.New("cluster nodes need the badger backend")
+)
+
+const (
+	// time a write waits to be committed
+	applyTimeout = 10 * time.Second
+	// snapshots kept by a node
+	snapshotsKept = 2
+)
+
+// Replication state of a node
+type Status struct {
+	ID    string
+	State string
+	// ID and URL of the leader, empty without leader
+	Leader    string
+	LeaderURL string
+	// index of the last command of the log, of the last one applied and of
+	// the last snapshot
+	LastIndex     uint64
+	AppliedIndex  uint64
+	SnapshotIndex uint64
+	// files whose data the node is fetching from the other nodes
+	Missing int
+	Peers   []Peer
+}
+
+// Store of a node, which the cluster reads data by SHA from
+type localStore interface {
+	database.Store
+	database.Mover
+	database.BlobReader
+	database.Watcher
+	database.UsageReporter
+	database.Searcher
+	database.Trasher
+	database.Versioner
+	database.KeyRotator
+	database.CacheReporter
+	database.Backuper
+	database.Scrubber
+	database.Checker
+	TrashAt(name string, by string, at time.Time) error
+	AddStreamExpiring(name string, SHA []byte, reader io.Reader, expires time.Time) error
+	UpdateStreamExpiring(name string, SHA []byte, reader io.Reader, expires time.Time) error
+	ExpireAt(name string, at time.Time) error
+}
+
+type Node struct {
+	config    Config
+	store     localStore
+	raft      *raft.Raft
+	logs      *logStore
+	transport *raft.NetworkTransport
+	staging   string
+	client    *http.Client
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// held while a command is applied, and while a missing file is written
+	applyLock sync.Mutex
+	applied   uint64
+	missing   map[string]missingFile
+	wake      chan struct{}
+}
+
+// Start a node of a cluster on top of its store. A node that has no Raft
+// state yet bootstraps the cluster with the peers, which every node does
+// with the same peers.
+func New(config *Config, store database.Store) (*Node, error) {
+	var self *Peer
+	for i := range config.Peers {
+		if config.Peers[i].ID == config.NodeID {
+			self = &config.Peers[i]
+		}
+	}
+	if self == nil {
+		return nil, fmt.Errorf("node %q is not one of the peers", config.NodeID)
+	}
+	if config.Replicas < 1 || config.Replicas > len(config.Peers) {
+		return nil, fmt.Errorf("replicas must be between 1 and %d, the number of peers", len(config.Peers))
+	}
+	local, ok := store.(localStore)
+	if !ok {
+		return nil, ErrClusterStore
+	}
+	logOutput := config.LogOutput
+	if logOutput == nil {
+		logOutput = io.Discard
+	}
+
+	n := &Node{
+		config:  *config,
+		store:   local,
+		staging: filepath.Join(config.Path, "staging"),
+		client:  &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}},
+		closed:  make(chan struct{}),
+		wake:    make(chan struct{}, 1),
+	}
+	if err := os.MkdirAll(n.staging, 0700); err != nil {
+		return nil, err
+	}
+	logs, err := openLogStore(filepath.Join(config.Path, "raft"))
+	if err != nil {
+		return nil, err
+	}
+	n.logs = logs
+	if n.applied, err = logs.applied(); err == nil {
+		n.missing, err = logs.missingFiles()
+	}
+	if err != nil {
+		logs.Close()
+		return nil, err
+	}
+	snapshots, err := raft.NewFileSnapshotStore(config.Path, snapshotsKept, logOutput)
+	if err != nil {
+		logs.Close()
+		return nil, err
+	}
+	address, err := net.ResolveTCPAddr("tcp", self.Address)
+	if err != nil {
+		logs.Close()
+		return nil, err
+	}
+	n.transport, err = raft.NewTCPTransport(self.Address, address, 3, 10*time.Second, logOutput)
+	if err != nil {
+		logs.Close()
+		return nil, err
+	}
+
+	conf := raft.DefaultConfig()
+	conf.LocalID = raft.ServerID(config.NodeID)
+	conf.LogOutput = logOutput
+	conf.LogLevel = "WARN"
+	// the files of the store are kept, commands are applied on top of them
+	conf.NoSnapshotRestoreOnStart = true
+	if config.SnapshotInterval > 0 {
+		conf.SnapshotInterval = config.SnapshotInterval
+	}
+	if config.SnapshotThreshold > 0 {
+		conf.SnapshotThreshold = config.SnapshotThreshold
+	}
+	if config.TrailingLogs > 0 {
+		conf.TrailingLogs = config.TrailingLogs
+	}
+	n.raft, err = raft.NewRaft(conf, (*fsm)(n), logs, logs, snapshots, n.transport)
+	if err != nil {
+		n.transport.Close()
+		logs.Close()
+		return nil, err
+	}
+	existing, err := raft.HasExistingState(logs, logs, snapshots)
+	if err == nil && !existing {
+		servers := make([]raft.Server, 0, len(config.Peers))
+		for _, peer := range config.Peers {
+			servers = append(servers, raft.Server{
+				ID:      raft.ServerID(peer.ID),
+				Address: raft.ServerAddress(peer.Address),
+			})
+		}
+		err = n.raft.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+		if err == raft.ErrCantBootstrap {
+			err = nil
+		}
+	}
+	if err != nil {
+		n.shutdown()
+		return nil, err
+	}
+	go n.runStagedSweep()
+	go n.runMissing()
+	return n, nil
+}
+
+// Leave the cluster and close the store
+func (n *Node) Close() error {
+	var err error
+	n.closeOnce.Do(func() {
+		err = n.shutdown()
+		if closeErr := n.store.Close(); err == nil {
+			err = closeErr
+		}
+	})
+	return err
+}
+
+// Stop Raft, leaving the store open
+func (n *Node) shutdown() error {
+	close(n.closed)
+	err := n.raft.Shutdown().Error()
+	if closeErr := n.transport.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := n.logs.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Returns the leader of the cluster, false without leader
+func (n *Node) Leader() (Peer, bool) {
+	_, id := n.raft.LeaderWithID()
+	for _, peer := range n.config.Peers {
+		if raft.ServerID(peer.ID) == id {
+			return peer, true
+		}
+	}
+	return Peer{}, false
+}
+
+func (n *Node) ID() string {
+	return n.config.NodeID
+}
+
+func (n *Node) IsLeader() bool {
+	return n.raft.State() == raft.Leader
+}
+
+func (n *Node) Status() Status {
+	status := Status{
+		ID:           n.config.NodeID,
+		State:        n.raft.State().String(),
+		LastIndex:    n.raft.LastIndex(),
+		AppliedIndex: n.raft.AppliedIndex(),
+		Peers:        n.config.Peers,
+	}
+	status.SnapshotIndex, _ = strconv.ParseUint(n.raft.Stats()["last_snapshot_index"], 10, 64)
+	n.applyLock.Lock()
+	status.Missing = len(n.missing)
+	n.applyLock.Unlock()
+	if leader, ok := n.Leader(); ok {
+		status.Leader, status.LeaderURL = leader.ID, leader.URL
+	}
+	return status
+}
@@ -0,0 +1,286 @@
+package cluster
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+	"github.com/sayan-biswas/file-store/pkg/database"
+)
+
+// The state agreed on through Raft is the names of the files of the root of
+// the store with the SHA of their data, kept in the store of each node and
+// in the missing files of the node. Every write is a command of the log,
+// applied to the store of every node in the order of the log. The index of
+// the last command applied is kept with the Raft state, so a node that
+// starts without restoring its snapshot skips the commands its store
+// already has. The versions and the trash bin of the files are kept by the
+// store of each node as the commands are applied, and are not part of the
+// snapshots.
+
+// Operations of the commands
+const (
+	opAdd          = "add"
+	opUpdate       = "update"
+	opRemove       = "remove"
+	opRename       = "rename"
+	opCopy         = "copy"
+	opTrash        = "trash"
+	opRestoreTrash = "restoreTrash"
+	opPurgeTrash   = "purgeTrash"
+	opRestore      = "restore"
+)
+
+// Write to the files of the store. Times are chosen by the leader, so that
+// every node applies the same command the same way.
+type command struct {
+	Op   string
+	Name string
+	// time of the leader when the command was written, in nanoseconds
+	Time int64 `json:",omitempty"`
+	// new name of a rename or a copy
+	To  string `json:",omitempty"`
+	SHA string `json:",omitempty"`
+	// IDs of the nodes that had the data when it was written
+	Holders []string `json:",omitempty"`
+	// expiry time of the file in nanoseconds, 0 when it does not expire
+	Expires int64 `json:",omitempty"`
+	// ID of a trash entry, the time of the removal in nanoseconds, and who
+	// removed the file
+	ID uint64 `json:",omitempty"`
+	By string `json:",omitempty"`
+	// number of the version restored
+	Version uint64 `json:",omitempty"`
+}
+
+// File of a snapshot
+type snapshotFile struct {
+	Name    string
+	SHA     string
+	Expires int64 `json:",omitempty"`
+}
+
+type fsm Node
+
+// Apply a command to the store, returns the error of the write
+func (f *fsm) Apply(log *raft.Log) interface{} {
+	n := (*Node)(f)
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+	if log.Index <= n.applied {
+		return nil
+	}
+	var cmd command
+	if err := json.Unmarshal(log.Data, &cmd); err != nil {
+		return err
+	}
+	err := n.applyCommand(&cmd)
+	n.applied = log.Index
+	// a command whose index is not saved is applied again on restart
+	n.logs.setApplied(log.Index)
+	return err
+}
+
+// Check if a file is in the store or missing
+func (n *Node) hasFile(name string) bool {
+	_, missing := n.missing[name]
+	return missing || n.store.FileExists(name)
+}
+
+func (n *Node) applyCommand(cmd *command) error {
+	if err := n.expire(cmd); err != nil {
+		return err
+	}
+	switch cmd.Op {
+	case opAdd:
+		if n.hasFile(cmd.Name) {
+			return badger.ErrConflict
+		}
+		return n.put(cmd.Name, missingFile{SHA: cmd.SHA, Holders: cmd.Holders, Expires: cmd.Expires}, opAdd)
+	case opUpdate:
+		return n.put(cmd.Name, missingFile{SHA: cmd.SHA, Holders: cmd.Holders, Expires: cmd.Expires}, opUpdate)
+	case opRemove, opTrash:
+		return n.remove(cmd)
+	case opRename, opCopy:
+		return n.move(cmd)
+	case opRestoreTrash:
+		if n.hasFile(cmd.Name) {
+			return badger.ErrConflict
+		}
+		err := n.store.RestoreTrash(cmd.Name, cmd.ID)
+		if err != badger.ErrKeyNotFound {
+			return err
+		}
+		// the node did not have the data of the file when it was removed
+		return n.put(cmd.Name, missingFile{SHA: cmd.SHA}, opUpdate)
+	case opPurgeTrash:
+		return n.store.PurgeTrash(cmd.Name, cmd.ID)
+	case opRestore:
+		if !n.hasFile(cmd.Name) {
+			return badger.ErrKeyNotFound
+		}
+		// the store restores its own version when it is the version of the
+		// leader, keeping the expiry of the file, unless the file is missing
+		if _, missing := n.missing[cmd.Name]; !missing {
+			versions, _ := n.store.Versions(cmd.Name)
+			for _, version := range versions {
+				if version.Version == cmd.Version && version.SHA == cmd.SHA {
+					return n.store.Restore(cmd.Name, cmd.Version)
+				}
+			}
+		}
+		return n.put(cmd.Name, missingFile{SHA: cmd.SHA}, opUpdate)
+	}
+	return nil
+}
+
+// Remove the files of a command that expired by its time, so that every
+// node applies it to the same files, whether or not its expiry sweeper
+// removed them yet
+func (n *Node) expire(cmd *command) error {
+	// commands written before they had a time
+	if cmd.Time == 0 {
+		return nil
+	}
+	for _, name := range []string{cmd.Name, cmd.To} {
+		if name == "" {
+			continue
+		}
+		if file, ok := n.missing[name]; ok && file.Expires != 0 && file.Expires <= cmd.Time {
+			if err := n.clearMissing(name); err != nil {
+				return err
+			}
+		}
+		if err := n.store.ExpireAt(name, time.Unix(0, cmd.Time)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove a file, or move it to the trash bin. A missing file is removed
+// without going to the trash bin, since the node does not have its data.
+func (n *Node) remove(cmd *command) error {
+	_, missing := n.missing[cmd.Name]
+	if err := n.clearMissing(cmd.Name); err != nil {
+		return err
+	}
+	var err error
+	if cmd.Op == opTrash {
+		err = n.store.TrashAt(cmd.Name, cmd.By, time.Unix(0, int64(cmd.ID)))
+	} else {
+		err = n.store.Remove(cmd.Name)
+	}
+	if err == badger.ErrKeyNotFound && missing {
+		return nil
+	}
+	return err
+}
+
+// Rename or copy a file, the missing file when its data is missing
+func (n *Node) move(cmd *command) error {
+	file, missing := n.missing[cmd.Name]
+	if !missing {
+		if _, ok := n.missing[cmd.To]; ok {
+			return badger.ErrConflict
+		}
+		if cmd.Op == opRename {
+			return n.store.Rename(cmd.Name, cmd.To)
+		}
+		return n.store.Copy(cmd.Name, cmd.To)
+	}
+	if n.hasFile(cmd.To) {
+		return badger.ErrConflict
+	}
+	if cmd.Op == opCopy {
+		// a copy does not expire
+		file.Expires = 0
+	}
+	if err := n.setMissing(cmd.To, file); err != nil {
+		return err
+	}
+	if cmd.Op == opRename {
+		return n.clearMissing(cmd.Name)
+	}
+	return nil
+}
+
+// Take the names and SHAs of the files, which are written by Persist while
+// the next commands are applied
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	n := (*Node)(f)
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+	list, err := n.store.List(database.ListOptions{Recursive: true, Details: true})
+	if err != nil {
+		return nil, err
+	}
+	files := make([]snapshotFile, 0, len(list.Files)+len(n.missing))
+	for _, file := range list.Files {
+		if _, ok := n.missing[file.Name]; !ok {
+			files = append(files, snapshotFile{Name: file.Name, SHA: file.SHA, Expires: nanoseconds(file.Expires)})
+		}
+	}
+	for name, file := range n.missing {
+		files = append(files, snapshotFile{Name: name, SHA: file.SHA, Expires: file.Expires})
+	}
+	return &snapshot{files: files}, nil
+}
+
+// Make the files of the store the files of a snapshot sent by the leader.
+// The files whose data the store does not have are missing until it is
+// fetched from the other nodes. The versions and trash entries of the store
+// are left as they are.
+func (f *fsm) Restore(reader io.ReadCloser) error {
+	n := (*Node)(f)
+	defer reader.Close()
+	var files []snapshotFile
+	if err := json.NewDecoder(reader).Decode(&files); err != nil {
+		return err
+	}
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+	list, err := n.store.List(database.ListOptions{Recursive: true, Details: true})
+	if err != nil {
+		return err
+	}
+	current := map[string]string{}
+	for _, file := range list.Files {
+		current[file.Name] = file.SHA
+	}
+	for name := range n.missing {
+		if err := n.clearMissing(name); err != nil {
+			return err
+		}
+	}
+	for _, file := range files {
+		delete(current, file.Name)
+	}
+	for name := range current {
+		if err := n.store.Remove(name); err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+	}
+	for _, file := range files {
+		if err := n.put(file.Name, missingFile{SHA: file.SHA, Expires: file.Expires}, opUpdate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type snapshot struct {
+	files []snapshotFile
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if err := json.NewEncoder(sink).Encode(s.files); err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
@@ -0,0 +1,285 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+)
+
+// The Raft log and the Raft state of a node are kept in a badger database
+// of their own, next to the snapshots. Log entries are kept under l/ with
+// their index in big endian, so that they are ordered by index, and the
+// state under s/. The files whose data the node is fetching are kept under
+// m/ by name, and the index of the last command applied to the store under
+// a/.
+
+var (
+	logPrefix     = []byte("l/")
+	stablePrefix  = []byte("s/")
+	missingPrefix = []byte("m/")
+	appliedKey    = []byte("a/applied")
+)
+
+var errBadLog = errors.New("corrupt raft log entry")
+
+type logStore struct {
+	db *badger.DB
+}
+
+func openLogStore(path string) (*logStore, error) {
+	// Raft takes what is stored as durable
+	opts := badger.DefaultOptions(path).
+		WithLoggingLevel(badger.ERROR).
+		WithSyncWrites(true)
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &logStore{db: db}, nil
+}
+
+func (s *logStore) Close() error {
+	return s.db.Close()
+}
+
+func logKey(index uint64) []byte {
+	key := make([]byte, len(logPrefix)+8)
+	copy(key, logPrefix)
+	binary.BigEndian.PutUint64(key[len(logPrefix):], index)
+	return key
+}
+
+// Log entry, its index, term, type and append time followed by the length
+// of its data, its data and its extensions
+func encodeLog(log *raft.Log) []byte {
+	length := make([]byte, binary.MaxVarintLen64)
+	length = length[:binary.PutUvarint(length, uint64(len(log.Data)))]
+	buf := make([]byte, 25, 25+len(length)+len(log.Data)+len(log.Extensions))
+	binary.BigEndian.PutUint64(buf, log.Index)
+	binary.BigEndian.PutUint64(buf[8:], log.Term)
+	buf[16] = byte(log.Type)
+	binary.BigEndian.PutUint64(buf[17:], uint64(log.AppendedAt.UnixNano()))
+	buf = append(buf, length...)
+	buf = append(buf, log.Data...)
+	return append(buf, log.Extensions...)
+}
+
+func decodeLog(buf []byte, log *raft.Log) error {
+	if len(buf) < 25 {
+		return errBadLog
+	}
+	log.Index = binary.BigEndian.Uint64(buf)
+	log.Term = binary.BigEndian.Uint64(buf[8:])
+	log.Type = raft.LogType(buf[16])
+	log.AppendedAt = time.Unix(0, int64(binary.BigEndian.Uint64(buf[17:])))
+	buf = buf[25:]
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < length {
+		return errBadLog
+	}
+	buf = buf[n:]
+	log.Data = append([]byte{}, buf[:length]...)
+	log.Extensions = nil
+	if len(buf) > int(length) {
+		log.Extensions = append([]byte{}, buf[length:]...)
+	}
+	return nil
+}
+
+// Returns the index of the first or the last log entry, 0 without entries
+func (s *logStore) edge(reverse bool) (uint64, error) {
+	var index uint64
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = logPrefix
+		opts.Reverse = reverse
+		iterator := txn.NewIterator(opts)
+		defer iterator.Close()
+		if reverse {
+			iterator.Seek(logKey(^uint64(0)))
+		} else {
+			iterator.Rewind()
+		}
+		if iterator.Valid() {
+			index = binary.BigEndian.Uint64(iterator.Item().Key()[len(logPrefix):])
+		}
+		return nil
+	})
+	return index, err
+}
+
+func (s *logStore) FirstIndex() (uint64, error) {
+	return s.edge(false)
+}
+
+func (s *logStore) LastIndex() (uint64, error) {
+	return s.edge(true)
+}
+
+func (s *logStore) GetLog(index uint64, log *raft.Log) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(logKey(index))
+		if err == badger.ErrKeyNotFound {
+			return raft.ErrLogNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(value []byte) error {
+			return decodeLog(value, log)
+		})
+	})
+}
+
+func (s *logStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+func (s *logStore) StoreLogs(logs []*raft.Log) error {
+	batch := s.db.NewWriteBatch()
+	defer batch.Cancel()
+	for _, log := range logs {
+		if err := batch.Set(logKey(log.Index), encodeLog(log)); err != nil {
+			return err
+		}
+	}
+	return batch.Flush()
+}
+
+func (s *logStore) DeleteRange(min uint64, max uint64) error {
+	batch := s.db.NewWriteBatch()
+	defer batch.Cancel()
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = logPrefix
+		iterator := txn.NewIterator(opts)
+		defer iterator.Close()
+		for iterator.Seek(logKey(min)); iterator.Valid(); iterator.Next() {
+			key := iterator.Item().KeyCopy(nil)
+			if binary.BigEndian.Uint64(key[len(logPrefix):]) > max {
+				break
+			}
+			if err := batch.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return batch.Flush()
+}
+
+// Returns the value of a key of the Raft state, nil when it is not set
+func (s *logStore) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(append([]byte{}, stablePrefix...), key...))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	return value, err
+}
+
+func (s *logStore) Set(key []byte, value []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(append(append([]byte{}, stablePrefix...), key...), value)
+	})
+}
+
+func (s *logStore) GetUint64(key []byte) (uint64, error) {
+	value, err := s.Get(key)
+	if err != nil || len(value) != 8 {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+func (s *logStore) SetUint64(key []byte, value uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	return s.Set(key, buf)
+}
+
+// Returns the index of the last command applied to the store
+func (s *logStore) applied() (uint64, error) {
+	var index uint64
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(appliedKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(value []byte) error {
+			if len(value) != 8 {
+				return errBadLog
+			}
+			index = binary.BigEndian.Uint64(value)
+			return nil
+		})
+	})
+	return index, err
+}
+
+func (s *logStore) setApplied(index uint64) error {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, index)
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(appliedKey, buf)
+	})
+}
+
+// Returns the files whose data is missing, by name
+func (s *logStore) missingFiles() (map[string]missingFile, error) {
+	files := map[string]missingFile{}
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = missingPrefix
+		iterator := txn.NewIterator(opts)
+		defer iterator.Close()
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			item := iterator.Item()
+			var file missingFile
+			err := item.Value(func(value []byte) error {
+				return json.Unmarshal(value, &file)
+			})
+			if err != nil {
+				return err
+			}
+			files[string(item.Key()[len(missingPrefix):])] = file
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (s *logStore) setMissing(name string, file missingFile) error {
+	value, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(append(append([]byte{}, missingPrefix...), name...), value)
+	})
+}
+
+func (s *logStore) deleteMissing(name string) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(append(append([]byte{}, missingPrefix...), name...))
+	})
+}
@@ -0,0 +1,322 @@
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/hashicorp/raft"
+	"github.com/sayan-biswas/file-store/pkg/database"
+)
+
+// A node is the store of the cluster: reads are served by the store of the
+// node, writes are committed through Raft and fail with database.ErrNotLeader on a
+// node that is not the leader. The maintenance of the store, the key, the
+// caches, backups, scrubs and checks, is left to each node.
+
+var emptySHA = sha256.Sum256(nil)
+
+func (n *Node) Add(name string, SHA []byte, data []byte) error {
+	return n.AddStream(name, SHA, bytes.NewReader(data))
+}
+
+func (n *Node) AddStream(name string, SHA []byte, reader io.Reader) error {
+	return n.write(opAdd, name, SHA, reader, 0)
+}
+
+func (n *Node) AddStreamTTL(name string, SHA []byte, reader io.Reader, ttl time.Duration) error {
+	return n.write(opAdd, name, SHA, reader, expiryTime(ttl))
+}
+
+func (n *Node) Update(name string, SHA []byte, data []byte) error {
+	return n.UpdateStream(name, SHA, bytes.NewReader(data))
+}
+
+func (n *Node) UpdateStream(name string, SHA []byte, reader io.Reader) error {
+	return n.write(opUpdate, name, SHA, reader, 0)
+}
+
+func (n *Node) UpdateStreamTTL(name string, SHA []byte, reader io.Reader, ttl time.Duration) error {
+	return n.write(opUpdate, name, SHA, reader, expiryTime(ttl))
+}
+
+// Returns the expiry time of a TTL in nanoseconds, 0 without TTL. The time
+// is taken by the leader, so that a file expires at the same time on every
+// node.
+func expiryTime(ttl time.Duration) int64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return time.Now().Add(ttl).UnixNano()
+}
+
+func (n *Node) Remove(name string) error {
+	return n.apply(&command{Op: opRemove, Name: name})
+}
+
+func (n *Node) Rename(name string, newName string) error {
+	return n.apply(&command{Op: opRename, Name: name, To: newName})
+}
+
+func (n *Node) Copy(name string, newName string) error {
+	return n.apply(&command{Op: opCopy, Name: name, To: newName})
+}
+
+// Move a file to the trash bin, with the ID given by the leader
+func (n *Node) Trash(name string, by string) error {
+	return n.apply(&command{Op: opTrash, Name: name, By: by, ID: uint64(time.Now().UnixNano())})
+}
+
+func (n *Node) TrashList() ([]database.Trashed, error) {
+	return n.store.TrashList()
+}
+
+// Move a file back from the trash bin. The entry is looked up on the leader,
+// and the nodes that do not have it fetch its data from the others.
+func (n *Node) RestoreTrash(name string, id uint64) error {
+	if !n.IsLeader() {
+		return database.ErrNotLeader
+	}
+	list, err := n.store.TrashList()
+	if err != nil {
+		return err
+	}
+	var entry *database.Trashed
+	for i := range list {
+		// the entries of a name are listed oldest first
+		if list[i].Name == name && (id == 0 || id == list[i].ID) {
+			entry = &list[i]
+		}
+	}
+	if entry == nil {
+		return badger.ErrKeyNotFound
+	}
+	return n.apply(&command{Op: opRestoreTrash, Name: name, ID: entry.ID, SHA: entry.SHA})
+}
+
+func (n *Node) PurgeTrash(name string, id uint64) error {
+	return n.apply(&command{Op: opPurgeTrash, Name: name, ID: id})
+}
+
+func (n *Node) Versions(name string) ([]database.Version, error) {
+	return n.store.Versions(name)
+}
+
+// Make a previous version the current version of a file. The version is
+// looked up on the leader, so that the nodes without it write its data as
+// an update of the file.
+func (n *Node) Restore(name string, number uint64) error {
+	if !n.IsLeader() {
+		return database.ErrNotLeader
+	}
+	versions, err := n.store.Versions(name)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if version.Version == number {
+			return n.apply(&command{Op: opRestore, Name: name, SHA: version.SHA, Version: number})
+		}
+	}
+	return badger.ErrKeyNotFound
+}
+
+// Stage the data of an add or an update and copy it to the replicas, then
+// commit the write. Data the store already has is not copied again, and a
+// SHA sent without data must be in the store.
+func (n *Node) write(op string, name string, SHA []byte, reader io.Reader, expires int64) error {
+	if !n.IsLeader() {
+		return database.ErrNotLeader
+	}
+	sum, path, err := n.stage(reader)
+	if err != nil {
+		return err
+	}
+	sha := hex.EncodeToString(sum)
+	holders := []string{n.config.NodeID}
+	switch {
+	case len(SHA) > 0 && !bytes.Equal(SHA, sum):
+		os.Remove(path)
+		if !bytes.Equal(sum, emptySHA[:]) {
+			return database.ErrSHAMismatch
+		}
+		if !n.store.SHAExists(SHA) {
+			return database.ErrMissingData
+		}
+		sha = hex.EncodeToString(SHA)
+	case n.store.SHAExists(sum):
+		os.Remove(path)
+	default:
+		if holders, err = n.replicate(sha); err != nil {
+			return err
+		}
+	}
+	return n.apply(&command{Op: op, Name: name, SHA: sha, Holders: holders, Expires: expires})
+}
+
+// Commit a command at the time of the leader, returns the error of the write
+func (n *Node) apply(cmd *command) error {
+	cmd.Time = time.Now().UnixNano()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	future := n.raft.Apply(data, applyTimeout)
+	switch err := future.Error(); err {
+	case nil:
+	case raft.ErrNotLeader, raft.ErrLeadershipLost:
+		return database.ErrNotLeader
+	default:
+		return err
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (n *Node) Get(name string) ([]byte, error) {
+	return n.store.Get(name)
+}
+
+func (n *Node) GetStream(name string, writer io.Writer) error {
+	return n.store.GetStream(name, writer)
+}
+
+// Write the data of a SHA, from the store or staged for a write being
+// committed
+func (n *Node) GetBlob(SHA []byte, writer io.Writer) error {
+	err := n.store.GetBlob(SHA, writer)
+	if err != badger.ErrKeyNotFound {
+		return err
+	}
+	file, err := os.Open(n.stagedPath(hex.EncodeToString(SHA)))
+	if err != nil {
+		return badger.ErrKeyNotFound
+	}
+	defer file.Close()
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+func (n *Node) List(options database.ListOptions) (*database.FileList, error) {
+	return n.store.List(options)
+}
+
+// Check if a file exists, in the store or missing
+func (n *Node) FileExists(name string) bool {
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+	return n.hasFile(name)
+}
+
+func (n *Node) SHAExists(SHA []byte) bool {
+	return n.store.SHAExists(SHA)
+}
+
+func (n *Node) WordCount() (int64, error) {
+	return n.store.WordCount()
+}
+
+func (n *Node) WordFrequency() (map[string]int64, error) {
+	return n.store.WordFrequency()
+}
+
+func (n *Node) Usage() (*database.Usage, error) {
+	return n.store.Usage()
+}
+
+func (n *Node) Search(query string, limit int) ([]database.SearchResult, error) {
+	return n.store.Search(query, limit)
+}
+
+func (n *Node) Watch(ctx context.Context, after uint64) (<-chan database.Event, error) {
+	return n.store.Watch(ctx, after)
+}
+
+func (n *Node) LastEvent() (database.Event, error) {
+	return n.store.LastEvent()
+}
+
+func (n *Node) RotateKey(key []byte) error {
+	return n.store.RotateKey(key)
+}
+
+func (n *Node) CacheStats() database.Caches {
+	return n.store.CacheStats()
+}
+
+func (n *Node) Backup(writer io.Writer, since uint64) (uint64, error) {
+	return n.store.Backup(writer, since)
+}
+
+// Buckets are not replicated, their files would only be on the node they
+// were written to
+func (n *Node) Bucket(name string) (database.Store, error) {
+	return nil, database.ErrBucketsUnsupported
+}
+
+func (n *Node) Buckets() ([]database.BucketInfo, error) {
+	return nil, database.ErrBucketsUnsupported
+}
+
+func (n *Node) CreateBucket(name string) error {
+	return database.ErrBucketsUnsupported
+}
+
+func (n *Node) DeleteBucket(name string) error {
+	return database.ErrBucketsUnsupported
+}
+
+// A backup can not be restored into a node, its files would no longer be
+// the files of the cluster
+func (n *Node) RestoreBackup(reader io.Reader, incremental bool) error {
+	return database.ErrRestoreUnsupported
+}
+
+func (n *Node) Scrub() (*database.ScrubReport, error) {
+	return n.store.Scrub()
+}
+
+func (n *Node) LastScrub() (*database.ScrubReport, error) {
+	return n.store.LastScrub()
+}
+
+// Check the store of the node. A repair frees the names of the files whose
+// data is not in the store, which the node then records as missing, so that
+// it keeps the files of the cluster and fetches their data from the others.
+func (n *Node) Check(repair bool) (*database.CheckReport, error) {
+	if !repair {
+		return n.store.Check(false)
+	}
+	n.applyLock.Lock()
+	defer n.applyLock.Unlock()
+	list, err := n.store.List(database.ListOptions{Recursive: true, Details: true})
+	if err != nil {
+		return nil, err
+	}
+	report, err := n.store.Check(true)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]database.File, len(list.Files))
+	for _, file := range list.Files {
+		files[file.Name] = file
+	}
+	for _, name := range report.Dangling {
+		file, ok := files[name]
+		if !ok {
+			continue
+		}
+		if err := n.setMissing(name, missingFile{SHA: file.SHA, Expires: nanoseconds(file.Expires)}); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"errors"
+	"sort"
+)
+
+// Opens a store from its configuration
+type Backend func(config *Config) (Store, error)
+
+// Backend used when the configuration does not name one
+const DefaultBackend = "badger"
+
+var backends = map[string]Backend{}
+
+var ErrUnknownBackend = errors.New("unknown storage backend")
+
+// Make a backend available under a name, for the Backend of the
+// configuration
+func Register(name string, backend Backend) {
+	backends[name] = backend
+}
+
+// Returns the names of the registered backends
+func Backends() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Open the store of the backend named in the configuration
+func Open(config *Config) (Store, error) {
+	name := config.Backend
+	if name == "" {
+		name = DefaultBackend
+	}
+	backend, ok := backends[name]
+	if !ok {
+		return nil, ErrUnknownBackend
+	}
+	return backend(config)
+}
+
+func init() {
+	Register("badger", func(config *Config) (Store, error) {
+		db, err := New(config)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	})
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"errors"
+	"io"
+)
+
+// Store that can be backed up and restored while it is in use
+type Backuper interface {
+	Backup(writer io.Writer, since uint64) (uint64, error)
+	RestoreBackup(reader io.Reader, incremental bool) error
+}
+
+// Returned by a store that can be backed up but not restored, like a node of
+// a cluster, whose files are those of the cluster
+var ErrRestoreUnsupported = errors.New("backups can not be restored into this store")
+
+// Write a consistent backup of the store, of the changes made since a
+// version when it is not 0. Returns the version to back up from next time.
+// Chunks kept in the object store are not part of the backup.
+func (db *database) Backup(writer io.Writer, since uint64) (uint64, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	version, err := db.store.Backup(writer, since)
+	if version < since {
+		// nothing changed since the last backup
+		version = since
+	}
+	return version, err
+}
+
+// Load a backup in to the store. A full backup replaces the content of the
+// store, while an incremental one is applied on top of it. No other use of
+// the store runs while it is restored.
+func (db *database) RestoreBackup(reader io.Reader, incremental bool) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	if !incremental {
+		if err := db.store.DropAll(); err != nil {
+			return err
+		}
+	}
+	// the backup may drop or replace data
+	if db.cache != nil {
+		db.cache.reset()
+	}
+	if err := db.store.Load(reader, snapshotPending); err != nil {
+		return err
+	}
+	// the backup may come from an older version of the store
+	if err := db.migrate(""); err != nil {
+		return err
+	}
+	db.wakeIndexer()
+	return nil
+}
@@ -0,0 +1,419 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Buckets are namespaces of file names in the store. The files of a bucket
+// are kept under names made of the ID of the bucket and the file name,
+// 0x00 <ID> 0x00 <name>, in the same records as the files of the root
+// namespace, so data is shared by the files of all buckets. File names hold
+// no 0x00 byte, so names of different namespaces never collide. Word counts
+// are kept per namespace.
+//
+// A deleted bucket is removed from the bucket records at once, and its files
+// are removed afterwards. Its ID is never used again, so a new bucket with
+// the same name starts empty.
+
+// Store whose files can be kept in separate buckets
+type Bucketer interface {
+	Bucket(name string) (Store, error)
+	Buckets() ([]BucketInfo, error)
+	CreateBucket(name string) error
+	DeleteBucket(name string) error
+}
+
+type BucketInfo struct {
+	Name    string
+	Created time.Time
+}
+
+var (
+	ErrInvalidBucket = errors.New("invalid bucket name, names are 1 to 63 lower case letters, digits, dots, dashes and underscores")
+	ErrNoBucket      = errors.New("bucket does not exist")
+	// returned by the nodes of a cluster, which do not replicate buckets
+	ErrBucketsUnsupported = errors.New("buckets are not replicated, and can not be used in a cluster")
+)
+
+var bucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]{0,62}$`)
+
+var bucketSeq = metaKey("buckets")
+
+// Names of the files of the root namespace or of a bucket
+type namespace struct {
+	bucket string
+	// 0x00 <ID> 0x00, nil for the root namespace
+	prefix []byte
+}
+
+var rootNamespace = namespace{}
+
+func bucketPrefix(id uint64) []byte {
+	return []byte(fmt.Sprintf("\x00%016x\x00", id))
+}
+
+// Returns the key of a file name in the namespace. Names holding a 0x00
+// byte are never found.
+func (ns namespace) key(name string) ([]byte, error) {
+	if strings.IndexByte(name, 0) >= 0 {
+		return nil, badger.ErrKeyNotFound
+	}
+	return append(append([]byte{}, ns.prefix...), name...), nil
+}
+
+// Returns the file name of a key of the namespace
+func (ns namespace) name(key []byte) string {
+	return string(key[len(ns.prefix):])
+}
+
+// Check if a key is a file name of the namespace
+func (ns namespace) owns(key []byte) bool {
+	if ns.prefix == nil {
+		return len(key) == 0 || key[0] != 0
+	}
+	return bytes.HasPrefix(key, ns.prefix)
+}
+
+// Fails with ErrNoBucket once the bucket of the namespace is deleted
+func (ns namespace) check(txn *badger.Txn) error {
+	if ns.prefix == nil {
+		return nil
+	}
+	b, err := getBucket(txn, ns.bucket)
+	if err == badger.ErrKeyNotFound || (err == nil && !bytes.Equal(b.prefix, ns.prefix)) {
+		return ErrNoBucket
+	}
+	return err
+}
+
+// Returns the namespace prefix of a file name key, nil for the root
+// namespace
+func scopeOf(key []byte) []byte {
+	if len(key) == 0 || key[0] != 0 {
+		return nil
+	}
+	if i := bytes.IndexByte(key[1:], 0); i >= 0 {
+		return key[:i+2]
+	}
+	return nil
+}
+
+// Returns the names of the buckets by the prefix of their file names
+func bucketNames(txn *badger.Txn) (map[string]string, error) {
+	names := map[string]string{}
+	err := eachRecord(txn, bucketsPrefix, func(key []byte, value []byte) error {
+		if len(value) != 16 {
+			return errors.New("corrupt bucket record")
+		}
+		names[string(bucketPrefix(decodeUint(value[:8])))] = string(key[len(bucketsPrefix):])
+		return nil
+	})
+	return names, err
+}
+
+// Returns a file name as shown in the reports on the whole store, prefixed
+// by the name of its bucket and a colon, or the ID of a deleted bucket
+func reportName(buckets map[string]string, key []byte) string {
+	scope := scopeOf(key)
+	if scope == nil {
+		return string(key)
+	}
+	bucket, ok := buckets[string(scope)]
+	if !ok {
+		bucket = strings.Trim(string(scope), "\x00")
+	}
+	return bucket + ":" + string(key[len(scope):])
+}
+
+// Bucket record, its ID and creation time
+type bucketRecord struct {
+	id      uint64
+	created int64
+	prefix  []byte
+}
+
+func (b *bucketRecord) encode() []byte {
+	return append(encodeUint(b.id), encodeUint(uint64(b.created))...)
+}
+
+func getBucket(txn *badger.Txn, name string) (*bucketRecord, error) {
+	item, err := txn.Get(bucketKey([]byte(name)))
+	if err != nil {
+		return nil, err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(value) != 16 {
+		return nil, errors.New("corrupt bucket record")
+	}
+	id := decodeUint(value[:8])
+	return &bucketRecord{id: id, created: int64(decodeUint(value[8:])), prefix: bucketPrefix(id)}, nil
+}
+
+// Returns the files of a bucket, ErrNoBucket when it does not exist
+func (db *database) Bucket(name string) (Store, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	var b *bucketRecord
+	err := db.store.View(func(txn *badger.Txn) error {
+		var err error
+		b, err = getBucket(txn, name)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNoBucket
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &bucket{db: db, ns: namespace{bucket: name, prefix: b.prefix}}, nil
+}
+
+// Returns the buckets of the store, by name
+func (db *database) Buckets() ([]BucketInfo, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	buckets := []BucketInfo{}
+	err := db.store.View(func(txn *badger.Txn) error {
+		return eachRecord(txn, bucketsPrefix, func(key []byte, value []byte) error {
+			if len(value) != 16 {
+				return errors.New("corrupt bucket record")
+			}
+			buckets = append(buckets, BucketInfo{
+				Name:    string(key[len(bucketsPrefix):]),
+				Created: time.Unix(0, int64(decodeUint(value[8:]))),
+			})
+			return nil
+		})
+	})
+	return buckets, err
+}
+
+// Create an empty bucket. Fails with badger.ErrConflict when the bucket
+// exists.
+func (db *database) CreateBucket(name string) error {
+	if !bucketName.MatchString(name) {
+		return ErrInvalidBucket
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(bucketKey([]byte(name))); err != badger.ErrKeyNotFound {
+			if err == nil {
+				return badger.ErrConflict
+			}
+			return err
+		}
+		id, err := getCount(txn, bucketSeq)
+		if err != nil {
+			return err
+		}
+		id++
+		if err := setCount(txn, bucketSeq, id); err != nil {
+			return err
+		}
+		b := &bucketRecord{id: id, created: time.Now().UnixNano()}
+		return txn.Set(bucketKey([]byte(name)), b.encode())
+	})
+}
+
+// Delete a bucket with all its files, versions and trash entries
+func (db *database) DeleteBucket(name string) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	err := db.update(func(txn *badger.Txn) error {
+		b, err := getBucket(txn, name)
+		if err == badger.ErrKeyNotFound {
+			return ErrNoBucket
+		}
+		if err != nil {
+			return err
+		}
+		if err := txn.Delete(bucketKey([]byte(name))); err != nil {
+			return err
+		}
+		return txn.Set(deletedKey(b.prefix), nil)
+	})
+	if err != nil {
+		return err
+	}
+	return db.emptyBuckets()
+}
+
+// Remove the files of the deleted buckets
+func (db *database) emptyBuckets() error {
+	var deleted [][]byte
+	err := db.store.View(func(txn *badger.Txn) error {
+		eachKey(txn, deletedPrefix, func(key []byte) {
+			deleted = append(deleted, key[len(deletedPrefix):])
+		})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, prefix := range deleted {
+		err := db.eachFileIn(prefixKey(filePrefix, prefix), func(txn *badger.Txn, name []byte) error {
+			return db.removeFile(txn, name)
+		})
+		if err != nil {
+			return err
+		}
+		err = db.eachTrashKey(prefixKey(trashPrefix, prefix), func(txn *badger.Txn, name []byte, id uint64) error {
+			return db.purgeTrashed(txn, name, id)
+		})
+		if err != nil {
+			return err
+		}
+		err = db.update(func(txn *badger.Txn) error {
+			var lost [][]byte
+			eachKey(txn, prefixKey(lostPrefix, prefix), func(key []byte) {
+				lost = append(lost, key)
+			})
+			for _, key := range lost {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			return txn.Delete(deletedKey(prefix))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove the files of the buckets whose deletion was interrupted
+func (db *database) runEmptyBuckets() {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	select {
+	case <-db.closed:
+		return
+	default:
+	}
+	db.emptyBuckets()
+}
+
+// Files of a bucket
+type bucket struct {
+	db *database
+	ns namespace
+}
+
+func (b *bucket) Add(name string, SHA []byte, data []byte) error {
+	return b.AddStream(name, SHA, bytes.NewReader(data))
+}
+
+func (b *bucket) AddStream(name string, SHA []byte, reader io.Reader) error {
+	return b.db.addStream(b.ns, name, SHA, reader, 0)
+}
+
+func (b *bucket) AddStreamTTL(name string, SHA []byte, reader io.Reader, ttl time.Duration) error {
+	return b.db.addStream(b.ns, name, SHA, reader, expiryTime(ttl))
+}
+
+func (b *bucket) Get(name string) ([]byte, error) {
+	return b.db.get(b.ns, name)
+}
+
+func (b *bucket) GetStream(name string, writer io.Writer) error {
+	return b.db.getStream(b.ns, name, writer)
+}
+
+func (b *bucket) Remove(name string) error {
+	return b.db.remove(b.ns, name)
+}
+
+func (b *bucket) Update(name string, SHA []byte, data []byte) error {
+	return b.UpdateStream(name, SHA, bytes.NewReader(data))
+}
+
+func (b *bucket) UpdateStream(name string, SHA []byte, reader io.Reader) error {
+	return b.db.updateStream(b.ns, name, SHA, reader, 0)
+}
+
+func (b *bucket) UpdateStreamTTL(name string, SHA []byte, reader io.Reader, ttl time.Duration) error {
+	return b.db.updateStream(b.ns, name, SHA, reader, expiryTime(ttl))
+}
+
+func (b *bucket) List(options ListOptions) (*FileList, error) {
+	return b.db.list(b.ns, options)
+}
+
+func (b *bucket) FileExists(name string) bool {
+	return b.db.fileExists(b.ns, name)
+}
+
+func (b *bucket) SHAExists(SHA []byte) bool {
+	return b.db.SHAExists(SHA)
+}
+
+func (b *bucket) WordCount() (int64, error) {
+	return b.db.wordCount(b.ns)
+}
+
+func (b *bucket) WordFrequency() (map[string]int64, error) {
+	return b.db.wordFrequency(b.ns)
+}
+
+func (b *bucket) Versions(name string) ([]Version, error) {
+	return b.db.versions(b.ns, name)
+}
+
+func (b *bucket) Restore(name string, version uint64) error {
+	return b.db.restore(b.ns, name, version)
+}
+
+func (b *bucket) Trash(name string, by string) error {
+	return b.db.trash(b.ns, name, by, time.Now())
+}
+
+func (b *bucket) TrashList() ([]Trashed, error) {
+	return b.db.trashList(b.ns)
+}
+
+func (b *bucket) RestoreTrash(name string, id uint64) error {
+	return b.db.restoreTrash(b.ns, name, id)
+}
+
+func (b *bucket) PurgeTrash(name string, id uint64) error {
+	return b.db.purgeTrash(b.ns, name, id)
+}
+
+func (b *bucket) Search(query string, limit int) ([]SearchResult, error) {
+	return b.db.search(b.ns, query, limit)
+}
+
+func (b *bucket) Rename(name string, newName string) error {
+	return b.db.rename(b.ns, name, newName)
+}
+
+func (b *bucket) Copy(name string, newName string) error {
+	return b.db.copy(b.ns, name, newName)
+}
+
+func (b *bucket) Watch(ctx context.Context, after uint64) (<-chan Event, error) {
+	return b.db.watch(ctx, b.ns, after)
+}
+
+func (b *bucket) LastEvent() (Event, error) {
+	return b.db.lastEvent(b.ns)
+}
+
+// The store stays open, it is closed on its own
+func (b *bucket) Close() error {
+	return nil
+}
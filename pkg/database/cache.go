@@ -0,0 +1,157 @@
+package database
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Least recently used cache of file data keyed by SHA, bounded by the total
+// size of the cached data
+type blobCache struct {
+	mutex   sync.Mutex
+	size    int64
+	maxSize int64
+	entries map[string]*list.Element
+	order   *list.List
+	hits    uint64
+	misses  uint64
+
+	// number of removals, which readers check to not add back dropped data
+	drops uint64
+}
+
+type blobEntry struct {
+	sha  string
+	data []byte
+}
+
+// Statistics of the caches in front of the store
+type Caches struct {
+	Blob  CacheStats
+	Block CacheStats
+	Index CacheStats
+}
+
+// Hit and miss counters of a cache
+type CacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Entries int64
+	Size    int64
+	MaxSize int64
+}
+
+func newBlobCache(maxSize int64) *blobCache {
+	return &blobCache{
+		maxSize: maxSize,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// Returns the cached data of a SHA
+func (cache *blobCache) get(sha []byte) ([]byte, bool) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	element, ok := cache.entries[string(sha)]
+	if !ok {
+		cache.misses++
+		return nil, false
+	}
+	cache.hits++
+	cache.order.MoveToFront(element)
+	return element.Value.(*blobEntry).data, true
+}
+
+// Returns the number of removals so far, taken before reading data to add
+func (cache *blobCache) generation() uint64 {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return cache.drops
+}
+
+// Add the data of a SHA, evicting the least recently used entries to make
+// room. The data is not added when any was removed since the generation it
+// was read at, as it may have been dropped meanwhile.
+func (cache *blobCache) add(sha []byte, data []byte, generation uint64) {
+	size := int64(len(data))
+	if size > cache.maxSize {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if cache.drops != generation {
+		return
+	}
+	if element, ok := cache.entries[string(sha)]; ok {
+		cache.order.MoveToFront(element)
+		return
+	}
+	for cache.size+size > cache.maxSize {
+		cache.evict(cache.order.Back())
+	}
+	cache.entries[string(sha)] = cache.order.PushFront(&blobEntry{string(sha), data})
+	cache.size += size
+}
+
+// Drop the cached data of a SHA
+func (cache *blobCache) remove(sha []byte) {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.drops++
+	if element, ok := cache.entries[string(sha)]; ok {
+		cache.evict(element)
+	}
+}
+
+// Drop all the cached data
+func (cache *blobCache) reset() {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	cache.drops++
+	cache.entries = map[string]*list.Element{}
+	cache.order.Init()
+	cache.size = 0
+}
+
+func (cache *blobCache) evict(element *list.Element) {
+	entry := cache.order.Remove(element).(*blobEntry)
+	delete(cache.entries, entry.sha)
+	cache.size -= int64(len(entry.data))
+}
+
+func (cache *blobCache) stats() CacheStats {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return CacheStats{
+		Hits:    cache.hits,
+		Misses:  cache.misses,
+		Entries: int64(len(cache.entries)),
+		Size:    cache.size,
+		MaxSize: cache.maxSize,
+	}
+}
+
+// Returns the statistics of the blob cache and of the badger caches
+func (db *database) CacheStats() Caches {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	caches := Caches{
+		Block: CacheStats{MaxSize: db.opts.BlockCacheSize},
+		Index: CacheStats{MaxSize: db.opts.IndexCacheSize},
+	}
+	if db.cache != nil {
+		caches.Blob = db.cache.stats()
+	}
+	if metrics := db.store.BlockCacheMetrics(); metrics != nil {
+		caches.Block.Hits, caches.Block.Misses = metrics.Hits(), metrics.Misses()
+		caches.Block.Size = int64(metrics.CostAdded() - metrics.CostEvicted())
+		caches.Block.Entries = int64(metrics.KeysAdded() - metrics.KeysEvicted())
+	}
+	if metrics := db.store.IndexCacheMetrics(); metrics != nil {
+		caches.Index.Hits, caches.Index.Misses = metrics.Hits(), metrics.Misses()
+		caches.Index.Size = int64(metrics.CostAdded() - metrics.CostEvicted())
+		caches.Index.Entries = int64(metrics.KeysAdded() - metrics.KeysEvicted())
+	}
+	return caches
+}
@@ -0,0 +1,166 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// File data is split in content defined chunks (FastCDC), so that chunks
+// are shared between files with similar content, and a small change only
+// stores the chunks around it.
+const (
+	minChunk = 16 << 10
+	avgChunk = 64 << 10
+	maxChunk = 256 << 10
+)
+
+// Normalized chunking: a harder mask before the average size and an easier
+// one after it, keeping most chunks close to the average
+var (
+	maskHard = mask(18)
+	maskEasy = mask(14)
+)
+
+// Gear hash table, generated from a fixed seed so chunk boundaries never
+// change between runs
+var gear [256]uint64
+
+func init() {
+	seed := uint64(0x5EED5EED5EED5EED)
+	for i := range gear {
+		// splitmix64
+		seed += 0x9E3779B97F4A7C15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xBF58476D1CE4E5B9
+		z = (z ^ (z >> 27)) * 0x94D049BB133111EB
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+// Returns a mask of the given number of high bits
+func mask(bits uint) uint64 {
+	return ((1 << bits) - 1) << (64 - bits)
+}
+
+// Returns the length of the first chunk in data
+func cut(data []byte) int {
+	size := len(data)
+	if size <= minChunk {
+		return size
+	}
+	if size > maxChunk {
+		size = maxChunk
+	}
+	normal := avgChunk
+	if size < normal {
+		normal = size
+	}
+	var hash uint64
+	i := minChunk
+	for ; i < normal; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&maskHard == 0 {
+			return i + 1
+		}
+	}
+	for ; i < size; i++ {
+		hash = (hash << 1) + gear[data[i]]
+		if hash&maskEasy == 0 {
+			return i + 1
+		}
+	}
+	return size
+}
+
+// Splits a stream in to content defined chunks
+type chunker struct {
+	reader io.Reader
+	buf    []byte
+	start  int
+	end    int
+	eof    bool
+}
+
+func newChunker(reader io.Reader) *chunker {
+	return &chunker{reader: reader, buf: make([]byte, 2*maxChunk)}
+}
+
+// Returns the next chunk, or io.EOF after the last one. The chunk is only
+// valid until the next call.
+func (c *chunker) next() ([]byte, error) {
+	if c.end-c.start < maxChunk && !c.eof {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+		for c.end < len(c.buf) && !c.eof {
+			n, err := c.reader.Read(c.buf[c.end:])
+			c.end += n
+			if err == io.EOF {
+				c.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	size := cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+size]
+	c.start += size
+	return chunk, nil
+}
+
+// Chunk read from a file, with the SHA of its data
+type fileChunk struct {
+	sha  []byte
+	data []byte
+}
+
+// Chunk of a file, identified by the SHA of its data
+type chunkRef struct {
+	sha  []byte
+	size uint32
+}
+
+// Ordered list of the chunks of a file
+type manifest struct {
+	size   int64
+	chunks []chunkRef
+}
+
+const chunkRefSize = sha256.Size + 4
+
+var errBadManifest = errors.New("corrupt file manifest")
+
+func (m *manifest) add(sha []byte, size int) {
+	m.chunks = append(m.chunks, chunkRef{sha: sha, size: uint32(size)})
+	m.size += int64(size)
+}
+
+func (m *manifest) encode() []byte {
+	buf := make([]byte, 8, 8+len(m.chunks)*chunkRefSize)
+	binary.BigEndian.PutUint64(buf, uint64(m.size))
+	for _, chunk := range m.chunks {
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, chunk.size)
+		buf = append(append(buf, chunk.sha...), size...)
+	}
+	return buf
+}
+
+func decodeManifest(buf []byte) (*manifest, error) {
+	if len(buf) < 8 || (len(buf)-8)%chunkRefSize != 0 {
+		return nil, errBadManifest
+	}
+	m := &manifest{size: int64(binary.BigEndian.Uint64(buf))}
+	for buf = buf[8:]; len(buf) > 0; buf = buf[chunkRefSize:] {
+		m.chunks = append(m.chunks, chunkRef{
+			sha:  append([]byte{}, buf[:sha256.Size]...),
+			size: binary.BigEndian.Uint32(buf[sha256.Size:chunkRefSize]),
+		})
+	}
+	return m, nil
+}
@@ -1,11 +1,12 @@
 package database
 
 import (
-	"bufio"
 	"bytes"
 	"crypto/sha256"
+	"errors"
 	"fmt"
-	"strings"
+	"io"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -13,12 +14,17 @@ import (
 	"github.com/dgraph-io/badger/v3/options"
 )
 
+// Store of files. Missing files are reported with badger.ErrKeyNotFound and
+// names already in use with badger.ErrConflict, whatever the backend.
 type Store interface {
 	Add(name string, SHA []byte, data []byte) error
+	AddStream(name string, SHA []byte, reader io.Reader) error
 	Get(name string) ([]byte, error)
+	GetStream(name string, writer io.Writer) error
 	Remove(name string) error
 	Update(name string, SHA []byte, data []byte) error
-	List(details bool) ([]interface{}, error)
+	UpdateStream(name string, SHA []byte, reader io.Reader) error
+	List(options ListOptions) (*FileList, error)
 	FileExists(name string) bool
 	SHAExists(SHA []byte) bool
 	WordCount() (int64, error)
@@ -26,15 +32,98 @@ type Store interface {
 	Close() error
 }
 
+// Errors of the writes of a store replicated by a cluster, which succeed
+// when they are sent again later
+var (
+	ErrNotLeader = errors.New("node is not the leader of the cluster")
+	ErrNoQuorum  = errors.New("data could not be copied to enough nodes, retry later")
+)
+
+// Store that reads data by SHA, whatever the files using it
+type BlobReader interface {
+	GetBlob(SHA []byte, writer io.Writer) error
+}
+
+// Store that can re-encrypt its data with a new key
+type KeyRotator interface {
+	RotateKey(key []byte) error
+}
+
+// Store that reports the statistics of its caches
+type CacheReporter interface {
+	CacheStats() Caches
+}
+
+// Public methods hold lock for reading while they use the store, so that
+// it can be reopened underneath them
 type database struct {
-	file *badger.DB
-	sha  *badger.DB
+	lock     sync.RWMutex
+	store    *badger.DB
+	opts     badger.Options
+	snapshot string
+	keyFile  string
+	cache    *blobCache
+	closed   chan struct{}
+	indexer  chan struct{}
+	releaser chan struct{}
+	objects  objectStore
+
+	// held for reading by uploads to the object store, and for writing by
+	// the sweeper of orphaned chunks
+	objectLock sync.RWMutex
+
+	// serializes read-write transactions, which all update the same counters
+	writes sync.Mutex
+
+	// SHAs whose data is dropped by the running transaction, removed from
+	// the blob cache once it commits. Guarded by writes.
+	dropped [][]byte
+
+	// runs one scrub at a time
+	scrubLock sync.Mutex
+
+	// runs one key rotation at a time
+	keyLock sync.Mutex
+
+	maxVersions    int
+	maxVersionAge  time.Duration
+	trashRetention time.Duration
+	eventRetention time.Duration
+	scrubInterval  time.Duration
+	scrubRate      int64
+	quotas         quotas
 }
 
 type Config struct {
-	Diskless  bool
-	Path      string
-	CacheSize int
+	Backend    string
+	Diskless   bool
+	Snapshot   string
+	Encryption bool
+	KeyFile    string
+	Key        string
+	Path       string
+	CacheSize  int
+	BlobCache  int
+
+	MaxVersions    int
+	MaxVersionAge  time.Duration
+	TrashRetention time.Duration
+
+	// age of the events of the watchers that are pruned, 0 to keep them
+	EventRetention time.Duration
+
+	// time between two scrubs, and the rate at which they read in MB/s
+	ScrubInterval time.Duration
+	ScrubRate     int
+
+	// limits of the store, sizes in MB, 0 for no limit
+	MaxPhysicalSize int
+	MaxLogicalSize  int
+	MaxFiles        int
+	MaxFileSize     int
+
+	// chunks are kept in badger unless a bucket is set
+	S3 S3Config
 }
 
 type File struct {
@@ -42,395 +131,813 @@ type File struct {
 	SHA       string
 	Size      int64
 	WordCount int64
+	Expires   *time.Time `json:",omitempty"`
+	Modified  *time.Time `json:",omitempty"`
 }
 
+// Badger requires an index cache for encrypted tables
+const encryptedIndexCache = 100 << 20
+
+// Cache sizes are configured in megabytes
+const megabyte = 1 << 20
+
+// Size of the chunk data written in one transaction, well under the size
+// limit of badger transactions
+const chunkBatch = 4 << 20
+
+// Number of times a transaction is retried when it conflicts with another one
+const retries = 5
+
 // Open or Creat a new database
 func New(config *Config) (*database, error) {
-	file, err := badger.Open(badger.DefaultOptions(config.Path + "/file").
+	opts := badger.DefaultOptions(filepath.Join(config.Path, "store"))
+	path := config.Path
+	if config.Diskless {
+		opts = badger.DefaultOptions("").WithInMemory(true)
+		path = ""
+	}
+	opts = opts.
 		WithLoggingLevel(badger.ERROR).
-		WithCompression(options.None))
+		WithCompression(options.None)
+	if config.CacheSize > 0 {
+		// three quarters for data blocks, the rest for table indices
+		size := int64(config.CacheSize) * megabyte
+		opts = opts.
+			WithBlockCacheSize(size - size/4).
+			WithIndexCacheSize(size / 4)
+	}
+	if config.Encryption {
+		key, err := loadKey(config)
+		if err != nil {
+			return nil, err
+		}
+		opts = opts.WithEncryptionKey(key)
+		if opts.IndexCacheSize == 0 {
+			opts = opts.WithIndexCacheSize(encryptedIndexCache)
+		}
+	}
+	store, err := open(opts)
+	if err == ErrKeyMismatch && config.Encryption && config.KeyFile != "" {
+		store, opts, err = openPreviousKey(config.KeyFile, opts)
+	}
 	if err != nil {
 		return nil, err
 	}
-	sha, err := badger.Open(badger.DefaultOptions(config.Path + "/sha").
-		WithLoggingLevel(badger.ERROR).
-		WithCompression(options.None))
-	if err != nil {
+
+	db := &database{
+		store:    store,
+		opts:     opts,
+		keyFile:  config.KeyFile,
+		closed:   make(chan struct{}),
+		indexer:  make(chan struct{}, 1),
+		releaser: make(chan struct{}, 1),
+
+		maxVersions:    config.MaxVersions,
+		maxVersionAge:  config.MaxVersionAge,
+		trashRetention: config.TrashRetention,
+		eventRetention: config.EventRetention,
+		scrubInterval:  config.ScrubInterval,
+		scrubRate:      int64(config.ScrubRate) * megabyte,
+		quotas: quotas{
+			physical: int64(config.MaxPhysicalSize) * megabyte,
+			logical:  int64(config.MaxLogicalSize) * megabyte,
+			files:    int64(config.MaxFiles),
+			fileSize: int64(config.MaxFileSize) * megabyte,
+		},
+	}
+	if config.S3.Bucket != "" {
+		objects, err := newS3Store(&config.S3)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+		db.objects = objects
+	}
+	if config.BlobCache > 0 {
+		db.cache = newBlobCache(int64(config.BlobCache) * megabyte)
+	}
+	if config.Diskless && config.Snapshot != "" {
+		db.snapshot = config.Snapshot
+		if err := db.loadSnapshot(); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	if err := db.migrate(path); err != nil {
+		store.Close()
 		return nil, err
 	}
 
-	go runValueLogGC(file)
-	go runValueLogGC(sha)
+	go db.runValueLogGC()
+	go db.runVersionPrune()
+	go db.runTrashPurge()
+	go db.runIndexer()
+	go db.runRelease()
+	go db.runScrub()
+	go db.runExpiry()
+	go db.runEmptyBuckets()
+	go db.runEventPrune()
+	if db.objects != nil {
+		go db.runObjectSweep()
+	}
 
-	return &database{file, sha}, nil
+	return db, nil
 }
 
 // Close database files
 func (db *database) Close() error {
-	if err := db.file.Close(); err != nil {
-		return err
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	select {
+	case <-db.closed:
+		return nil
+	default:
+		close(db.closed)
 	}
-	if err := db.sha.Close(); err != nil {
-		return err
+	// no download is left reading the orphaned chunks
+	if db.objects != nil {
+		db.sweepObjects(0)
+	}
+	if db.snapshot != "" {
+		if err := db.saveSnapshot(); err != nil {
+			db.store.Close()
+			return err
+		}
+	}
+	return db.store.Close()
+}
+
+// Run a read-write transaction, retrying it when it conflicts on commit
+func (db *database) update(fn func(txn *badger.Txn) error) error {
+	db.writes.Lock()
+	defer db.writes.Unlock()
+	for attempt := 0; ; attempt++ {
+		db.dropped = nil
+		txn := db.store.NewTransaction(true)
+		if err := fn(txn); err != nil {
+			txn.Discard()
+			return err
+		}
+		err := txn.Commit()
+		if err == nil {
+			if db.cache != nil {
+				for _, sha := range db.dropped {
+					db.cache.remove(sha)
+				}
+			}
+			// the transaction may have changed the word counts, or released
+			// the chunks of large data
+			db.wakeIndexer()
+			db.wakeReleaser()
+		}
+		if err != badger.ErrConflict || attempt == retries {
+			return err
+		}
 	}
-	return nil
 }
 
 // Check if File exists in the Store
 func (db *database) FileExists(name string) bool {
-	txn := db.file.NewTransaction(false)
+	return db.fileExists(rootNamespace, name)
+}
+
+func (db *database) fileExists(ns namespace, name string) bool {
+	key, err := ns.key(name)
+	if err != nil {
+		return false
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	txn := db.store.NewTransaction(false)
 	defer txn.Discard()
-	_, err := txn.Get([]byte(name))
+	_, err = txn.Get(fileKey(key))
 	return err == nil
 }
 
 // Check if SHA exists in the Store
 func (db *database) SHAExists(SHA []byte) bool {
-	txn := db.sha.NewTransaction(false)
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.shaExists(SHA)
+}
+
+// Data with quarantined chunks is reported missing, so that it is uploaded
+// again and heals the chunks
+func (db *database) shaExists(SHA []byte) bool {
+	txn := db.store.NewTransaction(false)
 	defer txn.Discard()
-	_, err := txn.Get(SHA)
-	return err == nil
+	_, err := txn.Get(shaKey(SHA))
+	if err != nil {
+		return false
+	}
+	damaged, err := isDamaged(txn, SHA)
+	return err == nil && !damaged
 }
 
-// Returns an array of list object containing file details
-func (db *database) List(details bool) ([]interface{}, error) {
-	txn := db.file.NewTransaction(false)
+// List the files in a directory, the root of the store when the directory
+// of the options is empty. Unless recursive, the files of sub directories
+// are listed as the name of the directory followed by a slash.
+func (db *database) List(options ListOptions) (*FileList, error) {
+	return db.list(rootNamespace, options)
+}
+
+func (db *database) list(ns namespace, options ListOptions) (*FileList, error) {
+	l, err := newListing(options)
+	if err != nil {
+		return nil, err
+	}
+	prefix, _ := ns.key(l.scan)
+	start, _ := ns.key(l.start())
+	if len(start) == 0 {
+		// the names of the buckets sort first, with a 0x00 byte
+		start = []byte{1}
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	txn := db.store.NewTransaction(false)
 	defer txn.Discard()
 	opts := badger.DefaultIteratorOptions
 	opts.PrefetchSize = 10
-	opts.PrefetchValues = details
+	opts.PrefetchValues = false
+	opts.Prefix = fileKey(prefix)
 	iterator := txn.NewIterator(opts)
 	defer iterator.Close()
-	files := []interface{}{}
-	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		item := iterator.Item()
-		key := item.KeyCopy(nil)
-		if details {
-			file := File{Name: string(key)}
-			sha, _ := item.ValueCopy(nil)
-			file.SHA = fmt.Sprintf("%x", sha)
-			size, _ := db.getSize(sha)
-			file.Size = size
-			count, _ := db.getWordCount(key)
-			file.WordCount = count
-			files = append(files, file)
+	iterator.Seek(fileKey(start))
+	next := func() (string, bool) {
+		if !iterator.Valid() {
+			return "", false
+		}
+		key := iterator.Item().KeyCopy(nil)[len(filePrefix):]
+		entry, dir := l.entry(ns.name(key))
+		if dir {
+			// skip the files of the sub directory, '0' follows '/'
+			sub, _ := ns.key(entry)
+			iterator.Seek(append(fileKey(sub[:len(sub)-1]), '0'))
 		} else {
-			files = append(files, string(key))
+			iterator.Next()
+		}
+		return entry, true
+	}
+	fill := func(file *File) error {
+		key, _ := ns.key(file.Name)
+		sha, err := getSHA(txn, key)
+		if err != nil {
+			return err
+		}
+		file.SHA = fmt.Sprintf("%x", sha)
+		// a file pointing to missing data is listed until it is repaired
+		file.Size, _ = getSize(txn, sha)
+		file.WordCount, _ = getWordCount(txn, sha)
+		expires, err := getExpiry(txn, key)
+		if err != nil {
+			return err
 		}
+		file.Expires = timeOf(int64(expires))
+		modified, err := modifiedTime(txn, key)
+		if err != nil {
+			return err
+		}
+		file.Modified = timeOf(modified)
+		return nil
 	}
-	return files, nil
+	return l.page(next, fill)
 }
 
 // Remove a file from the Store
 func (db *database) Remove(name string) error {
-	sha, err := db.getSHA([]byte(name))
+	return db.remove(rootNamespace, name)
+}
+
+func (db *database) remove(ns namespace, name string) error {
+	key, err := ns.key(name)
+	if err != nil {
+		return err
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.update(func(txn *badger.Txn) error {
+		return db.removeFile(txn, key)
+	})
+}
+
+// Remove a file record with its versions and release its reference on the SHA
+func (db *database) removeFile(txn *badger.Txn, key []byte) error {
+	sha, err := getSHA(txn, key)
 	if err != nil {
 		return err
 	}
-	if err := db.removeFile([]byte(name)); err != nil {
+	if err := txn.Delete(fileKey(key)); err != nil {
 		return err
 	}
-	if err := db.removeSHA(sha); err != nil {
+	if err := setExpiry(txn, key, 0); err != nil {
 		return err
 	}
-	return nil
+	if err := db.removeVersions(txn, key); err != nil {
+		return err
+	}
+	if err := countWords(txn, key, sha, -1); err != nil {
+		return err
+	}
+	if err := removeName(txn, sha, key); err != nil {
+		return err
+	}
+	if err := accountFile(txn, sha, nil, nil); err != nil {
+		return err
+	}
+	if err := recordEvent(txn, EventRemove, key, nil, sha); err != nil {
+		return err
+	}
+	return db.releaseSHA(txn, sha)
 }
 
-// Remove a file record
-func (db *database) removeFile(key []byte) error {
-	return db.file.Update(func(txn *badger.Txn) error {
-		return txn.Delete([]byte(key))
-	})
+// Add a file to the store
+func (db *database) Add(name string, SHA []byte, data []byte) error {
+	return db.AddStream(name, SHA, bytes.NewReader(data))
+}
+
+// Add a file to the store, reading its data from a stream
+func (db *database) AddStream(name string, SHA []byte, reader io.Reader) error {
+	return db.addStream(rootNamespace, name, SHA, reader, 0)
 }
 
-// Remove a SHA record
-func (db *database) removeSHA(key []byte) error {
-	return db.sha.Update(func(txn *badger.Txn) error {
-		if _, err := db.getName(key); err == badger.ErrKeyNotFound {
-			return txn.Delete([]byte(key))
+// Add a file to a namespace, expiring at a time in nanoseconds, 0 for a file
+// that does not expire
+func (db *database) addStream(ns namespace, name string, SHA []byte, reader io.Reader, expires uint64) error {
+	if !validName(name) {
+		return ErrInvalidName
+	}
+	key, _ := ns.key(name)
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	SHA, m, stats, err := db.putData(SHA, reader)
+	if err != nil {
+		return err
+	}
+	err = db.update(func(txn *badger.Txn) error {
+		if err := ns.check(txn); err != nil {
+			return err
 		}
-		return nil
+		if err := addSHA(txn, SHA, m, stats); err != nil {
+			return err
+		}
+		if err := db.addFile(txn, key, SHA); err != nil {
+			return err
+		}
+		return setExpiry(txn, key, expires)
 	})
+	if err != nil && m != nil {
+		db.dropChunks(m)
+	}
+	return err
 }
 
-// Add a file to the store
-func (db *database) Add(name string, SHA []byte, data []byte) error {
-	if len(SHA) == 0 {
-		newSHA := sha256.Sum256(data)
-		SHA = newSHA[:]
+// Add a new file record with its first version and take a reference on the SHA
+func (db *database) addFile(txn *badger.Txn, key []byte, value []byte) error {
+	if _, err := txn.Get(fileKey(key)); err != badger.ErrKeyNotFound {
+		return badger.ErrConflict
 	}
-	if err := db.addFile([]byte(name), SHA); err != nil {
+	if err := txn.Set(fileKey(key), value); err != nil {
 		return err
 	}
-	if err := db.addSHA(SHA, data); err != nil {
+	if err := retainSHA(txn, value); err != nil {
 		return err
 	}
-	return nil
+	if err := countWords(txn, key, value, 1); err != nil {
+		return err
+	}
+	if err := addName(txn, value, key); err != nil {
+		return err
+	}
+	if err := accountFile(txn, nil, value, &db.quotas); err != nil {
+		return err
+	}
+	if err := recordEvent(txn, EventAdd, key, nil, value); err != nil {
+		return err
+	}
+	return db.addVersion(txn, key, value)
 }
 
-// Add a new file record
-func (db *database) addFile(key []byte, value []byte) error {
-	return db.file.Update(func(txn *badger.Txn) error {
-		if _, err := txn.Get(key); err == badger.ErrKeyNotFound {
-			return txn.Set(key, value)
+// Add a new SHA record from the chunks and word statistics taken by putData.
+// When the SHA is already present the references on the chunks are given
+// back. Without chunks the SHA must already be present.
+func addSHA(txn *badger.Txn, key []byte, m *manifest, stats *wordStats) error {
+	_, err := txn.Get(shaKey(key))
+	switch {
+	case err == badger.ErrKeyNotFound && m == nil:
+		return ErrMissingData
+	case err == badger.ErrKeyNotFound:
+		if err := txn.Set(statsKey(key), stats.encode()); err != nil {
+			return err
 		}
-		return badger.ErrConflict
-	})
+		return txn.Set(shaKey(key), m.encode())
+	case err == nil && m != nil:
+		return releaseManifest(txn, m)
+	}
+	return err
 }
 
-// Add a new SHA record
-func (db *database) addSHA(key []byte, value []byte) error {
-	return db.sha.Update(func(txn *badger.Txn) error {
-		if _, err := txn.Get(key); err == badger.ErrKeyNotFound {
-			return txn.Set(key, value)
+// Update a file
+func (db *database) Update(name string, SHA []byte, data []byte) error {
+	return db.UpdateStream(name, SHA, bytes.NewReader(data))
+}
+
+// Update a file, reading its data from a stream. The file no longer
+// expires.
+func (db *database) UpdateStream(name string, SHA []byte, reader io.Reader) error {
+	return db.updateStream(rootNamespace, name, SHA, reader, 0)
+}
+
+// Update a file of a namespace, then expiring at a time in nanoseconds, 0
+// for a file that does not expire
+func (db *database) updateStream(ns namespace, name string, SHA []byte, reader io.Reader, expires uint64) error {
+	if !validName(name) {
+		return ErrInvalidName
+	}
+	key, _ := ns.key(name)
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	SHA, m, stats, err := db.putData(SHA, reader)
+	if err != nil {
+		return err
+	}
+	err = db.update(func(txn *badger.Txn) error {
+		if err := ns.check(txn); err != nil {
+			return err
 		}
-		return nil
+		if err := updateSHA(txn, SHA, m, stats); err != nil {
+			return err
+		}
+		if err := db.updateFile(txn, key, SHA); err != nil {
+			return err
+		}
+		return setExpiry(txn, key, expires)
 	})
+	if err != nil && m != nil {
+		db.dropChunks(m)
+	}
+	return err
 }
 
-// Update a file
-func (db *database) Update(name string, SHA []byte, data []byte) error {
-	if len(SHA) == 0 {
-		newSHA := sha256.Sum256(data)
-		SHA = newSHA[:]
+// Update the File record, move its reference to the new SHA and add it as
+// a new version. Writing the same data again does not add a version.
+func (db *database) updateFile(txn *badger.Txn, key []byte, value []byte) error {
+	oldSHA, err := getSHA(txn, key)
+	if err != nil && err != badger.ErrKeyNotFound {
+		return err
+	}
+	if bytes.Equal(oldSHA, value) {
+		return nil
+	}
+	if err := accountFile(txn, oldSHA, value, &db.quotas); err != nil {
+		return err
+	}
+	if err := txn.Set(fileKey(key), value); err != nil {
+		return err
+	}
+	if err := retainSHA(txn, value); err != nil {
+		return err
+	}
+	if err := countWords(txn, key, value, 1); err != nil {
+		return err
 	}
-	oldSHA, err := db.getSHA([]byte(name))
-	if err := db.updateFile([]byte(name), SHA); err != nil {
+	if err := addName(txn, value, key); err != nil {
 		return err
 	}
-	if err == nil && !bytes.Equal(oldSHA, SHA) {
-		if err := db.removeSHA(oldSHA); err != nil {
+	kind := EventUpdate
+	if oldSHA == nil {
+		kind = EventAdd
+	}
+	if err := recordEvent(txn, kind, key, nil, value); err != nil {
+		return err
+	}
+	if oldSHA != nil {
+		if err := countWords(txn, key, oldSHA, -1); err != nil {
+			return err
+		}
+		if err := removeName(txn, oldSHA, key); err != nil {
+			return err
+		}
+		if err := db.releaseSHA(txn, oldSHA); err != nil {
 			return err
 		}
 	}
-	if err := db.updateSHA(SHA, data); err != nil {
-		return err
+	return db.addVersion(txn, key, value)
+}
+
+// Update the SHA record
+func updateSHA(txn *badger.Txn, key []byte, m *manifest, stats *wordStats) error {
+	return addSHA(txn, key, m, stats)
+}
+
+// Store the data of a file, unless its SHA is given and already present.
+// Returns the SHA and the word statistics of the data, computed while it is
+// stored, and the manifest of its chunks.
+func (db *database) putData(SHA []byte, reader io.Reader) ([]byte, *manifest, *wordStats, error) {
+	if len(SHA) > 0 && db.shaExists(SHA) {
+		return SHA, nil, nil, nil
 	}
-	return nil
+	if db.quotas.fileSize > 0 {
+		reader = &sizeLimiter{reader: reader, left: db.quotas.fileSize}
+	}
+	hash := sha256.New()
+	counter := newWordCounter()
+	m, err := db.putChunks(io.TeeReader(reader, io.MultiWriter(hash, counter)), true)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	sum := hash.Sum(nil)
+	if err := checkSHA(SHA, sum, m.size); err != nil {
+		db.dropChunks(m)
+		return nil, nil, nil, err
+	}
+	return sum, m, counter.stats(), nil
 }
 
-// Update the File record
-func (db *database) updateFile(key []byte, value []byte) error {
-	return db.file.Update(func(txn *badger.Txn) error {
-		return txn.Set(key, value)
-	})
+// Check the SHA given with data against the SHA of the data. Without data
+// the given SHA had to be present already.
+func checkSHA(SHA []byte, sum []byte, size int64) error {
+	switch {
+	case len(SHA) == 0 || bytes.Equal(SHA, sum):
+		return nil
+	case size == 0:
+		return ErrMissingData
+	}
+	return ErrSHAMismatch
 }
 
-// Update the SHA record
-func (db *database) updateSHA(key []byte, value []byte) error {
-	return db.sha.Update(func(txn *badger.Txn) error {
-		if _, err := txn.Get(key); err == badger.ErrKeyNotFound {
-			return txn.Set(key, value)
+// Split data in to chunks and take a reference on each of them. Chunks are
+// read in batches and written in their own transactions, so that files of
+// any size can be stored and slow uploads do not hold up other writes.
+// With limit, new chunks fail over the physical quota.
+func (db *database) putChunks(reader io.Reader, limit bool) (*manifest, error) {
+	var batch []fileChunk
+	size := 0
+	m := &manifest{}
+	flush := func() error {
+		if db.objects != nil {
+			db.objectLock.RLock()
+			defer db.objectLock.RUnlock()
+			if err := db.putObjects(batch); err != nil {
+				return err
+			}
+		}
+		err := db.update(func(txn *badger.Txn) error {
+			for _, c := range batch {
+				data := c.data
+				if db.objects != nil {
+					data = nil
+				}
+				if err := retainChunk(txn, c.sha, len(c.data), data); err != nil {
+					return err
+				}
+			}
+			if !limit || db.quotas.physical <= 0 {
+				return nil
+			}
+			physical, err := getCount(txn, physicalKey)
+			if err == nil && int64(physical) > db.quotas.physical {
+				err = ErrPhysicalQuota
+			}
+			return err
+		})
+		if err != nil {
+			if db.objects != nil {
+				db.orphanObjects(batch)
+			}
+			return err
+		}
+		for _, c := range batch {
+			m.add(c.sha, len(c.data))
 		}
+		batch = nil
+		size = 0
 		return nil
-	})
+	}
+	chunker := newChunker(reader)
+	for {
+		data, err := chunker.next()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			sum := sha256.Sum256(data)
+			// the chunker reuses its buffer
+			batch = append(batch, fileChunk{sum[:], append([]byte{}, data...)})
+			if size += len(data); size >= chunkBatch {
+				err = flush()
+			}
+		}
+		if err != nil {
+			db.dropChunks(m)
+			return nil, err
+		}
+	}
+	if err := flush(); err != nil {
+		db.dropChunks(m)
+		return nil, err
+	}
+	return m, nil
+}
+
+// Give back the references taken by putChunks
+func (db *database) dropChunks(m *manifest) error {
+	for len(m.chunks) > 0 {
+		batch := m.chunks
+		if len(batch) > releaseBatch {
+			batch = batch[:releaseBatch]
+		}
+		err := db.update(func(txn *badger.Txn) error {
+			return releaseChunks(txn, batch)
+		})
+		if err != nil {
+			return err
+		}
+		m.chunks = m.chunks[len(batch):]
+	}
+	return nil
 }
 
 // Returns the data of a file identified by file name
 func (db *database) Get(name string) ([]byte, error) {
-	sha, err := db.getSHA([]byte(name))
+	return db.get(rootNamespace, name)
+}
+
+func (db *database) get(ns namespace, name string) ([]byte, error) {
+	key, err := ns.key(name)
 	if err != nil {
 		return nil, err
 	}
-	data, err := db.getData(sha)
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	txn := db.store.NewTransaction(false)
+	defer txn.Discard()
+	sha, err := getSHA(txn, key)
 	if err != nil {
 		return nil, err
 	}
-	return data, nil
-}
-
-// Returns the data in a file identified by SHA
-func (db *database) getData(key []byte) ([]byte, error) {
-	txn := db.sha.NewTransaction(false)
-	defer txn.Discard()
-	item, err := txn.Get(key)
+	data, err := db.getData(txn, sha)
 	if err != nil {
 		return nil, err
 	}
-	return item.ValueCopy(nil)
+	return data, nil
 }
 
-// Returns the SHA of a file indentified by the File Name
-func (db *database) getSHA(key []byte) ([]byte, error) {
-	txn := db.file.NewTransaction(false)
-	defer txn.Discard()
-	item, err := txn.Get(key)
-	if err != nil {
-		return nil, err
-	}
-	return item.ValueCopy(nil)
+// Write the data of a file identified by file name to a stream, one chunk
+// at a time
+func (db *database) GetStream(name string, writer io.Writer) error {
+	return db.getStream(rootNamespace, name, writer)
 }
 
-// Returns the size of a given file identified by SHA
-func (db *database) getSize(key []byte) (int64, error) {
-	txn := db.sha.NewTransaction(false)
+func (db *database) getStream(ns namespace, name string, writer io.Writer) error {
+	key, err := ns.key(name)
+	if err != nil {
+		return err
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	txn := db.store.NewTransaction(false)
 	defer txn.Discard()
-	item, err := txn.Get(key)
+	sha, err := getSHA(txn, key)
 	if err != nil {
-		return 0, err
+		return err
 	}
-	return item.ValueSize(), nil
+	return db.writeData(txn, sha, writer)
 }
 
-// Returns name a file identified by the SHA
-func (db *database) getName(sha []byte) ([]byte, error) {
-	txn := db.file.NewTransaction(false)
+// Write the data of a SHA to a stream, one chunk at a time
+func (db *database) GetBlob(SHA []byte, writer io.Writer) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	txn := db.store.NewTransaction(false)
 	defer txn.Discard()
-	opts := badger.DefaultIteratorOptions
-	opts.PrefetchSize = 10
-	iterator := txn.NewIterator(opts)
-	defer iterator.Close()
-	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		item := iterator.Item()
-		key := item.KeyCopy(nil)
-		err := item.Value(func(value []byte) error {
-			if string(value) != string(sha) {
-				return badger.ErrKeyNotFound
+	return db.writeData(txn, SHA, writer)
+}
+
+func (db *database) writeData(txn *badger.Txn, sha []byte, writer io.Writer) error {
+	var generation uint64
+	if db.cache != nil {
+		if data, ok := db.cache.get(sha); ok {
+			_, err := writer.Write(data)
+			return err
+		}
+		generation = db.cache.generation()
+	}
+	m, err := getManifest(txn, sha)
+	if err != nil {
+		return err
+	}
+	// keep the data of files that fit in the blob cache
+	var data []byte
+	cache := db.cache != nil && m.size <= db.cache.maxSize
+	for _, chunk := range m.chunks {
+		err := db.readChunk(txn, chunk.sha, func(value []byte) error {
+			if cache {
+				data = append(data, value...)
 			}
-			return nil
+			_, err := writer.Write(value)
+			return err
 		})
-		if err == nil {
-			return key, nil
+		if err != nil {
+			return err
 		}
 	}
-	return nil, badger.ErrKeyNotFound
+	if cache {
+		db.cacheData(sha, data, generation)
+	}
+	return nil
 }
 
-// Returns total word count in a single file in Store
-func (db *database) getWordCount(key []byte) (int64, error) {
-	var count int64
-	sha, err := db.getSHA(key)
-	if err != nil {
-		return 0, err
+// Returns the data in a file identified by SHA, served from the blob cache
+// when it is enabled. The returned data must not be modified.
+func (db *database) getData(txn *badger.Txn, key []byte) ([]byte, error) {
+	var generation uint64
+	if db.cache != nil {
+		if data, ok := db.cache.get(key); ok {
+			return data, nil
+		}
+		generation = db.cache.generation()
 	}
-	data, err := db.getData(sha)
+	m, err := getManifest(txn, key)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	reader := bytes.NewReader(data)
-	scanner := bufio.NewScanner(reader)
-	scanner.Split(bufio.ScanWords)
-	for scanner.Scan() {
-		count++
+	data := make([]byte, 0, m.size)
+	for _, chunk := range m.chunks {
+		err := db.readChunk(txn, chunk.sha, func(value []byte) error {
+			data = append(data, value...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
 	}
-	return count, nil
+	if db.cache != nil {
+		db.cacheData(key, data, generation)
+	}
+	return data, nil
 }
 
-// Returns frequency of words in a single file in Store
-func (db *database) getWordFrequency(key []byte, frequency map[string]int64, mutex *sync.RWMutex) error {
-	sha, err := db.getSHA(key)
+// Returns the chunk manifest of a file identified by SHA
+func getManifest(txn *badger.Txn, key []byte) (*manifest, error) {
+	item, err := txn.Get(shaKey(key))
 	if err != nil {
+		return nil, err
+	}
+	var m *manifest
+	err = item.Value(func(value []byte) error {
+		m, err = decodeManifest(value)
 		return err
+	})
+	return m, err
+}
+
+// Add data read from a transaction to the blob cache, unless the SHA was
+// dropped since. Data dropped after the check is caught by the generation,
+// as it is removed from the cache after its transaction commits.
+func (db *database) cacheData(sha []byte, data []byte, generation uint64) {
+	err := db.store.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(shaKey(sha))
+		return err
+	})
+	if err == nil {
+		db.cache.add(sha, data, generation)
 	}
-	data, err := db.getData(sha)
+}
+
+// Returns the SHA of a file indentified by the File Name
+func getSHA(txn *badger.Txn, key []byte) ([]byte, error) {
+	item, err := txn.Get(fileKey(key))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	reader := bytes.NewReader(data)
-	scanner := bufio.NewScanner(reader)
-	scanner.Split(bufio.ScanWords)
-	for scanner.Scan() {
-		word := scanner.Text()
-		word = strings.ToLower(word)
-		mutex.Lock()
-		frequency[word]++
-		mutex.Unlock()
+	return item.ValueCopy(nil)
+}
+
+// Returns the size of a given file identified by SHA
+func getSize(txn *badger.Txn, key []byte) (int64, error) {
+	m, err := getManifest(txn, key)
+	if err != nil {
+		return 0, err
 	}
-	return nil
+	return m.size, nil
 }
 
-// Returns total word count in all the files in Store
-func (db *database) WordCount() (int64, error) {
-	var totalCount int64
-	txn := db.file.NewTransaction(false)
-	defer txn.Discard()
-	opts := badger.DefaultIteratorOptions
-	opts.PrefetchValues = false
-	opts.PrefetchSize = 10
-	iterator := txn.NewIterator(opts)
-	defer iterator.Close()
-	wg := &sync.WaitGroup{}
-	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		item := iterator.Item()
-		key := item.KeyCopy(nil)
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			count, _ := db.getWordCount(key)
-			totalCount += count
-		}()
-	}
-	wg.Wait()
-	return totalCount, nil
-}
-
-// Returns frequency of words in all the files in Store
-func (db *database) WordFrequency() (map[string]int64, error) {
-	txn := db.file.NewTransaction(false)
-	defer txn.Discard()
-	opts := badger.DefaultIteratorOptions
-	opts.PrefetchValues = false
-	opts.PrefetchSize = 10
-	iterator := txn.NewIterator(opts)
-	defer iterator.Close()
-	frequency := map[string]int64{}
-	wg := &sync.WaitGroup{}
-	mutex := &sync.RWMutex{}
-	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		item := iterator.Item()
-		key := item.KeyCopy(nil)
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			db.getWordFrequency(key, frequency, mutex)
-		}()
-	}
-	wg.Wait()
-	return frequency, nil
-}
-
-// Run log garbage collector after every 5 seconds
-func runValueLogGC(db *badger.DB) {
+// Run log garbage collector after every 5 minutes
+func (db *database) runValueLogGC() {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
-	for range ticker.C {
+	for {
+		select {
+		case <-db.closed:
+			return
+		case <-ticker.C:
+		}
+		db.lock.RLock()
 	again:
-		err := db.RunValueLogGC(0.6)
+		err := db.store.RunValueLogGC(0.6)
 		if err == nil {
 			goto again
 		}
+		db.lock.RUnlock()
 	}
 }
-
-// Development and Debugging purpose
-func (db *database) ListHelpFiles() ([]interface{}, error) {
-	txn := db.file.NewTransaction(false)
-	defer txn.Discard()
-	opts := badger.DefaultIteratorOptions
-	opts.PrefetchSize = 10
-	iterator := txn.NewIterator(opts)
-	defer iterator.Close()
-	files := []interface{}{}
-	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		item := iterator.Item()
-		key := item.KeyCopy(nil)
-		files = append(files, string(key))
-	}
-	return files, nil
-}
-
-func (db *database) ListHelpSHA() ([]interface{}, error) {
-	txn := db.sha.NewTransaction(false)
-	defer txn.Discard()
-	opts := badger.DefaultIteratorOptions
-	opts.PrefetchSize = 10
-	iterator := txn.NewIterator(opts)
-	defer iterator.Close()
-	files := []interface{}{}
-	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
-		item := iterator.Item()
-		key := item.KeyCopy(nil)
-		files = append(files, string(key))
-	}
-	return files, nil
-}
@@ -0,0 +1,226 @@
+package database
+
+import (
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"unsafe"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+var (
+	ErrMissingKey   = errors.New("database encryption is enabled but no key is configured, set database.keyFile or STORE_DATABASE_KEY")
+	ErrInvalidKey   = errors.New("database key must be 16, 24 or 32 bytes, hex encoded")
+	ErrKeyMismatch  = errors.New("database is encrypted with a different key, or the key is missing")
+	ErrNotRotable   = errors.New("database key can only be rotated on an encrypted disk store")
+	ErrKeyNotStored = errors.New("database key can only be rotated when it is read from database.keyFile")
+)
+
+// Suffix of the file keeping the old key while the key is rotated
+const previousKeySuffix = ".previous"
+
+// Open the badger store, reporting a wrong or missing encryption key clearly
+func open(opts badger.Options) (*badger.DB, error) {
+	store, err := badger.Open(opts)
+	if errors.Is(err, badger.ErrEncryptionKeyMismatch) {
+		return nil, ErrKeyMismatch
+	}
+	return store, err
+}
+
+// Parse a hex encoded encryption key
+func ParseKey(key string) ([]byte, error) {
+	decoded, err := hex.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	switch len(decoded) {
+	case 16, 24, 32:
+		return decoded, nil
+	}
+	return nil, ErrInvalidKey
+}
+
+// Load the encryption key from the key file, or from the config value
+func loadKey(config *Config) ([]byte, error) {
+	key := config.Key
+	if config.KeyFile != "" {
+		data, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		key = string(data)
+	}
+	if strings.TrimSpace(key) == "" {
+		return nil, ErrMissingKey
+	}
+	return ParseKey(key)
+}
+
+// Re-encrypt the data keys of the store with a new encryption key, while
+// the store keeps running. The key must come from a key file, which is
+// replaced with the new key before the key registry is rewritten, the old key
+// being kept next to it until the registry holds the new one.
+func (db *database) RotateKey(key []byte) error {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	db.keyLock.Lock()
+	defer db.keyLock.Unlock()
+	if db.opts.InMemory || len(db.opts.EncryptionKey) == 0 {
+		return ErrNotRotable
+	}
+	if db.keyFile == "" {
+		return ErrKeyNotStored
+	}
+	switch len(key) {
+	case 16, 24, 32:
+	default:
+		return ErrInvalidKey
+	}
+	if db.cache != nil {
+		// nothing read with the old key is served after the rotation
+		db.cache.reset()
+	}
+	old := db.opts.EncryptionKey
+	previous := db.keyFile + previousKeySuffix
+	if err := writeKeyFile(previous, old); err != nil {
+		return err
+	}
+	if err := writeKeyFile(db.keyFile, key); err != nil {
+		os.Remove(previous)
+		return err
+	}
+	if err := rotateRegistry(db.store, db.opts.Dir, key); err != nil {
+		// the registry still has the old key
+		if writeErr := writeKeyFile(db.keyFile, old); writeErr == nil {
+			os.Remove(previous)
+		}
+		return err
+	}
+	db.opts.EncryptionKey = key
+	// the old key stays until the new registry is sure to be on disk
+	if err := syncDir(db.opts.Dir); err != nil {
+		return err
+	}
+	os.Remove(previous)
+	return nil
+}
+
+var errNoRegistry = errors.New("key registry of the store not found")
+
+// Re-encrypt the key registry of an open store with a new key. Badger
+// appends the data keys it creates to the registry file it opened, with the
+// key it was opened with, so the open registry is moved to the rewritten
+// file and the new key. The registry is not exported by badger, it is
+// reached by reflection on the version in go.mod.
+func rotateRegistry(store *badger.DB, dir string, key []byte) error {
+	field := reflect.ValueOf(store).Elem().FieldByName("registry")
+	if !field.IsValid() || field.Type() != reflect.TypeOf(&badger.KeyRegistry{}) {
+		return errNoRegistry
+	}
+	registry := *(**badger.KeyRegistry)(unsafe.Pointer(field.UnsafeAddr()))
+	fp := reflect.ValueOf(registry).Elem().FieldByName("fp")
+	opt := reflect.ValueOf(registry).Elem().FieldByName("opt")
+	if !fp.IsValid() || fp.Type() != reflect.TypeOf(&os.File{}) ||
+		!opt.IsValid() || opt.Type() != reflect.TypeOf(badger.KeyRegistryOptions{}) {
+		return errNoRegistry
+	}
+	file := (**os.File)(unsafe.Pointer(fp.UnsafeAddr()))
+	options := (*badger.KeyRegistryOptions)(unsafe.Pointer(opt.UnsafeAddr()))
+
+	// no data key is created while the registry is rewritten
+	registry.Lock()
+	defer registry.Unlock()
+	temp, err := os.MkdirTemp(dir, "rotate")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(temp)
+	rotated := *options
+	rotated.Dir = temp
+	rotated.EncryptionKey = key
+	if err := badger.WriteKeyRegistry(registry, rotated); err != nil {
+		return err
+	}
+	// the file is opened before it replaces the registry, so the registry
+	// never has a file it can not append to
+	name := filepath.Join(temp, badger.KeyRegistryFileName)
+	rewritten, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_SYNC, 0)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(name, filepath.Join(dir, badger.KeyRegistryFileName)); err != nil {
+		rewritten.Close()
+		return err
+	}
+	(*file).Close()
+	*file = rewritten
+	options.EncryptionKey = key
+	return nil
+}
+
+// Flush the entries of a directory to disk
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Open the store with the old key of a rotation that was interrupted before
+// the key registry was rewritten, and put that key back in the key file
+func openPreviousKey(keyFile string, opts badger.Options) (*badger.DB, badger.Options, error) {
+	previous := keyFile + previousKeySuffix
+	data, err := os.ReadFile(previous)
+	if err != nil {
+		return nil, opts, ErrKeyMismatch
+	}
+	key, err := ParseKey(string(data))
+	if err != nil {
+		return nil, opts, ErrKeyMismatch
+	}
+	opts = opts.WithEncryptionKey(key)
+	store, err := open(opts)
+	if err != nil {
+		return nil, opts, err
+	}
+	if err := writeKeyFile(keyFile, key); err != nil {
+		store.Close()
+		return nil, opts, err
+	}
+	os.Remove(previous)
+	return store, opts, nil
+}
+
+// Replace the key file with a new key
+func writeKeyFile(name string, key []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.WriteString(hex.EncodeToString(key) + "\n"); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(file.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), name)
+}
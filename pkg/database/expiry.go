@@ -0,0 +1,172 @@
+package database
+
+import (
+	"io"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// A file written with a time to live keeps its expiry time next to its
+// name, and in a second record ordered by time. The sweeper reads the
+// records ordered by time up to now, and removes the expired files the way
+// Remove does, releasing their data.
+
+// Store whose files can be written with a time to live
+type Expirer interface {
+	AddStreamTTL(name string, SHA []byte, reader io.Reader, ttl time.Duration) error
+	UpdateStreamTTL(name string, SHA []byte, reader io.Reader, ttl time.Duration) error
+}
+
+// Interval between two runs of the expiry sweeper, files are removed within
+// this time after they expire
+const expiryInterval = time.Second
+
+// Add a file to the store that is removed once the TTL has passed, 0 for a
+// file that does not expire
+func (db *database) AddStreamTTL(name string, SHA []byte, reader io.Reader, ttl time.Duration) error {
+	return db.addStream(rootNamespace, name, SHA, reader, expiryTime(ttl))
+}
+
+// Update a file, that is then removed once the TTL has passed. With a TTL
+// of 0 the file no longer expires.
+func (db *database) UpdateStreamTTL(name string, SHA []byte, reader io.Reader, ttl time.Duration) error {
+	return db.updateStream(rootNamespace, name, SHA, reader, expiryTime(ttl))
+}
+
+// Add a file that is removed at a time, the zero time for a file that does
+// not expire. Stores given the same time expire the file at the same time.
+func (db *database) AddStreamExpiring(name string, SHA []byte, reader io.Reader, expires time.Time) error {
+	return db.addStream(rootNamespace, name, SHA, reader, expiryAt(expires))
+}
+
+// Update a file, that is then removed at a time, or no longer expires with
+// the zero time
+func (db *database) UpdateStreamExpiring(name string, SHA []byte, reader io.Reader, expires time.Time) error {
+	return db.updateStream(rootNamespace, name, SHA, reader, expiryAt(expires))
+}
+
+// Remove a file that expires at or before a time, as the sweeper does once
+// it expired. Stores given the same time remove the same files.
+func (db *database) ExpireAt(name string, at time.Time) error {
+	key, err := rootNamespace.key(name)
+	if err != nil {
+		return err
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.expire(key, uint64(at.UnixNano()))
+}
+
+// Returns a time in nanoseconds, 0 for the zero time
+func expiryAt(expires time.Time) uint64 {
+	if expires.IsZero() {
+		return 0
+	}
+	return uint64(expires.UnixNano())
+}
+
+// Returns the expiry time of a TTL in nanoseconds, 0 without TTL
+func expiryTime(ttl time.Duration) uint64 {
+	if ttl <= 0 {
+		return 0
+	}
+	return uint64(time.Now().Add(ttl).UnixNano())
+}
+
+// Set the expiry time of a file, removing its previous one. With 0 the file
+// does not expire.
+func setExpiry(txn *badger.Txn, name []byte, expires uint64) error {
+	previous, err := getExpiry(txn, name)
+	if err != nil {
+		return err
+	}
+	if previous != 0 {
+		if err := txn.Delete(expiringKey(previous, name)); err != nil {
+			return err
+		}
+		if err := txn.Delete(expiryKey(name)); err != nil {
+			return err
+		}
+	}
+	if expires == 0 {
+		return nil
+	}
+	if err := txn.Set(expiryKey(name), encodeUint(expires)); err != nil {
+		return err
+	}
+	return txn.Set(expiringKey(expires, name), nil)
+}
+
+// Returns the expiry time of a file, 0 when it does not expire
+func getExpiry(txn *badger.Txn, name []byte) (uint64, error) {
+	item, err := txn.Get(expiryKey(name))
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return 0, err
+	}
+	return decodeUint(value), nil
+}
+
+// Remove the files that have expired
+func (db *database) runExpiry() {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closed:
+			return
+		case <-ticker.C:
+		}
+		db.lock.RLock()
+		db.removeExpired()
+		db.lock.RUnlock()
+	}
+}
+
+func (db *database) removeExpired() error {
+	now := uint64(time.Now().UnixNano())
+	var names [][]byte
+	err := db.store.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = expiringPrefix
+		iterator := txn.NewIterator(opts)
+		defer iterator.Close()
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			expires, name := splitExpiringKey(iterator.Item().KeyCopy(nil))
+			if expires > now {
+				break
+			}
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := db.expire(name, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove a file when it expires at or before a time in nanoseconds
+func (db *database) expire(name []byte, at uint64) error {
+	return db.update(func(txn *badger.Txn) error {
+		// the file may have been removed or written again since
+		expires, err := getExpiry(txn, name)
+		if err != nil || expires == 0 || expires > at {
+			return err
+		}
+		return db.removeFile(txn, name)
+	})
+}
@@ -0,0 +1,309 @@
+package database
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Size the log of the index may reach before it is compacted, when larger
+// than the index itself
+const indexLogSize = 1 << 20
+
+// Backend keeping the data of the files as plain files named by their SHA,
+// in directories sharded by its first bytes (blobs/ab/cd/abcd...), next to
+// the counts of their words (abcd....words). The metadata of the files is
+// kept in a JSON index, and each change of it is appended to a log, replayed
+// over the index on open and compacted into it once large.
+func newFilesystem(config *Config) (Store, error) {
+	blobs := &filesystemBlobs{root: config.Path}
+	// left by writes interrupted before their commit
+	if err := os.RemoveAll(blobs.tempDir()); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(blobs.tempDir(), 0755); err != nil {
+		return nil, err
+	}
+	index := &fileIndex{
+		Files:    map[string]string{},
+		Data:     map[string]*dataEntry{},
+		Modified: map[string]int64{},
+	}
+	data, err := os.ReadFile(blobs.indexPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, index); err != nil {
+			return nil, err
+		}
+		if err := blobs.moveWords(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := blobs.replay(index); err != nil {
+		return nil, err
+	}
+	for sha, entry := range index.Data {
+		if entry.Words, err = blobs.words(sha); err != nil {
+			return nil, err
+		}
+	}
+	// drops the log, with any change torn by a crash while it was appended
+	if err := blobs.compact(index); err != nil {
+		return nil, err
+	}
+	return newIndexStore(blobs, index), nil
+}
+
+func init() {
+	Register("filesystem", newFilesystem)
+}
+
+// Blobs and index of the filesystem backend, guarded by the lock of the
+// index store
+type filesystemBlobs struct {
+	root string
+	// log of the changes since the index was written, and their size
+	log    *os.File
+	logged int64
+	// size of the index when last written
+	indexed int64
+}
+
+type filesystemWriter struct {
+	*os.File
+	blobs *filesystemBlobs
+}
+
+func (b *filesystemBlobs) indexPath() string {
+	return filepath.Join(b.root, "index.json")
+}
+
+func (b *filesystemBlobs) logPath() string {
+	return filepath.Join(b.root, "index.log")
+}
+
+func (b *filesystemBlobs) tempDir() string {
+	return filepath.Join(b.root, "tmp")
+}
+
+func (b *filesystemBlobs) blobPath(sha []byte) string {
+	name := hex.EncodeToString(sha)
+	return filepath.Join(b.root, "blobs", name[:2], name[2:4], name)
+}
+
+func (b *filesystemBlobs) wordsPath(sha []byte) string {
+	return b.blobPath(sha) + ".words"
+}
+
+// New data is written to a temporary file, moved in place on commit
+func (b *filesystemBlobs) create() (blobWriter, error) {
+	file, err := os.CreateTemp(b.tempDir(), "blob-*")
+	if err != nil {
+		return nil, err
+	}
+	return &filesystemWriter{File: file, blobs: b}, nil
+}
+
+// The counts of the words are written first, so that they are present with
+// the data
+func (w *filesystemWriter) commit(sha []byte, words map[string]uint64) error {
+	if err := w.Sync(); err != nil {
+		w.abort()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	path := w.blobs.blobPath(sha)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	if err := w.blobs.saveWords(sha, words); err != nil {
+		os.Remove(w.Name())
+		return err
+	}
+	return os.Rename(w.Name(), path)
+}
+
+func (w *filesystemWriter) abort() error {
+	w.Close()
+	return os.Remove(w.Name())
+}
+
+func (b *filesystemBlobs) open(sha []byte) (io.ReadCloser, error) {
+	file, err := os.Open(b.blobPath(sha))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrMissingData
+	}
+	return file, err
+}
+
+func (b *filesystemBlobs) remove(sha []byte) error {
+	err := os.Remove(b.blobPath(sha))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	err = os.Remove(b.wordsPath(sha))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Write a file completely before moving it in place
+func (b *filesystemBlobs) writeFile(path string, data []byte) error {
+	file, err := os.CreateTemp(b.tempDir(), "file-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (b *filesystemBlobs) saveWords(sha []byte, words map[string]uint64) error {
+	data, err := json.Marshal(words)
+	if err != nil {
+		return err
+	}
+	return b.writeFile(b.wordsPath(sha), data)
+}
+
+// Returns the counts of the words of the data with the hex encoded SHA
+func (b *filesystemBlobs) words(sha string) (map[string]uint64, error) {
+	key, err := hex.DecodeString(sha)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(b.wordsPath(key))
+	if err != nil {
+		return nil, err
+	}
+	words := map[string]uint64{}
+	return words, json.Unmarshal(data, &words)
+}
+
+// Move the counts of the words out of an index written before they were
+// kept with the data
+func (b *filesystemBlobs) moveWords(data []byte) error {
+	var index struct {
+		Data map[string]struct {
+			Words map[string]uint64
+		}
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return err
+	}
+	for sha, entry := range index.Data {
+		if entry.Words == nil {
+			continue
+		}
+		key, err := hex.DecodeString(sha)
+		if err != nil {
+			return err
+		}
+		if err := b.saveWords(key, entry.Words); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply the changes of the log to the index. A change that cannot be read
+// was torn while it was appended, and ends the log.
+func (b *filesystemBlobs) replay(index *fileIndex) error {
+	file, err := os.Open(b.logPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		change := &indexChange{}
+		if json.Unmarshal(line, change) != nil {
+			return nil
+		}
+		change.apply(index)
+	}
+}
+
+// Append a change to the log, compacting the log once it grows larger than
+// the index
+func (b *filesystemBlobs) save(index *fileIndex, change *indexChange) error {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return err
+	}
+	if _, err := b.log.Write(append(data, '\n')); err != nil {
+		// so that the changes appended next are not read as torn
+		b.log.Truncate(b.logged)
+		return err
+	}
+	if err := b.log.Sync(); err != nil {
+		return err
+	}
+	b.logged += int64(len(data) + 1)
+	if b.logged < indexLogSize || b.logged < b.indexed {
+		return nil
+	}
+	return b.compact(index)
+}
+
+// Write the whole index, replacing the previous one only after the new one
+// is completely written, and empty the log
+func (b *filesystemBlobs) compact(index *fileIndex) error {
+	data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	if err := b.writeFile(b.indexPath(), data); err != nil {
+		return err
+	}
+	b.indexed = int64(len(data))
+	if b.log == nil {
+		b.log, err = os.OpenFile(b.logPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+	}
+	if err := b.log.Truncate(0); err != nil {
+		return err
+	}
+	b.logged = 0
+	return b.log.Sync()
+}
+
+func (b *filesystemBlobs) close() error {
+	if b.log == nil {
+		return nil
+	}
+	return b.log.Close()
+}
@@ -0,0 +1,498 @@
+package database
+
+import (
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// The checker walks the records of the store and compares them with each
+// other: file names, versions and trash entries must point to data in the
+// store, data must be pointed to, and the reference counts and file name
+// records must match the records they count. The whole store is read in one
+// transaction while no other use of the store runs, so uploads in progress
+// are not mistaken for orphans.
+//
+// A repair removes the orphans and moves the file names pointing to missing
+// data to the lost keyspace, where they are kept with their SHA. Chunks of
+// the data that are missing are quarantined, so that the next upload of the
+// same data stores them again.
+
+// Store whose records can be checked for consistency and repaired
+type Checker interface {
+	Check(repair bool) (*CheckReport, error)
+}
+
+// Inconsistencies found by a check of the store
+type CheckReport struct {
+	// names of the files whose data is not in the store
+	Dangling []string
+	// number of versions and trash entries whose data is not in the store
+	DanglingEntries int64
+	// SHAs of the data that no file, version or trash entry points to
+	Orphaned []string
+	// SHAs of the data whose manifest cannot be read
+	Corrupt []string
+	// number of chunks that no data uses
+	OrphanedChunks int64
+	// SHAs of the chunks used by data but missing from the store
+	MissingChunks []string
+	// number of reference counts, usage counters, file name and expiry
+	// records that do not match
+	Mismatched int64
+	Repaired   bool
+}
+
+// Check if the check found nothing to repair
+func (r *CheckReport) Consistent() bool {
+	return len(r.Dangling) == 0 && r.DanglingEntries == 0 && len(r.Orphaned) == 0 &&
+		len(r.Corrupt) == 0 && r.OrphanedChunks == 0 && len(r.MissingChunks) == 0 && r.Mismatched == 0
+}
+
+// Number of repairs applied in one transaction
+const repairBatch = 1000
+
+// Check the consistency of the store, and repair it when asked to
+func (db *database) Check(repair bool) (*CheckReport, error) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+	report := &CheckReport{
+		Dangling:      []string{},
+		Orphaned:      []string{},
+		Corrupt:       []string{},
+		MissingChunks: []string{},
+	}
+	var fixes []func(txn *badger.Txn) error
+	err := db.store.View(func(txn *badger.Txn) error {
+		var err error
+		fixes, err = db.check(txn, report)
+		return err
+	})
+	if err != nil || !repair {
+		return report, err
+	}
+	for len(fixes) > 0 {
+		batch := fixes
+		if len(batch) > repairBatch {
+			batch = batch[:repairBatch]
+		}
+		err := db.update(func(txn *badger.Txn) error {
+			for _, fix := range batch {
+				if err := fix(txn); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return report, err
+		}
+		fixes = fixes[len(batch):]
+	}
+	report.Repaired = true
+	return report, nil
+}
+
+// Walk the records of the store, filling the report. Returns the fixes
+// that repair the store.
+func (db *database) check(txn *badger.Txn, report *CheckReport) ([]func(txn *badger.Txn) error, error) {
+	var fixes []func(txn *badger.Txn) error
+	fix := func(fn func(txn *badger.Txn) error) {
+		fixes = append(fixes, fn)
+	}
+
+	// data in the store, with its chunks
+	manifests := map[string]*manifest{}
+	err := eachRecord(txn, shaPrefix, func(key []byte, value []byte) error {
+		sha := key[len(shaPrefix):]
+		m, err := decodeManifest(value)
+		if err != nil {
+			report.Corrupt = append(report.Corrupt, hex.EncodeToString(sha))
+			fix(func(txn *badger.Txn) error {
+				return db.dropData(txn, sha)
+			})
+			return nil
+		}
+		manifests[string(sha)] = m
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	buckets, err := bucketNames(txn)
+	if err != nil {
+		return nil, err
+	}
+
+	// references on the data from file names, versions and trash entries
+	refs := map[string]uint64{}
+	names := map[string]bool{}
+	existing := map[string]bool{}
+	var logical, files uint64
+	err = eachRecord(txn, filePrefix, func(key []byte, sha []byte) error {
+		name := key[len(filePrefix):]
+		existing[string(name)] = true
+		if m, ok := manifests[string(sha)]; ok {
+			refs[string(sha)]++
+			names[string(nameKey(sha, name))] = true
+			logical += uint64(m.size)
+			files++
+			return nil
+		}
+		report.Dangling = append(report.Dangling, reportName(buckets, name))
+		fix(func(txn *badger.Txn) error {
+			return loseFile(txn, name, sha)
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	entry := func(key []byte, sha []byte, err error) {
+		if _, ok := manifests[string(sha)]; ok && err == nil {
+			refs[string(sha)]++
+			return
+		}
+		report.DanglingEntries++
+		fix(func(txn *badger.Txn) error {
+			return txn.Delete(key)
+		})
+	}
+	err = eachRecord(txn, versionPrefix, func(key []byte, value []byte) error {
+		v, err := decodeVersion(value)
+		if err != nil {
+			entry(key, nil, err)
+			return nil
+		}
+		entry(key, v.sha, nil)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = eachRecord(txn, trashPrefix, func(key []byte, value []byte) error {
+		e, err := decodeTrashEntry(value)
+		if err != nil {
+			entry(key, nil, err)
+			return nil
+		}
+		entry(key, e.sha, nil)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// data without references is orphaned, the rest references its chunks
+	chunkRefs := map[string]uint64{}
+	chunkSizes := map[string]uint64{}
+	for sha, m := range manifests {
+		if refs[sha] == 0 {
+			report.Orphaned = append(report.Orphaned, hex.EncodeToString([]byte(sha)))
+			key := []byte(sha)
+			fix(func(txn *badger.Txn) error {
+				return db.dropData(txn, key)
+			})
+			continue
+		}
+		for _, chunk := range m.chunks {
+			chunkRefs[string(chunk.sha)]++
+			chunkSizes[string(chunk.sha)] = uint64(chunk.size)
+		}
+	}
+	// released data references the chunks the releaser has not released yet
+	err = eachRecord(txn, releasedPrefix, func(key []byte, value []byte) error {
+		if len(key) != len(releasedPrefix)+8 {
+			return nil
+		}
+		m, err := decodeManifest(value)
+		if err != nil {
+			return nil
+		}
+		next, err := getCount(txn, releasedNextKey(decodeUint(key[len(releasedPrefix):])))
+		if err != nil || next > uint64(len(m.chunks)) {
+			return err
+		}
+		for _, chunk := range m.chunks[next:] {
+			chunkRefs[string(chunk.sha)]++
+			chunkSizes[string(chunk.sha)] = uint64(chunk.size)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// stored reference counts must match the references found
+	counts := func(prefix []byte, expected map[string]uint64) error {
+		stored := map[string]bool{}
+		err := eachRecord(txn, prefix, func(key []byte, value []byte) error {
+			id := string(key[len(prefix):])
+			stored[id] = true
+			if decodeUint(value) != expected[id] {
+				report.Mismatched++
+				fix(func(txn *badger.Txn) error {
+					return setCount(txn, key, expected[id])
+				})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for id, count := range expected {
+			if !stored[id] {
+				report.Mismatched++
+				key := prefixKey(prefix, []byte(id))
+				count := count
+				fix(func(txn *badger.Txn) error {
+					return setCount(txn, key, count)
+				})
+			}
+		}
+		return nil
+	}
+	if err := counts(refPrefix, refs); err != nil {
+		return nil, err
+	}
+	if err := counts(chunkRefPrefix, chunkRefs); err != nil {
+		return nil, err
+	}
+
+	// chunks must have their data when used, and nothing left when not
+	chunks := map[string]bool{}
+	quarantined := map[string]bool{}
+	orphans := map[string]bool{}
+	for _, keys := range []struct {
+		prefix []byte
+		set    map[string]bool
+	}{{chunkPrefix, chunks}, {quarantinePrefix, quarantined}, {orphanPrefix, orphans}} {
+		eachKey(txn, keys.prefix, func(key []byte) {
+			keys.set[string(key[len(keys.prefix):])] = true
+		})
+	}
+	unused := map[string]bool{}
+	eachKey(txn, chunkRefPrefix, func(key []byte) {
+		if sha := string(key[len(chunkRefPrefix):]); chunkRefs[sha] == 0 {
+			unused[sha] = true
+		}
+	})
+	for sha := range chunks {
+		if chunkRefs[sha] == 0 {
+			unused[sha] = true
+		}
+	}
+	for sha := range quarantined {
+		if chunkRefs[sha] == 0 {
+			unused[sha] = true
+		}
+	}
+	for sha := range unused {
+		report.OrphanedChunks++
+		key, stored := []byte(sha), chunks[sha]
+		fix(func(txn *badger.Txn) error {
+			return db.dropChunk(txn, key, stored)
+		})
+	}
+	var missing []string
+	for sha := range chunkRefs {
+		key := []byte(sha)
+		if orphans[sha] {
+			// the object of a used chunk is not swept
+			fix(func(txn *badger.Txn) error {
+				return txn.Delete(orphanKey(key))
+			})
+		}
+		if chunks[sha] || quarantined[sha] || db.objects != nil {
+			continue
+		}
+		missing = append(missing, hex.EncodeToString(key))
+		fix(func(txn *badger.Txn) error {
+			return txn.Set(quarantineKey(key), nil)
+		})
+	}
+	sort.Strings(missing)
+	report.MissingChunks = append(report.MissingChunks, missing...)
+
+	// file name records of the data must match the file names
+	eachKey(txn, namePrefix, func(key []byte) {
+		if names[string(key)] {
+			delete(names, string(key))
+			return
+		}
+		report.Mismatched++
+		fix(func(txn *badger.Txn) error {
+			return txn.Delete(key)
+		})
+	})
+	for key := range names {
+		report.Mismatched++
+		key := []byte(key)
+		fix(func(txn *badger.Txn) error {
+			return txn.Set(key, nil)
+		})
+	}
+
+	// expiry records must belong to files and be found by time, the expiry
+	// of dangling files is removed with them
+	expiries := map[string]uint64{}
+	err = eachRecord(txn, expiryPrefix, func(key []byte, value []byte) error {
+		name := string(key[len(expiryPrefix):])
+		if existing[name] {
+			expiries[name] = decodeUint(value)
+			return nil
+		}
+		report.Mismatched++
+		fix(func(txn *badger.Txn) error {
+			return txn.Delete(key)
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	eachKey(txn, expiringPrefix, func(key []byte) {
+		expires, name := splitExpiringKey(key)
+		if expiry, ok := expiries[string(name)]; ok && expiry == expires {
+			delete(expiries, string(name))
+			return
+		}
+		report.Mismatched++
+		fix(func(txn *badger.Txn) error {
+			return txn.Delete(key)
+		})
+	})
+	for name, expires := range expiries {
+		report.Mismatched++
+		key := expiringKey(expires, []byte(name))
+		fix(func(txn *badger.Txn) error {
+			return txn.Set(key, nil)
+		})
+	}
+
+	// usage counters must match the files and chunks, they are fixed last
+	var physical uint64
+	for _, size := range chunkSizes {
+		physical += size
+	}
+	for _, usage := range []struct {
+		key   []byte
+		count uint64
+	}{{physicalKey, physical}, {logicalKey, logical}, {filesKey, files}} {
+		stored, err := getCount(txn, usage.key)
+		if err != nil {
+			return nil, err
+		}
+		if stored != usage.count {
+			report.Mismatched++
+			key, count := usage.key, usage.count
+			fix(func(txn *badger.Txn) error {
+				return setCount(txn, key, count)
+			})
+		}
+	}
+
+	sort.Strings(report.Orphaned)
+	sort.Strings(report.Corrupt)
+	return fixes, nil
+}
+
+// Move a file pointing to missing data to the lost keyspace, taking its
+// words out of the word counts when they are known
+func loseFile(txn *badger.Txn, name []byte, sha []byte) error {
+	if err := txn.Set(lostKey(name), sha); err != nil {
+		return err
+	}
+	if err := txn.Delete(fileKey(name)); err != nil {
+		return err
+	}
+	if err := setExpiry(txn, name, 0); err != nil {
+		return err
+	}
+	if err := recordEvent(txn, EventRemove, name, nil, sha); err != nil {
+		return err
+	}
+	if _, err := txn.Get(statsKey(sha)); err == badger.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return countWords(txn, name, sha, -1)
+}
+
+// Remove the manifest of data that is orphaned or unreadable, and its data
+// from the search index. Its chunks and counts are repaired on their own.
+func (db *database) dropData(txn *badger.Txn, sha []byte) error {
+	if err := txn.Delete(shaKey(sha)); err != nil {
+		return err
+	}
+	db.dropped = append(db.dropped, sha)
+	return queueChange(txn, dropIndex, sha)
+}
+
+// Remove an unused chunk. A chunk without data in badger is orphaned in
+// the object store, to be swept.
+func (db *database) dropChunk(txn *badger.Txn, sha []byte, stored bool) error {
+	if err := txn.Delete(quarantineKey(sha)); err != nil {
+		return err
+	}
+	if stored {
+		return txn.Delete(chunkKey(sha))
+	}
+	if db.objects == nil {
+		return nil
+	}
+	return txn.Set(orphanKey(sha), encodeUint(uint64(time.Now().UnixNano())))
+}
+
+// Iterate over the records under a prefix
+func eachRecord(txn *badger.Txn, prefix []byte, fn func(key []byte, value []byte) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	iterator := txn.NewIterator(opts)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		item := iterator.Item()
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		if err := fn(item.KeyCopy(nil), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Iterate over the keys under a prefix, without reading the values
+func eachKey(txn *badger.Txn, prefix []byte, fn func(key []byte)) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = prefix
+	iterator := txn.NewIterator(opts)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		fn(iterator.Item().KeyCopy(nil))
+	}
+}
+
+// Iterate over the keys under a prefix and their values
+func eachValue(txn *badger.Txn, prefix []byte, fn func(key []byte, value []byte) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	iterator := txn.NewIterator(opts)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		item := iterator.Item()
+		err := item.Value(func(value []byte) error {
+			return fn(item.KeyCopy(nil), value)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
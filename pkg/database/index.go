@@ -0,0 +1,492 @@
+package database
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// The memory and filesystem backends keep the metadata of the files in a
+// small index held in memory, and the data of the files apart, as blobs
+// named by their SHA. Every change of the index is saved after the blobs it
+// adds and before the blobs it no longer uses are removed, so that the index
+// never points to missing data.
+
+// Storage of the blobs and the index of an index store
+type blobStore interface {
+	// Returns a writer for new data, added under its SHA on commit
+	create() (blobWriter, error)
+	open(sha []byte) (io.ReadCloser, error)
+	remove(sha []byte) error
+	// Persist a change of the index, given with the whole index
+	save(index *fileIndex, change *indexChange) error
+	close() error
+}
+
+type blobWriter interface {
+	io.Writer
+	// Add the data and the counts of its words under its SHA, which must
+	// not be present already
+	commit(sha []byte, words map[string]uint64) error
+	// Drop the data
+	abort() error
+}
+
+// Metadata of the files, with the names pointing to the hex encoded SHA
+// of their data
+type fileIndex struct {
+	Files map[string]string
+	Data  map[string]*dataEntry
+	// time the files were last written, in nanoseconds
+	Modified map[string]int64
+}
+
+// Size, word statistics and reference count of the data of files. The
+// counts of the words are kept with the data by the blob store, out of the
+// saved index.
+type dataEntry struct {
+	Size      int64
+	Refs      int64
+	WordCount uint64
+	Words     map[string]uint64 `json:"-"`
+}
+
+// Change of the index, with the new state of the names and data it touches.
+// A name pointing to an empty SHA is removed, as is data without entry.
+type indexChange struct {
+	Files    map[string]string     `json:",omitempty"`
+	Modified map[string]int64      `json:",omitempty"`
+	Data     map[string]*dataEntry `json:",omitempty"`
+}
+
+func newIndexChange() *indexChange {
+	return &indexChange{
+		Files:    map[string]string{},
+		Modified: map[string]int64{},
+		Data:     map[string]*dataEntry{},
+	}
+}
+
+// Apply a change to the index
+func (c *indexChange) apply(index *fileIndex) {
+	for name, sha := range c.Files {
+		if sha == "" {
+			delete(index.Files, name)
+			delete(index.Modified, name)
+			continue
+		}
+		index.Files[name] = sha
+		index.Modified[name] = c.Modified[name]
+	}
+	for sha, entry := range c.Data {
+		if entry == nil {
+			delete(index.Data, sha)
+			continue
+		}
+		index.Data[sha] = entry
+	}
+}
+
+// Data written by a change, not in the index yet
+type newData struct {
+	writer blobWriter
+	entry  *dataEntry
+}
+
+// Store of the memory and filesystem backends. Writers hold the lock, except
+// while they write blobs, and readers hold it for reading.
+type indexStore struct {
+	lock  sync.RWMutex
+	blobs blobStore
+	index *fileIndex
+	// change of the index not saved yet
+	change *indexChange
+
+	// word counts of all the files, derived from the index
+	words     int64
+	frequency map[string]int64
+}
+
+func newIndexStore(blobs blobStore, index *fileIndex) *indexStore {
+	if index == nil {
+		index = &fileIndex{}
+	}
+	if index.Files == nil {
+		index.Files = map[string]string{}
+	}
+	if index.Data == nil {
+		index.Data = map[string]*dataEntry{}
+	}
+	if index.Modified == nil {
+		index.Modified = map[string]int64{}
+	}
+	s := &indexStore{
+		blobs:     blobs,
+		index:     index,
+		change:    newIndexChange(),
+		frequency: map[string]int64{},
+	}
+	for _, sha := range index.Files {
+		s.countWords(index.Data[sha], 1)
+	}
+	return s
+}
+
+func (s *indexStore) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.blobs.close()
+}
+
+// Check if File exists in the Store
+func (s *indexStore) FileExists(name string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, ok := s.index.Files[name]
+	return ok
+}
+
+// Check if SHA exists in the Store
+func (s *indexStore) SHAExists(SHA []byte) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	_, ok := s.index.Data[hex.EncodeToString(SHA)]
+	return ok
+}
+
+// Add a file to the store
+func (s *indexStore) Add(name string, SHA []byte, data []byte) error {
+	return s.AddStream(name, SHA, bytes.NewReader(data))
+}
+
+// Add a file to the store, reading its data from a stream
+func (s *indexStore) AddStream(name string, SHA []byte, reader io.Reader) error {
+	if !validName(name) {
+		return ErrInvalidName
+	}
+	sha, data, err := s.putData(SHA, reader)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.index.Files[name]; ok {
+		if data != nil {
+			data.writer.abort()
+		}
+		return badger.ErrConflict
+	}
+	if err := s.addData(sha, data); err != nil {
+		return err
+	}
+	s.link(name, sha)
+	return s.save()
+}
+
+// Update a file
+func (s *indexStore) Update(name string, SHA []byte, data []byte) error {
+	return s.UpdateStream(name, SHA, bytes.NewReader(data))
+}
+
+// Update a file, reading its data from a stream
+func (s *indexStore) UpdateStream(name string, SHA []byte, reader io.Reader) error {
+	if !validName(name) {
+		return ErrInvalidName
+	}
+	sha, data, err := s.putData(SHA, reader)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err := s.addData(sha, data); err != nil {
+		return err
+	}
+	oldSHA, ok := s.index.Files[name]
+	if ok && oldSHA == sha {
+		return nil
+	}
+	released := ""
+	if ok {
+		released = s.unlink(name)
+	}
+	s.link(name, sha)
+	if err := s.save(); err != nil {
+		return err
+	}
+	return s.removeData(released)
+}
+
+// Remove a file from the Store
+func (s *indexStore) Remove(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.index.Files[name]; !ok {
+		return badger.ErrKeyNotFound
+	}
+	released := s.unlink(name)
+	if err := s.save(); err != nil {
+		return err
+	}
+	return s.removeData(released)
+}
+
+// Rename a file. Fails with badger.ErrConflict when the new name is in use.
+func (s *indexStore) Rename(name string, newName string) error {
+	if !validName(newName) {
+		return ErrInvalidName
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sha, ok := s.index.Files[name]
+	if !ok {
+		return badger.ErrKeyNotFound
+	}
+	if _, ok := s.index.Files[newName]; ok {
+		return badger.ErrConflict
+	}
+	s.index.Files[newName] = sha
+	s.index.Modified[newName] = s.index.Modified[name]
+	delete(s.index.Files, name)
+	delete(s.index.Modified, name)
+	s.change.Files[newName] = sha
+	s.change.Modified[newName] = s.index.Modified[newName]
+	s.change.Files[name] = ""
+	return s.save()
+}
+
+// Copy a file, sharing its data. Fails with badger.ErrConflict when the new
+// name is in use.
+func (s *indexStore) Copy(name string, newName string) error {
+	if !validName(newName) {
+		return ErrInvalidName
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	sha, ok := s.index.Files[name]
+	if !ok {
+		return badger.ErrKeyNotFound
+	}
+	if _, ok := s.index.Files[newName]; ok {
+		return badger.ErrConflict
+	}
+	s.link(newName, sha)
+	return s.save()
+}
+
+// Returns the data of a file identified by file name
+func (s *indexStore) Get(name string) ([]byte, error) {
+	var data bytes.Buffer
+	if err := s.GetStream(name, &data); err != nil {
+		return nil, err
+	}
+	return data.Bytes(), nil
+}
+
+// Write the data of a file identified by file name to a stream. The blob
+// is opened under the lock, and stays readable when the file is removed
+// while it is written.
+func (s *indexStore) GetStream(name string, writer io.Writer) error {
+	s.lock.RLock()
+	sha, ok := s.index.Files[name]
+	if !ok {
+		s.lock.RUnlock()
+		return badger.ErrKeyNotFound
+	}
+	key, err := hex.DecodeString(sha)
+	if err != nil {
+		s.lock.RUnlock()
+		return err
+	}
+	reader, err := s.blobs.open(key)
+	s.lock.RUnlock()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(writer, reader)
+	return err
+}
+
+// List the files in a directory, the root of the store when the directory
+// of the options is empty. Unless recursive, the files of sub directories
+// are listed as the name of the directory followed by a slash.
+func (s *indexStore) List(options ListOptions) (*FileList, error) {
+	l, err := newListing(options)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	start := l.start()
+	names := []string{}
+	for name := range s.index.Files {
+		if strings.HasPrefix(name, l.scan) && name >= start {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	i := 0
+	next := func() (string, bool) {
+		if i == len(names) {
+			return "", false
+		}
+		entry, dir := l.entry(names[i])
+		i++
+		for dir && i < len(names) && strings.HasPrefix(names[i], entry) {
+			i++
+		}
+		return entry, true
+	}
+	fill := func(file *File) error {
+		sha := s.index.Files[file.Name]
+		entry := s.index.Data[sha]
+		file.SHA = sha
+		file.Size = entry.Size
+		file.WordCount = int64(entry.WordCount)
+		file.Modified = timeOf(s.index.Modified[file.Name])
+		return nil
+	}
+	return l.page(next, fill)
+}
+
+// Returns total word count in all the files in Store
+func (s *indexStore) WordCount() (int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.words, nil
+}
+
+// Returns frequency of words in all the files in Store
+func (s *indexStore) WordFrequency() (map[string]int64, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	frequency := make(map[string]int64, len(s.frequency))
+	for word, count := range s.frequency {
+		frequency[word] = count
+	}
+	return frequency, nil
+}
+
+// Write the data of a file as a new blob, counting its words, unless its
+// SHA is given and already present
+func (s *indexStore) putData(SHA []byte, reader io.Reader) (string, *newData, error) {
+	if len(SHA) > 0 && s.SHAExists(SHA) {
+		return hex.EncodeToString(SHA), nil, nil
+	}
+	writer, err := s.blobs.create()
+	if err != nil {
+		return "", nil, err
+	}
+	hash := sha256.New()
+	counter := newWordCounter()
+	size, err := io.Copy(io.MultiWriter(writer, hash, counter), reader)
+	if err != nil {
+		writer.abort()
+		return "", nil, err
+	}
+	sum := hash.Sum(nil)
+	if err := checkSHA(SHA, sum, size); err != nil {
+		writer.abort()
+		return "", nil, err
+	}
+	stats := counter.stats()
+	entry := &dataEntry{Size: size, WordCount: stats.count, Words: map[string]uint64{}}
+	for _, w := range stats.words {
+		entry.Words[w.word] = w.count
+	}
+	return hex.EncodeToString(sum), &newData{writer, entry}, nil
+}
+
+// Add the data written by putData to the index, or drop it when the SHA is
+// present already. Without data the SHA must be present.
+func (s *indexStore) addData(sha string, data *newData) error {
+	if _, ok := s.index.Data[sha]; ok {
+		if data != nil {
+			return data.writer.abort()
+		}
+		return nil
+	}
+	if data == nil {
+		return ErrMissingData
+	}
+	key, err := hex.DecodeString(sha)
+	if err != nil {
+		return err
+	}
+	if err := data.writer.commit(key, data.entry.Words); err != nil {
+		return err
+	}
+	s.index.Data[sha] = data.entry
+	s.change.Data[sha] = data.entry
+	return nil
+}
+
+// Save the change of the index made since the last save
+func (s *indexStore) save() error {
+	change := s.change
+	s.change = newIndexChange()
+	return s.blobs.save(s.index, change)
+}
+
+// Point a file name to data and take a reference on it
+func (s *indexStore) link(name string, sha string) {
+	entry := s.index.Data[sha]
+	entry.Refs++
+	s.index.Files[name] = sha
+	s.index.Modified[name] = time.Now().UnixNano()
+	s.change.Files[name] = sha
+	s.change.Modified[name] = s.index.Modified[name]
+	s.change.Data[sha] = entry
+	s.countWords(entry, 1)
+}
+
+// Remove a file name and release its reference on the data. Returns the SHA
+// of the data when it is no longer referenced, to remove it once the index
+// is saved.
+func (s *indexStore) unlink(name string) string {
+	sha := s.index.Files[name]
+	entry := s.index.Data[sha]
+	delete(s.index.Files, name)
+	delete(s.index.Modified, name)
+	s.change.Files[name] = ""
+	s.countWords(entry, -1)
+	if entry.Refs--; entry.Refs > 0 {
+		s.change.Data[sha] = entry
+		return ""
+	}
+	delete(s.index.Data, sha)
+	s.change.Data[sha] = nil
+	return sha
+}
+
+func (s *indexStore) removeData(sha string) error {
+	if sha == "" {
+		return nil
+	}
+	key, err := hex.DecodeString(sha)
+	if err != nil {
+		return err
+	}
+	return s.blobs.remove(key)
+}
+
+func (s *indexStore) countWords(entry *dataEntry, sign int64) {
+	if entry == nil {
+		return
+	}
+	s.words += sign * int64(entry.WordCount)
+	for word, count := range entry.Words {
+		s.frequency[word] += sign * int64(count)
+		if s.frequency[word] <= 0 {
+			delete(s.frequency, word)
+		}
+	}
+}
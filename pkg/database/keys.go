@@ -0,0 +1,287 @@
+package database
+
+import (
+	"encoding/binary"
+	"errors"
+	"path"
+	"strings"
+)
+
+// All records are kept in a single keyspace, separated by key prefixes
+//
+//	f/<name>    SHA of the file data
+//	s/<SHA>     manifest of the chunks of the file data
+//	r/<SHA>     number of records pointing to the SHA
+//	c/<SHA>     data of a chunk
+//	k/<SHA>     number of manifest entries pointing to the chunk
+//	o/<SHA>     time a chunk kept in the object store was released
+//	q/<SHA>     data of a chunk that does not match its SHA, in quarantine
+//	l/<name>    SHA of a file found pointing to missing data
+//	u/<bucket>  ID and creation time of a bucket
+//	d/0x00 <ID> 0x00
+//	            bucket deleted, whose files are being removed
+//	e/<name>    time the file expires
+//	y/<time><name>
+//	            file expiring at the time
+//	v/<name> 0x00 <version>
+//	            SHA, time and size of a version of the file
+//	t/<name> 0x00 <removal time>
+//	            SHA, size and remover of a file in the trash bin
+//	w/<SHA>     word statistics of the data
+//	n/<SHA>     number of pending changes using the word statistics
+//	g/<word>    number of times the word appears in the files of the root
+//	            namespace
+//	h/0x00 <ID> 0x00 <word>
+//	            number of times the word appears in the files of a bucket
+//	p/<seq>     change waiting for the indexer
+//	z/<seq>     event of the journal of the changes of the files
+//	b/<SHA><name>
+//	            file name pointing to the SHA
+//	i/<word> 0x00 <SHA><segment>
+//	            positions and offsets of the word in a segment of the data
+//	j/<SHA><segment>
+//	            words of a segment of the data in the search index
+//	x/<SHA>     number of segments of the data in the search index
+//	a/<seq>     manifest of released data whose chunks are being released
+//	a/<seq>/    number of chunks of the released data already released
+//	m/<key>     store metadata
+var (
+	filePrefix       = []byte("f/")
+	shaPrefix        = []byte("s/")
+	refPrefix        = []byte("r/")
+	chunkPrefix      = []byte("c/")
+	chunkRefPrefix   = []byte("k/")
+	orphanPrefix     = []byte("o/")
+	quarantinePrefix = []byte("q/")
+	lostPrefix       = []byte("l/")
+	bucketsPrefix    = []byte("u/")
+	deletedPrefix    = []byte("d/")
+	expiryPrefix     = []byte("e/")
+	expiringPrefix   = []byte("y/")
+	versionPrefix    = []byte("v/")
+	trashPrefix      = []byte("t/")
+	statsPrefix      = []byte("w/")
+	statsRefPrefix   = []byte("n/")
+	wordPrefix       = []byte("g/")
+	bucketWordPrefix = []byte("h/")
+	pendingPrefix    = []byte("p/")
+	namePrefix       = []byte("b/")
+	postingPrefix    = []byte("i/")
+	segmentPrefix    = []byte("j/")
+	indexedPrefix    = []byte("x/")
+	eventPrefix      = []byte("z/")
+	metaPrefix       = []byte("m/")
+	releasedPrefix   = []byte("a/")
+)
+
+var (
+	schemaKey = metaKey("schema")
+	scrubKey  = metaKey("scrub")
+)
+
+var (
+	ErrInvalidName = errors.New("invalid file name, names are relative paths without empty, . or .. elements")
+	ErrMissingData = errors.New("file data is not in the store")
+	ErrSHAMismatch = errors.New("file data does not match the SHA")
+	ErrCorruptData = errors.New("file data is corrupt and has been quarantined")
+)
+
+// Maximum length of a file name
+const maxName = 1 << 10
+
+// Check if a name can be stored as a file key. Names are slash separated
+// paths relative to the root of the store, without empty, "." or ".."
+// elements.
+func validName(name string) bool {
+	if name == "" || len(name) > maxName || strings.ContainsRune(name, 0) {
+		return false
+	}
+	if name == ".." || strings.HasPrefix(name, "/") || strings.HasPrefix(name, "../") {
+		return false
+	}
+	return path.Clean(name) == name && name != "."
+}
+
+// Returns the prefix of the names of the files in a directory, empty for
+// the root of the store
+func listPrefix(dir string) (string, error) {
+	dir = strings.TrimSuffix(dir, "/")
+	if dir == "" {
+		return "", nil
+	}
+	if !validName(dir) {
+		return "", ErrInvalidName
+	}
+	return dir + "/", nil
+}
+
+// Returns a key made of a prefix and an identifier
+func prefixKey(prefix []byte, id []byte) []byte {
+	key := make([]byte, 0, len(prefix)+len(id))
+	key = append(key, prefix...)
+	return append(key, id...)
+}
+
+func fileKey(name []byte) []byte {
+	return prefixKey(filePrefix, name)
+}
+
+func shaKey(sha []byte) []byte {
+	return prefixKey(shaPrefix, sha)
+}
+
+func refKey(sha []byte) []byte {
+	return prefixKey(refPrefix, sha)
+}
+
+func chunkKey(sha []byte) []byte {
+	return prefixKey(chunkPrefix, sha)
+}
+
+func chunkRefKey(sha []byte) []byte {
+	return prefixKey(chunkRefPrefix, sha)
+}
+
+func orphanKey(sha []byte) []byte {
+	return prefixKey(orphanPrefix, sha)
+}
+
+func quarantineKey(sha []byte) []byte {
+	return prefixKey(quarantinePrefix, sha)
+}
+
+func lostKey(name []byte) []byte {
+	return prefixKey(lostPrefix, name)
+}
+
+func expiryKey(name []byte) []byte {
+	return prefixKey(expiryPrefix, name)
+}
+
+func expiringKey(expires uint64, name []byte) []byte {
+	return append(prefixKey(expiringPrefix, encodeUint(expires)), name...)
+}
+
+// Returns the expiry time and name of an expiring file key
+func splitExpiringKey(key []byte) (uint64, []byte) {
+	id := key[len(expiringPrefix):]
+	return decodeUint(id[:8]), id[8:]
+}
+
+func bucketKey(name []byte) []byte {
+	return prefixKey(bucketsPrefix, name)
+}
+
+func deletedKey(prefix []byte) []byte {
+	return prefixKey(deletedPrefix, prefix)
+}
+
+func versionsKey(name []byte) []byte {
+	return append(prefixKey(versionPrefix, name), 0)
+}
+
+func versionKey(name []byte, version uint64) []byte {
+	return append(versionsKey(name), encodeUint(version)...)
+}
+
+// Returns the name and number of a version key
+func splitVersionKey(key []byte) ([]byte, uint64) {
+	end := len(key) - 9
+	return key[len(versionPrefix):end], decodeUint(key[end+1:])
+}
+
+func trashedKey(name []byte) []byte {
+	return append(prefixKey(trashPrefix, name), 0)
+}
+
+func trashKey(name []byte, id uint64) []byte {
+	return append(trashedKey(name), encodeUint(id)...)
+}
+
+// Returns the name and removal time of a trash key
+func splitTrashKey(key []byte) ([]byte, uint64) {
+	end := len(key) - 9
+	return key[len(trashPrefix):end], decodeUint(key[end+1:])
+}
+
+func statsKey(sha []byte) []byte {
+	return prefixKey(statsPrefix, sha)
+}
+
+func statsRefKey(sha []byte) []byte {
+	return prefixKey(statsRefPrefix, sha)
+}
+
+// Returns the prefix of the word counts of a namespace, given by the prefix
+// of its names
+func wordsPrefix(scope []byte) []byte {
+	if len(scope) == 0 {
+		return wordPrefix
+	}
+	return prefixKey(bucketWordPrefix, scope)
+}
+
+func wordKey(scope []byte, word []byte) []byte {
+	return prefixKey(wordsPrefix(scope), word)
+}
+
+func pendingKey(seq uint64) []byte {
+	return prefixKey(pendingPrefix, encodeUint(seq))
+}
+
+func releasedKey(seq uint64) []byte {
+	return prefixKey(releasedPrefix, encodeUint(seq))
+}
+
+func releasedNextKey(seq uint64) []byte {
+	return append(releasedKey(seq), '/')
+}
+
+func eventKey(seq uint64) []byte {
+	return prefixKey(eventPrefix, encodeUint(seq))
+}
+
+func nameKey(sha []byte, name []byte) []byte {
+	return append(prefixKey(namePrefix, sha), name...)
+}
+
+func postingsKey(word []byte) []byte {
+	return append(prefixKey(postingPrefix, word), 0)
+}
+
+func postingKey(word []byte, sha []byte, segment uint32) []byte {
+	return append(append(postingsKey(word), sha...), encodeSegment(segment)...)
+}
+
+func segmentKey(sha []byte, segment uint32) []byte {
+	return append(prefixKey(segmentPrefix, sha), encodeSegment(segment)...)
+}
+
+func indexedKey(sha []byte) []byte {
+	return prefixKey(indexedPrefix, sha)
+}
+
+func encodeSegment(segment uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, segment)
+	return buf
+}
+
+func metaKey(name string) []byte {
+	return prefixKey(metaPrefix, []byte(name))
+}
+
+// Encode an unsigned integer as a sortable value
+func encodeUint(value uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, value)
+	return buf
+}
+
+// Decode an unsigned integer encoded with encodeUint
+func decodeUint(buf []byte) uint64 {
+	if len(buf) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(buf)
+}
@@ -0,0 +1,253 @@
+package database
+
+import (
+	"errors"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A listing reads the names of the files in order, with the files of sub
+// directories collapsed into the directory unless recursive. Sorted by
+// name, it stops once the page is full and only reads the details of the
+// files of the page. Sorted by size, word count or modification time, the
+// details of every matching file are read and sorted in memory.
+
+// Orders of a listing
+const (
+	SortName     = "name"
+	SortSize     = "size"
+	SortWords    = "words"
+	SortModified = "modified"
+)
+
+var (
+	ErrInvalidSort   = errors.New("invalid sort, files are sorted by name, size, words or modified")
+	ErrInvalidCursor = errors.New("invalid cursor, pass the next cursor of the previous page")
+)
+
+// Options of a listing, the zero value lists the root of the store
+type ListOptions struct {
+	// directory to list, the root of the store when empty
+	Dir string
+	// list the files of the sub directories instead of the directories
+	Recursive bool
+	// read the details of the files, not only their names
+	Details bool
+	// only the names starting with the prefix
+	Prefix string
+	// only the entries whose last path element matches the glob pattern
+	Pattern string
+	// order of the entries, SortName when empty
+	Sort    string
+	Reverse bool
+	// maximum number of entries, 0 for no limit
+	Limit int
+	// cursor of the page, the Next of the previous page
+	After string
+}
+
+// Page of a listing
+type FileList struct {
+	Files []File
+	// cursor of the next page, empty on the last page
+	Next string
+}
+
+// Listing of the names under a prefix
+type listing struct {
+	ListOptions
+	dir string
+	// prefix of the names read, covering the directory and the prefix
+	scan  string
+	empty bool
+	// sort value and name of the last entry of the previous page
+	after      bool
+	afterValue int64
+	afterName  string
+}
+
+func newListing(options ListOptions) (*listing, error) {
+	dir, err := listPrefix(options.Dir)
+	if err != nil {
+		return nil, err
+	}
+	switch options.Sort {
+	case "":
+		options.Sort = SortName
+	case SortName, SortSize, SortWords, SortModified:
+	default:
+		return nil, ErrInvalidSort
+	}
+	if _, err := path.Match(options.Pattern, ""); err != nil {
+		return nil, err
+	}
+	l := &listing{ListOptions: options, dir: dir, scan: dir}
+	switch {
+	case strings.HasPrefix(options.Prefix, dir):
+		l.scan = options.Prefix
+	case !strings.HasPrefix(dir, options.Prefix):
+		l.empty = true
+	}
+	if options.After == "" {
+		return l, nil
+	}
+	l.after, l.afterName = true, options.After
+	if options.Sort != SortName {
+		i := strings.IndexByte(options.After, ':')
+		if i < 0 {
+			return nil, ErrInvalidCursor
+		}
+		if l.afterValue, err = strconv.ParseInt(options.After[:i], 10, 64); err != nil {
+			return nil, ErrInvalidCursor
+		}
+		l.afterName = options.After[i+1:]
+	}
+	if strings.IndexByte(l.afterName, 0) >= 0 {
+		return nil, ErrInvalidCursor
+	}
+	return l, nil
+}
+
+// Returns the entry of a name, the name of its sub directory followed by a
+// slash unless recursive
+func (l *listing) entry(name string) (string, bool) {
+	if i := strings.IndexByte(name[len(l.dir):], '/'); !l.Recursive && i >= 0 {
+		return name[:len(l.dir)+i+1], true
+	}
+	return name, false
+}
+
+// Returns the name to start reading from, past the previous page when
+// sorted by name
+func (l *listing) start() string {
+	if l.after && l.Sort == SortName && !l.Reverse && l.afterName > l.scan {
+		return l.afterName
+	}
+	return l.scan
+}
+
+func (l *listing) match(entry string) bool {
+	if l.Pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(l.Pattern, path.Base(entry))
+	return ok
+}
+
+// Returns the sort value of a file, 0 for a directory
+func (l *listing) value(file *File) int64 {
+	switch l.Sort {
+	case SortSize:
+		return file.Size
+	case SortWords:
+		return file.WordCount
+	case SortModified:
+		if file.Modified != nil {
+			return file.Modified.UnixNano()
+		}
+	}
+	return 0
+}
+
+// Check if an entry of a value and a name comes before another
+func (l *listing) before(value int64, name string, otherValue int64, otherName string) bool {
+	if l.Reverse {
+		value, name, otherValue, otherName = otherValue, otherName, value, name
+	}
+	if value != otherValue {
+		return value < otherValue
+	}
+	return name < otherName
+}
+
+func (l *listing) cursor(file *File) string {
+	if l.Sort == SortName {
+		return file.Name
+	}
+	return strconv.FormatInt(l.value(file), 10) + ":" + file.Name
+}
+
+// Returns a page of the entries given in name order by next, which returns
+// false after the last entry. The details of a file are read by fill, for
+// the files of the page, or for every file when they are sorted by their
+// details.
+func (l *listing) page(next func() (string, bool), fill func(file *File) error) (*FileList, error) {
+	list := &FileList{Files: []File{}}
+	if l.empty {
+		return list, nil
+	}
+	isDir := func(file *File) bool {
+		return strings.HasSuffix(file.Name, "/")
+	}
+	if l.Sort == SortName && !l.Reverse {
+		for entry, ok := next(); ok; entry, ok = next() {
+			if !l.match(entry) || (l.after && entry <= l.afterName) {
+				continue
+			}
+			if l.Limit > 0 && len(list.Files) == l.Limit {
+				list.Next = l.cursor(&list.Files[l.Limit-1])
+				break
+			}
+			list.Files = append(list.Files, File{Name: entry})
+		}
+	} else {
+		for entry, ok := next(); ok; entry, ok = next() {
+			if !l.match(entry) {
+				continue
+			}
+			file := File{Name: entry}
+			if l.Sort != SortName && !isDir(&file) {
+				if err := fill(&file); err != nil {
+					return nil, err
+				}
+			}
+			list.Files = append(list.Files, file)
+		}
+		sort.SliceStable(list.Files, func(i, j int) bool {
+			a, b := &list.Files[i], &list.Files[j]
+			return l.before(l.value(a), a.Name, l.value(b), b.Name)
+		})
+		if l.after {
+			start := sort.Search(len(list.Files), func(i int) bool {
+				file := &list.Files[i]
+				return l.before(l.afterValue, l.afterName, l.value(file), file.Name)
+			})
+			list.Files = list.Files[start:]
+		}
+		if l.Limit > 0 && len(list.Files) > l.Limit {
+			list.Files = list.Files[:l.Limit]
+			list.Next = l.cursor(&list.Files[l.Limit-1])
+		}
+		if l.Sort != SortName {
+			if !l.Details {
+				for i := range list.Files {
+					list.Files[i] = File{Name: list.Files[i].Name}
+				}
+			}
+			return list, nil
+		}
+	}
+	if l.Details {
+		for i := range list.Files {
+			if isDir(&list.Files[i]) {
+				continue
+			}
+			if err := fill(&list.Files[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return list, nil
+}
+
+// Returns a time in nanoseconds, nil for 0
+func timeOf(nanoseconds int64) *time.Time {
+	if nanoseconds == 0 {
+		return nil
+	}
+	t := time.Unix(0, nanoseconds)
+	return &t
+}
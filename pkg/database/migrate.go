@@ -0,0 +1,260 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/options"
+)
+
+// Current layout of the store
+//
+//	1 - single keyspace with reference count per SHA
+//	2 - file data split in content defined chunks
+//	3 - version history per file
+//	4 - word statistics per SHA and word counts of the store
+//	5 - search index
+//	6 - usage counters
+const schema uint64 = 6
+
+// Steps upgrading the store from the previous schema version
+var migrations = map[uint64]func(db *database) error{
+	2: (*database).chunkData,
+	3: (*database).initVersions,
+	4: (*database).indexWords,
+	5: (*database).initSearch,
+	6: (*database).initUsage,
+}
+
+// Directories of the file and sha DBs used before the single keyspace
+var legacyDirs = []string{"file", "sha"}
+
+// Upgrade the store to the current schema
+func (db *database) migrate(path string) error {
+	if legacy(path) {
+		if err := db.importLegacy(path); err != nil {
+			return err
+		}
+	}
+	version, err := db.schema()
+	if err != nil {
+		return err
+	}
+	if version > schema {
+		return errors.New("database was created by a newer version of the store")
+	}
+	if version == 0 {
+		return db.initSchema()
+	}
+	for version < schema {
+		version++
+		if err := migrations[version](db); err != nil {
+			return err
+		}
+		err := db.store.Update(func(txn *badger.Txn) error {
+			return txn.Set(schemaKey, encodeUint(version))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the schema version of the store, 0 when it is not initialized
+func (db *database) schema() (uint64, error) {
+	var version uint64
+	err := db.store.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(schemaKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(value []byte) error {
+			version = decodeUint(value)
+			return nil
+		})
+	})
+	return version, err
+}
+
+// Check if the path contains the file and sha DBs
+func legacy(path string) bool {
+	if path == "" {
+		return false
+	}
+	for _, dir := range legacyDirs {
+		if info, err := os.Stat(filepath.Join(path, dir)); err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// Copy the records of the file and sha DBs in to the single keyspace and
+// remove them. Copying is idempotent, so an interrupted upgrade is simply
+// repeated on the next start.
+func (db *database) importLegacy(path string) error {
+	open := func(dir string) (*badger.DB, error) {
+		return badger.Open(badger.DefaultOptions(filepath.Join(path, dir)).
+			WithLoggingLevel(badger.ERROR).
+			WithCompression(options.None))
+	}
+	file, err := open("file")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	sha, err := open("sha")
+	if err != nil {
+		return err
+	}
+	defer sha.Close()
+
+	batch := db.store.NewWriteBatch()
+	defer batch.Cancel()
+	refs := map[string]uint64{}
+
+	// file records, skipping the reference counts kept in the file DB
+	err = file.View(func(txn *badger.Txn) error {
+		iterator := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iterator.Close()
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			item := iterator.Item()
+			if key := item.Key(); len(key) > 0 && key[0] == 0 {
+				continue
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			refs[string(value)]++
+			if err := batch.Set(fileKey(item.KeyCopy(nil)), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// data records, dropping the ones no file points to
+	err = sha.View(func(txn *badger.Txn) error {
+		iterator := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer iterator.Close()
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			item := iterator.Item()
+			if refs[string(item.Key())] == 0 {
+				continue
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if err := batch.Set(shaKey(item.KeyCopy(nil)), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for key, count := range refs {
+		if err := batch.Set(refKey([]byte(key)), encodeUint(count)); err != nil {
+			return err
+		}
+	}
+	if err := batch.Set(schemaKey, encodeUint(1)); err != nil {
+		return err
+	}
+	if err := batch.Flush(); err != nil {
+		return err
+	}
+
+	file.Close()
+	sha.Close()
+	for _, dir := range legacyDirs {
+		if err := os.RemoveAll(filepath.Join(path, dir)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Initialize an empty store with the current schema
+func (db *database) initSchema() error {
+	return db.store.Update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(schemaKey); err != badger.ErrKeyNotFound {
+			return err
+		}
+		return txn.Set(schemaKey, encodeUint(schema))
+	})
+}
+
+// Split the data of every file in to chunks. The last converted SHA is
+// recorded with its manifest, so an interrupted upgrade resumes after it.
+func (db *database) chunkData() error {
+	progress := metaKey("migrate")
+	var resume []byte
+	err := db.store.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(progress)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		resume, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	txn := db.store.NewTransaction(false)
+	defer txn.Discard()
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = shaPrefix
+	iterator := txn.NewIterator(opts)
+	defer iterator.Close()
+	iterator.Rewind()
+	if resume != nil {
+		iterator.Seek(shaKey(resume))
+		if iterator.Valid() && bytes.Equal(iterator.Item().Key(), shaKey(resume)) {
+			iterator.Next()
+		}
+	}
+	for ; iterator.Valid(); iterator.Next() {
+		item := iterator.Item()
+		sha := item.KeyCopy(nil)[len(shaPrefix):]
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		m, err := db.putChunks(bytes.NewReader(data), false)
+		if err != nil {
+			return err
+		}
+		err = db.update(func(txn *badger.Txn) error {
+			if err := txn.Set(shaKey(sha), m.encode()); err != nil {
+				return err
+			}
+			return txn.Set(progress, sha)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return db.store.Update(func(txn *badger.Txn) error {
+		return txn.Delete(progress)
+	})
+}
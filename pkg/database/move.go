@@ -0,0 +1,131 @@
+package database
+
+import (
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Files point to their data by SHA, so a rename moves the file record, its
+// versions and its expiry to the new name, and a copy adds a file record
+// pointing to the same data, taking a reference on it. Neither reads nor
+// writes the data.
+
+// Store whose files can be renamed and copied without copying their data
+type Mover interface {
+	Rename(name string, newName string) error
+	Copy(name string, newName string) error
+}
+
+// Rename a file, keeping its versions and expiry. Fails with
+// badger.ErrConflict when the new name is in use.
+func (db *database) Rename(name string, newName string) error {
+	return db.rename(rootNamespace, name, newName)
+}
+
+func (db *database) rename(ns namespace, name string, newName string) error {
+	key, newKey, err := moveKeys(ns, name, newName)
+	if err != nil {
+		return err
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.update(func(txn *badger.Txn) error {
+		if err := ns.check(txn); err != nil {
+			return err
+		}
+		sha, err := getSHA(txn, key)
+		if err != nil {
+			return err
+		}
+		if _, err := txn.Get(fileKey(newKey)); err != badger.ErrKeyNotFound {
+			if err == nil {
+				return badger.ErrConflict
+			}
+			return err
+		}
+		if err := txn.Delete(fileKey(key)); err != nil {
+			return err
+		}
+		if err := txn.Set(fileKey(newKey), sha); err != nil {
+			return err
+		}
+		if err := removeName(txn, sha, key); err != nil {
+			return err
+		}
+		if err := addName(txn, sha, newKey); err != nil {
+			return err
+		}
+		if err := moveVersions(txn, key, newKey); err != nil {
+			return err
+		}
+		if err := recordEvent(txn, EventRename, newKey, key, sha); err != nil {
+			return err
+		}
+		expires, err := getExpiry(txn, key)
+		if err != nil {
+			return err
+		}
+		if err := setExpiry(txn, key, 0); err != nil {
+			return err
+		}
+		return setExpiry(txn, newKey, expires)
+	})
+}
+
+// Copy a file, the copy does not expire and starts a history of its own.
+// Fails with badger.ErrConflict when the new name is in use.
+func (db *database) Copy(name string, newName string) error {
+	return db.copy(rootNamespace, name, newName)
+}
+
+func (db *database) copy(ns namespace, name string, newName string) error {
+	key, newKey, err := moveKeys(ns, name, newName)
+	if err != nil {
+		return err
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.update(func(txn *badger.Txn) error {
+		if err := ns.check(txn); err != nil {
+			return err
+		}
+		sha, err := getSHA(txn, key)
+		if err != nil {
+			return err
+		}
+		return db.addFile(txn, newKey, sha)
+	})
+}
+
+// Returns the keys of the source and the target of a rename or a copy
+func moveKeys(ns namespace, name string, newName string) ([]byte, []byte, error) {
+	if !validName(newName) {
+		return nil, nil, ErrInvalidName
+	}
+	key, err := ns.key(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	newKey, _ := ns.key(newName)
+	return key, newKey, nil
+}
+
+// Move the versions of a file to another name, keeping their numbers
+func moveVersions(txn *badger.Txn, name []byte, newName []byte) error {
+	versions := map[uint64]*version{}
+	err := eachVersion(txn, name, func(number uint64, v *version) error {
+		versions[number] = v
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for number, v := range versions {
+		if err := txn.Delete(versionKey(name, number)); err != nil {
+			return err
+		}
+		if err := txn.Set(versionKey(newName, number), v.encode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
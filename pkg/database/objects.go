@@ -0,0 +1,268 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// With an object store the data of the chunks is kept in a bucket, under
+// the SHA of the chunk, while the file records stay in badger. Chunks whose
+// data is already in badger stay there.
+//
+// A chunk released for the last time is recorded as an orphan instead of
+// being deleted at once, so that an upload of the same data can take it
+// back. Orphans are swept by deleting their objects while uploads are held
+// off, so an upload never takes a reference on a deleted object.
+
+// Bucket of an S3 compatible object store
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+	Secure    bool
+}
+
+// Storage of the data of the chunks outside of badger
+type objectStore interface {
+	put(sha []byte, data []byte) error
+	get(sha []byte) ([]byte, error)
+	delete(sha []byte) error
+}
+
+// Interval between two sweeps of the orphaned chunks, and the time they are
+// kept before, for the downloads of removed files still reading them
+const (
+	objectSweepInterval = time.Minute
+	objectGrace         = time.Minute
+)
+
+// Time limit of a request to the object store
+const objectTimeout = time.Minute
+
+var ErrMissingBucket = errors.New("object store bucket does not exist")
+
+type s3Store struct {
+	client *minio.Client
+	bucket string
+	prefix string
+}
+
+func newS3Store(config *S3Config) (*s3Store, error) {
+	lookup := minio.BucketLookupAuto
+	if config.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
+		Secure:       config.Secure,
+		Region:       config.Region,
+		BucketLookup: lookup,
+	})
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), objectTimeout)
+	defer cancel()
+	exists, err := client.BucketExists(ctx, config.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrMissingBucket
+	}
+	return &s3Store{client: client, bucket: config.Bucket, prefix: config.Prefix}, nil
+}
+
+func (s *s3Store) object(sha []byte) string {
+	return s.prefix + hex.EncodeToString(sha)
+}
+
+func (s *s3Store) put(sha []byte, data []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), objectTimeout)
+	defer cancel()
+	_, err := s.client.PutObject(ctx, s.bucket, s.object(sha), bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: "application/octet-stream"})
+	return err
+}
+
+func (s *s3Store) get(sha []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), objectTimeout)
+	defer cancel()
+	object, err := s.client.GetObject(ctx, s.bucket, s.object(sha), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Close()
+	data, err := io.ReadAll(object)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, ErrMissingData
+	}
+	return data, err
+}
+
+func (s *s3Store) delete(sha []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), objectTimeout)
+	defer cancel()
+	return s.client.RemoveObject(ctx, s.bucket, s.object(sha), minio.RemoveObjectOptions{})
+}
+
+// Pass the data of a chunk to a function, from badger or the object store.
+// Chunks in quarantine are reported with ErrCorruptData.
+func (db *database) readChunk(txn *badger.Txn, sha []byte, fn func(data []byte) error) error {
+	item, err := txn.Get(chunkKey(sha))
+	if err == badger.ErrKeyNotFound {
+		if _, err := txn.Get(quarantineKey(sha)); err != badger.ErrKeyNotFound {
+			if err == nil {
+				err = ErrCorruptData
+			}
+			return err
+		}
+	}
+	if err == badger.ErrKeyNotFound && db.objects != nil {
+		data, err := db.objects.get(sha)
+		if err != nil {
+			return err
+		}
+		return fn(data)
+	}
+	if err != nil {
+		return err
+	}
+	return item.Value(fn)
+}
+
+// Upload the chunks of a batch whose data is not known to be in the object
+// store, or is quarantined. Must be called while holding objectLock for reading, until the
+// references on the chunks are taken.
+func (db *database) putObjects(batch []fileChunk) error {
+	for _, chunk := range batch {
+		sha := chunk.sha
+		stored := false
+		err := db.store.View(func(txn *badger.Txn) error {
+			// quarantined chunks are uploaded again
+			if _, err := txn.Get(quarantineKey(sha)); err != badger.ErrKeyNotFound {
+				return err
+			}
+			if _, err := txn.Get(orphanKey(sha)); err != badger.ErrKeyNotFound {
+				stored = err == nil
+				return err
+			}
+			refs, err := getCount(txn, chunkRefKey(sha))
+			if err != nil || refs == 0 {
+				return err
+			}
+			_, err = txn.Get(chunkKey(sha))
+			if err == badger.ErrKeyNotFound {
+				stored = true
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if stored {
+			continue
+		}
+		if err := db.objects.put(sha, chunk.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Orphan the objects uploaded for a batch that could not be retained, so
+// that they are swept. Must be called while holding objectLock for reading.
+func (db *database) orphanObjects(batch []fileChunk) error {
+	return db.update(func(txn *badger.Txn) error {
+		now := encodeUint(uint64(time.Now().UnixNano()))
+		for _, chunk := range batch {
+			refs, err := getCount(txn, chunkRefKey(chunk.sha))
+			if err != nil {
+				return err
+			}
+			if refs > 0 {
+				continue
+			}
+			if _, err := txn.Get(chunkKey(chunk.sha)); err == nil {
+				continue
+			} else if err != badger.ErrKeyNotFound {
+				return err
+			}
+			if err := txn.Set(orphanKey(chunk.sha), now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Delete the objects of the chunks that have been orphaned for longer than
+// the grace period, all of them with a zero grace
+func (db *database) sweepObjects(grace time.Duration) error {
+	db.objectLock.Lock()
+	defer db.objectLock.Unlock()
+	expired := uint64(time.Now().Add(-grace).UnixNano())
+	var shas [][]byte
+	err := db.store.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = orphanPrefix
+		iterator := txn.NewIterator(opts)
+		defer iterator.Close()
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			item := iterator.Item()
+			err := item.Value(func(value []byte) error {
+				if decodeUint(value) <= expired {
+					shas = append(shas, item.KeyCopy(nil)[len(orphanPrefix):])
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, sha := range shas {
+		err := db.update(func(txn *badger.Txn) error {
+			return txn.Delete(orphanKey(sha))
+		})
+		if err != nil {
+			return err
+		}
+		if err := db.objects.delete(sha); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *database) runObjectSweep() {
+	ticker := time.NewTicker(objectSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closed:
+			return
+		case <-ticker.C:
+		}
+		db.lock.RLock()
+		db.sweepObjects(objectGrace)
+		db.lock.RUnlock()
+	}
+}
@@ -0,0 +1,191 @@
+package database
+
+import (
+	"errors"
+	"io"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// The store keeps three usage counters, updated with the records they
+// count: the physical size of the data, each chunk counted once however many
+// files use it, the logical size of the files, and the number of files.
+// Versions and files in the trash bin only use physical space.
+
+// Store that limits and reports the space used by its files
+type UsageReporter interface {
+	Usage() (*Usage, error)
+}
+
+// Space used by the files of the store, against the configured quotas
+type Usage struct {
+	PhysicalBytes Quota
+	LogicalBytes  Quota
+	Files         Quota
+	MaxFileSize   int64
+}
+
+// Usage of a quota, without limit when the limit is 0
+type Quota struct {
+	Used  int64
+	Limit int64
+}
+
+var (
+	physicalKey = metaKey("physical")
+	logicalKey  = metaKey("logical")
+	filesKey    = metaKey("files")
+)
+
+var (
+	ErrFileTooLarge  = errors.New("file is larger than the maximum file size")
+	ErrPhysicalQuota = errors.New("storage quota exceeded: physical bytes")
+	ErrLogicalQuota  = errors.New("storage quota exceeded: logical bytes")
+	ErrFileQuota     = errors.New("storage quota exceeded: file count")
+)
+
+// Limits of the store, 0 for no limit
+type quotas struct {
+	physical int64
+	logical  int64
+	files    int64
+	fileSize int64
+}
+
+// Returns the space used by the store and its quotas
+func (db *database) Usage() (*Usage, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	usage := &Usage{
+		PhysicalBytes: Quota{Limit: db.quotas.physical},
+		LogicalBytes:  Quota{Limit: db.quotas.logical},
+		Files:         Quota{Limit: db.quotas.files},
+		MaxFileSize:   db.quotas.fileSize,
+	}
+	err := db.store.View(func(txn *badger.Txn) error {
+		for _, counter := range []struct {
+			key  []byte
+			used *int64
+		}{
+			{physicalKey, &usage.PhysicalBytes.Used},
+			{logicalKey, &usage.LogicalBytes.Used},
+			{filesKey, &usage.Files.Used},
+		} {
+			count, err := getCount(txn, counter.key)
+			if err != nil {
+				return err
+			}
+			*counter.used = int64(count)
+		}
+		return nil
+	})
+	return usage, err
+}
+
+// Add to a usage counter, without going below 0. Fails when the counter
+// grows over a limit.
+func addUsage(txn *badger.Txn, key []byte, delta int64, limit int64, quota error) error {
+	if delta == 0 {
+		return nil
+	}
+	count, err := getCount(txn, key)
+	if err != nil {
+		return err
+	}
+	used := int64(count) + delta
+	if used < 0 {
+		used = 0
+	}
+	if delta > 0 && limit > 0 && used > limit {
+		return quota
+	}
+	return setCount(txn, key, uint64(used))
+}
+
+// Account for a file record moving from one SHA to another, either of them
+// nil when the file is added or removed. Growth over the quotas fails, the
+// limits are not checked without quotas.
+func accountFile(txn *badger.Txn, oldSHA []byte, newSHA []byte, q *quotas) error {
+	if q == nil {
+		q = &quotas{}
+	}
+	var size, files int64
+	if newSHA != nil {
+		newSize, err := getSize(txn, newSHA)
+		if err != nil {
+			return err
+		}
+		if q.fileSize > 0 && newSize > q.fileSize {
+			return ErrFileTooLarge
+		}
+		size, files = size+newSize, files+1
+	}
+	if oldSHA != nil {
+		oldSize, err := getSize(txn, oldSHA)
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		size, files = size-oldSize, files-1
+	}
+	if err := addUsage(txn, logicalKey, size, q.logical, ErrLogicalQuota); err != nil {
+		return err
+	}
+	return addUsage(txn, filesKey, files, q.files, ErrFileQuota)
+}
+
+// Reader failing with ErrFileTooLarge once more than the maximum file size
+// has been read
+type sizeLimiter struct {
+	reader io.Reader
+	left   int64
+}
+
+func (l *sizeLimiter) Read(p []byte) (int, error) {
+	n, err := l.reader.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n, ErrFileTooLarge
+	}
+	return n, err
+}
+
+// Compute the usage counters of a store from its records
+func (db *database) initUsage() error {
+	return db.update(func(txn *badger.Txn) error {
+		chunks := map[string]int64{}
+		sizes := map[string]int64{}
+		err := eachRecord(txn, shaPrefix, func(key []byte, value []byte) error {
+			m, err := decodeManifest(value)
+			if err != nil {
+				return err
+			}
+			sizes[string(key[len(shaPrefix):])] = m.size
+			for _, chunk := range m.chunks {
+				chunks[string(chunk.sha)] = int64(chunk.size)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		var physical, logical, files int64
+		for _, size := range chunks {
+			physical += size
+		}
+		err = eachRecord(txn, filePrefix, func(key []byte, sha []byte) error {
+			logical += sizes[string(sha)]
+			files++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if err := setCount(txn, physicalKey, uint64(physical)); err != nil {
+			return err
+		}
+		if err := setCount(txn, logicalKey, uint64(logical)); err != nil {
+			return err
+		}
+		return setCount(txn, filesKey, uint64(files))
+	})
+}
@@ -0,0 +1,297 @@
+package database
+
+import (
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Returns the reference count stored at a key
+func getCount(txn *badger.Txn, key []byte) (uint64, error) {
+	item, err := txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var refs uint64
+	err = item.Value(func(value []byte) error {
+		refs = decodeUint(value)
+		return nil
+	})
+	return refs, err
+}
+
+// Set the reference count stored at a key, deleting it when it reaches zero
+func setCount(txn *badger.Txn, key []byte, refs uint64) error {
+	if refs == 0 {
+		return txn.Delete(key)
+	}
+	return txn.Set(key, encodeUint(refs))
+}
+
+// Returns the number of file records, versions and trash entries pointing
+// to a SHA
+func getRefs(txn *badger.Txn, sha []byte) (uint64, error) {
+	return getCount(txn, refKey(sha))
+}
+
+// Take a reference on a SHA
+func retainSHA(txn *badger.Txn, sha []byte) error {
+	refs, err := getRefs(txn, sha)
+	if err != nil {
+		return err
+	}
+	return setCount(txn, refKey(sha), refs+1)
+}
+
+// Chunks released in one transaction. The chunks of larger data are queued
+// with the last reference on it, and released in batches of this size.
+const releaseBatch = 1000
+
+// Interval between two runs of the releaser, when it is not woken up
+const releaseInterval = time.Minute
+
+// Key of the sequence of the released data
+var releasedSeq = metaKey("released")
+
+// Release a reference on a SHA and remove its manifest and word statistics
+// with the last one, releasing the chunks of the file
+func (db *database) releaseSHA(txn *badger.Txn, sha []byte) error {
+	refs, err := getRefs(txn, sha)
+	if err != nil {
+		return err
+	}
+	if refs > 1 {
+		return setCount(txn, refKey(sha), refs-1)
+	}
+	if err := setCount(txn, refKey(sha), 0); err != nil {
+		return err
+	}
+	m, err := getManifest(txn, sha)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := releaseManifest(txn, m); err != nil {
+		return err
+	}
+	if err := txn.Delete(shaKey(sha)); err != nil {
+		return err
+	}
+	db.dropped = append(db.dropped, sha)
+	// the data leaves the search index after the changes queued before
+	if err := queueChange(txn, dropIndex, sha); err != nil {
+		return err
+	}
+	// word statistics still used by pending changes are kept
+	if refs, err := getCount(txn, statsRefKey(sha)); err != nil || refs > 0 {
+		return err
+	}
+	return txn.Delete(statsKey(sha))
+}
+
+// Take a reference on a chunk, storing its data with the first one. Without
+// data the chunk is in the object store, and is taken back when orphaned.
+// A chunk in quarantine is healed by the data, which has the right SHA.
+// The size of the chunk is added to the physical usage with the first
+// reference.
+func retainChunk(txn *badger.Txn, sha []byte, size int, data []byte) error {
+	refs, err := getCount(txn, chunkRefKey(sha))
+	if err != nil {
+		return err
+	}
+	if refs > 0 {
+		if err := healChunk(txn, sha, data); err != nil {
+			return err
+		}
+	} else if data == nil {
+		if err := txn.Delete(orphanKey(sha)); err != nil {
+			return err
+		}
+	} else {
+		if _, err := txn.Get(chunkKey(sha)); err == badger.ErrKeyNotFound {
+			if err := txn.Set(chunkKey(sha), append([]byte{}, data...)); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+	}
+	if refs == 0 {
+		if err := addUsage(txn, physicalKey, int64(size), 0, nil); err != nil {
+			return err
+		}
+	}
+	return setCount(txn, chunkRefKey(sha), refs+1)
+}
+
+// Take a chunk out of quarantine, storing its data in badger unless it has
+// been uploaded to the object store
+func healChunk(txn *badger.Txn, sha []byte, data []byte) error {
+	_, err := txn.Get(quarantineKey(sha))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if data != nil {
+		if err := txn.Set(chunkKey(sha), append([]byte{}, data...)); err != nil {
+			return err
+		}
+	}
+	return txn.Delete(quarantineKey(sha))
+}
+
+// Release a reference on each chunk, removing the data of the chunks that
+// are no longer referenced. The chunks kept in the object store are
+// orphaned, to be swept later, and those in quarantine are dropped.
+func releaseChunks(txn *badger.Txn, chunks []chunkRef) error {
+	for _, chunk := range chunks {
+		refs, err := getCount(txn, chunkRefKey(chunk.sha))
+		if err != nil {
+			return err
+		}
+		if refs > 1 {
+			if err := setCount(txn, chunkRefKey(chunk.sha), refs-1); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := setCount(txn, chunkRefKey(chunk.sha), 0); err != nil {
+			return err
+		}
+		if err := addUsage(txn, physicalKey, -int64(chunk.size), 0, nil); err != nil {
+			return err
+		}
+		// quarantined chunks have no data left to remove
+		_, err = txn.Get(quarantineKey(chunk.sha))
+		if err == nil {
+			if err := txn.Delete(quarantineKey(chunk.sha)); err != nil {
+				return err
+			}
+			continue
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+		_, err = txn.Get(chunkKey(chunk.sha))
+		if err == badger.ErrKeyNotFound {
+			err = txn.Set(orphanKey(chunk.sha), encodeUint(uint64(time.Now().UnixNano())))
+		} else if err == nil {
+			err = txn.Delete(chunkKey(chunk.sha))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Release the chunks of a manifest, or queue them for the releaser when
+// there are too many for one transaction
+func releaseManifest(txn *badger.Txn, m *manifest) error {
+	if len(m.chunks) <= releaseBatch {
+		return releaseChunks(txn, m.chunks)
+	}
+	seq, err := getCount(txn, releasedSeq)
+	if err != nil {
+		return err
+	}
+	seq++
+	if err := txn.Set(releasedSeq, encodeUint(seq)); err != nil {
+		return err
+	}
+	return txn.Set(releasedKey(seq), m.encode())
+}
+
+// Wake up the releaser, without waiting when it is busy
+func (db *database) wakeReleaser() {
+	select {
+	case db.releaser <- struct{}{}:
+	default:
+	}
+}
+
+// Release the chunks of the queued manifests
+func (db *database) runRelease() {
+	ticker := time.NewTicker(releaseInterval)
+	defer ticker.Stop()
+	for {
+		db.lock.RLock()
+		db.releaseQueued()
+		db.lock.RUnlock()
+		select {
+		case <-db.closed:
+			return
+		case <-db.releaser:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Release the chunks of the queued manifests, oldest first, in batches that
+// each record how many chunks of the manifest are released. A manifest is
+// removed with its last batch.
+func (db *database) releaseQueued() error {
+	for {
+		var seq, next uint64
+		var m *manifest
+		err := db.store.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = releasedPrefix
+			iterator := txn.NewIterator(opts)
+			defer iterator.Close()
+			iterator.Rewind()
+			if !iterator.Valid() {
+				return nil
+			}
+			// the manifest sorts before the number of released chunks
+			item := iterator.Item()
+			seq = decodeUint(item.KeyCopy(nil)[len(releasedPrefix):])
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if m, err = decodeManifest(value); err != nil {
+				// the counts of the chunks are repaired by a check
+				m = &manifest{}
+			}
+			next, err = getCount(txn, releasedNextKey(seq))
+			return err
+		})
+		if err != nil || m == nil {
+			return err
+		}
+		for {
+			end := next + releaseBatch
+			if end > uint64(len(m.chunks)) {
+				end = uint64(len(m.chunks))
+			}
+			err := db.update(func(txn *badger.Txn) error {
+				if next < end {
+					if err := releaseChunks(txn, m.chunks[next:end]); err != nil {
+						return err
+					}
+				}
+				if end < uint64(len(m.chunks)) {
+					return setCount(txn, releasedNextKey(seq), end)
+				}
+				if err := txn.Delete(releasedNextKey(seq)); err != nil {
+					return err
+				}
+				return txn.Delete(releasedKey(seq))
+			})
+			if err != nil {
+				return err
+			}
+			if end == uint64(len(m.chunks)) {
+				break
+			}
+			next = end
+		}
+	}
+}
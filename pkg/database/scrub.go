@@ -0,0 +1,389 @@
+package database
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// The scrubber reads every chunk referenced in the store, from badger or
+// the object store, and checks that its data still has the SHA it is
+// stored under. A corrupt chunk is moved to quarantine, where it is kept
+// for inspection and no longer served, until the same data is uploaded
+// again or the files using it are removed.
+
+// Store whose data can be verified against the SHAs it is stored under
+type Scrubber interface {
+	Scrub() (*ScrubReport, error)
+	LastScrub() (*ScrubReport, error)
+}
+
+// Outcome of a scrub of the store
+type ScrubReport struct {
+	Started  time.Time
+	Finished time.Time
+	Chunks   int64
+	Bytes    int64
+	// SHAs of the chunks quarantined by the scrub
+	Corrupt []string
+	// number of chunks in quarantine, including those of previous scrubs
+	Quarantined int64
+	// names of the files whose data has chunks in quarantine
+	Damaged []string
+	// versions whose data has chunks in quarantine, by file name
+	DamagedVersions map[string][]uint64
+	// IDs of the trashed files whose data has chunks in quarantine, by file
+	// name
+	DamagedTrash map[string][]uint64
+}
+
+// Size of the chunk data verified in one transaction
+const scrubBatch = 4 << 20
+
+// Time waited before scrubbing again after a failed scrub
+const scrubRetry = time.Hour
+
+var errScrubStopped = errors.New("scrub stopped by closing the store")
+
+// Verify every chunk of the store, quarantine the corrupt ones and report
+// the files they damage. Reads are limited to the configured rate.
+func (db *database) Scrub() (*ScrubReport, error) {
+	db.scrubLock.Lock()
+	defer db.scrubLock.Unlock()
+	report := &ScrubReport{Started: time.Now(), Corrupt: []string{}}
+	// chunks are verified in batches, leaving the store free in between
+	next := chunkRefPrefix
+	for next != nil {
+		var err error
+		next, err = db.scrubBatch(next, report)
+		if err != nil {
+			return nil, err
+		}
+		if err := db.throttle(report.Started, report.Bytes); err != nil {
+			return nil, err
+		}
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if err := db.damagedFiles(report); err != nil {
+		return nil, err
+	}
+	report.Finished = time.Now()
+	value, err := json.Marshal(report)
+	if err != nil {
+		return nil, err
+	}
+	err = db.update(func(txn *badger.Txn) error {
+		return txn.Set(scrubKey, value)
+	})
+	return report, err
+}
+
+// Returns the report of the last scrub, nil when the store was never
+// scrubbed
+func (db *database) LastScrub() (*ScrubReport, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.lastScrub()
+}
+
+func (db *database) lastScrub() (*ScrubReport, error) {
+	var report *ScrubReport
+	err := db.store.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(scrubKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(value []byte) error {
+			report = &ScrubReport{}
+			return json.Unmarshal(value, report)
+		})
+	})
+	return report, err
+}
+
+// Verify the chunks from a chunk reference key until the batch is full,
+// quarantining the corrupt ones. Returns the key to continue from, nil
+// after the last chunk.
+func (db *database) scrubBatch(start []byte, report *ScrubReport) ([]byte, error) {
+	select {
+	case <-db.closed:
+		return nil, errScrubStopped
+	default:
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	var next []byte
+	var corrupt [][]byte
+	size := 0
+	err := db.store.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = chunkRefPrefix
+		iterator := txn.NewIterator(opts)
+		defer iterator.Close()
+		for iterator.Seek(start); iterator.Valid(); iterator.Next() {
+			key := iterator.Item().KeyCopy(nil)
+			if size >= scrubBatch {
+				next = key
+				return nil
+			}
+			sha := key[len(chunkRefPrefix):]
+			err := db.readChunk(txn, sha, func(data []byte) error {
+				size += len(data)
+				report.Chunks++
+				report.Bytes += int64(len(data))
+				if sum := sha256.Sum256(data); !bytes.Equal(sum[:], sha) {
+					corrupt = append(corrupt, sha)
+				}
+				return nil
+			})
+			if err == ErrMissingData {
+				// the object of the chunk is gone
+				report.Chunks++
+				corrupt = append(corrupt, sha)
+				err = nil
+			}
+			// chunks already in quarantine, or without data at all, are not
+			// verified
+			if err != nil && err != ErrCorruptData && err != badger.ErrKeyNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, sha := range corrupt {
+		quarantined, err := db.quarantine(sha)
+		if err != nil {
+			return nil, err
+		}
+		if quarantined {
+			report.Corrupt = append(report.Corrupt, hex.EncodeToString(sha))
+		}
+	}
+	return next, nil
+}
+
+// Move a chunk to quarantine when it is still referenced and its data still
+// does not match its SHA. Objects are checked again while uploads are held
+// off, and deleted once quarantined.
+func (db *database) quarantine(sha []byte) (bool, error) {
+	var object []byte
+	inObjects := false
+	if db.objects != nil && !db.chunkInBadger(sha) {
+		db.objectLock.Lock()
+		defer db.objectLock.Unlock()
+		data, err := db.objects.get(sha)
+		if err != nil && err != ErrMissingData {
+			return false, err
+		}
+		object, inObjects = data, true
+	}
+	quarantined := false
+	err := db.update(func(txn *badger.Txn) error {
+		quarantined = false
+		if refs, err := getCount(txn, chunkRefKey(sha)); err != nil || refs == 0 {
+			return err
+		}
+		if _, err := txn.Get(quarantineKey(sha)); err != badger.ErrKeyNotFound {
+			return err
+		}
+		data := object
+		if !inObjects {
+			item, err := txn.Get(chunkKey(sha))
+			if err != nil {
+				return err
+			}
+			if data, err = item.ValueCopy(nil); err != nil {
+				return err
+			}
+		}
+		if sum := sha256.Sum256(data); bytes.Equal(sum[:], sha) {
+			return nil
+		}
+		if err := txn.Set(quarantineKey(sha), data); err != nil {
+			return err
+		}
+		quarantined = true
+		return txn.Delete(chunkKey(sha))
+	})
+	if err != nil || !quarantined {
+		return false, err
+	}
+	if inObjects {
+		if err := db.objects.delete(sha); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// Check if the data of a chunk is kept in badger
+func (db *database) chunkInBadger(sha []byte) bool {
+	txn := db.store.NewTransaction(false)
+	defer txn.Discard()
+	_, err := txn.Get(chunkKey(sha))
+	return err == nil
+}
+
+// Report the files, versions and trashed files whose data has chunks in
+// quarantine, and the number of chunks in quarantine. Cached data of the
+// damaged files is dropped.
+func (db *database) damagedFiles(report *ScrubReport) error {
+	report.Damaged = []string{}
+	report.DamagedVersions = map[string][]uint64{}
+	report.DamagedTrash = map[string][]uint64{}
+	err := db.store.View(func(txn *badger.Txn) error {
+		chunks := map[string]bool{}
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = quarantinePrefix
+		iterator := txn.NewIterator(opts)
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			chunks[string(iterator.Item().Key()[len(quarantinePrefix):])] = true
+		}
+		iterator.Close()
+		report.Quarantined = int64(len(chunks))
+		if len(chunks) == 0 {
+			return nil
+		}
+		buckets, err := bucketNames(txn)
+		if err != nil {
+			return err
+		}
+		damaged := map[string]bool{}
+		err = eachValue(txn, shaPrefix, func(key []byte, value []byte) error {
+			sha := key[len(shaPrefix):]
+			m, err := decodeManifest(value)
+			if err != nil {
+				return err
+			}
+			for _, chunk := range m.chunks {
+				if chunks[string(chunk.sha)] {
+					damaged[string(sha)] = true
+					for _, key := range getNameKeys(txn, nameKey(sha, nil)) {
+						report.Damaged = append(report.Damaged, reportName(buckets, key[len(namePrefix)+len(sha):]))
+					}
+					if db.cache != nil {
+						db.cache.remove(sha)
+					}
+					break
+				}
+			}
+			return nil
+		})
+		if err != nil || len(damaged) == 0 {
+			return err
+		}
+		err = eachValue(txn, versionPrefix, func(key []byte, value []byte) error {
+			v, err := decodeVersion(value)
+			if err != nil || !damaged[string(v.sha)] {
+				return err
+			}
+			file, number := splitVersionKey(key)
+			name := reportName(buckets, file)
+			report.DamagedVersions[name] = append(report.DamagedVersions[name], number)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return eachValue(txn, trashPrefix, func(key []byte, value []byte) error {
+			e, err := decodeTrashEntry(value)
+			if err != nil || !damaged[string(e.sha)] {
+				return err
+			}
+			file, id := splitTrashKey(key)
+			name := reportName(buckets, file)
+			report.DamagedTrash[name] = append(report.DamagedTrash[name], id)
+			return nil
+		})
+	})
+	sort.Strings(report.Damaged)
+	return err
+}
+
+// Check if the data of a file has chunks in quarantine
+func isDamaged(txn *badger.Txn, sha []byte) (bool, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = quarantinePrefix
+	iterator := txn.NewIterator(opts)
+	iterator.Rewind()
+	empty := !iterator.Valid()
+	iterator.Close()
+	if empty {
+		return false, nil
+	}
+	m, err := getManifest(txn, sha)
+	if err != nil {
+		return false, err
+	}
+	for _, chunk := range m.chunks {
+		_, err := txn.Get(quarantineKey(chunk.sha))
+		if err == nil {
+			return true, nil
+		}
+		if err != badger.ErrKeyNotFound {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// Wait until the bytes read since the start of a scrub are within the rate
+// limit
+func (db *database) throttle(start time.Time, bytes int64) error {
+	if db.scrubRate <= 0 {
+		return nil
+	}
+	due := start.Add(time.Duration(float64(bytes) / float64(db.scrubRate) * float64(time.Second)))
+	wait := time.Until(due)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-db.closed:
+		return errScrubStopped
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Scrub the store once the interval has passed since the last scrub
+func (db *database) runScrub() {
+	if db.scrubInterval <= 0 {
+		return
+	}
+	var err error
+	for {
+		wait := db.scrubInterval
+		if err != nil {
+			wait = scrubRetry
+		} else if report, _ := db.LastScrub(); report != nil {
+			wait = time.Until(report.Finished.Add(db.scrubInterval))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-db.closed:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		_, err = db.Scrub()
+	}
+}
@@ -0,0 +1,633 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Store that finds the files containing words
+type Searcher interface {
+	Search(query string, limit int) ([]SearchResult, error)
+}
+
+// File matching a search, with a piece of its text around the first match
+type SearchResult struct {
+	Name    string
+	SHA     string
+	Score   float64
+	Snippet string
+}
+
+var ErrInvalidQuery = errors.New("invalid search query")
+
+// The search index maps each word to the data it appears in, with the
+// positions and byte offsets of the word in the data. Data is indexed by
+// the indexer after it is written, in segments of words, so that indexing
+// a large file does not hold all of its words in memory. The words of each
+// segment are listed with the data, to remove them from the index with it.
+const segmentWords = 1 << 16
+
+// Words longer than this, or not valid UTF-8, are counted in the word
+// frequency but left out of the search index, which keeps binary data from
+// flooding it
+const maxWord = 64
+
+// Number of bytes of text shown on each side of a match
+const snippetContext = 60
+
+var indexedCount = metaKey("indexed")
+
+var errBadPostings = errors.New("corrupt search index")
+
+// Position and byte offset of a word in the data
+type posting struct {
+	position uint64
+	offset   uint64
+}
+
+func encodePostings(postings []posting) []byte {
+	buf := make([]byte, 0, len(postings)*4)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	var last posting
+	for _, p := range postings {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, p.position-last.position)]...)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, p.offset-last.offset)]...)
+		last = p
+	}
+	return buf
+}
+
+func decodePostings(buf []byte, postings []posting) ([]posting, error) {
+	var last posting
+	for len(buf) > 0 {
+		position, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errBadPostings
+		}
+		buf = buf[n:]
+		offset, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errBadPostings
+		}
+		buf = buf[n:]
+		last = posting{last.position + position, last.offset + offset}
+		postings = append(postings, last)
+	}
+	return postings, nil
+}
+
+// Returns the term a word is indexed under, without the punctuation around
+// it. Words too long or not valid UTF-8 are not indexed, nor the ones
+// holding a NUL, which separates the word from the data in the keys.
+func searchTerm(word string) string {
+	if len(word) > maxWord || !utf8.ValidString(word) || strings.ContainsRune(word, 0) {
+		return ""
+	}
+	return strings.TrimFunc(word, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Add the data of a SHA to the search index, unless it is indexed already
+// or no longer in the store
+func (db *database) buildIndex(sha []byte) error {
+	txn := db.store.NewTransaction(false)
+	defer txn.Discard()
+	if _, err := txn.Get(indexedKey(sha)); err != badger.ErrKeyNotFound {
+		return err
+	}
+	m, err := getManifest(txn, sha)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var segment uint32
+	words := 0
+	postings := map[string][]posting{}
+	flush := func() error {
+		terms := make([]string, 0, len(postings))
+		for term := range postings {
+			terms = append(terms, term)
+		}
+		sort.Strings(terms)
+		for start := 0; start < len(terms); start += indexBatch {
+			batch := terms[start:]
+			if len(batch) > indexBatch {
+				batch = batch[:indexBatch]
+			}
+			err := db.update(func(txn *badger.Txn) error {
+				for _, term := range batch {
+					err := txn.Set(postingKey([]byte(term), sha, segment), encodePostings(postings[term]))
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		err := db.update(func(txn *badger.Txn) error {
+			return txn.Set(segmentKey(sha, segment), encodeTerms(terms))
+		})
+		segment++
+		words = 0
+		postings = map[string][]posting{}
+		return err
+	}
+
+	counter := newWordCounter()
+	counter.emit = func(word string, position uint64, offset uint64) {
+		if term := searchTerm(word); term != "" {
+			postings[term] = append(postings[term], posting{position, offset})
+			words++
+		}
+	}
+	for _, chunk := range m.chunks {
+		err := db.readChunk(txn, chunk.sha, func(value []byte) error {
+			_, err := counter.Write(value)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if words >= segmentWords {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	counter.stats()
+	if words > 0 {
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+	return db.update(func(txn *badger.Txn) error {
+		count, err := getCount(txn, indexedCount)
+		if err != nil {
+			return err
+		}
+		if err := setCount(txn, indexedCount, count+1); err != nil {
+			return err
+		}
+		return txn.Set(indexedKey(sha), encodeUint(uint64(segment)))
+	})
+}
+
+// Remove the data of a SHA from the search index, unless it is back in the
+// store
+func (db *database) dropIndex(sha []byte) error {
+	var segments uint64
+	err := db.store.View(func(txn *badger.Txn) error {
+		if _, err := txn.Get(shaKey(sha)); err != badger.ErrKeyNotFound {
+			if err == nil {
+				return errStop
+			}
+			return err
+		}
+		item, err := txn.Get(indexedKey(sha))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(value []byte) error {
+			segments = decodeUint(value)
+			return nil
+		})
+	})
+	if err == errStop || err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for segment := uint32(0); uint64(segment) < segments; segment++ {
+		var terms []string
+		err := db.store.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(segmentKey(sha, segment))
+			if err == badger.ErrKeyNotFound {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return item.Value(func(value []byte) error {
+				terms, err = decodeTerms(value)
+				return err
+			})
+		})
+		if err != nil {
+			return err
+		}
+		for start := 0; start < len(terms); start += indexBatch {
+			batch := terms[start:]
+			if len(batch) > indexBatch {
+				batch = batch[:indexBatch]
+			}
+			err := db.update(func(txn *badger.Txn) error {
+				for _, term := range batch {
+					if err := txn.Delete(postingKey([]byte(term), sha, segment)); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		err = db.update(func(txn *badger.Txn) error {
+			return txn.Delete(segmentKey(sha, segment))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return db.update(func(txn *badger.Txn) error {
+		count, err := getCount(txn, indexedCount)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			count--
+		}
+		if err := setCount(txn, indexedCount, count); err != nil {
+			return err
+		}
+		return txn.Delete(indexedKey(sha))
+	})
+}
+
+func encodeTerms(terms []string) []byte {
+	return []byte(strings.Join(terms, "\x00"))
+}
+
+func decodeTerms(buf []byte) ([]string, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(buf), "\x00"), nil
+}
+
+// Record a file name pointing to a SHA, for the search results
+func addName(txn *badger.Txn, sha []byte, name []byte) error {
+	return txn.Set(nameKey(sha, name), nil)
+}
+
+func removeName(txn *badger.Txn, sha []byte, name []byte) error {
+	return txn.Delete(nameKey(sha, name))
+}
+
+// Returns the names of the files of a namespace pointing to a SHA
+func getNames(txn *badger.Txn, sha []byte, ns namespace) []string {
+	names := []string{}
+	for _, key := range getNameKeys(txn, nameKey(sha, ns.prefix)) {
+		if key = key[len(namePrefix)+len(sha):]; ns.owns(key) {
+			names = append(names, ns.name(key))
+		}
+	}
+	return names
+}
+
+// Returns the file name records under a prefix
+func getNameKeys(txn *badger.Txn, prefix []byte) [][]byte {
+	var keys [][]byte
+	eachKey(txn, prefix, func(key []byte) {
+		keys = append(keys, key)
+	})
+	return keys
+}
+
+// Part of a query: a word, or a phrase of words following each other
+type queryItem struct {
+	words []string
+}
+
+// Parse a query in to clauses joined by OR, each made of items that must
+// all match. Phrases are quoted, and AND may be written between items.
+func parseQuery(query string) ([][]queryItem, error) {
+	clauses := [][]queryItem{{}}
+	for query = strings.TrimSpace(query); query != ""; query = strings.TrimSpace(query) {
+		if query[0] == '"' {
+			end := strings.IndexByte(query[1:], '"')
+			if end < 0 {
+				return nil, ErrInvalidQuery
+			}
+			words := queryWords(query[1 : end+1])
+			query = query[end+2:]
+			if len(words) > 0 {
+				last := len(clauses) - 1
+				clauses[last] = append(clauses[last], queryItem{words})
+			}
+			continue
+		}
+		end := strings.IndexFunc(query, func(r rune) bool {
+			return unicode.IsSpace(r) || r == '"'
+		})
+		if end < 0 {
+			end = len(query)
+		}
+		word := query[:end]
+		query = query[end:]
+		switch word {
+		case "OR":
+			clauses = append(clauses, []queryItem{})
+		case "AND":
+		default:
+			if words := queryWords(word); len(words) > 0 {
+				last := len(clauses) - 1
+				clauses[last] = append(clauses[last], queryItem{words})
+			}
+		}
+	}
+	for _, clause := range clauses {
+		if len(clause) == 0 {
+			return nil, ErrInvalidQuery
+		}
+	}
+	return clauses, nil
+}
+
+// Returns the search terms of the words of a query
+func queryWords(text string) []string {
+	words := []string{}
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		if term := searchTerm(word); term != "" {
+			words = append(words, term)
+		}
+	}
+	return words
+}
+
+// Returns the postings of a word in each SHA it appears in
+func getPostings(txn *badger.Txn, word string) (map[string][]posting, error) {
+	postings := map[string][]posting{}
+	if len(word) > maxWord || !utf8.ValidString(word) {
+		return postings, nil
+	}
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = postingsKey([]byte(word))
+	iterator := txn.NewIterator(opts)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		item := iterator.Item()
+		key := item.Key()[len(opts.Prefix):]
+		if len(key) != 32+4 {
+			return nil, errBadPostings
+		}
+		sha := string(key[:32])
+		err := item.Value(func(value []byte) error {
+			var err error
+			postings[sha], err = decodePostings(value, postings[sha])
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return postings, nil
+}
+
+// Returns the postings of the first word of each occurrence of a phrase
+func phrasePostings(words [][]posting) []posting {
+	matches := []posting{}
+	for _, first := range words[0] {
+		match := true
+		for i, postings := range words[1:] {
+			position := first.position + uint64(i+1)
+			j := sort.Search(len(postings), func(j int) bool {
+				return postings[j].position >= position
+			})
+			if j == len(postings) || postings[j].position != position {
+				match = false
+				break
+			}
+		}
+		if match {
+			matches = append(matches, first)
+		}
+	}
+	return matches
+}
+
+// Find the files matching a query, best matches first. Items of a query are
+// scored by the number of matches in a file, weighted by how rare they are
+// in the store.
+func (db *database) Search(query string, limit int) ([]SearchResult, error) {
+	return db.search(rootNamespace, query, limit)
+}
+
+func (db *database) search(ns namespace, query string, limit int) ([]SearchResult, error) {
+	clauses, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	results := []SearchResult{}
+	err = db.store.View(func(txn *badger.Txn) error {
+		total, err := getCount(txn, indexedCount)
+		if err != nil {
+			return err
+		}
+		cache := map[string]map[string][]posting{}
+		lookup := func(word string) (map[string][]posting, error) {
+			if postings, ok := cache[word]; ok {
+				return postings, nil
+			}
+			postings, err := getPostings(txn, word)
+			cache[word] = postings
+			return postings, err
+		}
+		idf := func(word string) float64 {
+			return math.Log(1 + float64(total+1)/float64(len(cache[word])+1))
+		}
+
+		scores := map[string]float64{}
+		firstMatch := map[string]posting{}
+		for _, clause := range clauses {
+			var matches map[string]float64
+			first := map[string]posting{}
+			for _, item := range clause {
+				words := make([]map[string][]posting, len(item.words))
+				for i, word := range item.words {
+					if words[i], err = lookup(word); err != nil {
+						return err
+					}
+				}
+				weight := 0.0
+				for _, word := range item.words {
+					weight += idf(word)
+				}
+				itemMatches := map[string]float64{}
+				for sha, postings := range words[0] {
+					if matches != nil {
+						if _, ok := matches[sha]; !ok {
+							continue
+						}
+					}
+					if len(item.words) > 1 {
+						phrase := make([][]posting, len(item.words))
+						phrase[0] = postings
+						for i := range item.words[1:] {
+							phrase[i+1] = words[i+1][sha]
+						}
+						postings = phrasePostings(phrase)
+					}
+					if len(postings) == 0 {
+						continue
+					}
+					itemMatches[sha] = (1 + math.Log(float64(len(postings)))) * weight
+					if _, ok := first[sha]; !ok || postings[0].offset < first[sha].offset {
+						first[sha] = postings[0]
+					}
+				}
+				if matches == nil {
+					matches = itemMatches
+					continue
+				}
+				for sha := range matches {
+					if score, ok := itemMatches[sha]; ok {
+						matches[sha] += score
+					} else {
+						delete(matches, sha)
+					}
+				}
+			}
+			for sha, score := range matches {
+				scores[sha] += score
+				if _, ok := firstMatch[sha]; !ok || first[sha].offset < firstMatch[sha].offset {
+					firstMatch[sha] = first[sha]
+				}
+			}
+		}
+
+		for sha, score := range scores {
+			names := getNames(txn, []byte(sha), ns)
+			if len(names) == 0 {
+				continue
+			}
+			snippet, err := db.getSnippet(txn, []byte(sha), firstMatch[sha].offset)
+			if err != nil && err != badger.ErrKeyNotFound {
+				return err
+			}
+			for _, name := range names {
+				results = append(results, SearchResult{
+					Name:    name,
+					SHA:     hex.EncodeToString([]byte(sha)),
+					Score:   score,
+					Snippet: snippet,
+				})
+			}
+		}
+		return nil
+	})
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Name < results[j].Name
+	})
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results, err
+}
+
+// Returns the text around an offset in the data of a SHA, cut at white space
+func (db *database) getSnippet(txn *badger.Txn, sha []byte, offset uint64) (string, error) {
+	m, err := getManifest(txn, sha)
+	if err != nil {
+		return "", err
+	}
+	start := uint64(0)
+	if offset > snippetContext {
+		start = offset - snippetContext
+	}
+	end := offset + 2*snippetContext
+	var text []byte
+	var position uint64
+	for _, chunk := range m.chunks {
+		next := position + uint64(chunk.size)
+		if next > start && position < end {
+			err := db.readChunk(txn, chunk.sha, func(value []byte) error {
+				from, to := uint64(0), uint64(len(value))
+				if start > position {
+					from = start - position
+				}
+				if end < next {
+					to = end - position
+				}
+				text = append(text, value[from:to]...)
+				return nil
+			})
+			if err != nil {
+				return "", err
+			}
+		}
+		position = next
+	}
+	// drop the words cut at both ends
+	if start > 0 {
+		if i := bytes.IndexFunc(text, unicode.IsSpace); i >= 0 && uint64(i) < offset-start {
+			text = text[i:]
+		}
+	}
+	if end < uint64(m.size) {
+		if i := bytes.LastIndexFunc(text, unicode.IsSpace); i > 0 {
+			text = text[:i]
+		}
+	}
+	return strings.Join(strings.Fields(strings.ToValidUTF8(string(text), "")), " "), nil
+}
+
+// Record the names of the files and index the data already in the store
+func (db *database) initSearch() error {
+	err := db.eachFile(func(txn *badger.Txn, name []byte) error {
+		sha, err := getSHA(txn, name)
+		if err != nil {
+			return err
+		}
+		return addName(txn, sha, name)
+	})
+	if err != nil {
+		return err
+	}
+	var shas [][]byte
+	err = db.store.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = shaPrefix
+		iterator := txn.NewIterator(opts)
+		defer iterator.Close()
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			shas = append(shas, iterator.Item().KeyCopy(nil)[len(shaPrefix):])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, sha := range shas {
+		err := db.update(func(txn *badger.Txn) error {
+			return queueChange(txn, buildIndex, sha)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
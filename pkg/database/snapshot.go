@@ -0,0 +1,48 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Number of pending writes while loading a snapshot
+const snapshotPending = 256
+
+// Load the snapshot of a diskless store, if one was saved before
+func (db *database) loadSnapshot() error {
+	file, err := os.Open(db.snapshot)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return db.store.Load(file, snapshotPending)
+}
+
+// Save the snapshot of a diskless store, replacing the previous one only
+// after the new one is completely written
+func (db *database) saveSnapshot() error {
+	if err := os.MkdirAll(filepath.Dir(db.snapshot), 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(db.snapshot), filepath.Base(db.snapshot)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := db.store.Backup(file, 0); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), db.snapshot)
+}
@@ -0,0 +1,323 @@
+package database
+
+import (
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Store that keeps removed files in a trash bin until they are purged
+type Trasher interface {
+	Trash(name string, by string) error
+	TrashList() ([]Trashed, error)
+	RestoreTrash(name string, id uint64) error
+	PurgeTrash(name string, id uint64) error
+}
+
+// File in the trash bin. The ID is the time the file was removed, and tells
+// apart the files removed under the same name.
+type Trashed struct {
+	Name      string
+	ID        uint64
+	SHA       string
+	Size      int64
+	Deleted   time.Time
+	DeletedBy string
+}
+
+// Interval between two runs of the trash purger
+const trashPurgeInterval = time.Minute
+
+var errBadTrash = errors.New("corrupt trash entry")
+
+// A trash entry holds a reference on its SHA, like a file record, so the
+// data stays in the store until the entry is purged
+type trashEntry struct {
+	sha  []byte
+	size int64
+	by   string
+}
+
+func (e *trashEntry) encode() []byte {
+	buf := make([]byte, 0, 32+8+len(e.by))
+	buf = append(buf, e.sha...)
+	buf = append(buf, encodeUint(uint64(e.size))...)
+	return append(buf, e.by...)
+}
+
+func decodeTrashEntry(buf []byte) (*trashEntry, error) {
+	if len(buf) < 32+8 {
+		return nil, errBadTrash
+	}
+	return &trashEntry{
+		sha:  append([]byte{}, buf[:32]...),
+		size: int64(decodeUint(buf[32:40])),
+		by:   string(buf[40:]),
+	}, nil
+}
+
+// Iterate over the trash entries under a prefix, oldest first for a name
+func eachTrashed(txn *badger.Txn, prefix []byte, fn func(name []byte, id uint64, e *trashEntry) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	iterator := txn.NewIterator(opts)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		item := iterator.Item()
+		name, id := splitTrashKey(item.KeyCopy(nil))
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		e, err := decodeTrashEntry(value)
+		if err != nil {
+			return err
+		}
+		if err := fn(name, id, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Move a file to the trash bin. Without a retention period the file is
+// removed for good.
+func (db *database) Trash(name string, by string) error {
+	return db.trash(rootNamespace, name, by, time.Now())
+}
+
+// Move a file to the trash bin as removed at a time, which its ID is taken
+// from, so that stores removing the same files at the same times give them
+// the same IDs
+func (db *database) TrashAt(name string, by string, at time.Time) error {
+	return db.trash(rootNamespace, name, by, at)
+}
+
+func (db *database) trash(ns namespace, name string, by string, at time.Time) error {
+	key, err := ns.key(name)
+	if err != nil {
+		return err
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	if db.trashRetention <= 0 {
+		return db.update(func(txn *badger.Txn) error {
+			return db.removeFile(txn, key)
+		})
+	}
+	return db.update(func(txn *badger.Txn) error {
+		sha, err := getSHA(txn, key)
+		if err != nil {
+			return err
+		}
+		size, err := getSize(txn, sha)
+		if err != nil {
+			return err
+		}
+		// removal times are unique per name
+		id := uint64(at.UnixNano())
+		for {
+			if _, err := txn.Get(trashKey(key, id)); err == badger.ErrKeyNotFound {
+				break
+			} else if err != nil {
+				return err
+			}
+			id++
+		}
+		e := &trashEntry{sha: sha, size: size, by: by}
+		if err := txn.Set(trashKey(key, id), e.encode()); err != nil {
+			return err
+		}
+		if err := retainSHA(txn, sha); err != nil {
+			return err
+		}
+		return db.removeFile(txn, key)
+	})
+}
+
+// Returns the files in the trash bin
+func (db *database) TrashList() ([]Trashed, error) {
+	return db.trashList(rootNamespace)
+}
+
+func (db *database) trashList(ns namespace) ([]Trashed, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	list := []Trashed{}
+	err := db.store.View(func(txn *badger.Txn) error {
+		return eachTrashed(txn, prefixKey(trashPrefix, ns.prefix), func(name []byte, id uint64, e *trashEntry) error {
+			if !ns.owns(name) {
+				return nil
+			}
+			list = append(list, Trashed{
+				Name:      ns.name(name),
+				ID:        id,
+				SHA:       hex.EncodeToString(e.sha),
+				Size:      e.size,
+				Deleted:   time.Unix(0, int64(id)),
+				DeletedBy: e.by,
+			})
+			return nil
+		})
+	})
+	return list, err
+}
+
+// Move a file back from the trash bin, the most recently removed one when
+// the ID is 0. Fails with badger.ErrConflict when the name is in use.
+func (db *database) RestoreTrash(name string, id uint64) error {
+	return db.restoreTrash(rootNamespace, name, id)
+}
+
+func (db *database) restoreTrash(ns namespace, name string, id uint64) error {
+	key, err := ns.key(name)
+	if err != nil {
+		return err
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.update(func(txn *badger.Txn) error {
+		if err := ns.check(txn); err != nil {
+			return err
+		}
+		var sha []byte
+		err := eachTrashed(txn, trashedKey(key), func(_ []byte, trashed uint64, e *trashEntry) error {
+			if id == 0 || id == trashed {
+				sha = e.sha
+				id = trashed
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if sha == nil {
+			return badger.ErrKeyNotFound
+		}
+		if err := db.addFile(txn, key, sha); err != nil {
+			return err
+		}
+		if err := txn.Delete(trashKey(key, id)); err != nil {
+			return err
+		}
+		return db.releaseSHA(txn, sha)
+	})
+}
+
+// Remove files from the trash bin for good. With an ID of 0 every entry of
+// the name is purged, and with an empty name the whole trash bin.
+func (db *database) PurgeTrash(name string, id uint64) error {
+	return db.purgeTrash(rootNamespace, name, id)
+}
+
+func (db *database) purgeTrash(ns namespace, name string, id uint64) error {
+	prefix := prefixKey(trashPrefix, ns.prefix)
+	if name != "" {
+		key, err := ns.key(name)
+		if err != nil {
+			return err
+		}
+		prefix = trashedKey(key)
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	purged := false
+	err := db.eachTrashKey(prefix, func(txn *badger.Txn, key []byte, trashed uint64) error {
+		if (id != 0 && id != trashed) || !ns.owns(key) {
+			return nil
+		}
+		purged = true
+		return db.purgeTrashed(txn, key, trashed)
+	})
+	if err == nil && !purged && name != "" {
+		return badger.ErrKeyNotFound
+	}
+	return err
+}
+
+func (db *database) purgeTrashed(txn *badger.Txn, name []byte, id uint64) error {
+	item, err := txn.Get(trashKey(name, id))
+	if err != nil {
+		return err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	e, err := decodeTrashEntry(value)
+	if err != nil {
+		return err
+	}
+	if err := txn.Delete(trashKey(name, id)); err != nil {
+		return err
+	}
+	return db.releaseSHA(txn, e.sha)
+}
+
+// Run a read-write transaction for every trash entry under a prefix
+func (db *database) eachTrashKey(prefix []byte, fn func(txn *badger.Txn, name []byte, id uint64) error) error {
+	type entry struct {
+		name []byte
+		id   uint64
+	}
+	var entries []entry
+	err := db.store.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		iterator := txn.NewIterator(opts)
+		defer iterator.Close()
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			name, id := splitTrashKey(iterator.Item().KeyCopy(nil))
+			entries = append(entries, entry{name, id})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		err := db.update(func(txn *badger.Txn) error {
+			if _, err := txn.Get(trashKey(e.name, e.id)); err == badger.ErrKeyNotFound {
+				return nil
+			}
+			return fn(txn, e.name, e.id)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Purge the files that have been in the trash bin longer than the retention
+// period
+func (db *database) runTrashPurge() {
+	if db.trashRetention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closed:
+			return
+		case <-ticker.C:
+		}
+		db.lock.RLock()
+		db.purgeExpiredTrash()
+		db.lock.RUnlock()
+	}
+}
+
+func (db *database) purgeExpiredTrash() error {
+	expired := uint64(time.Now().Add(-db.trashRetention).UnixNano())
+	return db.eachTrashKey(trashPrefix, func(txn *badger.Txn, name []byte, id uint64) error {
+		if id > expired {
+			return nil
+		}
+		return db.purgeTrashed(txn, name, id)
+	})
+}
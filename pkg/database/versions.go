@@ -0,0 +1,331 @@
+package database
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Store that keeps the previous versions of a file
+type Versioner interface {
+	Versions(name string) ([]Version, error)
+	Restore(name string, version uint64) error
+}
+
+// Version of a file, numbered from 1 in the order they were written
+type Version struct {
+	Version uint64
+	SHA     string
+	Size    int64
+	Time    time.Time
+}
+
+// Every file keeps its history, the current version included. Each version
+// holds a reference on its SHA, in addition to the one of the file record,
+// so identical versions share their data.
+const versionSize = 32 + 8 + 8
+
+var errBadVersion = errors.New("corrupt file version")
+
+type version struct {
+	sha  []byte
+	time int64
+	size int64
+}
+
+func (v *version) encode() []byte {
+	buf := make([]byte, 0, versionSize)
+	buf = append(buf, v.sha...)
+	buf = append(buf, encodeUint(uint64(v.time))...)
+	return append(buf, encodeUint(uint64(v.size))...)
+}
+
+func decodeVersion(buf []byte) (*version, error) {
+	if len(buf) != versionSize {
+		return nil, errBadVersion
+	}
+	return &version{
+		sha:  append([]byte{}, buf[:32]...),
+		time: int64(binary.BigEndian.Uint64(buf[32:40])),
+		size: int64(binary.BigEndian.Uint64(buf[40:48])),
+	}, nil
+}
+
+// Iterate over the versions of a file, oldest first
+func eachVersion(txn *badger.Txn, name []byte, fn func(number uint64, v *version) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = versionsKey(name)
+	iterator := txn.NewIterator(opts)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		item := iterator.Item()
+		number := decodeUint(item.Key()[len(opts.Prefix):])
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		v, err := decodeVersion(value)
+		if err != nil {
+			return err
+		}
+		if err := fn(number, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the number of the latest version of a file, 0 without versions
+func lastVersion(txn *badger.Txn, name []byte) (uint64, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Reverse = true
+	opts.Prefix = versionsKey(name)
+	iterator := txn.NewIterator(opts)
+	defer iterator.Close()
+	// seek past the largest version number
+	iterator.Seek(append(versionsKey(name), 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF))
+	if !iterator.Valid() {
+		return 0, nil
+	}
+	return decodeUint(iterator.Item().Key()[len(opts.Prefix):]), nil
+}
+
+// Returns the time of the latest version of a file in nanoseconds, 0
+// without versions
+func modifiedTime(txn *badger.Txn, name []byte) (int64, error) {
+	last, err := lastVersion(txn, name)
+	if err != nil || last == 0 {
+		return 0, err
+	}
+	item, err := txn.Get(versionKey(name, last))
+	if err != nil {
+		return 0, err
+	}
+	value, err := item.ValueCopy(nil)
+	if err != nil {
+		return 0, err
+	}
+	v, err := decodeVersion(value)
+	if err != nil {
+		return 0, err
+	}
+	return v.time, nil
+}
+
+// Add a new version of a file and drop the versions that are too many or
+// too old, the new version is always kept
+func (db *database) addVersion(txn *badger.Txn, name []byte, sha []byte) error {
+	last, err := lastVersion(txn, name)
+	if err != nil {
+		return err
+	}
+	size, err := getSize(txn, sha)
+	if err != nil {
+		return err
+	}
+	v := &version{sha: sha, time: time.Now().UnixNano(), size: size}
+	if err := txn.Set(versionKey(name, last+1), v.encode()); err != nil {
+		return err
+	}
+	if err := retainSHA(txn, sha); err != nil {
+		return err
+	}
+	return db.pruneVersions(txn, name, last+1)
+}
+
+// Drop the versions of a file exceeding the maximum count or age, the
+// latest version is always kept
+func (db *database) pruneVersions(txn *badger.Txn, name []byte, latest uint64) error {
+	numbers := []uint64{}
+	versions := []*version{}
+	err := eachVersion(txn, name, func(number uint64, v *version) error {
+		numbers = append(numbers, number)
+		versions = append(versions, v)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	minTime := int64(0)
+	if db.maxVersionAge > 0 {
+		minTime = time.Now().Add(-db.maxVersionAge).UnixNano()
+	}
+	count := len(versions)
+	for i, v := range versions {
+		if numbers[i] == latest {
+			continue
+		}
+		if (db.maxVersions > 0 && count > db.maxVersions) || v.time < minTime {
+			count--
+			if err := txn.Delete(versionKey(name, numbers[i])); err != nil {
+				return err
+			}
+			if err := db.releaseSHA(txn, v.sha); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Drop every version of a file
+func (db *database) removeVersions(txn *badger.Txn, name []byte) error {
+	var numbers []uint64
+	err := eachVersion(txn, name, func(number uint64, v *version) error {
+		numbers = append(numbers, number)
+		return db.releaseSHA(txn, v.sha)
+	})
+	if err != nil {
+		return err
+	}
+	for _, number := range numbers {
+		if err := txn.Delete(versionKey(name, number)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Returns the versions of a file, oldest first
+func (db *database) Versions(name string) ([]Version, error) {
+	return db.versions(rootNamespace, name)
+}
+
+func (db *database) versions(ns namespace, name string) ([]Version, error) {
+	key, err := ns.key(name)
+	if err != nil {
+		return nil, err
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	versions := []Version{}
+	err = db.store.View(func(txn *badger.Txn) error {
+		if _, err := txn.Get(fileKey(key)); err != nil {
+			return err
+		}
+		return eachVersion(txn, key, func(number uint64, v *version) error {
+			versions = append(versions, Version{
+				Version: number,
+				SHA:     hex.EncodeToString(v.sha),
+				Size:    v.size,
+				Time:    time.Unix(0, v.time),
+			})
+			return nil
+		})
+	})
+	return versions, err
+}
+
+// Make a previous version the current version of a file. The restored data
+// is added as a new version, so the history is never rewritten.
+func (db *database) Restore(name string, number uint64) error {
+	return db.restore(rootNamespace, name, number)
+}
+
+func (db *database) restore(ns namespace, name string, number uint64) error {
+	key, err := ns.key(name)
+	if err != nil {
+		return err
+	}
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	return db.update(func(txn *badger.Txn) error {
+		if err := ns.check(txn); err != nil {
+			return err
+		}
+		item, err := txn.Get(versionKey(key, number))
+		if err != nil {
+			return err
+		}
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		v, err := decodeVersion(value)
+		if err != nil {
+			return err
+		}
+		return db.updateFile(txn, key, v.sha)
+	})
+}
+
+// Prune the versions of all files once an hour, so versions older than the
+// maximum age go away even when a file is not written
+func (db *database) runVersionPrune() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closed:
+			return
+		case <-ticker.C:
+		}
+		db.lock.RLock()
+		db.pruneAllVersions()
+		db.lock.RUnlock()
+	}
+}
+
+func (db *database) pruneAllVersions() error {
+	return db.eachFile(func(txn *badger.Txn, name []byte) error {
+		latest, err := lastVersion(txn, name)
+		if err != nil {
+			return err
+		}
+		return db.pruneVersions(txn, name, latest)
+	})
+}
+
+// Add the current data of every file as its first version
+func (db *database) initVersions() error {
+	return db.eachFile(func(txn *badger.Txn, name []byte) error {
+		if last, err := lastVersion(txn, name); err != nil || last > 0 {
+			return err
+		}
+		sha, err := getSHA(txn, name)
+		if err != nil {
+			return err
+		}
+		return db.addVersion(txn, name, sha)
+	})
+}
+
+// Run a read-write transaction for every file in the store
+func (db *database) eachFile(fn func(txn *badger.Txn, name []byte) error) error {
+	return db.eachFileIn(filePrefix, fn)
+}
+
+// Run a read-write transaction for every file under a file key prefix
+func (db *database) eachFileIn(prefix []byte, fn func(txn *badger.Txn, name []byte) error) error {
+	var names [][]byte
+	err := db.store.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		iterator := txn.NewIterator(opts)
+		defer iterator.Close()
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			names = append(names, iterator.Item().KeyCopy(nil)[len(filePrefix):])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		err := db.update(func(txn *badger.Txn) error {
+			if _, err := txn.Get(fileKey(name)); err == badger.ErrKeyNotFound {
+				return nil
+			}
+			return fn(txn, name)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
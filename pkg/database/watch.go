@@ -0,0 +1,389 @@
+package database
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/pb"
+)
+
+// Every change of a file record is written to a journal of events in the
+// same transaction, numbered by a sequence that only grows. Watchers read
+// the journal from the sequence number they resume from, and subscribe to
+// the journal records to be woken up when events are written. Events older
+// than the retention period are pruned.
+
+// Store that streams the changes of its files
+type Watcher interface {
+	Watch(ctx context.Context, after uint64) (<-chan Event, error)
+	LastEvent() (Event, error)
+}
+
+// Change of a file
+type Event struct {
+	Sequence uint64
+	// add, update, remove or rename
+	Type string
+	Name string
+	// previous name of a renamed file
+	From string `json:",omitempty"`
+	// SHA of the data of the file, of the removed data for a removal
+	SHA  string
+	Time time.Time
+}
+
+// Types of the events
+const (
+	EventAdd    = "add"
+	EventUpdate = "update"
+	EventRemove = "remove"
+	EventRename = "rename"
+)
+
+// Type of the last event sent to a watcher whose next events were pruned
+// before it read them. It has the sequence number of the last event sent, and
+// the files must be listed again to catch up with the changes.
+const EventReset = "reset"
+
+// Sequence number to watch from, to get the events written from now on
+const WatchNow = ^uint64(0)
+
+var ErrEventsPruned = errors.New("events after the sequence number have been pruned")
+
+var errBadEvent = errors.New("corrupt event")
+
+var eventSeq = metaKey("events")
+
+const (
+	// events read at a time by a watcher
+	watchBatch = 1000
+	// time after which watchers read the journal without being woken up
+	watchInterval = time.Second
+	// interval between two runs of the pruning of the journal
+	eventPruneInterval = time.Minute
+)
+
+var eventTypes = []string{EventAdd, EventUpdate, EventRemove, EventRename}
+
+// Event record, with the file names as keys of a namespace
+type event struct {
+	kind byte
+	time int64
+	sha  []byte
+	name []byte
+	from []byte
+}
+
+func (e *event) encode() []byte {
+	length := make([]byte, binary.MaxVarintLen64)
+	length = length[:binary.PutUvarint(length, uint64(len(e.from)))]
+	buf := make([]byte, 0, 10+len(e.sha)+len(length)+len(e.from)+len(e.name))
+	buf = append(buf, e.kind)
+	buf = append(buf, encodeUint(uint64(e.time))...)
+	buf = append(buf, byte(len(e.sha)))
+	buf = append(buf, e.sha...)
+	buf = append(buf, length...)
+	buf = append(buf, e.from...)
+	return append(buf, e.name...)
+}
+
+func decodeEvent(buf []byte) (*event, error) {
+	if len(buf) < 10 || int(buf[0]) >= len(eventTypes) {
+		return nil, errBadEvent
+	}
+	e := &event{kind: buf[0], time: int64(decodeUint(buf[1:9]))}
+	size := int(buf[9])
+	buf = buf[10:]
+	if len(buf) < size {
+		return nil, errBadEvent
+	}
+	e.sha, buf = append([]byte{}, buf[:size]...), buf[size:]
+	length, n := binary.Uvarint(buf)
+	if n <= 0 || uint64(len(buf)-n) < length {
+		return nil, errBadEvent
+	}
+	buf = buf[n:]
+	e.from, e.name = append([]byte{}, buf[:length]...), append([]byte{}, buf[length:]...)
+	return e, nil
+}
+
+// Returns the event of a record of the journal, with the file names of the
+// namespace
+func (e *event) event(ns namespace, seq uint64) Event {
+	event := Event{
+		Sequence: seq,
+		Type:     eventTypes[e.kind],
+		Name:     ns.name(e.name),
+		SHA:      hex.EncodeToString(e.sha),
+		Time:     time.Unix(0, e.time),
+	}
+	if len(e.from) > 0 {
+		event.From = ns.name(e.from)
+	}
+	return event
+}
+
+// Write an event to the journal
+func recordEvent(txn *badger.Txn, kind string, name []byte, from []byte, sha []byte) error {
+	seq, err := getCount(txn, eventSeq)
+	if err != nil {
+		return err
+	}
+	seq++
+	if err := txn.Set(eventSeq, encodeUint(seq)); err != nil {
+		return err
+	}
+	e := &event{time: time.Now().UnixNano(), sha: sha, name: name, from: from}
+	for i, t := range eventTypes {
+		if t == kind {
+			e.kind = byte(i)
+		}
+	}
+	return txn.Set(eventKey(seq), e.encode())
+}
+
+// Returns the events with a sequence number after the given one, the first
+// ones when they are many. The events start from the current sequence
+// number with WatchNow, and reads fail with ErrEventsPruned when the journal
+// no longer has the events that follow the sequence number.
+func (db *database) readEvents(ns namespace, after uint64) ([]Event, uint64, bool, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	var events []Event
+	more := false
+	err := db.store.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = eventPrefix
+		iterator := txn.NewIterator(opts)
+		defer iterator.Close()
+		seq, err := getCount(txn, eventSeq)
+		if err != nil {
+			return err
+		}
+		if after == WatchNow {
+			after = seq
+		}
+		oldest := seq + 1
+		if iterator.Rewind(); iterator.Valid() {
+			oldest = decodeUint(iterator.Item().Key()[len(eventPrefix):])
+		}
+		if after+1 < oldest {
+			return ErrEventsPruned
+		}
+		count := 0
+		for iterator.Seek(eventKey(after + 1)); iterator.Valid(); iterator.Next() {
+			if count == watchBatch {
+				more = true
+				break
+			}
+			count++
+			item := iterator.Item()
+			after = decodeUint(item.Key()[len(eventPrefix):])
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			e, err := decodeEvent(value)
+			if err != nil {
+				return err
+			}
+			if ns.owns(e.name) {
+				events = append(events, e.event(ns, after))
+			}
+		}
+		return nil
+	})
+	return events, after, more, err
+}
+
+// Stream the changes of the files after a sequence number, WatchNow for the
+// changes to come. The channel is closed once the context is done or the
+// store is closed, or after an EventReset when the watcher falls behind the
+// events kept. Fails with ErrEventsPruned when the events following the
+// sequence number are no longer kept.
+func (db *database) Watch(ctx context.Context, after uint64) (<-chan Event, error) {
+	return db.watch(ctx, rootNamespace, after)
+}
+
+// Returns the last event kept. When none is kept, the event only has the
+// sequence number of the last event written, 0 when there was none, which
+// the events to come can be watched from.
+func (db *database) LastEvent() (Event, error) {
+	return db.lastEvent(rootNamespace)
+}
+
+func (db *database) lastEvent(ns namespace) (Event, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	var last Event
+	err := db.store.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = eventPrefix
+		opts.Reverse = true
+		iterator := txn.NewIterator(opts)
+		defer iterator.Close()
+		for iterator.Seek(eventKey(WatchNow)); iterator.Valid(); iterator.Next() {
+			item := iterator.Item()
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			e, err := decodeEvent(value)
+			if err != nil {
+				return err
+			}
+			if ns.owns(e.name) {
+				last = e.event(ns, decodeUint(item.Key()[len(eventPrefix):]))
+				return nil
+			}
+		}
+		seq, err := getCount(txn, eventSeq)
+		last.Sequence = seq
+		return err
+	})
+	return last, err
+}
+
+func (db *database) watch(ctx context.Context, ns namespace, after uint64) (<-chan Event, error) {
+	events, after, more, err := db.readEvents(ns, after)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	wake := make(chan struct{}, 1)
+	go db.subscribeEvents(ctx, wake)
+	ch := make(chan Event)
+	go func() {
+		defer cancel()
+		defer close(ch)
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		for {
+			for _, event := range events {
+				select {
+				case ch <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if !more {
+				select {
+				case <-ctx.Done():
+					return
+				case <-db.closed:
+					return
+				case <-wake:
+				case <-ticker.C:
+				}
+			}
+			if events, after, more, err = db.readEvents(ns, after); err != nil {
+				if err == ErrEventsPruned {
+					reset := Event{Sequence: after, Type: EventReset, Time: time.Now()}
+					select {
+					case ch <- reset:
+					case <-ctx.Done():
+					}
+				}
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// Wake a watcher up when events are written, until the context is done.
+// The subscription ends when the store is closed, and is taken again on the
+// store it is reopened with. Watchers also read the journal on their own
+// every second, should the store be closed while it is subscribed to.
+func (db *database) subscribeEvents(ctx context.Context, wake chan<- struct{}) {
+	notify := func(*badger.KVList) error {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	matches := []pb.Match{{Prefix: eventPrefix}}
+	for {
+		db.lock.RLock()
+		store := db.store
+		db.lock.RUnlock()
+		select {
+		case <-ctx.Done():
+			return
+		case <-db.closed:
+			return
+		default:
+		}
+		store.Subscribe(ctx, notify, matches)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchInterval):
+		}
+	}
+}
+
+// Prune the events older than the retention period, once the store is
+// opened and then every minute
+func (db *database) runEventPrune() {
+	if db.eventRetention <= 0 {
+		return
+	}
+	ticker := time.NewTicker(eventPruneInterval)
+	defer ticker.Stop()
+	for {
+		db.lock.RLock()
+		db.pruneEvents()
+		db.lock.RUnlock()
+		select {
+		case <-db.closed:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (db *database) pruneEvents() error {
+	expired := time.Now().Add(-db.eventRetention).UnixNano()
+	for {
+		var keys [][]byte
+		err := db.store.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = eventPrefix
+			iterator := txn.NewIterator(opts)
+			defer iterator.Close()
+			for iterator.Rewind(); iterator.Valid() && len(keys) < repairBatch; iterator.Next() {
+				item := iterator.Item()
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				// events are written in time order
+				if e, err := decodeEvent(value); err == nil && e.time > expired {
+					break
+				}
+				keys = append(keys, item.KeyCopy(nil))
+			}
+			return nil
+		})
+		if err != nil || len(keys) == 0 {
+			return err
+		}
+		err = db.update(func(txn *badger.Txn) error {
+			for _, key := range keys {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil || len(keys) < repairBatch {
+			return err
+		}
+	}
+}
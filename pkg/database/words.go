@@ -0,0 +1,622 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/dgraph-io/badger/v3"
+)
+
+// Words are counted once, when the data of a file is written, and kept
+// with the data as its word statistics. The total word count of each
+// namespace is updated in the same transaction as the file records, while the counts
+// of each word are updated by the indexer in the background, from a queue
+// of pending changes. Reads of the word frequency apply the pending changes
+// on the fly, so they never see a partial update.
+
+// Number of word counts updated in one transaction by the indexer
+const indexBatch = 10000
+
+// Interval between two runs of the indexer, when it is not woken up
+const indexInterval = time.Minute
+
+var pendingSeq = metaKey("pending")
+
+// Returns the key of the total word count of a namespace, given by the
+// prefix of its names
+func wordsKey(scope []byte) []byte {
+	return append(metaKey("words"), scope...)
+}
+
+var errBadWords = errors.New("corrupt word statistics")
+
+type wordCount struct {
+	word  string
+	count uint64
+}
+
+// Word statistics of the data of a file
+type wordStats struct {
+	count uint64
+	words []wordCount
+}
+
+func (s *wordStats) encode() []byte {
+	buf := make([]byte, 8, 8+len(s.words)*16)
+	binary.BigEndian.PutUint64(buf, s.count)
+	tmp := make([]byte, binary.MaxVarintLen64)
+	for _, w := range s.words {
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, uint64(len(w.word)))]...)
+		buf = append(buf, w.word...)
+		buf = append(buf, tmp[:binary.PutUvarint(tmp, w.count)]...)
+	}
+	return buf
+}
+
+func decodeWordStats(buf []byte) (*wordStats, error) {
+	if len(buf) < 8 {
+		return nil, errBadWords
+	}
+	s := &wordStats{count: binary.BigEndian.Uint64(buf)}
+	for buf = buf[8:]; len(buf) > 0; {
+		size, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf)-n) < size {
+			return nil, errBadWords
+		}
+		word := string(buf[n : n+int(size)])
+		buf = buf[n+int(size):]
+		count, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return nil, errBadWords
+		}
+		buf = buf[n:]
+		s.words = append(s.words, wordCount{word, count})
+	}
+	return s, nil
+}
+
+// Returns the word statistics of the data identified by SHA
+func getWordStats(txn *badger.Txn, sha []byte) (*wordStats, error) {
+	item, err := txn.Get(statsKey(sha))
+	if err != nil {
+		return nil, err
+	}
+	var s *wordStats
+	err = item.Value(func(value []byte) error {
+		s, err = decodeWordStats(value)
+		return err
+	})
+	return s, err
+}
+
+// Returns the number of words in the data identified by SHA
+func getWordCount(txn *badger.Txn, sha []byte) (int64, error) {
+	item, err := txn.Get(statsKey(sha))
+	if err != nil {
+		return 0, err
+	}
+	var count uint64
+	err = item.Value(func(value []byte) error {
+		if len(value) < 8 {
+			return errBadWords
+		}
+		count = binary.BigEndian.Uint64(value)
+		return nil
+	})
+	return int64(count), err
+}
+
+// Counts the words of a stream written to it. Words are separated by white
+// space, and counted in lower case, as bufio.ScanWords splits them. Like a
+// bufio.Scanner, counting stops at a word too long for its buffer.
+type wordCounter struct {
+	count   uint64
+	words   map[string]uint64
+	word    []byte
+	partial []byte
+	offset  uint64
+	start   uint64
+	stopped bool
+
+	// Called with the position and offset of every word, instead of
+	// counting it
+	emit func(word string, position uint64, offset uint64)
+}
+
+func newWordCounter() *wordCounter {
+	return &wordCounter{words: map[string]uint64{}}
+}
+
+func (c *wordCounter) Write(data []byte) (int, error) {
+	size := len(data)
+	offset := c.offset - uint64(len(c.partial))
+	c.offset += uint64(size)
+	if c.stopped {
+		return size, nil
+	}
+	if len(c.partial) > 0 {
+		data = append(c.partial, data...)
+		c.partial = nil
+	}
+	for len(data) > 0 {
+		if !utf8.FullRune(data) {
+			// the rest of the rune comes with the next write
+			c.partial = append([]byte{}, data...)
+			break
+		}
+		r, n := utf8.DecodeRune(data)
+		if unicode.IsSpace(r) {
+			c.end()
+		} else {
+			if len(c.word) == 0 {
+				c.start = offset
+			}
+			c.word = append(c.word, data[:n]...)
+			if len(c.word) >= bufio.MaxScanTokenSize {
+				c.word = c.word[:0]
+				c.partial = nil
+				c.stopped = true
+				break
+			}
+		}
+		data = data[n:]
+		offset += uint64(n)
+	}
+	return size, nil
+}
+
+// End the current word
+func (c *wordCounter) end() {
+	if len(c.word) == 0 {
+		return
+	}
+	c.count++
+	if c.emit != nil {
+		c.emit(strings.ToLower(string(c.word)), c.count-1, c.start)
+	} else {
+		c.words[strings.ToLower(string(c.word))]++
+	}
+	c.word = c.word[:0]
+}
+
+// Returns the statistics of the words written so far
+func (c *wordCounter) stats() *wordStats {
+	if len(c.partial) > 0 {
+		if len(c.word) == 0 {
+			c.start = c.offset - uint64(len(c.partial))
+		}
+		c.word = append(c.word, c.partial...)
+		c.partial = nil
+	}
+	c.end()
+	s := &wordStats{count: c.count, words: make([]wordCount, 0, len(c.words))}
+	for word, count := range c.words {
+		s.words = append(s.words, wordCount{word, count})
+	}
+	sort.Slice(s.words, func(i, j int) bool {
+		return s.words[i].word < s.words[j].word
+	})
+	return s
+}
+
+// Kinds of pending changes. The kinds of file names added and removed are
+// the signs of their change of the word counts.
+const (
+	addWords    byte = 0x01
+	removeWords byte = 0xFF
+	dropIndex   byte = 0x02
+	buildIndex  byte = 0x03
+)
+
+// Change waiting for the indexer: the words of a SHA added to or removed
+// from the counts of a namespace, from the given word on, or the data of a
+// SHA added to or removed from the search index
+type pendingChange struct {
+	kind  byte
+	sha   []byte
+	next  uint64
+	scope []byte
+}
+
+// Returns the change of the word counts, +1, -1 or 0
+func (p *pendingChange) sign() int64 {
+	switch p.kind {
+	case addWords:
+		return 1
+	case removeWords:
+		return -1
+	}
+	return 0
+}
+
+func (p *pendingChange) encode() []byte {
+	buf := make([]byte, 0, 1+32+8+len(p.scope))
+	buf = append(buf, p.kind)
+	buf = append(buf, p.sha...)
+	buf = append(buf, encodeUint(p.next)...)
+	return append(buf, p.scope...)
+}
+
+func decodePendingChange(buf []byte) (*pendingChange, error) {
+	if len(buf) < 1+32+8 {
+		return nil, errBadWords
+	}
+	p := &pendingChange{
+		kind: buf[0],
+		sha:  append([]byte{}, buf[1:33]...),
+		next: decodeUint(buf[33:41]),
+	}
+	if len(buf) > 41 {
+		p.scope = append([]byte{}, buf[41:]...)
+	}
+	return p, nil
+}
+
+// Account the words of a file in the word counts of its namespace, with a
+// sign of +1 when the file is added and -1 when it is removed
+func countWords(txn *badger.Txn, name []byte, sha []byte, sign int8) error {
+	count, err := getWordCount(txn, sha)
+	if err != nil {
+		return err
+	}
+	scope := scopeOf(name)
+	total, err := getCount(txn, wordsKey(scope))
+	if err != nil {
+		return err
+	}
+	kind := addWords
+	if sign > 0 {
+		total += uint64(count)
+	} else if total > uint64(count) {
+		kind = removeWords
+		total -= uint64(count)
+	} else {
+		kind = removeWords
+		total = 0
+	}
+	if err := setCount(txn, wordsKey(scope), total); err != nil {
+		return err
+	}
+	return queuePending(txn, &pendingChange{kind: kind, sha: sha, scope: scope})
+}
+
+// Queue a change of the search index for the indexer
+func queueChange(txn *badger.Txn, kind byte, sha []byte) error {
+	return queuePending(txn, &pendingChange{kind: kind, sha: sha})
+}
+
+// Queue a change for the indexer. The change holds a reference on the word
+// statistics of the SHA, so they are kept until it is applied, even when the
+// data is removed.
+func queuePending(txn *badger.Txn, p *pendingChange) error {
+	seq, err := getCount(txn, pendingSeq)
+	if err != nil {
+		return err
+	}
+	seq++
+	if err := txn.Set(pendingSeq, encodeUint(seq)); err != nil {
+		return err
+	}
+	if err := txn.Set(pendingKey(seq), p.encode()); err != nil {
+		return err
+	}
+	return retainStats(txn, p.sha)
+}
+
+// Take a reference on the word statistics of a SHA for a pending change
+func retainStats(txn *badger.Txn, sha []byte) error {
+	refs, err := getCount(txn, statsRefKey(sha))
+	if err != nil {
+		return err
+	}
+	return setCount(txn, statsRefKey(sha), refs+1)
+}
+
+// Release a reference on the word statistics of a SHA, removing them with
+// the last one when the data is gone
+func releaseStats(txn *badger.Txn, sha []byte) error {
+	refs, err := getCount(txn, statsRefKey(sha))
+	if err != nil {
+		return err
+	}
+	if refs > 1 {
+		return setCount(txn, statsRefKey(sha), refs-1)
+	}
+	if err := setCount(txn, statsRefKey(sha), 0); err != nil {
+		return err
+	}
+	if _, err := txn.Get(shaKey(sha)); err != badger.ErrKeyNotFound {
+		return err
+	}
+	return txn.Delete(statsKey(sha))
+}
+
+// Wake up the indexer, without waiting when it is busy
+func (db *database) wakeIndexer() {
+	select {
+	case db.indexer <- struct{}{}:
+	default:
+	}
+}
+
+// Iterate over the pending changes, oldest first
+func eachPending(txn *badger.Txn, fn func(seq uint64, p *pendingChange) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = pendingPrefix
+	iterator := txn.NewIterator(opts)
+	defer iterator.Close()
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		item := iterator.Item()
+		seq := decodeUint(item.Key()[len(pendingPrefix):])
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		p, err := decodePendingChange(value)
+		if err != nil {
+			return err
+		}
+		if err := fn(seq, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply the pending changes to the word counts and the search index
+func (db *database) runIndexer() {
+	ticker := time.NewTicker(indexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closed:
+			return
+		case <-db.indexer:
+		case <-ticker.C:
+		}
+		db.lock.RLock()
+		db.applyPending()
+		db.lock.RUnlock()
+	}
+}
+
+func (db *database) applyPending() error {
+	for {
+		var seq uint64
+		var p *pendingChange
+		var stats *wordStats
+		err := db.store.View(func(txn *badger.Txn) error {
+			err := eachPending(txn, func(s uint64, pending *pendingChange) error {
+				seq, p = s, pending
+				return errStop
+			})
+			if err != errStop || p == nil {
+				return err
+			}
+			stats, err = getWordStats(txn, p.sha)
+			if err == badger.ErrKeyNotFound && p.sign() == 0 {
+				// data removed before it had word statistics
+				stats, err = &wordStats{}, nil
+			}
+			return err
+		})
+		if err != nil || p == nil {
+			return err
+		}
+		for p.sign() != 0 && p.next < uint64(len(stats.words)) {
+			err := db.update(func(txn *badger.Txn) error {
+				var err error
+				p, err = applyWords(txn, seq, p, stats)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		switch p.kind {
+		case addWords, buildIndex:
+			err = db.buildIndex(p.sha)
+		case dropIndex:
+			err = db.dropIndex(p.sha)
+		}
+		if err != nil {
+			return err
+		}
+		err = db.update(func(txn *badger.Txn) error {
+			if err := txn.Delete(pendingKey(seq)); err != nil {
+				return err
+			}
+			return releaseStats(txn, p.sha)
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Stops an iteration early
+var errStop = errors.New("stop")
+
+// Apply a batch of the words of a pending change to the word counts.
+// Returns the change left to apply.
+func applyWords(txn *badger.Txn, seq uint64, p *pendingChange, stats *wordStats) (*pendingChange, error) {
+	// the transaction may be retried, so p is left untouched
+	next := p.next
+	for ; next < uint64(len(stats.words)) && next < p.next+indexBatch; next++ {
+		w := stats.words[next]
+		key := wordKey(p.scope, []byte(w.word))
+		count, err := getCount(txn, key)
+		if err != nil {
+			return nil, err
+		}
+		if p.sign() > 0 {
+			count += w.count
+		} else if count > w.count {
+			count -= w.count
+		} else {
+			count = 0
+		}
+		if err := setCount(txn, key, count); err != nil {
+			return nil, err
+		}
+	}
+	left := &pendingChange{kind: p.kind, sha: p.sha, next: next, scope: p.scope}
+	return left, txn.Set(pendingKey(seq), left.encode())
+}
+
+// Returns total word count in all the files in Store
+func (db *database) WordCount() (int64, error) {
+	return db.wordCount(rootNamespace)
+}
+
+func (db *database) wordCount(ns namespace) (int64, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	var count uint64
+	err := db.store.View(func(txn *badger.Txn) error {
+		var err error
+		count, err = getCount(txn, wordsKey(ns.prefix))
+		return err
+	})
+	return int64(count), err
+}
+
+// Returns frequency of words in all the files in Store
+func (db *database) WordFrequency() (map[string]int64, error) {
+	return db.wordFrequency(rootNamespace)
+}
+
+func (db *database) wordFrequency(ns namespace) (map[string]int64, error) {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+	frequency := map[string]int64{}
+	err := db.store.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = wordsPrefix(ns.prefix)
+		iterator := txn.NewIterator(opts)
+		defer iterator.Close()
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			item := iterator.Item()
+			word := string(item.Key()[len(opts.Prefix):])
+			err := item.Value(func(value []byte) error {
+				frequency[word] = int64(decodeUint(value))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		// changes not applied by the indexer yet
+		return eachPending(txn, func(seq uint64, p *pendingChange) error {
+			if p.sign() == 0 || !bytes.Equal(p.scope, ns.prefix) {
+				return nil
+			}
+			stats, err := getWordStats(txn, p.sha)
+			if err != nil {
+				return err
+			}
+			for _, w := range stats.words[p.next:] {
+				frequency[w.word] += p.sign() * int64(w.count)
+			}
+			return nil
+		})
+	})
+	for word, count := range frequency {
+		if count <= 0 {
+			delete(frequency, word)
+		}
+	}
+	return frequency, err
+}
+
+// Count the words of all the data in the store and rebuild the word counts
+// from the file records. The counts are reset first, so an interrupted
+// upgrade is simply repeated.
+func (db *database) indexWords() error {
+	var shas [][]byte
+	err := db.store.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = shaPrefix
+		iterator := txn.NewIterator(opts)
+		defer iterator.Close()
+		for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+			shas = append(shas, iterator.Item().KeyCopy(nil)[len(shaPrefix):])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, sha := range shas {
+		if err := db.countData(sha); err != nil {
+			return err
+		}
+	}
+
+	err = db.store.DropPrefix(wordPrefix)
+	if err != nil {
+		return err
+	}
+	err = db.update(func(txn *badger.Txn) error {
+		if err := txn.Delete(wordsKey(nil)); err != nil {
+			return err
+		}
+		return eachPending(txn, func(seq uint64, p *pendingChange) error {
+			if p.sign() == 0 {
+				return nil
+			}
+			if err := txn.Delete(pendingKey(seq)); err != nil {
+				return err
+			}
+			return releaseStats(txn, p.sha)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	return db.eachFile(func(txn *badger.Txn, name []byte) error {
+		sha, err := getSHA(txn, name)
+		if err != nil {
+			return err
+		}
+		return countWords(txn, name, sha, 1)
+	})
+}
+
+// Store the word statistics of data that has none
+func (db *database) countData(sha []byte) error {
+	txn := db.store.NewTransaction(false)
+	defer txn.Discard()
+	if _, err := txn.Get(statsKey(sha)); err != badger.ErrKeyNotFound {
+		return err
+	}
+	m, err := getManifest(txn, sha)
+	if err != nil {
+		return err
+	}
+	counter := newWordCounter()
+	for _, chunk := range m.chunks {
+		err := db.readChunk(txn, chunk.sha, func(value []byte) error {
+			_, err := counter.Write(value)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	value := counter.stats().encode()
+	return db.update(func(txn *badger.Txn) error {
+		if _, err := txn.Get(shaKey(sha)); err != nil {
+			return err
+		}
+		return txn.Set(statsKey(sha), value)
+	})
+}
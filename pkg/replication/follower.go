@@ -0,0 +1,393 @@
+package replication
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/sayan-biswas/file-store/pkg/database"
+)
+
+// A follower copies the files of the root of the store of a leader server.
+// It first compares its files with the ones listed by the leader, then
+// follows the watch feed of the leader from the sequence number of the
+// last event the leader had before the listing. Events are applied in
+// order, and applying an event twice leaves the files the same, so events
+// that happened while the files were listed are applied on top of them.
+// The data of a file is only fetched by SHA when the store of the follower
+// does not have it. When the leader has pruned the events the follower did
+// not apply, the files are compared again.
+
+// Replication state of a follower
+type Status struct {
+	Leader    string
+	Connected bool
+	// sequence number of the last event of the leader applied
+	Sequence uint64
+	// sequence number of the last event of the leader
+	LeaderSequence uint64
+	// time between the last event of the leader and the last event applied,
+	// 0 once every event is applied
+	Lag time.Duration
+	// last error met, cleared once the follower is connected again
+	Error string `json:",omitempty"`
+}
+
+var errPruned = errors.New("leader pruned the events to apply")
+
+const (
+	// time to wait before connecting to the leader again
+	retryInterval = 2 * time.Second
+	// interval between two reads of the last event of the leader
+	pollInterval = time.Second
+	// time without anything read from the watch feed after which the leader
+	// is taken as gone, longer than the interval of its keep-alives
+	idleTimeout = 45 * time.Second
+	// files listed at a time
+	listPage = 1000
+)
+
+type Follower struct {
+	leader *url.URL
+	token  string
+	store  database.Store
+	client *http.Client
+	cancel context.CancelFunc
+	done   sync.WaitGroup
+
+	lock   sync.Mutex
+	status Status
+	// leader time of the last event applied and of the last leader event
+	applied time.Time
+	last    time.Time
+}
+
+// Start following a leader, given by the URL of its server and its admin
+// token, which its data is fetched with
+func NewFollower(leader string, token string, store database.Store) (*Follower, error) {
+	leaderURL, err := url.Parse(leader)
+	if err != nil {
+		return nil, err
+	}
+	if leaderURL.Scheme != "http" && leaderURL.Scheme != "https" {
+		return nil, fmt.Errorf("invalid leader URL %q", leader)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Follower{
+		leader: leaderURL,
+		token:  token,
+		store:  store,
+		client: &http.Client{
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: time.Second * 10}).DialContext,
+				TLSHandshakeTimeout:   time.Second * 10,
+				ResponseHeaderTimeout: time.Second * 10,
+			},
+		},
+		cancel: cancel,
+		status: Status{Leader: leader},
+	}
+	f.done.Add(2)
+	go f.run(ctx)
+	go f.poll(ctx)
+	return f, nil
+}
+
+// Stop following the leader
+func (f *Follower) Close() error {
+	f.cancel()
+	f.done.Wait()
+	return nil
+}
+
+func (f *Follower) Status() Status {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	status := f.status
+	if status.Sequence < status.LeaderSequence && f.last.After(f.applied) {
+		status.Lag = f.last.Sub(f.applied)
+	}
+	return status
+}
+
+// Compare the files with the leader, then apply the events of the leader
+// until the follower is closed
+func (f *Follower) run(ctx context.Context) {
+	defer f.done.Done()
+	synced := false
+	for {
+		var err error
+		if !synced {
+			err = f.sync(ctx)
+			synced = err == nil
+		}
+		if synced {
+			err = f.follow(ctx)
+			if err == errPruned {
+				synced = false
+			}
+		}
+		f.setError(err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// Read the last event of the leader, to know how far behind the follower is
+func (f *Follower) poll(ctx context.Context) {
+	defer f.done.Done()
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		if last, err := f.lastEvent(ctx); err == nil {
+			f.lock.Lock()
+			f.status.LeaderSequence, f.last = last.Sequence, last.Time
+			f.lock.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (f *Follower) setError(err error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.status.Connected = false
+	if err != nil && err != context.Canceled {
+		f.status.Error = err.Error()
+	}
+}
+
+// Record an event as applied
+func (f *Follower) setApplied(event *database.Event) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.status.Sequence, f.applied = event.Sequence, event.Time
+	if event.Sequence > f.status.LeaderSequence {
+		f.status.LeaderSequence, f.last = event.Sequence, event.Time
+	}
+}
+
+// Make the files the same as the files of the leader, and take the last
+// event of the leader before its files were listed as applied
+func (f *Follower) sync(ctx context.Context) error {
+	last, err := f.lastEvent(ctx)
+	if err != nil {
+		return err
+	}
+	files, err := f.leaderFiles(ctx)
+	if err != nil {
+		return err
+	}
+	local, err := f.store.List(database.ListOptions{Recursive: true, Details: true})
+	if err != nil {
+		return err
+	}
+	current := map[string]string{}
+	for _, file := range local.Files {
+		current[file.Name] = file.SHA
+		if _, ok := files[file.Name]; !ok {
+			if err := f.remove(file.Name); err != nil {
+				return err
+			}
+		}
+	}
+	for name, sha := range files {
+		if current[name] == sha {
+			continue
+		}
+		if err := f.put(ctx, name, sha); err != nil {
+			return err
+		}
+	}
+	f.setApplied(&last)
+	return nil
+}
+
+// Apply the events of the leader after the last one applied, until the
+// watch feed ends
+func (f *Follower) follow(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	f.lock.Lock()
+	after := f.status.Sequence
+	f.lock.Unlock()
+	res, err := f.get(ctx, "/store/watch", url.Values{"after": {strconv.FormatUint(after, 10)}})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusGone:
+		return errPruned
+	default:
+		return fmt.Errorf("leader answered %s to the watch", res.Status)
+	}
+	f.lock.Lock()
+	f.status.Connected, f.status.Error = true, ""
+	f.lock.Unlock()
+
+	idle := time.AfterFunc(idleTimeout, cancel)
+	defer idle.Stop()
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		idle.Reset(idleTimeout)
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var event database.Event
+		if err := json.Unmarshal([]byte(line[len("data: "):]), &event); err != nil {
+			return err
+		}
+		if event.Type == database.EventReset {
+			return errPruned
+		}
+		if err := f.apply(ctx, &event); err != nil {
+			return err
+		}
+		f.setApplied(&event)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.ErrUnexpectedEOF
+}
+
+// Apply an event of the leader to the store
+func (f *Follower) apply(ctx context.Context, event *database.Event) error {
+	switch event.Type {
+	case database.EventAdd, database.EventUpdate:
+		return f.put(ctx, event.Name, event.SHA)
+	case database.EventRemove:
+		return f.remove(event.Name)
+	case database.EventRename:
+		if mover, ok := f.store.(database.Mover); ok {
+			err := mover.Rename(event.From, event.Name)
+			if err != badger.ErrKeyNotFound && err != badger.ErrConflict {
+				return err
+			}
+		}
+		// the file was renamed or written since the files were listed
+		if err := f.put(ctx, event.Name, event.SHA); err != nil {
+			return err
+		}
+		return f.remove(event.From)
+	}
+	return nil
+}
+
+// Write a file with the data of a SHA, fetching the data from the leader
+// when the store does not have it
+func (f *Follower) put(ctx context.Context, name string, sha string) error {
+	SHA, err := hex.DecodeString(sha)
+	if err != nil {
+		return err
+	}
+	err = f.store.UpdateStream(name, SHA, bytes.NewReader(nil))
+	if err != database.ErrMissingData {
+		return err
+	}
+	res, err := f.get(ctx, "/store/blob", url.Values{"sha": {sha}})
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return f.store.UpdateStream(name, SHA, res.Body)
+	case http.StatusNotFound:
+		// the data is gone from the leader, the event removing the file follows
+		return nil
+	}
+	return fmt.Errorf("leader answered %s to the data of %s", res.Status, sha)
+}
+
+func (f *Follower) remove(name string) error {
+	if err := f.store.Remove(name); err != nil && err != badger.ErrKeyNotFound {
+		return err
+	}
+	return nil
+}
+
+// Returns the names and SHAs of the files of the leader
+func (f *Follower) leaderFiles(ctx context.Context) (map[string]string, error) {
+	files := map[string]string{}
+	next := ""
+	for {
+		query := url.Values{
+			"recursive": {"true"},
+			"details":   {"true"},
+			"limit":     {strconv.Itoa(listPage)},
+		}
+		if next != "" {
+			query.Set("after", next)
+		}
+		var page []database.File
+		res, err := f.getJSON(ctx, "/store/list", query, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range page {
+			files[file.Name] = file.SHA
+		}
+		if next = res.Header.Get("X-Store-Next"); next == "" {
+			return files, nil
+		}
+	}
+}
+
+// Returns the last event of the leader
+func (f *Follower) lastEvent(ctx context.Context) (database.Event, error) {
+	var event database.Event
+	_, err := f.getJSON(ctx, "/store/watch/last", nil, &event)
+	return event, err
+}
+
+func (f *Follower) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	leaderURL := *f.leader
+	leaderURL.Path = strings.TrimSuffix(leaderURL.Path, "/") + path
+	leaderURL.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, leaderURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if f.token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.token)
+	}
+	return f.client.Do(req)
+}
+
+func (f *Follower) getJSON(ctx context.Context, path string, query url.Values, value interface{}) (*http.Response, error) {
+	res, err := f.get(ctx, path, query)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("leader answered %s to %s", res.Status, path)
+	}
+	return res, json.NewDecoder(res.Body).Decode(value)
+}
@@ -10,6 +10,7 @@ func init() {
 	viper.SetDefault("server.tls", false)
 	viper.SetDefault("server.certificate", "certificate.crt")
 	viper.SetDefault("server.privateKey", "private.key")
+	viper.SetDefault("server.adminToken", "")
 
 	viper.SetDefault("cors.allowOrigins", []string{"*"})
 	viper.SetDefault("cors.allowMethods", []string{"*"})
@@ -18,8 +19,37 @@ func init() {
 	viper.SetDefault("cors.allowCredentials", true)
 	viper.SetDefault("cors.maxAge", 86400)
 
+	viper.SetDefault("database.backend", "badger")
 	viper.SetDefault("database.diskless", false)
+	viper.SetDefault("database.snapshot", "")
 	viper.SetDefault("database.encryption", false)
+	viper.SetDefault("database.keyFile", "")
+	viper.SetDefault("database.key", "")
 	viper.SetDefault("database.cacheSize", 100)
+	viper.SetDefault("database.blobCache", 0)
 	viper.SetDefault("database.path", "database")
+	viper.SetDefault("database.versions.max", 10)
+	viper.SetDefault("database.versions.maxAge", 0)
+	viper.SetDefault("database.trash.retention", "168h")
+	viper.SetDefault("database.events.retention", "24h")
+	viper.SetDefault("database.scrub.interval", "168h")
+	viper.SetDefault("database.scrub.rate", 16)
+	viper.SetDefault("database.quota.physical", 0)
+	viper.SetDefault("database.quota.logical", 0)
+	viper.SetDefault("database.quota.files", 0)
+	viper.SetDefault("database.quota.fileSize", 0)
+	viper.SetDefault("database.s3.endpoint", "")
+	viper.SetDefault("database.s3.bucket", "")
+	viper.SetDefault("database.s3.region", "us-east-1")
+	viper.SetDefault("database.s3.prefix", "")
+	viper.SetDefault("database.s3.accessKey", "")
+	viper.SetDefault("database.s3.secretKey", "")
+	viper.SetDefault("database.s3.pathStyle", false)
+	viper.SetDefault("database.s3.secure", true)
+	viper.SetDefault("replication.leader", "")
+	viper.SetDefault("replication.token", "")
+	viper.SetDefault("cluster.node", "")
+	viper.SetDefault("cluster.path", "cluster")
+	viper.SetDefault("cluster.replicas", 2)
+	viper.SetDefault("cluster.peers", []interface{}{})
 }
@@ -12,6 +12,7 @@ func init() {
 	pflag.Int("port", 8080, "Server Port")
 	pflag.String("host", "", "Server Hostname")
 	pflag.Bool("tls", false, "Enable TLS")
+	pflag.Bool("repair", false, "Repair the store found inconsistent by fsck")
 	pflag.Parse()
 
 	viper.BindPFlag("server.log", pflag.Lookup("log"))
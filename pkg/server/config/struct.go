@@ -1,9 +1,13 @@
 package config
 
+import "time"
+
 type Config struct {
-	Server   server
-	CORS     cors
-	Database database
+	Server      server
+	CORS        cors
+	Database    database
+	Replication replication
+	Cluster     cluster
 }
 
 type server struct {
@@ -14,6 +18,7 @@ type server struct {
 	Log         string
 	Certificate string
 	PrivateKey  string
+	AdminToken  string
 }
 
 type cors struct {
@@ -25,9 +30,74 @@ type cors struct {
 	MaxAge           int
 }
 
+type replication struct {
+	Leader string
+	Token  string
+}
+
+type cluster struct {
+	Node     string
+	Path     string
+	Replicas int
+	Peers    []peer
+}
+
+type peer struct {
+	ID      string
+	Address string
+	URL     string
+}
+
 type database struct {
+	Backend    string
 	Diskless   bool
+	Snapshot   string
 	Encryption bool
+	KeyFile    string
+	Key        string
 	CacheSize  int
+	BlobCache  int
 	Path       string
+	Versions   versions
+	Trash      trash
+	Events     events
+	Scrub      scrub
+	Quota      quota
+	S3         s3
+}
+
+type s3 struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	PathStyle bool
+	Secure    bool
+}
+
+type trash struct {
+	Retention time.Duration
+}
+
+type events struct {
+	Retention time.Duration
+}
+
+type quota struct {
+	Physical int
+	Logical  int
+	Files    int
+	FileSize int
+}
+
+type scrub struct {
+	Interval time.Duration
+	Rate     int
+}
+
+type versions struct {
+	Max    int
+	MaxAge time.Duration
 }
@@ -0,0 +1,173 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sayan-biswas/file-store/pkg/database"
+	"go.uber.org/zap"
+)
+
+type Key struct {
+	Key string
+}
+
+func RotateKey(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		rotator, ok := store.(database.KeyRotator)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		request := Key{}
+		if err := ctx.BindJSON(&request); err != nil {
+			return
+		}
+		key, err := database.ParseKey(request.Key)
+		if err != nil {
+			ctx.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		switch err := rotator.RotateKey(key); err {
+		case nil:
+			ctx.Status(http.StatusNoContent)
+		case database.ErrNotRotable, database.ErrKeyNotStored:
+			ctx.String(http.StatusConflict, err.Error())
+		default:
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+	return gin.HandlerFunc(fn)
+}
+
+func CacheStats(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		reporter, ok := store.(database.CacheReporter)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		ctx.JSON(http.StatusOK, reporter.CacheStats())
+	}
+	return gin.HandlerFunc(fn)
+}
+
+// Trailer of a backup with the version to back up from next time, sent
+// after the backup so that it is only received with a complete backup
+const versionTrailer = "X-Store-Version"
+
+func Backup(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		backuper, ok := store.(database.Backuper)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		var since uint64
+		if ctx.Query("since") != "" {
+			var err error
+			if since, err = strconv.ParseUint(ctx.Query("since"), 10, 64); err != nil {
+				ctx.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+		}
+		ctx.Header("Content-Type", "application/octet-stream")
+		ctx.Header("Trailer", versionTrailer)
+		ctx.Status(http.StatusOK)
+		version, err := backuper.Backup(ctx.Writer, since)
+		if err != nil {
+			log.Error(err.Error())
+			return
+		}
+		ctx.Writer.Header().Set(versionTrailer, strconv.FormatUint(version, 10))
+	}
+	return gin.HandlerFunc(fn)
+}
+
+func RestoreBackup(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		backuper, ok := store.(database.Backuper)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		incremental, _ := strconv.ParseBool(ctx.Query("incremental"))
+		switch err := backuper.RestoreBackup(ctx.Request.Body, incremental); err {
+		case nil:
+			ctx.Status(http.StatusNoContent)
+		case database.ErrRestoreUnsupported:
+			ctx.String(http.StatusNotImplemented, err.Error())
+		default:
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+	return gin.HandlerFunc(fn)
+}
+
+func Scrub(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		scrubber, ok := store.(database.Scrubber)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		report, err := scrubber.Scrub()
+		if err != nil {
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if len(report.Corrupt) > 0 {
+			log.Warn("corrupt chunks quarantined", zap.Strings("chunks", report.Corrupt), zap.Strings("damaged", report.Damaged))
+		}
+		ctx.JSON(http.StatusOK, report)
+	}
+	return gin.HandlerFunc(fn)
+}
+
+func LastScrub(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		scrubber, ok := store.(database.Scrubber)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		report, err := scrubber.LastScrub()
+		if err != nil {
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if report == nil {
+			ctx.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+		ctx.JSON(http.StatusOK, report)
+	}
+	return gin.HandlerFunc(fn)
+}
+
+func Check(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		checker, ok := store.(database.Checker)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		repair, _ := strconv.ParseBool(ctx.Query("repair"))
+		report, err := checker.Check(repair)
+		if err != nil {
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if !report.Consistent() {
+			log.Warn("store is inconsistent", zap.Bool("repaired", report.Repaired))
+		}
+		ctx.JSON(http.StatusOK, report)
+	}
+	return gin.HandlerFunc(fn)
+}
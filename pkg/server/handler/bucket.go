@@ -0,0 +1,100 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gin-gonic/gin"
+	"github.com/sayan-biswas/file-store/pkg/database"
+)
+
+// Run a handler of the files of a store on the bucket named in the path
+func InBucket(store database.Store, handler func(store database.Store) gin.HandlerFunc) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		bucketer, ok := store.(database.Bucketer)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		bucket, err := bucketer.Bucket(ctx.Param("bucket"))
+		switch err {
+		case nil:
+			handler(bucket)(ctx)
+		case database.ErrNoBucket:
+			ctx.String(http.StatusNotFound, err.Error())
+		case database.ErrBucketsUnsupported:
+			ctx.String(http.StatusNotImplemented, err.Error())
+		default:
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+	return gin.HandlerFunc(fn)
+}
+
+func ListBuckets(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		bucketer, ok := store.(database.Bucketer)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		buckets, err := bucketer.Buckets()
+		switch err {
+		case nil:
+			ctx.JSON(http.StatusOK, buckets)
+		case database.ErrBucketsUnsupported:
+			ctx.String(http.StatusNotImplemented, err.Error())
+		default:
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+	return gin.HandlerFunc(fn)
+}
+
+func CreateBucket(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		bucketer, ok := store.(database.Bucketer)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		switch err := bucketer.CreateBucket(ctx.Param("bucket")); err {
+		case nil:
+			ctx.Status(http.StatusCreated)
+		case badger.ErrConflict:
+			ctx.AbortWithStatus(http.StatusConflict)
+		case database.ErrInvalidBucket:
+			ctx.String(http.StatusBadRequest, err.Error())
+		case database.ErrBucketsUnsupported:
+			ctx.String(http.StatusNotImplemented, err.Error())
+		default:
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+	return gin.HandlerFunc(fn)
+}
+
+func DeleteBucket(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		bucketer, ok := store.(database.Bucketer)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		switch err := bucketer.DeleteBucket(ctx.Param("bucket")); err {
+		case nil:
+			ctx.Status(http.StatusNoContent)
+		case database.ErrNoBucket:
+			ctx.AbortWithStatus(http.StatusNotFound)
+		case database.ErrBucketsUnsupported:
+			ctx.String(http.StatusNotImplemented, err.Error())
+		default:
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+	return gin.HandlerFunc(fn)
+}
@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"encoding/hex"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sayan-biswas/file-store/pkg/cluster"
+	"github.com/sayan-biswas/file-store/pkg/database"
+)
+
+// Get the Raft state of a cluster node
+func ClusterStatus(node *cluster.Node) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, node.Status())
+	}
+	return gin.HandlerFunc(fn)
+}
+
+// Stage the data of a write sent by the leader, by the SHA of the sha query
+func StageBlob(node *cluster.Node) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		SHA, err := hex.DecodeString(ctx.Query("sha"))
+		if err != nil || len(SHA) == 0 {
+			ctx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		switch err := node.Stage(SHA, ctx.Request.Body); err {
+		case nil:
+			ctx.Status(http.StatusCreated)
+		case database.ErrSHAMismatch:
+			ctx.AbortWithStatus(http.StatusBadRequest)
+		default:
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+	return gin.HandlerFunc(fn)
+}
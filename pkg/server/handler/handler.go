@@ -3,11 +3,15 @@ package handler
 import (
 	_ "embed"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
+	"path"
 	"sort"
 	"strconv"
+	"time"
 
 	"github.com/dgraph-io/badger/v3"
 	"github.com/gin-gonic/gin"
@@ -35,44 +39,97 @@ func Root(ctx *gin.Context) {
 func GetFile(store database.Store) gin.HandlerFunc {
 	fn := func(ctx *gin.Context) {
 		file := ctx.Query("file")
-		data, err := store.Get(file)
-		if err != nil {
-			ctx.AbortWithError(http.StatusNotFound, err)
-			return
-		}
 		ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s", file))
-		ctx.Data(http.StatusOK, "application/octet-stream", data)
+		ctx.Header("Content-Type", "application/octet-stream")
+		if err := store.GetStream(file, ctx.Writer); err != nil {
+			if !ctx.Writer.Written() {
+				ctx.Header("Content-Disposition", "")
+				if err == database.ErrCorruptData {
+					log.Error(err.Error())
+					ctx.AbortWithError(http.StatusInternalServerError, err)
+					return
+				}
+				ctx.AbortWithError(http.StatusNotFound, err)
+				return
+			}
+			log.Error(err.Error())
+		}
 	}
 	return gin.HandlerFunc(fn)
 }
 
-func AddFile(store database.Store) gin.HandlerFunc {
+// Stream the data of the SHA of the sha query
+func GetBlob(store database.Store) gin.HandlerFunc {
 	fn := func(ctx *gin.Context) {
-		SHA := []byte(ctx.Request.FormValue("SHA"))
-		fileHeader, err := ctx.FormFile("file")
-		if err != nil {
-			log.Error(err.Error())
-			ctx.AbortWithStatus(http.StatusInternalServerError)
+		reader, ok := store.(database.BlobReader)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
 			return
 		}
-		file, err := fileHeader.Open()
+		SHA, err := hex.DecodeString(ctx.Query("sha"))
+		if err != nil || len(SHA) == 0 {
+			ctx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		ctx.Header("Content-Type", "application/octet-stream")
+		if err := reader.GetBlob(SHA, ctx.Writer); err != nil {
+			if !ctx.Writer.Written() {
+				if err == badger.ErrKeyNotFound {
+					ctx.AbortWithStatus(http.StatusNotFound)
+					return
+				}
+				log.Error(err.Error())
+				ctx.AbortWithStatus(http.StatusInternalServerError)
+				return
+			}
+			log.Error(err.Error())
+		}
+	}
+	return gin.HandlerFunc(fn)
+}
+
+func AddFile(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		fields, file, err := readUpload(ctx)
 		if err != nil {
 			log.Error(err.Error())
-			ctx.AbortWithStatus(http.StatusInternalServerError)
+			ctx.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
 		defer file.Close()
-		data, err := io.ReadAll(file)
+		ttl, err := uploadTTL(fields)
 		if err != nil {
-			log.Error(err.Error())
-			ctx.AbortWithStatus(http.StatusInternalServerError)
+			ctx.String(http.StatusBadRequest, err.Error())
 			return
 		}
-		switch store.Add(fileHeader.Filename, SHA, data) {
+		add := store.AddStream
+		if ttl > 0 {
+			expirer, ok := store.(database.Expirer)
+			if !ok {
+				ctx.AbortWithStatus(http.StatusNotImplemented)
+				return
+			}
+			add = func(name string, SHA []byte, reader io.Reader) error {
+				return expirer.AddStreamTTL(name, SHA, reader, ttl)
+			}
+		}
+		switch err := add(uploadName(fields, file), fields["SHA"], file); err {
 		case nil:
 			ctx.Status(http.StatusCreated)
 		case badger.ErrConflict:
 			ctx.AbortWithStatus(http.StatusConflict)
+		case database.ErrInvalidName, database.ErrSHAMismatch:
+			ctx.AbortWithStatus(http.StatusBadRequest)
+		case database.ErrMissingData:
+			ctx.AbortWithStatus(http.StatusPreconditionFailed)
+		case database.ErrFileTooLarge:
+			ctx.String(http.StatusRequestEntityTooLarge, err.Error())
+		case database.ErrPhysicalQuota, database.ErrLogicalQuota, database.ErrFileQuota:
+			ctx.String(http.StatusInsufficientStorage, err.Error())
+		case database.ErrNoBucket:
+			ctx.String(http.StatusNotFound, err.Error())
+		case database.ErrNotLeader, database.ErrNoQuorum:
+			ctx.String(http.StatusServiceUnavailable, err.Error())
 		default:
 			log.Error(err.Error())
 			ctx.AbortWithStatus(http.StatusInternalServerError)
@@ -83,34 +140,50 @@ func AddFile(store database.Store) gin.HandlerFunc {
 
 func UpdateFile(store database.Store) gin.HandlerFunc {
 	fn := func(ctx *gin.Context) {
-		SHA := []byte(ctx.Request.FormValue("SHA"))
-		fileHeader, err := ctx.FormFile("file")
-		if err != nil {
-			log.Error(err.Error())
-			ctx.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
-		file, err := fileHeader.Open()
+		fields, file, err := readUpload(ctx)
 		if err != nil {
 			log.Error(err.Error())
-			ctx.AbortWithStatus(http.StatusInternalServerError)
+			ctx.AbortWithStatus(http.StatusBadRequest)
 			return
 		}
 		defer file.Close()
-		data, err := io.ReadAll(file)
+		ttl, err := uploadTTL(fields)
 		if err != nil {
-			log.Error(err.Error())
-			ctx.AbortWithStatus(http.StatusInternalServerError)
+			ctx.String(http.StatusBadRequest, err.Error())
 			return
 		}
-		fileExists := store.FileExists(fileHeader.Filename)
-		switch store.Update(fileHeader.Filename, SHA, data) {
+		update := store.UpdateStream
+		if ttl > 0 {
+			expirer, ok := store.(database.Expirer)
+			if !ok {
+				ctx.AbortWithStatus(http.StatusNotImplemented)
+				return
+			}
+			update = func(name string, SHA []byte, reader io.Reader) error {
+				return expirer.UpdateStreamTTL(name, SHA, reader, ttl)
+			}
+		}
+		name := uploadName(fields, file)
+		fileExists := store.FileExists(name)
+		switch err := update(name, fields["SHA"], file); err {
 		case nil:
 			if fileExists {
 				ctx.Status(http.StatusOK)
 			} else {
 				ctx.Status(http.StatusCreated)
 			}
+		case database.ErrInvalidName, database.ErrSHAMismatch:
+			ctx.AbortWithStatus(http.StatusBadRequest)
+		case database.ErrMissingData:
+			ctx.AbortWithStatus(http.StatusPreconditionFailed)
+		case database.ErrFileTooLarge:
+			ctx.String(http.StatusRequestEntityTooLarge, err.Error())
+		case database.ErrPhysicalQuota, database.ErrLogicalQuota, database.ErrFileQuota:
+			ctx.String(http.StatusInsufficientStorage, err.Error())
+		case database.ErrNoBucket:
+			ctx.String(http.StatusNotFound, err.Error())
+		case database.ErrNotLeader, database.ErrNoQuorum:
+			ctx.String(http.StatusServiceUnavailable, err.Error())
 		default:
 			log.Error(err.Error())
 			ctx.AbortWithStatus(http.StatusInternalServerError)
@@ -122,12 +195,19 @@ func UpdateFile(store database.Store) gin.HandlerFunc {
 func RemoveFile(store database.Store) gin.HandlerFunc {
 	fn := func(ctx *gin.Context) {
 		file := ctx.Query("file")
-		err := store.Remove(file)
+		var err error
+		if trasher, ok := store.(database.Trasher); ok {
+			err = trasher.Trash(file, remover(ctx))
+		} else {
+			err = store.Remove(file)
+		}
 		switch err {
 		case badger.ErrKeyNotFound:
 			ctx.AbortWithStatus(http.StatusNotFound)
 		case nil:
 			ctx.Status(http.StatusNoContent)
+		case database.ErrNotLeader, database.ErrNoQuorum:
+			ctx.String(http.StatusServiceUnavailable, err.Error())
 		default:
 			log.Error(err.Error())
 			ctx.AbortWithStatus(http.StatusInternalServerError)
@@ -142,13 +222,50 @@ func ListFiles(store database.Store) gin.HandlerFunc {
 		if ctx.Request.URL.Query().Has("details") {
 			details, _ = strconv.ParseBool(ctx.Query("details"))
 		}
-		list, err := store.List(details)
-		if err != nil {
+		recursive, _ := strconv.ParseBool(ctx.Query("recursive"))
+		reverse, _ := strconv.ParseBool(ctx.Query("reverse"))
+		limit := 0
+		if ctx.Query("limit") != "" {
+			var err error
+			if limit, err = strconv.Atoi(ctx.Query("limit")); err != nil || limit < 0 {
+				ctx.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+		}
+		list, err := store.List(database.ListOptions{
+			Dir:       ctx.Query("dir"),
+			Recursive: recursive,
+			Details:   details,
+			Prefix:    ctx.Query("prefix"),
+			Pattern:   ctx.Query("glob"),
+			Sort:      ctx.Query("sort"),
+			Reverse:   reverse,
+			Limit:     limit,
+			After:     ctx.Query("after"),
+		})
+		switch err {
+		case nil:
+		case database.ErrInvalidName, database.ErrInvalidSort, database.ErrInvalidCursor, path.ErrBadPattern:
+			ctx.String(http.StatusBadRequest, err.Error())
+			return
+		default:
 			log.Error(err.Error())
 			ctx.AbortWithStatus(http.StatusInternalServerError)
 			return
 		}
-		ctx.JSON(http.StatusOK, list)
+		// the cursor of the next page, when there is one
+		if list.Next != "" {
+			ctx.Header("X-Store-Next", list.Next)
+		}
+		if details {
+			ctx.JSON(http.StatusOK, list.Files)
+			return
+		}
+		names := make([]string, len(list.Files))
+		for i, file := range list.Files {
+			names[i] = file.Name
+		}
+		ctx.JSON(http.StatusOK, names)
 	}
 	return gin.HandlerFunc(fn)
 }
@@ -166,6 +283,24 @@ func WordCount(store database.Store) gin.HandlerFunc {
 	return gin.HandlerFunc(fn)
 }
 
+func Usage(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		reporter, ok := store.(database.UsageReporter)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		usage, err := reporter.Usage()
+		if err != nil {
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		ctx.JSON(http.StatusOK, usage)
+	}
+	return gin.HandlerFunc(fn)
+}
+
 func WordFrequency(store database.Store) gin.HandlerFunc {
 	fn := func(ctx *gin.Context) {
 		order := ctx.Query("order")
@@ -231,3 +366,111 @@ func CheckFile(store database.Store) gin.HandlerFunc {
 	}
 	return gin.HandlerFunc(fn)
 }
+
+func ListVersions(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		versioner, ok := store.(database.Versioner)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		versions, err := versioner.Versions(ctx.Query("file"))
+		switch err {
+		case nil:
+			ctx.JSON(http.StatusOK, versions)
+		case badger.ErrKeyNotFound:
+			ctx.AbortWithStatus(http.StatusNotFound)
+		default:
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+	return gin.HandlerFunc(fn)
+}
+
+func RestoreVersion(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		versioner, ok := store.(database.Versioner)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		version, err := strconv.ParseUint(ctx.Query("version"), 10, 64)
+		if err != nil {
+			ctx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		switch err := versioner.Restore(ctx.Query("file"), version); err {
+		case nil:
+			ctx.Status(http.StatusOK)
+		case badger.ErrKeyNotFound, database.ErrNoBucket:
+			ctx.AbortWithStatus(http.StatusNotFound)
+		case database.ErrNotLeader, database.ErrNoQuorum:
+			ctx.String(http.StatusServiceUnavailable, err.Error())
+		default:
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+	return gin.HandlerFunc(fn)
+}
+
+// Maximum size of a form field in an upload
+const maxFieldSize = 1 << 10
+
+// Read the form fields of a multipart upload up to the file part, which is
+// returned unread so that its data can be streamed in to the store. Form
+// fields must be sent before the file.
+func readUpload(ctx *gin.Context) (map[string][]byte, *multipart.Part, error) {
+	reader, err := ctx.Request.MultipartReader()
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := map[string][]byte{}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, nil, errors.New("upload has no file")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if part.FormName() == "file" {
+			return fields, part, nil
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxFieldSize+1))
+		part.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(value) > maxFieldSize {
+			return nil, nil, fmt.Errorf("upload field %s is too large", part.FormName())
+		}
+		fields[part.FormName()] = value
+	}
+}
+
+// Returns the time to live sent in the ttl field of an upload, 0 when the
+// file does not expire
+func uploadTTL(fields map[string][]byte) (time.Duration, error) {
+	if len(fields["ttl"]) == 0 {
+		return 0, nil
+	}
+	ttl, err := time.ParseDuration(string(fields["ttl"]))
+	if err != nil {
+		return 0, err
+	}
+	if ttl <= 0 {
+		return 0, errors.New("ttl must be positive")
+	}
+	return ttl, nil
+}
+
+// Returns the name of an uploaded file, the path sent in the name field or
+// else the file name of the part, which has no directory
+func uploadName(fields map[string][]byte, file *multipart.Part) string {
+	if name := string(fields["name"]); name != "" {
+		return name
+	}
+	return file.FileName()
+}
@@ -0,0 +1,54 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gin-gonic/gin"
+	"github.com/sayan-biswas/file-store/pkg/database"
+)
+
+func RenameFile(store database.Store) gin.HandlerFunc {
+	return moveFile(store, http.StatusOK, func(mover database.Mover, name string, newName string) error {
+		return mover.Rename(name, newName)
+	})
+}
+
+func CopyFile(store database.Store) gin.HandlerFunc {
+	return moveFile(store, http.StatusCreated, func(mover database.Mover, name string, newName string) error {
+		return mover.Copy(name, newName)
+	})
+}
+
+// Rename or copy the file of the file query to the name of the to query
+func moveFile(store database.Store, status int, move func(mover database.Mover, name string, newName string) error) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		mover, ok := store.(database.Mover)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		switch err := move(mover, ctx.Query("file"), ctx.Query("to")); err {
+		case nil:
+			ctx.Status(status)
+		case badger.ErrKeyNotFound:
+			ctx.AbortWithStatus(http.StatusNotFound)
+		case badger.ErrConflict:
+			ctx.AbortWithStatus(http.StatusConflict)
+		case database.ErrInvalidName:
+			ctx.AbortWithStatus(http.StatusBadRequest)
+		case database.ErrFileTooLarge:
+			ctx.String(http.StatusRequestEntityTooLarge, err.Error())
+		case database.ErrPhysicalQuota, database.ErrLogicalQuota, database.ErrFileQuota:
+			ctx.String(http.StatusInsufficientStorage, err.Error())
+		case database.ErrNoBucket:
+			ctx.String(http.StatusNotFound, err.Error())
+		case database.ErrNotLeader, database.ErrNoQuorum:
+			ctx.String(http.StatusServiceUnavailable, err.Error())
+		default:
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+	return gin.HandlerFunc(fn)
+}
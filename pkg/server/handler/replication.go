@@ -0,0 +1,16 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sayan-biswas/file-store/pkg/replication"
+)
+
+// Get the replication state of a follower
+func Replication(follower *replication.Follower) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		ctx.JSON(http.StatusOK, follower.Status())
+	}
+	return gin.HandlerFunc(fn)
+}
@@ -0,0 +1,42 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sayan-biswas/file-store/pkg/database"
+)
+
+// Number of search results returned when the request does not set a limit
+const searchLimit = 20
+
+func Search(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		searcher, ok := store.(database.Searcher)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		limit := searchLimit
+		if ctx.Query("limit") != "" {
+			var err error
+			limit, err = strconv.Atoi(ctx.Query("limit"))
+			if err != nil || limit <= 0 {
+				ctx.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+		}
+		results, err := searcher.Search(ctx.Query("q"), limit)
+		switch err {
+		case nil:
+			ctx.JSON(http.StatusOK, results)
+		case database.ErrInvalidQuery:
+			ctx.AbortWithStatus(http.StatusBadRequest)
+		default:
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+	return gin.HandlerFunc(fn)
+}
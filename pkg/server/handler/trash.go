@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gin-gonic/gin"
+	"github.com/sayan-biswas/file-store/pkg/database"
+)
+
+// Header naming the user on whose behalf a client removes files
+const userHeader = "X-Store-User"
+
+// Returns who is removing a file, the user sent by the client and its address
+func remover(ctx *gin.Context) string {
+	if user := ctx.GetHeader(userHeader); user != "" {
+		return user + "@" + ctx.ClientIP()
+	}
+	return ctx.ClientIP()
+}
+
+// Parse the optional trash entry ID of a request, 0 when it is not set
+func trashID(ctx *gin.Context) (uint64, bool) {
+	if ctx.Query("id") == "" {
+		return 0, true
+	}
+	id, err := strconv.ParseUint(ctx.Query("id"), 10, 64)
+	return id, err == nil
+}
+
+func ListTrash(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		trasher, ok := store.(database.Trasher)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		list, err := trasher.TrashList()
+		if err != nil {
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		ctx.JSON(http.StatusOK, list)
+	}
+	return gin.HandlerFunc(fn)
+}
+
+func RestoreTrash(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		trasher, ok := store.(database.Trasher)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		id, ok := trashID(ctx)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		switch err := trasher.RestoreTrash(ctx.Query("file"), id); err {
+		case nil:
+			ctx.Status(http.StatusOK)
+		case badger.ErrKeyNotFound, database.ErrNoBucket:
+			ctx.AbortWithStatus(http.StatusNotFound)
+		case badger.ErrConflict:
+			ctx.AbortWithStatus(http.StatusConflict)
+		case database.ErrNotLeader, database.ErrNoQuorum:
+			ctx.String(http.StatusServiceUnavailable, err.Error())
+		default:
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+	return gin.HandlerFunc(fn)
+}
+
+func PurgeTrash(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		trasher, ok := store.(database.Trasher)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		id, ok := trashID(ctx)
+		all, _ := strconv.ParseBool(ctx.Query("all"))
+		// purging the whole trash bin must be asked for explicitly
+		if !ok || (ctx.Query("file") == "") != all {
+			ctx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+		switch err := trasher.PurgeTrash(ctx.Query("file"), id); err {
+		case nil:
+			ctx.Status(http.StatusNoContent)
+		case badger.ErrKeyNotFound:
+			ctx.AbortWithStatus(http.StatusNotFound)
+		case database.ErrNotLeader, database.ErrNoQuorum:
+			ctx.String(http.StatusServiceUnavailable, err.Error())
+		default:
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+		}
+	}
+	return gin.HandlerFunc(fn)
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sayan-biswas/file-store/pkg/database"
+)
+
+// Interval between two comments sent to keep an idle stream open
+const keepAlive = 15 * time.Second
+
+// Stream the changes of the files as server-sent events, from the sequence
+// number after the one of the after query or of the Last-Event-ID header of
+// a reconnecting client, or from now on without either
+func Watch(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		watcher, ok := store.(database.Watcher)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		after := database.WatchNow
+		last := ctx.Query("after")
+		if last == "" {
+			last = ctx.GetHeader("Last-Event-ID")
+		}
+		if last != "" {
+			var err error
+			if after, err = strconv.ParseUint(last, 10, 64); err != nil || after == database.WatchNow {
+				ctx.AbortWithStatus(http.StatusBadRequest)
+				return
+			}
+		}
+		events, err := watcher.Watch(ctx.Request.Context(), after)
+		switch err {
+		case nil:
+		case database.ErrEventsPruned:
+			ctx.String(http.StatusGone, err.Error())
+			return
+		default:
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		ctx.Header("Content-Type", "text/event-stream")
+		ctx.Header("Cache-Control", "no-cache")
+		ctx.Status(http.StatusOK)
+		ctx.Writer.Flush()
+		ticker := time.NewTicker(keepAlive)
+		defer ticker.Stop()
+		for {
+			select {
+			case event, ok := <-events:
+				if !ok {
+					return
+				}
+				data, err := json.Marshal(event)
+				if err != nil {
+					log.Error(err.Error())
+					return
+				}
+				if event.Type == database.EventReset {
+					// without an ID, a reconnecting client resumes after the
+					// last change it received and is answered 410 Gone
+					fmt.Fprintf(ctx.Writer, "event: %s\ndata: %s\n\n", event.Type, data)
+					ctx.Writer.Flush()
+					return
+				}
+				if _, err := fmt.Fprintf(ctx.Writer, "id: %d\nevent: %s\ndata: %s\n\n", event.Sequence, event.Type, data); err != nil {
+					return
+				}
+			case <-ticker.C:
+				if _, err := fmt.Fprint(ctx.Writer, ": keep-alive\n\n"); err != nil {
+					return
+				}
+			}
+			ctx.Writer.Flush()
+		}
+	}
+	return gin.HandlerFunc(fn)
+}
+
+// Get the last event of the files, with a zero sequence number when there
+// is none
+func LastEvent(store database.Store) gin.HandlerFunc {
+	fn := func(ctx *gin.Context) {
+		watcher, ok := store.(database.Watcher)
+		if !ok {
+			ctx.AbortWithStatus(http.StatusNotImplemented)
+			return
+		}
+		event, err := watcher.LastEvent()
+		if err != nil {
+			log.Error(err.Error())
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		ctx.JSON(http.StatusOK, event)
+	}
+	return gin.HandlerFunc(fn)
+}
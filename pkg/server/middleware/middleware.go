@@ -1,10 +1,16 @@
 package middleware
 
 import (
+	"crypto/subtle"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/sayan-biswas/file-store/pkg/cluster"
 	"github.com/sayan-biswas/file-store/pkg/server/config"
 )
 
@@ -18,3 +24,79 @@ func CORS(config *config.Config) gin.HandlerFunc {
 		MaxAge:           time.Duration(config.CORS.MaxAge),
 	})
 }
+
+// Reject the requests that change the files, on a follower which only
+// takes its files from the leader. Buckets are not replicated, so requests
+// to the buckets of a follower are all rejected.
+func ReadOnly() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		path := ctx.Request.URL.Path
+		if strings.HasPrefix(path, "/buckets") {
+			ctx.String(http.StatusNotImplemented, "buckets are not replicated, use the leader")
+			ctx.Abort()
+			return
+		}
+		switch ctx.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+		if strings.HasPrefix(path, "/store") {
+			ctx.String(http.StatusForbidden, "read only follower, write to the leader")
+			ctx.Abort()
+		}
+	}
+}
+
+// Header of the requests forwarded to the leader of a cluster
+const forwardedHeader = "X-Store-Forwarded"
+
+// Forward the requests that change the files or the buckets to the leader
+// of the cluster, on a node that is not the leader. A request is forwarded
+// once, so a node that sees the leader differently answers with 503 instead
+// of sending it back.
+func Forward(node *cluster.Node) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		switch ctx.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return
+		}
+		path := ctx.Request.URL.Path
+		if !strings.HasPrefix(path, "/store") && !strings.HasPrefix(path, "/buckets") {
+			return
+		}
+		if node.IsLeader() {
+			return
+		}
+		leader, ok := node.Leader()
+		if !ok || ctx.GetHeader(forwardedHeader) != "" {
+			ctx.String(http.StatusServiceUnavailable, cluster.ErrNoLeader.Error())
+			ctx.Abort()
+			return
+		}
+		target, err := url.Parse(leader.URL)
+		if err != nil {
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		ctx.Request.Header.Set(forwardedHeader, node.ID())
+		httputil.NewSingleHostReverseProxy(target).ServeHTTP(ctx.Writer, ctx.Request)
+		ctx.Abort()
+	}
+}
+
+// Reject the requests that do not send the admin token, and every request
+// when no admin token is set
+func Admin(config *config.Config) gin.HandlerFunc {
+	token := []byte("Bearer " + config.Server.AdminToken)
+	return func(ctx *gin.Context) {
+		if config.Server.AdminToken == "" {
+			ctx.String(http.StatusForbidden, "admin endpoints are disabled, set server.adminToken")
+			ctx.Abort()
+			return
+		}
+		header := []byte(ctx.GetHeader("Authorization"))
+		if subtle.ConstantTimeCompare(header, token) != 1 {
+			ctx.AbortWithStatus(http.StatusUnauthorized)
+		}
+	}
+}
@@ -2,7 +2,9 @@ package router
 
 import (
 	"github.com/gin-gonic/gin"
+	"github.com/sayan-biswas/file-store/pkg/cluster"
 	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/sayan-biswas/file-store/pkg/replication"
 	"github.com/sayan-biswas/file-store/pkg/server/handler"
 )
 
@@ -11,13 +13,63 @@ func Root(router *gin.Engine) {
 }
 
 func Store(router *gin.Engine, store database.Store) {
-	router.DELETE("/store", handler.RemoveFile(store))
-	router.GET("/store", handler.GetFile(store))
-	router.POST("/store", handler.AddFile(store))
-	router.PUT("/store", handler.UpdateFile(store))
-	router.GET("/store/check/file", handler.CheckFile(store))
-	router.GET("/store/check/sha", handler.CheckSHA(store))
-	router.GET("/store/list", handler.ListFiles(store))
-	router.GET("/store/count", handler.WordCount(store))
-	router.GET("/store/frequency", handler.WordFrequency(store))
+	files(router.Group("/store"), func(h func(database.Store) gin.HandlerFunc) gin.HandlerFunc {
+		return h(store)
+	})
+	files(router.Group("/buckets/:bucket/store"), func(h func(database.Store) gin.HandlerFunc) gin.HandlerFunc {
+		return handler.InBucket(store, h)
+	})
+	router.GET("/store/usage", handler.Usage(store))
+	router.GET("/buckets", handler.ListBuckets(store))
+	router.PUT("/buckets/:bucket", handler.CreateBucket(store))
+	router.DELETE("/buckets/:bucket", handler.DeleteBucket(store))
+}
+
+// Routes of the files of the store or of a bucket
+func files(routes gin.IRoutes, with func(func(database.Store) gin.HandlerFunc) gin.HandlerFunc) {
+	routes.DELETE("", with(handler.RemoveFile))
+	routes.GET("", with(handler.GetFile))
+	routes.POST("", with(handler.AddFile))
+	routes.PUT("", with(handler.UpdateFile))
+	routes.POST("/rename", with(handler.RenameFile))
+	routes.POST("/copy", with(handler.CopyFile))
+	routes.GET("/check/file", with(handler.CheckFile))
+	routes.GET("/check/sha", with(handler.CheckSHA))
+	routes.GET("/list", with(handler.ListFiles))
+	routes.GET("/count", with(handler.WordCount))
+	routes.GET("/frequency", with(handler.WordFrequency))
+	routes.GET("/versions", with(handler.ListVersions))
+	routes.POST("/restore", with(handler.RestoreVersion))
+	routes.GET("/trash", with(handler.ListTrash))
+	routes.POST("/trash/restore", with(handler.RestoreTrash))
+	routes.DELETE("/trash", with(handler.PurgeTrash))
+	routes.GET("/search", with(handler.Search))
+	routes.GET("/watch", with(handler.Watch))
+	routes.GET("/watch/last", with(handler.LastEvent))
+}
+
+// Data by SHA, fetched by replication followers and cluster nodes with the
+// admin token
+func Blob(router *gin.Engine, store database.Store, auth gin.HandlerFunc) {
+	router.GET("/store/blob", auth, handler.GetBlob(store))
+}
+
+func Replication(router *gin.Engine, follower *replication.Follower) {
+	router.GET("/replication", handler.Replication(follower))
+}
+
+func Cluster(router *gin.Engine, node *cluster.Node, auth gin.HandlerFunc) {
+	router.GET("/cluster", handler.ClusterStatus(node))
+	router.POST("/cluster/blob", auth, handler.StageBlob(node))
+}
+
+func Admin(router *gin.Engine, store database.Store, auth gin.HandlerFunc) {
+	admin := router.Group("/admin", auth)
+	admin.POST("/rotate", handler.RotateKey(store))
+	admin.GET("/cache", handler.CacheStats(store))
+	admin.POST("/backup", handler.Backup(store))
+	admin.POST("/restore", handler.RestoreBackup(store))
+	admin.POST("/scrub", handler.Scrub(store))
+	admin.GET("/scrub", handler.LastScrub(store))
+	admin.POST("/fsck", handler.Check(store))
 }
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Write a backup to a file, or to the standard output with "-". The file is
+// only created once the whole backup is received. The version to pass as
+// since to the next incremental backup is printed.
+func backup(client *http.Client, url string, token string, file string) error {
+	response, err := adminRequest(client, url, token, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var output io.Writer = os.Stdout
+	var temp *os.File
+	if file != "-" {
+		temp, err = os.CreateTemp(filepath.Dir(file), ".backup-*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(temp.Name())
+		defer temp.Close()
+		output = temp
+	}
+	if _, err := io.Copy(output, response.Body); err != nil {
+		return err
+	}
+	// the trailer is only sent after a complete backup
+	version := response.Trailer.Get("X-Store-Version")
+	if version == "" {
+		return errors.New("backup incomplete")
+	}
+	if temp != nil {
+		if err := temp.Close(); err != nil {
+			return err
+		}
+		if err := os.Rename(temp.Name(), file); err != nil {
+			return err
+		}
+		fmt.Println(version)
+		return nil
+	}
+	fmt.Fprintln(os.Stderr, version)
+	return nil
+}
+
+func restore(client *http.Client, url string, token string, file string) error {
+	input, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+	response, err := adminRequest(client, url, token, input)
+	if err != nil {
+		return err
+	}
+	return response.Body.Close()
+}
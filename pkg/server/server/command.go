@@ -0,0 +1,106 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/sayan-biswas/file-store/pkg/server/config"
+	"github.com/spf13/pflag"
+)
+
+var ErrUsage = errors.New("usage: store-server backup <file|-> [since] | store-server restore <full backup> [incremental backups...] | store-server fsck [--repair]")
+
+// Run a subcommand against the running server, with the address, TLS
+// certificate and admin token of its configuration
+func Command(args []string) error {
+	if len(args) == 0 {
+		return ErrUsage
+	}
+	config.Load()
+	config, err := config.Get()
+	if err != nil {
+		return err
+	}
+	client, url, err := adminClient(config)
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "backup":
+		if len(args) < 2 || len(args) > 3 {
+			return ErrUsage
+		}
+		since := "0"
+		if len(args) == 3 {
+			if _, err := strconv.ParseUint(args[2], 10, 64); err != nil {
+				return ErrUsage
+			}
+			since = args[2]
+		}
+		return backup(client, url+"/backup?since="+since, config.Server.AdminToken, args[1])
+	case "restore":
+		if len(args) < 2 {
+			return ErrUsage
+		}
+		for i, file := range args[1:] {
+			incremental := strconv.FormatBool(i > 0)
+			if err := restore(client, url+"/restore?incremental="+incremental, config.Server.AdminToken, file); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "fsck":
+		if len(args) > 1 {
+			return ErrUsage
+		}
+		repair := pflag.Lookup("repair").Value.String()
+		return fsck(client, url+"/fsck?repair="+repair, config.Server.AdminToken)
+	}
+	return ErrUsage
+}
+
+// HTTP client and URL of the admin endpoints of the server
+func adminClient(config *config.Config) (*http.Client, string, error) {
+	host := config.Server.Host
+	if host == "" {
+		host = "localhost"
+	}
+	address := host + ":" + strconv.Itoa(config.Server.Port)
+	if !config.Server.TLS {
+		return http.DefaultClient, "http://" + address + "/admin", nil
+	}
+	certificate, err := os.ReadFile(config.Server.Certificate)
+	if err != nil {
+		return nil, "", err
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(certificate)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}}
+	return client, "https://" + address + "/admin", nil
+}
+
+func adminRequest(client *http.Client, url string, token string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(http.MethodPost, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 != 2 {
+		response.Body.Close()
+		return nil, errors.New("server error: " + response.Status)
+	}
+	return response, nil
+}
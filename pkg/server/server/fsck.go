@@ -0,0 +1,37 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/sayan-biswas/file-store/pkg/database"
+)
+
+var ErrInconsistent = errors.New("store is inconsistent, run fsck with --repair to repair it")
+
+// Check the store and print the report. Fails when the store is found
+// inconsistent and is not repaired.
+func fsck(client *http.Client, url string, token string) error {
+	response, err := adminRequest(client, url, token, nil)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	report := database.CheckReport{}
+	if err := json.NewDecoder(response.Body).Decode(&report); err != nil {
+		return err
+	}
+	output, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stdout.Write(append(output, '\n')); err != nil {
+		return err
+	}
+	if !report.Consistent() && !report.Repaired {
+		return ErrInconsistent
+	}
+	return nil
+}
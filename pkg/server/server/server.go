@@ -3,11 +3,14 @@ package server
 import (
 	"context"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sayan-biswas/file-store/pkg/cluster"
 	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/sayan-biswas/file-store/pkg/replication"
 	"github.com/sayan-biswas/file-store/pkg/server/config"
 	"github.com/sayan-biswas/file-store/pkg/server/logger"
 	"github.com/sayan-biswas/file-store/pkg/server/middleware"
@@ -18,6 +21,7 @@ import (
 var httpServer *http.Server
 var log = logger.Log
 var store database.Store
+var follower *replication.Follower
 
 func Start() {
 
@@ -34,11 +38,74 @@ func Start() {
 	}
 
 	// initialize database
-	db, err := database.New(&database.Config{Path: config.Database.Path})
+	db, err := database.Open(&database.Config{
+		Backend:    config.Database.Backend,
+		Diskless:   config.Database.Diskless,
+		Snapshot:   config.Database.Snapshot,
+		Encryption: config.Database.Encryption,
+		KeyFile:    config.Database.KeyFile,
+		Key:        config.Database.Key,
+		Path:       config.Database.Path,
+		CacheSize:  config.Database.CacheSize,
+		BlobCache:  config.Database.BlobCache,
+
+		MaxVersions:   config.Database.Versions.Max,
+		MaxVersionAge: config.Database.Versions.MaxAge,
+
+		TrashRetention: config.Database.Trash.Retention,
+		EventRetention: config.Database.Events.Retention,
+
+		ScrubInterval: config.Database.Scrub.Interval,
+		ScrubRate:     config.Database.Scrub.Rate,
+
+		MaxPhysicalSize: config.Database.Quota.Physical,
+		MaxLogicalSize:  config.Database.Quota.Logical,
+		MaxFiles:        config.Database.Quota.Files,
+		MaxFileSize:     config.Database.Quota.FileSize,
+
+		S3: database.S3Config{
+			Endpoint:  config.Database.S3.Endpoint,
+			Bucket:    config.Database.S3.Bucket,
+			Region:    config.Database.S3.Region,
+			Prefix:    config.Database.S3.Prefix,
+			AccessKey: config.Database.S3.AccessKey,
+			SecretKey: config.Database.S3.SecretKey,
+			PathStyle: config.Database.S3.PathStyle,
+			Secure:    config.Database.S3.Secure,
+		},
+	})
 	if err != nil {
 		log.Fatal(err.Error())
 	}
 	store = db
+
+	// join the cluster, the store of the server becomes the node
+	var node *cluster.Node
+	if config.Cluster.Node != "" {
+		if config.Replication.Leader != "" {
+			log.Fatal("a cluster node can not follow a leader")
+		}
+		if config.Server.AdminToken == "" {
+			log.Fatal("cluster nodes need server.adminToken")
+		}
+		peers := make([]cluster.Peer, 0, len(config.Cluster.Peers))
+		for _, peer := range config.Cluster.Peers {
+			peers = append(peers, cluster.Peer{ID: peer.ID, Address: peer.Address, URL: peer.URL})
+		}
+		node, err = cluster.New(&cluster.Config{
+			NodeID:    config.Cluster.Node,
+			Peers:     peers,
+			Path:      config.Cluster.Path,
+			Replicas:  config.Cluster.Replicas,
+			Token:     config.Server.AdminToken,
+			LogOutput: os.Stderr,
+		}, db)
+		if err != nil {
+			db.Close()
+			log.Fatal(err.Error())
+		}
+		store = node
+	}
 	defer store.Close()
 
 	if config.Server.Debug {
@@ -53,9 +120,29 @@ func Start() {
 	// middleware chain
 	engine.Use(middleware.CORS(config))
 
+	// follow the leader, serving reads only
+	if config.Replication.Leader != "" {
+		follower, err = replication.NewFollower(config.Replication.Leader, config.Replication.Token, store)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		engine.Use(middleware.ReadOnly())
+		router.Replication(engine, follower)
+		log.Info("following leader", zap.String("leader", config.Replication.Leader))
+	}
+
+	// forward writes to the leader of the cluster
+	if node != nil {
+		engine.Use(middleware.Forward(node))
+		router.Cluster(engine, node, middleware.Admin(config))
+		log.Info("joined cluster", zap.String("node", config.Cluster.Node))
+	}
+
 	// router chain
 	router.Root(engine)
 	router.Store(engine, store)
+	router.Blob(engine, store, middleware.Admin(config))
+	router.Admin(engine, store, middleware.Admin(config))
 
 	// define server
 	httpServer = &http.Server{
@@ -78,6 +165,9 @@ func Start() {
 
 func Stop() {
 	log.Info("shutting down server")
+	if follower != nil {
+		follower.Close()
+	}
 	if err := store.Close(); err != nil {
 		log.Fatal(err.Error())
 	}
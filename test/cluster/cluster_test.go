@@ -0,0 +1,442 @@
+package cluster
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/gin-gonic/gin"
+	"github.com/sayan-biswas/file-store/pkg/cluster"
+	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/sayan-biswas/file-store/pkg/server/middleware"
+	"github.com/sayan-biswas/file-store/pkg/server/router"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// Handler of a server, boxed to be swapped atomically
+type handler struct {
+	http.Handler
+}
+
+var unavailable = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+})
+
+// Nodes of a cluster with their servers, on disk so that they can be
+// restarted. A node that is down keeps its URL and answers 503.
+type testCluster struct {
+	t        *testing.T
+	dir      string
+	config   cluster.Config
+	peers    []cluster.Peer
+	handlers []atomic.Value
+	engines  []*gin.Engine
+	nodes    []*cluster.Node
+	stores   []database.Store
+	// set to answer 503 to the data fetched by SHA, on every server
+	noFetch int32
+}
+
+func newCluster(t *testing.T, size int, config cluster.Config) *testCluster {
+	config.Token = "cluster-token"
+	c := &testCluster{
+		t:        t,
+		dir:      t.TempDir(),
+		config:   config,
+		peers:    make([]cluster.Peer, size),
+		handlers: make([]atomic.Value, size),
+		engines:  make([]*gin.Engine, size),
+		nodes:    make([]*cluster.Node, size),
+		stores:   make([]database.Store, size),
+	}
+	for i := range c.peers {
+		i := i
+		c.handlers[i].Store(handler{unavailable})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if atomic.LoadInt32(&c.noFetch) == 1 && r.URL.Path == "/store/blob" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			c.handlers[i].Load().(handler).ServeHTTP(w, r)
+		}))
+		t.Cleanup(server.Close)
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		address := listener.Addr().String()
+		listener.Close()
+		c.peers[i] = cluster.Peer{ID: fmt.Sprintf("node%d", i), Address: address, URL: server.URL}
+	}
+	for i := range c.nodes {
+		c.start(i)
+	}
+	t.Cleanup(func() {
+		for i := range c.nodes {
+			if c.nodes[i] != nil {
+				c.nodes[i].Close()
+			}
+		}
+	})
+	return c
+}
+
+// Start a node on its store and Raft state
+func (c *testCluster) start(i int) {
+	store, err := database.New(&database.Config{
+		Path:           filepath.Join(c.dir, c.peers[i].ID, "store"),
+		TrashRetention: time.Hour,
+	})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	config := c.config
+	config.NodeID = c.peers[i].ID
+	config.Peers = c.peers
+	config.Path = filepath.Join(c.dir, c.peers[i].ID, "cluster")
+	node, err := cluster.New(&config, store)
+	if err != nil {
+		store.Close()
+		c.t.Fatal(err)
+	}
+	engine := gin.New()
+	engine.Use(middleware.Forward(node))
+	router.Store(engine, node)
+	router.Blob(engine, node, c.auth)
+	router.Cluster(engine, node, c.auth)
+	router.Admin(engine, node, func(ctx *gin.Context) {})
+	c.nodes[i], c.stores[i], c.engines[i] = node, store, engine
+	c.up(i)
+}
+
+// Stop a node, closing its store
+func (c *testCluster) stop(i int) {
+	c.down(i)
+	assert.NoError(c.t, c.nodes[i].Close())
+	c.nodes[i] = nil
+}
+
+// Reject the requests between nodes that do not send the token of the
+// cluster
+func (c *testCluster) auth(ctx *gin.Context) {
+	if ctx.GetHeader("Authorization") != "Bearer "+c.config.Token {
+		ctx.AbortWithStatus(http.StatusUnauthorized)
+	}
+}
+
+// Make the server of a node answer 503, or serve again
+func (c *testCluster) down(i int) {
+	c.handlers[i].Store(handler{unavailable})
+}
+
+func (c *testCluster) up(i int) {
+	c.handlers[i].Store(handler{c.engines[i]})
+}
+
+// Wait for one of the nodes to be the leader, and return it
+func (c *testCluster) leader(nodes ...int) int {
+	leader := -1
+	found := assert.Eventually(c.t, func() bool {
+		for _, i := range nodes {
+			if c.nodes[i].IsLeader() {
+				leader = i
+				return true
+			}
+		}
+		return false
+	}, 15*time.Second, 50*time.Millisecond)
+	if !found {
+		c.t.FailNow()
+	}
+	return leader
+}
+
+// Check if a node has the same files as another one, and the data of all
+// of them
+func (c *testCluster) sameFiles(i int, other int) bool {
+	want, err := c.nodes[other].List(database.ListOptions{Recursive: true, Details: true})
+	if err != nil {
+		return false
+	}
+	got, err := c.nodes[i].List(database.ListOptions{Recursive: true, Details: true})
+	if err != nil || len(got.Files) != len(want.Files) {
+		return false
+	}
+	for j := range want.Files {
+		if got.Files[j].Name != want.Files[j].Name || got.Files[j].SHA != want.Files[j].SHA {
+			return false
+		}
+	}
+	return c.nodes[i].Status().Missing == 0
+}
+
+func TestMissingData(t *testing.T) {
+	c := newCluster(t, 3, cluster.Config{Replicas: 2})
+	leader := c.leader(0, 1, 2)
+	lagging, holder := (leader+1)%3, (leader+2)%3
+
+	// the data can neither be sent to the lagging node nor fetched by it, so
+	// it applies the write without the data
+	c.down(lagging)
+	atomic.StoreInt32(&c.noFetch, 1)
+	data := []byte("this is written while a node can not get it")
+	assert.NoError(t, c.nodes[leader].Add("a.txt", nil, data))
+	assert.Eventually(t, func() bool {
+		return c.nodes[lagging].Status().Missing == 1
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.True(t, c.nodes[lagging].FileExists("a.txt"))
+	_, err := c.nodes[lagging].Get("a.txt")
+	assert.Error(t, err)
+
+	// a missing file is renamed, and can not be added again
+	assert.NoError(t, c.nodes[leader].Rename("a.txt", "b.txt"))
+	assert.Eventually(t, func() bool {
+		return c.nodes[lagging].FileExists("b.txt") && !c.nodes[lagging].FileExists("a.txt")
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, 1, c.nodes[lagging].Status().Missing)
+
+	// with the leader gone, the data is fetched from the other holder
+	c.stop(leader)
+	c.up(lagging)
+	atomic.StoreInt32(&c.noFetch, 0)
+	c.leader(lagging, holder)
+	assert.Eventually(t, func() bool {
+		return c.sameFiles(lagging, holder)
+	}, 15*time.Second, 50*time.Millisecond)
+	got, err := c.nodes[lagging].Get("b.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	c := newCluster(t, 3, cluster.Config{
+		Replicas:          2,
+		SnapshotInterval:  50 * time.Millisecond,
+		SnapshotThreshold: 4,
+		TrailingLogs:      2,
+	})
+	leader := c.leader(0, 1, 2)
+	stopped := (leader + 1) % 3
+	assert.NoError(t, c.nodes[leader].Add("a.txt", nil, []byte("this is removed while a node is down")))
+	assert.NoError(t, c.nodes[leader].Add("b.txt", nil, []byte("this is updated while a node is down")))
+	assert.Eventually(t, func() bool {
+		return c.sameFiles(stopped, leader)
+	}, 5*time.Second, 50*time.Millisecond)
+	c.stop(stopped)
+	stoppedAt := c.nodes[leader].Status().LastIndex
+
+	// the log the stopped node needs is compacted into a snapshot
+	assert.NoError(t, c.nodes[leader].Remove("a.txt"))
+	assert.NoError(t, c.nodes[leader].Update("b.txt", nil, []byte("this is the updated data")))
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("dir/%d.txt", i)
+		assert.NoError(t, c.nodes[leader].Add(name, nil, []byte("this is written while a node is down "+name)))
+	}
+	var snapshot uint64
+	assert.Eventually(t, func() bool {
+		snapshot = c.nodes[leader].Status().SnapshotIndex
+		return snapshot > stoppedAt+2
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// the node restarts from the snapshot of the leader
+	c.start(stopped)
+	assert.Eventually(t, func() bool {
+		return c.sameFiles(stopped, leader)
+	}, 15*time.Second, 50*time.Millisecond)
+	assert.GreaterOrEqual(t, c.nodes[stopped].Status().SnapshotIndex, snapshot)
+	data, err := c.nodes[stopped].Get("b.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "this is the updated data", string(data))
+}
+
+func TestRestartReplay(t *testing.T) {
+	c := newCluster(t, 3, cluster.Config{Replicas: 2})
+	leader := c.leader(0, 1, 2)
+	restarted := (leader + 1) % 3
+	assert.NoError(t, c.nodes[leader].Add("a.txt", nil, []byte("first version")))
+	assert.NoError(t, c.nodes[leader].Update("a.txt", nil, []byte("second version")))
+	assert.NoError(t, c.nodes[leader].Update("a.txt", nil, []byte("third version")))
+	assert.Eventually(t, func() bool {
+		return c.sameFiles(restarted, leader)
+	}, 5*time.Second, 50*time.Millisecond)
+	c.stop(restarted)
+
+	assert.NoError(t, c.nodes[leader].Update("a.txt", nil, []byte("fourth version")))
+	assert.NoError(t, c.nodes[leader].Add("b.txt", nil, []byte("written while a node is down")))
+
+	// the node only applies the commands its store does not have
+	c.start(restarted)
+	assert.Eventually(t, func() bool {
+		return c.sameFiles(restarted, leader)
+	}, 15*time.Second, 50*time.Millisecond)
+	want, err := c.stores[leader].(database.Versioner).Versions("a.txt")
+	assert.NoError(t, err)
+	got, err := c.stores[restarted].(database.Versioner).Versions("a.txt")
+	assert.NoError(t, err)
+	assert.Len(t, want, 4)
+	assert.Len(t, got, 4)
+}
+
+func TestTrash(t *testing.T) {
+	c := newCluster(t, 3, cluster.Config{Replicas: 2})
+	leader := c.leader(0, 1, 2)
+	follower := (leader + 1) % 3
+	assert.NoError(t, c.nodes[leader].Add("a.txt", nil, []byte("this is trashed")))
+	// a node without the data of a file removes it without a trash entry
+	assert.Eventually(t, func() bool {
+		return c.sameFiles((leader+1)%3, leader) && c.sameFiles((leader+2)%3, leader)
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.NoError(t, c.nodes[leader].Trash("a.txt", "user"))
+
+	// every node has the same trash entry
+	trashed := func(i int) []database.Trashed {
+		list, err := c.nodes[i].TrashList()
+		assert.NoError(t, err)
+		return list
+	}
+	assert.Eventually(t, func() bool {
+		for i := range c.nodes {
+			if len(trashed(i)) != 1 || c.nodes[i].FileExists("a.txt") {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+	entry := trashed(leader)[0]
+	for i := range c.nodes {
+		assert.Equal(t, entry.ID, trashed(i)[0].ID)
+		assert.Equal(t, "user", trashed(i)[0].DeletedBy)
+	}
+
+	assert.Equal(t, database.ErrNotLeader, c.nodes[follower].RestoreTrash("a.txt", entry.ID))
+	assert.NoError(t, c.nodes[leader].RestoreTrash("a.txt", entry.ID))
+	assert.Eventually(t, func() bool {
+		return c.sameFiles(follower, leader) && len(trashed(follower)) == 0
+	}, 5*time.Second, 50*time.Millisecond)
+	data, err := c.nodes[follower].Get("a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "this is trashed", string(data))
+
+	assert.NoError(t, c.nodes[leader].Trash("a.txt", "user"))
+	assert.NoError(t, c.nodes[leader].PurgeTrash("a.txt", 0))
+	assert.Eventually(t, func() bool {
+		return len(trashed(follower)) == 0 && !c.nodes[follower].FileExists("a.txt")
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, badger.ErrKeyNotFound, c.nodes[leader].RestoreTrash("a.txt", 0))
+}
+
+func TestRestoreVersion(t *testing.T) {
+	c := newCluster(t, 3, cluster.Config{Replicas: 2})
+	leader := c.leader(0, 1, 2)
+	follower := (leader + 1) % 3
+	assert.NoError(t, c.nodes[leader].Add("a.txt", nil, []byte("first version")))
+	assert.NoError(t, c.nodes[leader].Update("a.txt", nil, []byte("second version")))
+	assert.Eventually(t, func() bool {
+		return c.sameFiles(follower, leader)
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.NoError(t, c.nodes[leader].Restore("a.txt", 1))
+	assert.Equal(t, badger.ErrKeyNotFound, c.nodes[leader].Restore("a.txt", 5))
+	assert.Eventually(t, func() bool {
+		versions, err := c.nodes[follower].Versions("a.txt")
+		return err == nil && len(versions) == 3
+	}, 5*time.Second, 50*time.Millisecond)
+	data, err := c.nodes[follower].Get("a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "first version", string(data))
+}
+
+func TestExpiry(t *testing.T) {
+	c := newCluster(t, 3, cluster.Config{Replicas: 2})
+	leader := c.leader(0, 1, 2)
+	data := []byte("this expires")
+	assert.NoError(t, c.nodes[leader].AddStreamTTL("a.txt", nil, bytes.NewReader(data), 2*time.Second))
+
+	// the file expires at the time chosen by the leader on every node
+	var expires []time.Time
+	assert.Eventually(t, func() bool {
+		expires = nil
+		for i := range c.nodes {
+			list, err := c.nodes[i].List(database.ListOptions{Details: true})
+			if err != nil || len(list.Files) != 1 || list.Files[0].Expires == nil {
+				return false
+			}
+			expires = append(expires, *list.Files[0].Expires)
+		}
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+	for i := range expires {
+		assert.True(t, expires[i].Equal(expires[0]))
+	}
+	assert.Eventually(t, func() bool {
+		for i := range c.nodes {
+			if c.nodes[i].FileExists("a.txt") {
+				return false
+			}
+		}
+		return true
+	}, 10*time.Second, 50*time.Millisecond)
+
+	// a file written again once it expired is written on every node,
+	// whether or not its expiry was swept yet
+	assert.NoError(t, c.nodes[leader].AddStreamTTL("b.txt", nil, bytes.NewReader(data), 200*time.Millisecond))
+	time.Sleep(300 * time.Millisecond)
+	assert.NoError(t, c.nodes[leader].Add("b.txt", nil, []byte("this stays")))
+	assert.Eventually(t, func() bool {
+		for i := range c.nodes {
+			data, err := c.nodes[i].Get("b.txt")
+			if err != nil || string(data) != "this stays" {
+				return false
+			}
+		}
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestUnsupported(t *testing.T) {
+	c := newCluster(t, 3, cluster.Config{Replicas: 2})
+	leader := c.leader(0, 1, 2)
+	follower := (leader + 1) % 3
+	assert.NoError(t, c.nodes[leader].Add("a.txt", nil, []byte("this is backed up")))
+
+	// a node is backed up on its own, but not restored
+	var backup bytes.Buffer
+	_, err := c.nodes[leader].Backup(&backup, 0)
+	assert.NoError(t, err)
+	assert.NotZero(t, backup.Len())
+	assert.Equal(t, database.ErrRestoreUnsupported, c.nodes[leader].RestoreBackup(&backup, false))
+
+	requests := []struct {
+		method string
+		path   string
+		body   string
+	}{
+		{http.MethodPost, "/admin/restore", database.ErrRestoreUnsupported.Error()},
+		{http.MethodPut, "/buckets/bucket", database.ErrBucketsUnsupported.Error()},
+		{http.MethodDelete, "/buckets/bucket", database.ErrBucketsUnsupported.Error()},
+		{http.MethodGet, "/buckets", database.ErrBucketsUnsupported.Error()},
+		{http.MethodGet, "/buckets/bucket/store/list", database.ErrBucketsUnsupported.Error()},
+	}
+	for _, r := range requests {
+		request, err := http.NewRequest(r.method, c.peers[follower].URL+r.path, nil)
+		assert.NoError(t, err)
+		response, err := http.DefaultClient.Do(request)
+		if assert.NoError(t, err) {
+			body, _ := io.ReadAll(response.Body)
+			response.Body.Close()
+			assert.Equal(t, http.StatusNotImplemented, response.StatusCode, r.path)
+			assert.Equal(t, r.body, string(body), r.path)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package database
+
+import (
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuckets(t *testing.T) {
+	config := database.Config{Path: t.TempDir(), MaxVersions: 2, TrashRetention: time.Hour}
+	store, err := database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	assert.NoError(t, store.CreateBucket("team-a"))
+	assert.NoError(t, store.CreateBucket("team-b"))
+	assert.Equal(t, badger.ErrConflict, store.CreateBucket("team-a"))
+	assert.Equal(t, database.ErrInvalidBucket, store.CreateBucket("Team A"))
+	_, err = store.Bucket("team-c")
+	assert.Equal(t, database.ErrNoBucket, err)
+
+	buckets, err := store.Buckets()
+	assert.NoError(t, err)
+	if assert.Len(t, buckets, 2) {
+		assert.Equal(t, "team-a", buckets[0].Name)
+		assert.Equal(t, "team-b", buckets[1].Name)
+	}
+
+	a, err := store.Bucket("team-a")
+	assert.NoError(t, err)
+	b, err := store.Bucket("team-b")
+	assert.NoError(t, err)
+
+	// the same data under the same name in both buckets and at the root
+	data := []byte("the quick brown fox")
+	sum := sha256.Sum256(data)
+	assert.NoError(t, a.Add("docs/fox.txt", nil, data))
+	assert.NoError(t, b.Add("docs/fox.txt", nil, data))
+	assert.NoError(t, b.Add("dog.txt", nil, []byte("the lazy dog")))
+	assert.NoError(t, store.Add("root.txt", nil, []byte("root")))
+	assert.Equal(t, badger.ErrConflict, a.Add("docs/fox.txt", nil, data))
+	assert.False(t, a.FileExists("dog.txt"))
+	assert.False(t, store.FileExists("docs/fox.txt"))
+	assert.True(t, a.SHAExists(sum[:]))
+
+	list, err := b.List(database.ListOptions{Recursive: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"docs/fox.txt", "dog.txt"}, fileNames(list))
+	list, err = store.List(database.ListOptions{Recursive: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"root.txt"}, fileNames(list))
+
+	count, err := a.WordCount()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), count)
+	count, err = b.WordCount()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), count)
+	count, err = store.WordCount()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), count)
+	frequency, err := a.WordFrequency()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"the": 1, "quick": 1, "brown": 1, "fox": 1}, frequency)
+
+	// the data is stored once for both buckets
+	usage, err := store.Usage()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(data)+len("the lazy dog")+len("root")), usage.PhysicalBytes.Used)
+
+	// versions and trash entries go with the bucket
+	red := []byte("the quick red fox")
+	redSum := sha256.Sum256(red)
+	assert.NoError(t, a.Add("red.txt", nil, red))
+	assert.NoError(t, a.Update("red.txt", nil, []byte("the slow red fox")))
+	versions, err := a.(database.Versioner).Versions("red.txt")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 2)
+	_, err = b.(database.Versioner).Versions("red.txt")
+	assert.Equal(t, badger.ErrKeyNotFound, err)
+	assert.NoError(t, a.(database.Versioner).Restore("red.txt", versions[0].Version))
+	assert.NoError(t, a.(database.Trasher).Trash("red.txt", "test"))
+	trashed, err := a.(database.Trasher).TrashList()
+	assert.NoError(t, err)
+	if assert.Len(t, trashed, 1) {
+		assert.Equal(t, "red.txt", trashed[0].Name)
+	}
+	trashed, err = b.(database.Trasher).TrashList()
+	assert.NoError(t, err)
+	assert.Empty(t, trashed)
+
+	// deleting a bucket removes its files, the shared data stays
+	assert.NoError(t, store.DeleteBucket("team-b"))
+	assert.Equal(t, database.ErrNoBucket, store.DeleteBucket("team-b"))
+	assert.Equal(t, database.ErrNoBucket, b.Add("cat.txt", nil, []byte("the cat")))
+	assert.True(t, store.SHAExists(sum[:]))
+	assert.NoError(t, store.DeleteBucket("team-a"))
+	assert.False(t, store.SHAExists(sum[:]))
+	assert.False(t, store.SHAExists(redSum[:]))
+
+	// a new bucket of the same name starts empty
+	assert.NoError(t, store.CreateBucket("team-b"))
+	b, err = store.Bucket("team-b")
+	assert.NoError(t, err)
+	assert.False(t, b.FileExists("dog.txt"))
+	count, err = b.WordCount()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), count)
+
+	usage, err = store.Usage()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), usage.Files.Used)
+	report, err := store.Check(false)
+	assert.NoError(t, err)
+	assert.True(t, report.Consistent())
+}
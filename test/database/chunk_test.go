@@ -0,0 +1,78 @@
+package database
+
+import (
+	"io"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/stretchr/testify/assert"
+)
+
+// Reader of a block repeated a number of times
+type repeatReader struct {
+	block  []byte
+	count  int
+	offset int
+}
+
+func (r *repeatReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && r.count > 0 {
+		copied := copy(p[n:], r.block[r.offset:])
+		n += copied
+		if r.offset += copied; r.offset == len(r.block) {
+			r.offset = 0
+			r.count--
+		}
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func TestRemoveLarge(t *testing.T) {
+	config := database.Config{Path: t.TempDir()}
+	store, err := database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the block of words is a single chunk of close to the minimum size,
+	// repeated more times than the releases of its references fit in one
+	// transaction
+	const letters = "abcdefghijklmnopqrstuvwxyz "
+	random := rand.New(rand.NewSource(154))
+	block := make([]byte, 16405)
+	for i := range block {
+		block[i] = letters[random.Intn(len(letters))]
+	}
+	assert.NoError(t, store.AddStream("large.bin", nil, &repeatReader{block: block, count: 110000}))
+	assert.NoError(t, store.Remove("large.bin"))
+	assert.False(t, store.FileExists("large.bin"))
+
+	// the chunks left to release are still referenced, after a restart too
+	report, err := store.Check(false)
+	assert.NoError(t, err)
+	assert.True(t, report.Consistent())
+	assert.NoError(t, store.Close())
+	store, err = database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	report, err = store.Check(false)
+	assert.NoError(t, err)
+	assert.True(t, report.Consistent())
+
+	// the chunk is removed with its last reference
+	assert.Eventually(t, func() bool {
+		usage, err := store.Usage()
+		return err == nil && usage.PhysicalBytes.Used == 0
+	}, time.Minute, 100*time.Millisecond)
+	report, err = store.Check(false)
+	assert.NoError(t, err)
+	assert.True(t, report.Consistent())
+}
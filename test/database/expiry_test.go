@@ -0,0 +1,90 @@
+package database
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiry(t *testing.T) {
+	config := database.Config{Path: t.TempDir()}
+	store, err := database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("this is a short lived build log")
+	sum := sha256.Sum256(data)
+
+	assert.NoError(t, store.AddStreamTTL("build.log", nil, bytes.NewReader(data), 500*time.Millisecond))
+	assert.NoError(t, store.Add("kept.log", nil, data))
+	assert.NoError(t, store.UpdateStreamTTL("other.log", nil, bytes.NewReader([]byte("this is another log")), time.Hour))
+	assert.NoError(t, store.AddStreamTTL("updated.log", nil, bytes.NewReader([]byte("this is an updated log")), time.Hour))
+	assert.NoError(t, store.Update("updated.log", nil, []byte("this is an updated log that stays")))
+	at := time.Now().Add(time.Hour).Round(0)
+	assert.NoError(t, store.AddStreamExpiring("at.log", nil, bytes.NewReader([]byte("this log expires at a time")), at))
+	assert.NoError(t, store.AddStreamExpiring("never.log", nil, bytes.NewReader([]byte("this log does not expire")), time.Time{}))
+
+	list, err := store.List(database.ListOptions{Recursive: true, Details: true})
+	assert.NoError(t, err)
+	expires := map[string]*time.Time{}
+	for _, file := range list.Files {
+		expires[file.Name] = file.Expires
+	}
+	if assert.NotNil(t, expires["build.log"]) && assert.NotNil(t, expires["other.log"]) {
+		assert.WithinDuration(t, time.Now().Add(time.Hour), *expires["other.log"], time.Minute)
+	}
+	assert.Nil(t, expires["kept.log"])
+	assert.Nil(t, expires["updated.log"])
+	if assert.NotNil(t, expires["at.log"]) {
+		assert.True(t, at.Equal(*expires["at.log"]))
+	}
+	assert.Nil(t, expires["never.log"])
+
+	// the expired file is removed, its data stays with the other file
+	assert.Eventually(t, func() bool {
+		return !store.FileExists("build.log")
+	}, 5*time.Second, 50*time.Millisecond)
+	newData, err := store.Get("kept.log")
+	assert.NoError(t, err)
+	assert.Equal(t, data, newData)
+	usage, err := store.Usage()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), usage.Files.Used)
+	assert.NoError(t, store.Remove("kept.log"))
+	assert.False(t, store.SHAExists(sum[:]))
+
+	report, err := store.Check(false)
+	assert.NoError(t, err)
+	assert.True(t, report.Consistent())
+	assert.NoError(t, store.Close())
+
+	// an expiry the sweeper cannot find is found again by a repair
+	editStore(t, config.Path, func(txn *badger.Txn) error {
+		return deletePrefix(txn, []byte("y/"))
+	})
+	store, err = database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	report, err = store.Check(true)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), report.Mismatched)
+	report, err = store.Check(false)
+	assert.NoError(t, err)
+	assert.True(t, report.Consistent())
+
+	// a file is removed at a time at or after its expiry only
+	assert.NoError(t, store.ExpireAt("at.log", at.Add(-time.Nanosecond)))
+	assert.True(t, store.FileExists("at.log"))
+	assert.NoError(t, store.ExpireAt("never.log", at))
+	assert.True(t, store.FileExists("never.log"))
+	assert.NoError(t, store.ExpireAt("at.log", at))
+	assert.False(t, store.FileExists("at.log"))
+	assert.NoError(t, store.ExpireAt("missing.log", at))
+}
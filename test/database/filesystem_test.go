@@ -0,0 +1,121 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/stretchr/testify/assert"
+)
+
+// The changes of the index are kept across a reopen, even when the last
+// one was torn by a crash
+func TestFilesystemIndex(t *testing.T) {
+	config := database.Config{Backend: "filesystem", Path: t.TempDir()}
+	store, err := database.Open(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("file%d.txt", i)
+		assert.NoError(t, store.Add(name, nil, []byte(fmt.Sprintf("common word%d", i))))
+	}
+	assert.NoError(t, store.Update("file0.txt", nil, []byte("common updated")))
+	mover := store.(database.Mover)
+	assert.NoError(t, mover.Rename("file1.txt", "renamed.txt"))
+	assert.NoError(t, mover.Copy("file2.txt", "copied.txt"))
+	assert.NoError(t, store.Remove("file3.txt"))
+	assert.NoError(t, store.Close())
+
+	// the index holds no word counts, and every change went to the log
+	index, err := os.ReadFile(filepath.Join(config.Path, "index.json"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(index), "common")
+	log, err := os.OpenFile(filepath.Join(config.Path, "index.log"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = log.WriteString(`{"Files":{"torn.txt"`)
+	assert.NoError(t, err)
+	assert.NoError(t, log.Close())
+
+	store, err = database.Open(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	assert.False(t, store.FileExists("torn.txt"))
+	assert.False(t, store.FileExists("file1.txt"))
+	assert.False(t, store.FileExists("file3.txt"))
+	data, err := store.Get("file0.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "common updated", string(data))
+	data, err = store.Get("renamed.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "common word1", string(data))
+	data, err = store.Get("copied.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "common word2", string(data))
+
+	count, err := store.WordCount()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200), count)
+	frequency, err := store.WordFrequency()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), frequency["common"])
+	assert.Equal(t, int64(2), frequency["word2"])
+	assert.Zero(t, frequency["word0"])
+	assert.Zero(t, frequency["word3"])
+
+	// the store goes on after the torn change
+	assert.NoError(t, store.Add("next.txt", nil, []byte("next")))
+	assert.True(t, store.FileExists("next.txt"))
+}
+
+// An index written with the word counts in it is read, and its word counts
+// moved next to the data
+func TestFilesystemIndexWords(t *testing.T) {
+	dir := t.TempDir()
+	data := []byte("hello hello world")
+	sum := sha256.Sum256(data)
+	sha := hex.EncodeToString(sum[:])
+	blob := filepath.Join(dir, "blobs", sha[:2], sha[2:4], sha)
+	assert.NoError(t, os.MkdirAll(filepath.Dir(blob), 0755))
+	assert.NoError(t, os.WriteFile(blob, data, 0644))
+	index := fmt.Sprintf(`{"Files":{"file.txt":%q},"Modified":{"file.txt":1},`+
+		`"Data":{%q:{"Size":%d,"Refs":1,"WordCount":3,"Words":{"hello":2,"world":1}}}}`,
+		sha, sha, len(data))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "index.json"), []byte(index), 0644))
+
+	config := database.Config{Backend: "filesystem", Path: dir}
+	for i := 0; i < 2; i++ {
+		store, err := database.Open(&config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := store.Get("file.txt")
+		assert.NoError(t, err)
+		assert.Equal(t, data, got)
+		frequency, err := store.WordFrequency()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int64{"hello": 2, "world": 1}, frequency)
+		assert.NoError(t, store.Close())
+	}
+	written, err := os.ReadFile(filepath.Join(dir, "index.json"))
+	assert.NoError(t, err)
+	assert.NotContains(t, string(written), "hello")
+	assert.FileExists(t, blob+".words")
+
+	store, err := database.Open(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	assert.NoError(t, store.Remove("file.txt"))
+	assert.NoFileExists(t, blob)
+	assert.NoFileExists(t, blob+".words")
+}
@@ -0,0 +1,143 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/stretchr/testify/assert"
+)
+
+// Delete the records under a prefix
+func deletePrefix(txn *badger.Txn, prefix []byte) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Prefix = prefix
+	iterator := txn.NewIterator(opts)
+	defer iterator.Close()
+	var keys [][]byte
+	for iterator.Rewind(); iterator.Valid(); iterator.Next() {
+		keys = append(keys, iterator.Item().KeyCopy(nil))
+	}
+	for _, key := range keys {
+		if err := txn.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestCheck(t *testing.T) {
+	config := database.Config{Path: t.TempDir(), TrashRetention: 1 << 40}
+	files := map[string][]byte{
+		"dangling.txt": []byte("this is data that goes missing"),
+		"orphan.txt":   []byte("this is data that nothing points to"),
+		"missing.txt":  []byte("this is data that loses its chunk"),
+		"counted.txt":  []byte("this is data that is miscounted"),
+		"sound.txt":    []byte("this is data that stays sound"),
+	}
+	SHA := map[string][]byte{}
+	store, err := database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		sum := sha256.Sum256(data)
+		SHA[name] = sum[:]
+		assert.NoError(t, store.Add(name, nil, data))
+	}
+	assert.NoError(t, store.Add("copy/sound.txt", nil, files["sound.txt"]))
+	assert.NoError(t, store.Update("sound.txt", nil, []byte("this is data of an update")))
+	assert.NoError(t, store.Add("trashed.txt", nil, []byte("this is data in the trash")))
+	assert.NoError(t, store.Trash("trashed.txt", "test"))
+
+	report, err := store.Check(false)
+	assert.NoError(t, err)
+	assert.True(t, report.Consistent())
+	assert.NoError(t, store.Close())
+
+	editStore(t, config.Path, func(txn *badger.Txn) error {
+		if err := txn.Delete(append([]byte("s/"), SHA["dangling.txt"]...)); err != nil {
+			return err
+		}
+		if err := txn.Delete([]byte("f/orphan.txt")); err != nil {
+			return err
+		}
+		if err := deletePrefix(txn, []byte("v/orphan.txt\x00")); err != nil {
+			return err
+		}
+		if err := txn.Delete(append([]byte("c/"), SHA["missing.txt"]...)); err != nil {
+			return err
+		}
+		refs := make([]byte, 8)
+		binary.BigEndian.PutUint64(refs, 7)
+		return txn.Set(append([]byte("r/"), SHA["counted.txt"]...), refs)
+	})
+
+	store, err = database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	report, err = store.Check(false)
+	assert.NoError(t, err)
+	assert.False(t, report.Consistent())
+	assert.False(t, report.Repaired)
+	assert.Equal(t, []string{"dangling.txt"}, report.Dangling)
+	// the current version of the dangling file
+	assert.Equal(t, int64(1), report.DanglingEntries)
+	assert.Equal(t, []string{hex.EncodeToString(SHA["orphan.txt"])}, report.Orphaned)
+	assert.Empty(t, report.Corrupt)
+	// the chunks of the missing and orphaned data
+	assert.Equal(t, int64(2), report.OrphanedChunks)
+	assert.Equal(t, []string{hex.EncodeToString(SHA["missing.txt"])}, report.MissingChunks)
+	// reference counts of the dangling, orphaned and miscounted data, chunk
+	// reference counts of the missing and orphaned data, name records of the
+	// dangling and orphaned files, and the three usage counters
+	assert.Equal(t, int64(10), report.Mismatched)
+
+	// a check alone changes nothing
+	again, err := store.Check(false)
+	assert.NoError(t, err)
+	assert.Equal(t, report, again)
+
+	report, err = store.Check(true)
+	assert.NoError(t, err)
+	assert.True(t, report.Repaired)
+	report, err = store.Check(false)
+	assert.NoError(t, err)
+	assert.True(t, report.Consistent(), report)
+
+	// dangling names are freed, and missing chunks quarantined
+	assert.False(t, store.FileExists("dangling.txt"))
+	assert.False(t, store.SHAExists(SHA["orphan.txt"]))
+	_, err = store.Get("missing.txt")
+	assert.Equal(t, database.ErrCorruptData, err)
+	list, err := store.List(database.ListOptions{Recursive: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"copy/sound.txt", "counted.txt", "missing.txt", "sound.txt"}, fileNames(list))
+	trash, err := store.TrashList()
+	assert.NoError(t, err)
+	assert.Len(t, trash, 1)
+
+	// the data can be uploaded again
+	for _, name := range []string{"dangling.txt", "orphan.txt", "missing.txt"} {
+		assert.NoError(t, store.Update(name, nil, files[name]))
+	}
+	for _, name := range []string{"dangling.txt", "orphan.txt", "missing.txt", "counted.txt"} {
+		got, err := store.Get(name)
+		assert.NoError(t, err)
+		assert.Equal(t, files[name], got)
+	}
+	got, err := store.Get("copy/sound.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, files["sound.txt"], got)
+	assert.NoError(t, store.Remove("counted.txt"))
+	assert.False(t, store.SHAExists(SHA["counted.txt"]))
+	report, err = store.Check(false)
+	assert.NoError(t, err)
+	assert.True(t, report.Consistent(), report)
+}
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMove(t *testing.T) {
+	config := database.Config{Path: t.TempDir(), MaxFiles: 3}
+	store, err := database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	assert.NoError(t, store.AddStreamTTL("draft.txt", nil, bytes.NewReader([]byte("the first draft")), time.Hour))
+	assert.NoError(t, store.Update("draft.txt", nil, []byte("the second draft")))
+	assert.NoError(t, store.UpdateStreamTTL("draft.txt", nil, bytes.NewReader([]byte("the final draft")), time.Hour))
+
+	// the versions and the expiry go with the new name
+	assert.NoError(t, store.Rename("draft.txt", "final.txt"))
+	versions, err := store.Versions("final.txt")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 3)
+	_, err = store.Versions("draft.txt")
+	assert.Equal(t, badger.ErrKeyNotFound, err)
+	list, err := store.List(database.ListOptions{Details: true})
+	assert.NoError(t, err)
+	if assert.Len(t, list.Files, 1) {
+		assert.Equal(t, "final.txt", list.Files[0].Name)
+		assert.NotNil(t, list.Files[0].Expires)
+		assert.Equal(t, versions[2].Time.UnixNano(), list.Files[0].Modified.UnixNano())
+	}
+
+	// a copy starts its own history and does not expire
+	assert.NoError(t, store.Copy("final.txt", "copy.txt"))
+	versions, err = store.Versions("copy.txt")
+	assert.NoError(t, err)
+	assert.Len(t, versions, 1)
+	assert.NoError(t, store.Copy("final.txt", "other.txt"))
+	assert.Equal(t, database.ErrFileQuota, store.Copy("final.txt", "more.txt"))
+	usage, err := store.Usage()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), usage.Files.Used)
+	assert.Equal(t, int64(3*len("the final draft")), usage.LogicalBytes.Used)
+
+	// searches find the new names
+	assert.Eventually(t, func() bool {
+		results, err := store.Search("final", 10)
+		names := map[string]bool{}
+		for _, result := range results {
+			names[result.Name] = true
+		}
+		return err == nil && len(names) == 3 && names["final.txt"] && names["copy.txt"] && names["other.txt"]
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// names are only moved inside a bucket
+	assert.NoError(t, store.Remove("other.txt"))
+	assert.NoError(t, store.CreateBucket("team"))
+	bucket, err := store.Bucket("team")
+	assert.NoError(t, err)
+	assert.NoError(t, bucket.Add("notes.txt", nil, []byte("the notes of the team")))
+	mover := bucket.(database.Mover)
+	assert.Equal(t, badger.ErrKeyNotFound, mover.Rename("final.txt", "moved.txt"))
+	assert.NoError(t, mover.Rename("notes.txt", "old/notes.txt"))
+	assert.True(t, bucket.FileExists("old/notes.txt"))
+	assert.False(t, store.FileExists("old/notes.txt"))
+
+	report, err := store.Check(false)
+	assert.NoError(t, err)
+	assert.True(t, report.Consistent())
+}
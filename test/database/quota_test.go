@@ -0,0 +1,76 @@
+package database
+
+import (
+	"crypto/rand"
+	"testing"
+
+	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func randomData(t *testing.T, size int) []byte {
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestQuotas(t *testing.T) {
+	config := database.Config{
+		Path:            t.TempDir(),
+		MaxPhysicalSize: 1,
+		MaxLogicalSize:  2,
+		MaxFiles:        3,
+		MaxFileSize:     1,
+	}
+	store, err := database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	data := randomData(t, 700<<10)
+	assert.NoError(t, store.Add("data.bin", nil, data))
+
+	// over the maximum file size, rejected before the physical quota
+	assert.Equal(t, database.ErrFileTooLarge, store.Add("large.bin", nil, randomData(t, 1<<20+1)))
+	assert.Equal(t, database.ErrFileTooLarge, store.Update("data.bin", nil, randomData(t, 1<<20+1)))
+
+	// new data over the physical quota, a copy of stored data only grows
+	// the logical size
+	assert.Equal(t, database.ErrPhysicalQuota, store.Add("other.bin", nil, randomData(t, 700<<10)))
+	assert.NoError(t, store.Add("copy.bin", nil, data))
+	assert.Equal(t, database.ErrLogicalQuota, store.Add("copy2.bin", nil, data))
+
+	assert.NoError(t, store.Add("small.txt", nil, []byte("small file")))
+	assert.Equal(t, database.ErrFileQuota, store.Add("over.txt", nil, []byte("one file too many")))
+	for _, name := range []string{"large.bin", "other.bin", "copy2.bin", "over.txt"} {
+		assert.False(t, store.FileExists(name))
+	}
+	newData, err := store.Get("data.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, data, newData)
+
+	usage, err := store.Usage()
+	assert.NoError(t, err)
+	assert.Equal(t, database.Quota{Used: 3, Limit: 3}, usage.Files)
+	assert.Equal(t, int64(2*len(data)+10), usage.LogicalBytes.Used)
+	assert.Equal(t, int64(2<<20), usage.LogicalBytes.Limit)
+	assert.GreaterOrEqual(t, usage.PhysicalBytes.Used, int64(len(data)+10))
+	assert.Less(t, usage.PhysicalBytes.Used, int64(len(data)+(64<<10)))
+	assert.Equal(t, int64(1<<20), usage.MaxFileSize)
+
+	// removed files free their quota, data is freed with its last file
+	assert.NoError(t, store.Remove("copy.bin"))
+	assert.NoError(t, store.Remove("small.txt"))
+	usage, err = store.Usage()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), usage.Files.Used)
+	assert.Equal(t, int64(len(data)), usage.LogicalBytes.Used)
+	assert.NoError(t, store.Add("other.bin", nil, randomData(t, 200<<10)))
+
+	report, err := store.Check(false)
+	assert.NoError(t, err)
+	assert.True(t, report.Consistent())
+}
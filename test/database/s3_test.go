@@ -0,0 +1,186 @@
+package database
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/stretchr/testify/assert"
+)
+
+// In-process stand-in for an S3 compatible object store, serving path style
+// requests on a single bucket
+type fakeS3 struct {
+	lock    sync.Mutex
+	bucket  string
+	objects map[string][]byte
+}
+
+func newFakeS3(bucket string) (*fakeS3, *httptest.Server) {
+	s3 := &fakeS3{bucket: bucket, objects: map[string][]byte{}}
+	return s3, httptest.NewServer(s3)
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	if path[0] != s.bucket {
+		s.error(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if len(path) == 1 || path[1] == "" {
+		// bucket requests, only HEAD to check that it exists
+		if r.Method != http.MethodHead {
+			s.error(w, http.StatusNotImplemented, "NotImplemented")
+		}
+		return
+	}
+	key := path[1]
+	switch r.Method {
+	case http.MethodPut:
+		data, err := readBody(r)
+		if err != nil {
+			s.error(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		s.objects[key] = data
+		w.Header().Set("ETag", etag(data))
+	case http.MethodGet, http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			s.error(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", etag(data))
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		w.Write(data)
+	case http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.error(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// Read the data of an upload, sent in signed chunks by streaming uploads
+func readBody(r *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(r.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return io.ReadAll(r.Body)
+	}
+	data := []byte{}
+	reader := bufio.NewReader(r.Body)
+	for {
+		// <hex size>;chunk-signature=<signature>\r\n<data>\r\n
+		header, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(header, ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, chunk); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return data, nil
+		}
+		data = append(data, chunk[:size]...)
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+func (s *fakeS3) error(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>`+code+`</Code></Error>`)
+}
+
+// Returns the keys of the objects, checking that each holds the data of its SHA
+func (s *fakeS3) keys(t *testing.T, prefix string) []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	keys := []string{}
+	for key, data := range s.objects {
+		sum := sha256.Sum256(data)
+		assert.Equal(t, prefix+hex.EncodeToString(sum[:]), key)
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func s3Config(server *httptest.Server) database.S3Config {
+	return database.S3Config{
+		Endpoint:  strings.TrimPrefix(server.URL, "http://"),
+		Bucket:    "store",
+		Region:    "us-east-1",
+		Prefix:    "chunks/",
+		AccessKey: "access",
+		SecretKey: "secret",
+		PathStyle: true,
+	}
+}
+
+func TestS3Conformance(t *testing.T) {
+	s3, server := newFakeS3("store")
+	defer server.Close()
+	conformance(t, database.Config{Backend: "badger", S3: s3Config(server)}, true)
+
+	// only the data of the file kept by the reopen test is left in the bucket
+	assert.Len(t, s3.keys(t, "chunks/"), 1)
+}
+
+func TestS3(t *testing.T) {
+	s3, server := newFakeS3("store")
+	defer server.Close()
+	config := database.Config{Backend: "badger", Path: t.TempDir(), S3: s3Config(server)}
+	store, err := database.Open(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// chunks are written to the bucket, not to the database
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	assert.NoError(t, store.Add("large.bin", nil, data))
+	keys := s3.keys(t, "chunks/")
+	assert.Greater(t, len(keys), 1)
+	assert.NoError(t, store.Add("copy.bin", nil, data))
+	assert.Len(t, s3.keys(t, "chunks/"), len(keys))
+
+	// the chunks of removed files stay until they are swept, and can be
+	// taken back by an upload of the same data
+	assert.NoError(t, store.Remove("large.bin"))
+	assert.NoError(t, store.Remove("copy.bin"))
+	assert.Len(t, s3.keys(t, "chunks/"), len(keys))
+	assert.NoError(t, store.Add("again.bin", nil, data))
+	got, err := store.Get("again.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	assert.NoError(t, store.Remove("again.bin"))
+	assert.NoError(t, store.Close())
+	assert.Empty(t, s3.keys(t, "chunks/"))
+
+	config.S3.Bucket = "missing"
+	_, err = database.Open(&config)
+	assert.Equal(t, database.ErrMissingBucket, err)
+}
@@ -0,0 +1,226 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/stretchr/testify/assert"
+)
+
+// Edit the records of a store in badger directly, with the store closed
+func editStore(t *testing.T, path string, fn func(txn *badger.Txn) error) {
+	store, err := badger.Open(badger.DefaultOptions(filepath.Join(path, "store")).WithLoggingLevel(badger.ERROR))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Update(fn); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Flip a byte of a chunk stored in badger, with the store closed
+func corruptChunk(t *testing.T, path string, sha []byte) {
+	editStore(t, path, func(txn *badger.Txn) error {
+		key := append([]byte("c/"), sha...)
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		data, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		data[0] ^= 0xff
+		return txn.Set(key, data)
+	})
+}
+
+func TestScrub(t *testing.T) {
+	config := database.Config{Path: t.TempDir()}
+	data := []byte("this is data that rots")
+	SHA := sha256.Sum256(data)
+	store, err := database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, store.Add("rotten.txt", nil, data))
+	assert.NoError(t, store.Add("copy/rotten.txt", nil, data))
+	assert.NoError(t, store.Add("sound.txt", nil, []byte("this is data that keeps")))
+	report, err := store.LastScrub()
+	assert.NoError(t, err)
+	assert.Nil(t, report)
+	assert.NoError(t, store.Close())
+
+	corruptChunk(t, config.Path, SHA[:])
+	store, err = database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// the corrupt chunk is quarantined and the files using it flagged
+	report, err = store.Scrub()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), report.Chunks)
+	assert.Equal(t, []string{hex.EncodeToString(SHA[:])}, report.Corrupt)
+	assert.Equal(t, int64(1), report.Quarantined)
+	assert.Equal(t, []string{"copy/rotten.txt", "rotten.txt"}, report.Damaged)
+	last, err := store.LastScrub()
+	assert.NoError(t, err)
+	assert.Equal(t, report.Damaged, last.Damaged)
+	assert.True(t, last.Finished.Equal(report.Finished))
+
+	_, err = store.Get("rotten.txt")
+	assert.Equal(t, database.ErrCorruptData, err)
+	got, err := store.Get("sound.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("this is data that keeps"), got)
+	// the damaged data is asked for again instead of being deduplicated
+	assert.False(t, store.SHAExists(SHA[:]))
+
+	// a scrub does not quarantine a chunk twice
+	report, err = store.Scrub()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Corrupt)
+	assert.Equal(t, int64(1), report.Chunks)
+	assert.Equal(t, int64(1), report.Quarantined)
+
+	// uploading the data again heals the files
+	assert.NoError(t, store.Add("again.txt", nil, data))
+	for _, name := range []string{"rotten.txt", "copy/rotten.txt", "again.txt"} {
+		got, err := store.Get(name)
+		assert.NoError(t, err)
+		assert.Equal(t, data, got)
+	}
+	assert.True(t, store.SHAExists(SHA[:]))
+	report, err = store.Scrub()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), report.Quarantined)
+	assert.Empty(t, report.Damaged)
+}
+
+func TestScrubRemoved(t *testing.T) {
+	config := database.Config{Path: t.TempDir()}
+	data := []byte("this is data that is removed")
+	SHA := sha256.Sum256(data)
+	store, err := database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, store.Add("removed.txt", nil, data))
+	assert.NoError(t, store.Close())
+	corruptChunk(t, config.Path, SHA[:])
+
+	store, err = database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	report, err := store.Scrub()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"removed.txt"}, report.Damaged)
+
+	// removing the damaged files drops the quarantined chunk
+	assert.NoError(t, store.Remove("removed.txt"))
+	report, err = store.Scrub()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), report.Chunks)
+	assert.Equal(t, int64(0), report.Quarantined)
+	assert.NoError(t, store.Add("removed.txt", nil, data))
+	got, err := store.Get("removed.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+}
+
+func TestScrubS3(t *testing.T) {
+	s3, server := newFakeS3("store")
+	defer server.Close()
+	config := database.Config{Path: t.TempDir(), S3: s3Config(server)}
+	store, err := database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	assert.NoError(t, store.Add("large.bin", nil, data))
+	keys := s3.keys(t, "chunks/")
+
+	// one object rots and another one goes missing
+	s3.lock.Lock()
+	s3.objects[keys[0]][0] ^= 0xff
+	delete(s3.objects, keys[1])
+	s3.lock.Unlock()
+
+	report, err := store.Scrub()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(keys)), report.Chunks)
+	assert.ElementsMatch(t, []string{keys[0][len("chunks/"):], keys[1][len("chunks/"):]}, report.Corrupt)
+	assert.Equal(t, []string{"large.bin"}, report.Damaged)
+	assert.Len(t, s3.keys(t, "chunks/"), len(keys)-2)
+	_, err = store.Get("large.bin")
+	assert.Equal(t, database.ErrCorruptData, err)
+
+	// the objects are uploaded again with the data
+	assert.NoError(t, store.Add("again.bin", nil, data))
+	assert.Len(t, s3.keys(t, "chunks/"), len(keys))
+	got, err := store.Get("large.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+	report, err = store.Scrub()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Damaged)
+}
+
+func TestScrubHistory(t *testing.T) {
+	config := database.Config{Path: t.TempDir(), MaxVersions: 3, TrashRetention: time.Hour}
+	data := []byte("this is data that rots in the history")
+	SHA := sha256.Sum256(data)
+	store, err := database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, store.CreateBucket("team"))
+	bucket, err := store.Bucket("team")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, store := range []database.Store{store, bucket} {
+		assert.NoError(t, store.Add("report.txt", nil, data))
+		assert.NoError(t, store.Update("report.txt", nil, []byte("this is data that keeps")))
+		assert.NoError(t, store.Add("trashed.txt", nil, data))
+		assert.NoError(t, store.(database.Trasher).Trash("trashed.txt", "test"))
+	}
+	trashed, err := store.TrashList()
+	assert.NoError(t, err)
+	bucketTrashed, err := bucket.(database.Trasher).TrashList()
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+	corruptChunk(t, config.Path, SHA[:])
+
+	store, err = database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// only old versions and trashed files use the damaged data
+	report, err := store.Scrub()
+	assert.NoError(t, err)
+	assert.Empty(t, report.Damaged)
+	assert.Equal(t, map[string][]uint64{"report.txt": {1}, "team:report.txt": {1}}, report.DamagedVersions)
+	if assert.Len(t, trashed, 1) && assert.Len(t, bucketTrashed, 1) {
+		assert.Equal(t, map[string][]uint64{
+			"trashed.txt":      {trashed[0].ID},
+			"team:trashed.txt": {bucketTrashed[0].ID},
+		}, report.DamagedTrash)
+	}
+}
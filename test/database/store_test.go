@@ -0,0 +1,451 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/stretchr/testify/assert"
+)
+
+// Backends run through the conformance suite, with whether they keep the
+// files when the store is opened again
+var backends = []struct {
+	config     database.Config
+	persistent bool
+}{
+	{database.Config{Backend: "badger"}, true},
+	{database.Config{Backend: "badger", Diskless: true}, false},
+	{database.Config{Backend: "filesystem"}, true},
+	{database.Config{Backend: "memory"}, false},
+}
+
+// Every backend must behave the same through the Store interface
+func TestConformance(t *testing.T) {
+	for _, backend := range backends {
+		name := backend.config.Backend
+		if backend.config.Diskless {
+			name += "/diskless"
+		}
+		t.Run(name, func(t *testing.T) {
+			conformance(t, backend.config, backend.persistent)
+		})
+	}
+}
+
+// Run the conformance suite on a store opened from a configuration
+func conformance(t *testing.T, config database.Config, persistent bool) {
+	config.Path = t.TempDir()
+	open := func(t *testing.T) database.Store {
+		store, err := database.Open(&config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	}
+	for _, test := range []struct {
+		name string
+		fn   func(t *testing.T, store database.Store)
+	}{
+		{"AddGet", testAddGet},
+		{"Update", testUpdate},
+		{"Remove", testRemove},
+		{"SHA", testSHA},
+		{"Names", testNames},
+		{"List", testList},
+		{"ListPages", testListPages},
+		{"Move", testMove},
+		{"Words", testWords},
+		{"Concurrent", testConcurrent},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			store := open(t)
+			defer store.Close()
+			defer removeAll(t, store)
+			test.fn(t, store)
+		})
+	}
+	if persistent {
+		t.Run("Reopen", func(t *testing.T) {
+			testReopen(t, open)
+		})
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	store, err := database.Open(&database.Config{Backend: "tape"})
+	assert.Nil(t, store)
+	assert.Equal(t, database.ErrUnknownBackend, err)
+	assert.Equal(t, []string{"badger", "filesystem", "memory"}, database.Backends())
+}
+
+// Remove every file, so that the next test starts from an empty store
+func removeAll(t *testing.T, store database.Store) {
+	list, err := store.List(database.ListOptions{Recursive: true})
+	assert.NoError(t, err)
+	for _, name := range fileNames(list) {
+		assert.NoError(t, store.Remove(name))
+	}
+}
+
+// Returns the names of the files of a listing
+func fileNames(list *database.FileList) []string {
+	names := []string{}
+	for _, file := range list.Files {
+		names = append(names, file.Name)
+	}
+	return names
+}
+
+func testAddGet(t *testing.T, store database.Store) {
+	data := []byte("this is test data")
+	assert.False(t, store.FileExists("file.txt"))
+	assert.NoError(t, store.Add("file.txt", nil, data))
+	assert.True(t, store.FileExists("file.txt"))
+
+	got, err := store.Get("file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+	var buf bytes.Buffer
+	assert.NoError(t, store.GetStream("file.txt", &buf))
+	assert.Equal(t, data, buf.Bytes())
+
+	assert.Equal(t, badger.ErrConflict, store.Add("file.txt", nil, []byte("other data")))
+	got, err = store.Get("file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	_, err = store.Get("missing.txt")
+	assert.Equal(t, badger.ErrKeyNotFound, err)
+	assert.Equal(t, badger.ErrKeyNotFound, store.GetStream("missing.txt", &buf))
+
+	// streams of several chunks
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	assert.NoError(t, store.AddStream("large.bin", nil, bytes.NewReader(large)))
+	buf.Reset()
+	assert.NoError(t, store.GetStream("large.bin", &buf))
+	assert.Equal(t, large, buf.Bytes())
+
+	assert.NoError(t, store.Add("empty.txt", nil, nil))
+	got, err = store.Get("empty.txt")
+	assert.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func testUpdate(t *testing.T, store database.Store) {
+	old := []byte("this is old data")
+	updated := []byte("this is new data")
+	oldSHA := sha256.Sum256(old)
+
+	// update creates missing files
+	assert.NoError(t, store.Update("file.txt", nil, old))
+	assert.NoError(t, store.UpdateStream("file.txt", nil, bytes.NewReader(updated)))
+	got, err := store.Get("file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, updated, got)
+
+	assert.NoError(t, store.Update("file.txt", nil, updated))
+	got, err = store.Get("file.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, updated, got)
+	list, err := store.List(database.ListOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"file.txt"}, fileNames(list))
+
+	// the old data is gone, unless something else keeps it
+	if _, ok := store.(database.Versioner); !ok {
+		assert.False(t, store.SHAExists(oldSHA[:]))
+	}
+}
+
+func testRemove(t *testing.T, store database.Store) {
+	data := []byte("this is removed data")
+	SHA := sha256.Sum256(data)
+	assert.NoError(t, store.Add("one.txt", nil, data))
+	assert.NoError(t, store.Add("two.txt", nil, data))
+
+	// data shared by two files stays until both are removed
+	assert.NoError(t, store.Remove("one.txt"))
+	assert.False(t, store.FileExists("one.txt"))
+	assert.True(t, store.SHAExists(SHA[:]))
+	got, err := store.Get("two.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	assert.NoError(t, store.Remove("two.txt"))
+	assert.False(t, store.SHAExists(SHA[:]))
+	assert.Equal(t, badger.ErrKeyNotFound, store.Remove("two.txt"))
+
+	// the name can be used again
+	assert.NoError(t, store.Add("one.txt", nil, []byte("new data")))
+}
+
+func testSHA(t *testing.T, store database.Store) {
+	data := []byte("this is deduplicated data")
+	SHA := sha256.Sum256(data)
+	assert.False(t, store.SHAExists(SHA[:]))
+	assert.NoError(t, store.Add("one.txt", SHA[:], data))
+	assert.True(t, store.SHAExists(SHA[:]))
+
+	// data already in the store is not sent again
+	assert.NoError(t, store.Add("two.txt", SHA[:], nil))
+	assert.NoError(t, store.Update("three.txt", SHA[:], nil))
+	for _, name := range []string{"two.txt", "three.txt"} {
+		got, err := store.Get(name)
+		assert.NoError(t, err)
+		assert.Equal(t, data, got)
+	}
+
+	// data sent with a SHA must match it
+	other := sha256.Sum256([]byte("this is other data"))
+	assert.Equal(t, database.ErrSHAMismatch, store.Add("four.txt", other[:], data))
+	assert.Equal(t, database.ErrSHAMismatch, store.Update("four.txt", other[:], data))
+	assert.Equal(t, database.ErrMissingData, store.Add("four.txt", other[:], nil))
+	assert.False(t, store.FileExists("four.txt"))
+	assert.False(t, store.SHAExists(other[:]))
+
+	list, err := store.List(database.ListOptions{Details: true})
+	assert.NoError(t, err)
+	assert.Len(t, list.Files, 3)
+	for _, file := range list.Files {
+		assert.Equal(t, hex.EncodeToString(SHA[:]), file.SHA)
+	}
+}
+
+func testNames(t *testing.T, store database.Store) {
+	for _, name := range []string{"", ".", "..", "../up.txt", "/root.txt", "a//b.txt", "a/./b.txt", "a/", "a\x00b"} {
+		assert.Equal(t, database.ErrInvalidName, store.Add(name, nil, []byte("data")), name)
+		assert.Equal(t, database.ErrInvalidName, store.Update(name, nil, []byte("data")), name)
+	}
+	_, err := store.List(database.ListOptions{Dir: "../a"})
+	assert.Equal(t, database.ErrInvalidName, err)
+}
+
+func testList(t *testing.T, store database.Store) {
+	files := []string{"a.txt", "a/report.txt", "a/sub/deep.txt", "a0.txt", "b/report.txt", "top.txt"}
+	for _, name := range files {
+		assert.NoError(t, store.Add(name, nil, []byte("data of "+name)))
+	}
+	for _, test := range []struct {
+		dir       string
+		recursive bool
+		list      []string
+	}{
+		{"", false, []string{"a.txt", "a/", "a0.txt", "b/", "top.txt"}},
+		{"a", false, []string{"a/report.txt", "a/sub/"}},
+		{"a/", false, []string{"a/report.txt", "a/sub/"}},
+		{"a", true, []string{"a/report.txt", "a/sub/deep.txt"}},
+		{"", true, files},
+		{"c", false, []string{}},
+	} {
+		list, err := store.List(database.ListOptions{Dir: test.dir, Recursive: test.recursive})
+		assert.NoError(t, err)
+		assert.Equal(t, test.list, fileNames(list), test.dir)
+	}
+
+	list, err := store.List(database.ListOptions{Dir: "a", Details: true})
+	assert.NoError(t, err)
+	if assert.Len(t, list.Files, 2) {
+		assert.NotNil(t, list.Files[0].Modified)
+		list.Files[0].Modified = nil
+	}
+	SHA := sha256.Sum256([]byte("data of a/report.txt"))
+	assert.Equal(t, []database.File{
+		{Name: "a/report.txt", SHA: hex.EncodeToString(SHA[:]), Size: 20, WordCount: 3},
+		{Name: "a/sub/"},
+	}, list.Files)
+}
+
+func testListPages(t *testing.T, store database.Store) {
+	files := map[string]string{
+		"logs/a.log": "one",
+		"logs/b.log": "one two three four",
+		"logs/c.txt": "one two",
+		"notes.txt":  "one two three",
+	}
+	for name, data := range files {
+		assert.NoError(t, store.Add(name, nil, []byte(data)))
+	}
+	// read every page of a listing
+	pages := func(options database.ListOptions) ([]string, int) {
+		names, count := []string{}, 0
+		for {
+			list, err := store.List(options)
+			if !assert.NoError(t, err) {
+				return nil, 0
+			}
+			assert.LessOrEqual(t, len(list.Files), options.Limit)
+			names, count = append(names, fileNames(list)...), count+1
+			if list.Next == "" {
+				return names, count
+			}
+			options.After = list.Next
+		}
+	}
+	for _, test := range []struct {
+		options database.ListOptions
+		list    []string
+		pages   int
+	}{
+		{database.ListOptions{Recursive: true}, []string{"logs/a.log", "logs/b.log", "logs/c.txt", "notes.txt"}, 2},
+		{database.ListOptions{}, []string{"logs/", "notes.txt"}, 1},
+		{database.ListOptions{Recursive: true, Prefix: "logs/b"}, []string{"logs/b.log"}, 1},
+		{database.ListOptions{Prefix: "lo"}, []string{"logs/"}, 1},
+		{database.ListOptions{Dir: "logs", Prefix: "notes"}, []string{}, 1},
+		{database.ListOptions{Recursive: true, Pattern: "*.txt"}, []string{"logs/c.txt", "notes.txt"}, 1},
+		{database.ListOptions{Pattern: "log*"}, []string{"logs/"}, 1},
+		{database.ListOptions{Recursive: true, Reverse: true}, []string{"notes.txt", "logs/c.txt", "logs/b.log", "logs/a.log"}, 2},
+		{database.ListOptions{Recursive: true, Sort: database.SortSize}, []string{"logs/a.log", "logs/c.txt", "notes.txt", "logs/b.log"}, 2},
+		{database.ListOptions{Dir: "logs", Sort: database.SortWords, Reverse: true}, []string{"logs/b.log", "logs/c.txt", "logs/a.log"}, 2},
+	} {
+		test.options.Limit = 2
+		names, count := pages(test.options)
+		assert.Equal(t, test.list, names, test.options)
+		assert.Equal(t, test.pages, count, test.options)
+	}
+
+	// the last written file comes first, newest first
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, store.Update("logs/a.log", nil, []byte("one more line")))
+	list, err := store.List(database.ListOptions{Recursive: true, Sort: database.SortModified, Reverse: true, Limit: 1, Details: true})
+	assert.NoError(t, err)
+	if assert.Len(t, list.Files, 1) {
+		assert.Equal(t, "logs/a.log", list.Files[0].Name)
+		assert.Equal(t, int64(13), list.Files[0].Size)
+	}
+	assert.NotEmpty(t, list.Next)
+
+	_, err = store.List(database.ListOptions{Sort: "color"})
+	assert.Equal(t, database.ErrInvalidSort, err)
+	_, err = store.List(database.ListOptions{Pattern: "["})
+	assert.Equal(t, path.ErrBadPattern, err)
+	_, err = store.List(database.ListOptions{Sort: database.SortSize, After: "notes.txt"})
+	assert.Equal(t, database.ErrInvalidCursor, err)
+}
+
+func testMove(t *testing.T, store database.Store) {
+	mover, ok := store.(database.Mover)
+	if !ok {
+		t.Skip("backend does not rename files")
+	}
+	data := []byte("this is moved data")
+	SHA := sha256.Sum256(data)
+	assert.NoError(t, store.Add("a.txt", nil, data))
+	assert.NoError(t, store.Add("b.txt", nil, []byte("this is other data")))
+
+	assert.NoError(t, mover.Rename("a.txt", "dir/a.txt"))
+	assert.False(t, store.FileExists("a.txt"))
+	assert.Equal(t, badger.ErrKeyNotFound, mover.Rename("a.txt", "c.txt"))
+	assert.Equal(t, badger.ErrConflict, mover.Rename("dir/a.txt", "b.txt"))
+	assert.Equal(t, database.ErrInvalidName, mover.Rename("dir/a.txt", "../a.txt"))
+
+	assert.NoError(t, mover.Copy("dir/a.txt", "copy.txt"))
+	assert.Equal(t, badger.ErrConflict, mover.Copy("dir/a.txt", "b.txt"))
+	assert.Equal(t, badger.ErrKeyNotFound, mover.Copy("a.txt", "d.txt"))
+	for _, name := range []string{"dir/a.txt", "copy.txt"} {
+		newData, err := store.Get(name)
+		assert.NoError(t, err)
+		assert.Equal(t, data, newData)
+	}
+	count, err := store.WordCount()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12), count)
+
+	// the data stays until the last copy is removed
+	assert.NoError(t, store.Remove("dir/a.txt"))
+	assert.True(t, store.SHAExists(SHA[:]))
+	assert.NoError(t, store.Remove("copy.txt"))
+	if _, ok := store.(database.Versioner); !ok {
+		assert.False(t, store.SHAExists(SHA[:]))
+	}
+}
+
+func testWords(t *testing.T, store database.Store) {
+	assert.NoError(t, store.Add("one.txt", nil, []byte("The quick brown fox")))
+	assert.NoError(t, store.Add("two.txt", nil, []byte("the lazy DOG "+strings.Repeat("x", 100))))
+	assert.NoError(t, store.Add("three.txt", nil, []byte("The quick brown fox")))
+	assert.NoError(t, store.Update("three.txt", nil, []byte("a fox")))
+	assert.NoError(t, store.Remove("two.txt"))
+	assert.NoError(t, store.Add("four.txt", nil, []byte("lazy\nlazy\tdog")))
+	// long words and invalid UTF-8 are counted, and counting stops at a word
+	// too long for a bufio.Scanner
+	assert.NoError(t, store.Add("five.txt", nil, []byte("Long "+strings.Repeat("y", 100)+" \xffbad")))
+	assert.NoError(t, store.Add("six.txt", nil, []byte("first "+strings.Repeat("z", bufio.MaxScanTokenSize)+" last")))
+
+	count, err := store.WordCount()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(13), count)
+	frequency, err := store.WordFrequency()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{
+		"the":   1,
+		"quick": 1,
+		"brown": 1,
+		"fox":   2,
+		"a":     1,
+		"lazy":  2,
+		"dog":   1,
+		"long":  1,
+		"first": 1,
+
+		strings.Repeat("y", 100): 1,
+		"\ufffdbad":              1,
+	}, frequency)
+}
+
+func testConcurrent(t *testing.T, store database.Store) {
+	data := []byte("this is shared data")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := string(rune('a'+i)) + ".txt"
+			for j := 0; j < 10; j++ {
+				assert.NoError(t, store.Update(name, nil, data))
+				assert.NoError(t, store.Remove(name))
+			}
+			assert.NoError(t, store.Add(name, nil, data))
+		}(i)
+	}
+	wg.Wait()
+	list, err := store.List(database.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, list.Files, 8)
+	count, err := store.WordCount()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8*4), count)
+}
+
+func testReopen(t *testing.T, open func(t *testing.T) database.Store) {
+	store := open(t)
+	data := []byte("this is kept data")
+	assert.NoError(t, store.Add("dir/kept.txt", nil, data))
+	assert.NoError(t, store.Add("removed.txt", nil, []byte("this is removed data")))
+	assert.NoError(t, store.Remove("removed.txt"))
+	assert.NoError(t, store.Close())
+
+	store = open(t)
+	defer store.Close()
+	got, err := store.Get("dir/kept.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.False(t, store.FileExists("removed.txt"))
+	list, err := store.List(database.ListOptions{Recursive: true})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dir/kept.txt"}, fileNames(list))
+	count, err := store.WordCount()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), count)
+	frequency, err := store.WordFrequency()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int64{"this": 1, "is": 1, "kept": 1, "data": 1}, frequency)
+}
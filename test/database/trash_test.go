@@ -0,0 +1,33 @@
+package database
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrashAt(t *testing.T) {
+	store, err := database.New(&database.Config{Path: t.TempDir(), TrashRetention: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	// files removed under the same name at the same time get the next IDs
+	at := time.Now()
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, store.Add("a.txt", nil, []byte("this is removed at a given time")))
+		assert.NoError(t, store.TrashAt("a.txt", "test", at))
+	}
+	trashed, err := store.TrashList()
+	assert.NoError(t, err)
+	if assert.Len(t, trashed, 2) {
+		assert.Equal(t, uint64(at.UnixNano()), trashed[0].ID)
+		assert.Equal(t, uint64(at.UnixNano())+1, trashed[1].ID)
+		assert.Equal(t, "test", trashed[1].DeletedBy)
+	}
+	assert.NoError(t, store.RestoreTrash("a.txt", uint64(at.UnixNano())))
+	assert.True(t, store.FileExists("a.txt"))
+}
@@ -0,0 +1,178 @@
+package database
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns the next n events of a watch
+func nextEvents(t *testing.T, events <-chan database.Event, n int) []database.Event {
+	var received []database.Event
+	for len(received) < n {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				t.Fatal("watch ended")
+			}
+			received = append(received, event)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d events out of %d", len(received), n)
+		}
+	}
+	return received
+}
+
+func shaOf(data string) string {
+	sum := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestWatch(t *testing.T) {
+	config := database.Config{Path: t.TempDir()}
+	store, err := database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// watching from now on only sees the changes to come
+	assert.NoError(t, store.Add("old.txt", nil, []byte("written before the watch")))
+	events, err := store.Watch(ctx, database.WatchNow)
+	assert.NoError(t, err)
+
+	assert.NoError(t, store.Add("a.txt", nil, []byte("the first text")))
+	assert.NoError(t, store.Update("a.txt", nil, []byte("the second text")))
+	assert.NoError(t, store.Update("a.txt", nil, []byte("the second text")))
+	assert.NoError(t, store.Rename("a.txt", "b.txt"))
+	assert.NoError(t, store.Copy("b.txt", "c.txt"))
+	assert.NoError(t, store.Remove("b.txt"))
+
+	sha := shaOf("the second text")
+	received := nextEvents(t, events, 5)
+	expected := []database.Event{
+		{Type: database.EventAdd, Name: "a.txt", SHA: shaOf("the first text")},
+		{Type: database.EventUpdate, Name: "a.txt", SHA: sha},
+		{Type: database.EventRename, Name: "b.txt", From: "a.txt", SHA: sha},
+		{Type: database.EventAdd, Name: "c.txt", SHA: sha},
+		{Type: database.EventRemove, Name: "b.txt", SHA: sha},
+	}
+	for i, event := range received {
+		assert.Equal(t, received[0].Sequence+uint64(i), event.Sequence)
+		assert.False(t, event.Time.IsZero())
+		event.Sequence, event.Time = 0, time.Time{}
+		assert.Equal(t, expected[i], event)
+	}
+
+	last, err := store.LastEvent()
+	assert.NoError(t, err)
+	assert.Equal(t, received[4], last)
+
+	// a watch resumes after a sequence number
+	resumed, err := store.Watch(ctx, received[2].Sequence)
+	assert.NoError(t, err)
+	again := nextEvents(t, resumed, 2)
+	assert.Equal(t, received[3:], again)
+
+	// the events of a bucket are only seen by the watchers of the bucket
+	assert.NoError(t, store.CreateBucket("photos"))
+	bucket, err := store.Bucket("photos")
+	assert.NoError(t, err)
+	bucketEvents, err := bucket.(database.Watcher).Watch(ctx, database.WatchNow)
+	assert.NoError(t, err)
+	assert.NoError(t, bucket.Add("cat.txt", nil, []byte("a cat")))
+	assert.NoError(t, store.Add("dog.txt", nil, []byte("a dog")))
+	event := nextEvents(t, bucketEvents, 1)[0]
+	assert.Equal(t, "cat.txt", event.Name)
+	event = nextEvents(t, events, 1)[0]
+	assert.Equal(t, "dog.txt", event.Name)
+
+	// the watch ends with its context
+	cancel()
+	assert.Eventually(t, func() bool {
+		for {
+			select {
+			case _, ok := <-events:
+				if !ok {
+					return true
+				}
+			default:
+				return false
+			}
+		}
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestWatchPruned(t *testing.T) {
+	path := t.TempDir()
+	config := database.Config{Path: path}
+	store, err := database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, store.Add("a.txt", nil, []byte("some text")))
+	assert.NoError(t, store.Add("b.txt", nil, []byte("more text")))
+	events, err := store.Watch(context.Background(), 0)
+	assert.NoError(t, err)
+	assert.Len(t, nextEvents(t, events, 2), 2)
+	assert.NoError(t, store.Close())
+
+	// the events past the retention are pruned once the store is opened
+	config = database.Config{Path: path, EventRetention: time.Nanosecond}
+	store, err = database.New(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	assert.Eventually(t, func() bool {
+		_, err := store.Watch(context.Background(), 0)
+		return err == database.ErrEventsPruned
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// with no event kept, the last event only has the sequence number of the
+	// last event written, which the events to come are watched from
+	last, err := store.LastEvent()
+	assert.NoError(t, err)
+	assert.Equal(t, database.Event{Sequence: 2}, last)
+
+	// a watcher left behind the events kept, here by restoring the pruned
+	// journal, gets a reset event and its watch ends
+	backup := &bytes.Buffer{}
+	_, err = store.Backup(backup, 0)
+	assert.NoError(t, err)
+	other, err := database.New(&database.Config{Path: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	behind, err := other.Watch(context.Background(), database.WatchNow)
+	assert.NoError(t, err)
+	assert.NoError(t, other.RestoreBackup(backup, false))
+	reset := nextEvents(t, behind, 1)[0]
+	assert.Equal(t, database.EventReset, reset.Type)
+	assert.Equal(t, uint64(0), reset.Sequence)
+	select {
+	case _, ok := <-behind:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch did not end")
+	}
+
+	// the sequence numbers go on from the last event
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err = store.Watch(ctx, last.Sequence)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Add("c.txt", nil, []byte("new text")))
+	event := nextEvents(t, events, 1)[0]
+	assert.Equal(t, uint64(3), event.Sequence)
+	assert.Equal(t, "c.txt", event.Name)
+}
@@ -1,20 +1,33 @@
 package server
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sayan-biswas/file-store/pkg/cluster"
 	"github.com/sayan-biswas/file-store/pkg/database"
+	"github.com/sayan-biswas/file-store/pkg/replication"
+	"github.com/sayan-biswas/file-store/pkg/server/config"
+	"github.com/sayan-biswas/file-store/pkg/server/middleware"
 	"github.com/sayan-biswas/file-store/pkg/server/router"
 	"github.com/stretchr/testify/assert"
 )
@@ -34,6 +47,31 @@ func cleanUp() {
 		log.Fatal(err)
 	}
 }
+
+// Build a multipart request the same way the client does
+func upload(method string, fileName string, SHA []byte, data []byte) (*http.Request, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	ioWriter, _ := writer.CreateFormField("name")
+	if _, err := io.WriteString(ioWriter, fileName); err != nil {
+		return nil, err
+	}
+	ioWriter, _ = writer.CreateFormField("SHA")
+	if _, err := ioWriter.Write(SHA); err != nil {
+		return nil, err
+	}
+	ioWriter, _ = writer.CreateFormFile("file", path.Base(fileName))
+	if _, err := ioWriter.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	req := httptest.NewRequest(method, "/store", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	return req, nil
+}
+
 func TestServer(t *testing.T) {
 	defer cleanUp()
 
@@ -153,6 +191,10 @@ func TestServer(t *testing.T) {
 		response := []database.File{}
 		err := json.Unmarshal(rr.Body.Bytes(), &response)
 		assert.NoError(t, err)
+		for i := range response {
+			assert.NotNil(t, response[i].Modified)
+			response[i].Modified = nil
+		}
 		assert.Equal(t, list, response)
 	})
 
@@ -206,4 +248,1424 @@ func TestServer(t *testing.T) {
 		assert.Equal(t, http.StatusNotFound, rr.Code)
 	})
 
+	t.Run("Remove_Shared_SHA", func(t *testing.T) {
+		data := []byte("shared data between two files")
+		SHA256 := sha256.Sum256(data)
+		SHA := SHA256[:]
+		for _, name := range []string{"shared1.txt", "shared2.txt"} {
+			req, err := upload(http.MethodPost, name, nil, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			server.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusCreated, rr.Code)
+		}
+		for i, name := range []string{"shared1.txt", "shared2.txt"} {
+			rr := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodDelete, "/store?file="+name, nil)
+			server.ServeHTTP(rr, req)
+			assert.Equal(t, http.StatusNoContent, rr.Code)
+			assert.Equal(t, i == 0, store.SHAExists(SHA))
+		}
+	})
+
+}
+
+func TestDiskless(t *testing.T) {
+	defer cleanUp()
+
+	config := &database.Config{Diskless: true, Snapshot: "temp/snapshot.bak"}
+	db, err := database.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("this is test data for a diskless store")
+	if err := db.Add("diskless.txt", nil, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = os.Stat("temp/store")
+	assert.True(t, os.IsNotExist(err))
+
+	db, err = database.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	newData, err := db.Get("diskless.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, data, newData)
+}
+
+func TestEncryption(t *testing.T) {
+	defer cleanUp()
+
+	key := "000102030405060708090a0b0c0d0e0f"
+	newKey := "0f0e0d0c0b0a09080706050403020100"
+	data := []byte("this is test data for an encrypted store")
+
+	_, err := database.New(&database.Config{Path: "temp", Encryption: true})
+	assert.Equal(t, database.ErrMissingKey, err)
+
+	// a key that is not read from a key file can not be rotated
+	db, err := database.New(&database.Config{Path: "temp", Encryption: true, Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Add("encrypted.txt", nil, data); err != nil {
+		t.Fatal(err)
+	}
+	rotated, _ := database.ParseKey(newKey)
+	assert.Equal(t, database.ErrKeyNotStored, db.RotateKey(rotated))
+	db.Close()
+
+	keyFile := path.Join(t.TempDir(), "store.key")
+	assert.NoError(t, os.WriteFile(keyFile, []byte(key+"\n"), 0600))
+	db, err = database.New(&database.Config{Path: "temp", Encryption: true, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, db.RotateKey(rotated))
+	newData, err := db.Get("encrypted.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, data, newData)
+	// the store stays open, and keeps the data written after the rotation
+	assert.NoError(t, db.Add("rotated.txt", nil, data))
+	db.Close()
+	saved, err := os.ReadFile(keyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, newKey, strings.TrimSpace(string(saved)))
+	_, err = os.Stat(keyFile + ".previous")
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = database.New(&database.Config{Path: "temp", Encryption: true, Key: key})
+	assert.Equal(t, database.ErrKeyMismatch, err)
+	_, err = database.New(&database.Config{Path: "temp"})
+	assert.Equal(t, database.ErrKeyMismatch, err)
+
+	db, err = database.New(&database.Config{Path: "temp", Encryption: true, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"encrypted.txt", "rotated.txt"} {
+		newData, err = db.Get(name)
+		assert.NoError(t, err)
+		assert.Equal(t, data, newData)
+	}
+	db.Close()
+
+	// a rotation stopped before the key registry was rewritten leaves the
+	// new key in the key file and the key of the store next to it
+	assert.NoError(t, os.WriteFile(keyFile+".previous", []byte(newKey+"\n"), 0600))
+	assert.NoError(t, os.WriteFile(keyFile, []byte(key+"\n"), 0600))
+	db, err = database.New(&database.Config{Path: "temp", Encryption: true, KeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	newData, err = db.Get("encrypted.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, data, newData)
+	saved, err = os.ReadFile(keyFile)
+	assert.NoError(t, err)
+	assert.Equal(t, newKey, strings.TrimSpace(string(saved)))
+}
+
+func TestAdminAuth(t *testing.T) {
+	db, err := database.New(&database.Config{Diskless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// the default config has no admin token, so every admin request is
+	// rejected
+	conf, err := config.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "", conf.Server.AdminToken)
+	gin.SetMode(gin.TestMode)
+	server := gin.Default()
+	router.Admin(server, db, middleware.Admin(conf))
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/admin/cache", nil),
+		httptest.NewRequest(http.MethodPost, "/admin/backup", nil),
+		httptest.NewRequest(http.MethodPost, "/admin/restore", nil),
+		httptest.NewRequest(http.MethodPost, "/admin/fsck?repair=true", nil),
+	} {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusForbidden, rr.Code, req.URL.Path)
+	}
+
+	// with a token, only the requests that send it are served
+	conf.Server.AdminToken = "secret"
+	server = gin.Default()
+	router.Admin(server, db, middleware.Admin(conf))
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/cache", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	req := httptest.NewRequest(http.MethodGet, "/admin/cache", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestBlobCache(t *testing.T) {
+	defer cleanUp()
+
+	db, err := database.New(&database.Config{Path: "temp", CacheSize: 16, BlobCache: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	gin.SetMode(gin.TestMode)
+	server := gin.Default()
+	router.Store(server, db)
+	router.Admin(server, db, func(ctx *gin.Context) {})
+
+	if err := db.Add("cached.txt", nil, []byte("this is cached test data")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/store?file=cached.txt", nil)
+		server.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/admin/cache", nil)
+	server.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	caches := database.Caches{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &caches))
+	assert.Equal(t, uint64(2), caches.Blob.Hits)
+	assert.Equal(t, uint64(1), caches.Blob.Misses)
+	assert.Equal(t, int64(1), caches.Blob.Entries)
+	assert.Equal(t, int64(16*3/4)<<20, caches.Block.MaxSize)
+
+	// removed data leaves the cache
+	assert.NoError(t, db.Remove("cached.txt"))
+	assert.Equal(t, int64(0), db.CacheStats().Blob.Entries)
+	assert.Equal(t, int64(0), db.CacheStats().Blob.Size)
+}
+
+func TestChunking(t *testing.T) {
+	defer cleanUp()
+
+	db, err := database.New(&database.Config{Diskless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// text larger than a single chunk, and a copy with one word changed
+	words := &bytes.Buffer{}
+	for i := 0; words.Len() < 1<<20; i++ {
+		fmt.Fprintf(words, "word%d ", i%5000)
+	}
+	data := words.Bytes()
+	changed := append([]byte{}, data...)
+	copy(changed[len(changed)/2:], "changed")
+
+	assert.NoError(t, db.Add("large.txt", nil, data))
+	assert.NoError(t, db.Add("changed.txt", nil, changed))
+	newData, err := db.Get("large.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, data, newData)
+	newData, err = db.Get("changed.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, changed, newData)
+
+	count, err := db.WordCount()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(bytes.Fields(data))+len(bytes.Fields(changed))), count)
+
+	stream := &bytes.Buffer{}
+	assert.NoError(t, db.GetStream("large.txt", stream))
+	assert.Equal(t, data, stream.Bytes())
+
+	assert.NoError(t, db.Remove("large.txt"))
+	newData, err = db.Get("changed.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, changed, newData)
+}
+
+func TestVersions(t *testing.T) {
+	defer cleanUp()
+
+	db, err := database.New(&database.Config{Path: "temp", MaxVersions: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	gin.SetMode(gin.TestMode)
+	server := gin.Default()
+	router.Store(server, db)
+
+	fileName := "versioned.txt"
+	contents := [][]byte{
+		[]byte("first version"),
+		[]byte("second version"),
+		[]byte("third version"),
+	}
+	if err := db.Add(fileName, nil, contents[0]); err != nil {
+		t.Fatal(err)
+	}
+	for _, data := range contents[1:] {
+		if err := db.Update(fileName, nil, data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// same data does not add a version
+	if err := db.Update(fileName, nil, contents[2]); err != nil {
+		t.Fatal(err)
+	}
+
+	listVersions := func() []database.Version {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/store/versions?file="+fileName, nil)
+		server.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		versions := []database.Version{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &versions))
+		return versions
+	}
+
+	versions := listVersions()
+	assert.Len(t, versions, 3)
+	for i, version := range versions {
+		SHA := sha256.Sum256(contents[i])
+		assert.Equal(t, uint64(i+1), version.Version)
+		assert.Equal(t, hex.EncodeToString(SHA[:]), version.SHA)
+		assert.Equal(t, int64(len(contents[i])), version.Size)
+	}
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/store/restore?file="+fileName+"&version=1", nil)
+	server.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	data, err := db.Get(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, contents[0], data)
+
+	// restoring adds a version, dropping the oldest one
+	versions = listVersions()
+	assert.Len(t, versions, 3)
+	assert.Equal(t, uint64(2), versions[0].Version)
+	assert.Equal(t, uint64(4), versions[2].Version)
+
+	for _, test := range []struct {
+		query string
+		code  int
+	}{
+		{"file=" + fileName + "&version=1", http.StatusNotFound},
+		{"file=" + fileName + "&version=latest", http.StatusBadRequest},
+		{"file=missing.txt&version=1", http.StatusNotFound},
+	} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/store/restore?"+test.query, nil)
+		server.ServeHTTP(rr, req)
+		assert.Equal(t, test.code, rr.Code, test.query)
+	}
+
+	// the data of dropped versions is freed with the file
+	assert.NoError(t, db.Remove(fileName))
+	for _, data := range contents {
+		SHA := sha256.Sum256(data)
+		assert.False(t, db.SHAExists(SHA[:]))
+	}
+}
+
+func TestTrash(t *testing.T) {
+	defer cleanUp()
+
+	db, err := database.New(&database.Config{Path: "temp", TrashRetention: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	gin.SetMode(gin.TestMode)
+	server := gin.Default()
+	router.Store(server, db)
+
+	fileName := "trashed.txt"
+	data := []byte("this is trashed test data")
+	SHA := sha256.Sum256(data)
+	if err := db.Add(fileName, nil, data); err != nil {
+		t.Fatal(err)
+	}
+
+	remove := func() {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodDelete, "/store?file="+fileName, nil)
+		req.Header.Set("X-Store-User", "tester")
+		server.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+		assert.False(t, db.FileExists(fileName))
+	}
+	listTrash := func() []database.Trashed {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/store/trash", nil)
+		server.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		list := []database.Trashed{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+		return list
+	}
+	request := func(method string, target string) int {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest(method, target, nil))
+		return rr.Code
+	}
+
+	// the data stays in the store while the file is in the trash bin
+	remove()
+	assert.True(t, db.SHAExists(SHA[:]))
+	list := listTrash()
+	assert.Len(t, list, 1)
+	assert.Equal(t, fileName, list[0].Name)
+	assert.Equal(t, hex.EncodeToString(SHA[:]), list[0].SHA)
+	assert.Equal(t, int64(len(data)), list[0].Size)
+	assert.Equal(t, "tester@192.0.2.1", list[0].DeletedBy)
+
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/store/trash/restore?file="+fileName))
+	restored, err := db.Get(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, data, restored)
+	assert.Empty(t, listTrash())
+
+	// a restored file does not replace a file added under the same name
+	remove()
+	if err := db.Add(fileName, nil, []byte("this is new test data")); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusConflict, request(http.MethodPost, "/store/trash/restore?file="+fileName))
+	assert.Equal(t, http.StatusNotFound, request(http.MethodPost, "/store/trash/restore?file=missing.txt"))
+
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodDelete, "/store/trash"))
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodDelete, "/store/trash?file="+fileName+"&id=first"))
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/store/trash?file=missing.txt"))
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/store/trash?file="+fileName))
+	assert.False(t, db.SHAExists(SHA[:]))
+	assert.Empty(t, listTrash())
+
+	remove()
+	assert.Len(t, listTrash(), 1)
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/store/trash?all=true"))
+	assert.Empty(t, listTrash())
+}
+
+func TestPaths(t *testing.T) {
+	defer cleanUp()
+
+	db, err := database.New(&database.Config{Diskless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	gin.SetMode(gin.TestMode)
+	server := gin.Default()
+	router.Store(server, db)
+
+	files := []string{"a.txt", "a/report.txt", "a/sub/deep.txt", "a0.txt", "b/report.txt", "top.txt"}
+	for _, fileName := range files {
+		req, err := upload(http.MethodPost, fileName, nil, []byte("data of "+fileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusCreated, rr.Code, fileName)
+	}
+	for _, fileName := range files {
+		data, err := db.Get(fileName)
+		assert.NoError(t, err)
+		assert.Equal(t, "data of "+fileName, string(data))
+	}
+
+	for _, fileName := range []string{"../up.txt", "..", "/root.txt", "a//b.txt", "a/./b.txt", "a/../b.txt", "a/", "."} {
+		req, err := upload(http.MethodPut, fileName, nil, []byte("invalid"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, fileName)
+	}
+
+	for _, test := range []struct {
+		query string
+		list  []string
+	}{
+		{"", []string{"a.txt", "a/", "a0.txt", "b/", "top.txt"}},
+		{"dir=a", []string{"a/report.txt", "a/sub/"}},
+		{"dir=a/", []string{"a/report.txt", "a/sub/"}},
+		{"dir=a&recursive=true", []string{"a/report.txt", "a/sub/deep.txt"}},
+		{"recursive=true", files},
+		{"dir=c", []string{}},
+		{"recursive=true&prefix=a/", []string{"a/report.txt", "a/sub/deep.txt"}},
+		{"recursive=true&glob=report.*", []string{"a/report.txt", "b/report.txt"}},
+		{"sort=name&reverse=true", []string{"top.txt", "b/", "a0.txt", "a/", "a.txt"}},
+		{"dir=a&recursive=true&sort=size", []string{"a/report.txt", "a/sub/deep.txt"}},
+	} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/store/list?"+test.query, nil)
+		server.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		list := []string{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &list))
+		assert.Equal(t, test.list, list, test.query)
+	}
+
+	for _, query := range []string{"dir=../a", "sort=color", "glob=[", "limit=-1", "sort=size&after=a.txt"} {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/store/list?"+query, nil)
+		server.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusBadRequest, rr.Code, query)
+	}
+
+	// pages are read with the cursor of the previous page
+	names := []string{}
+	query := url.Values{"recursive": {"true"}, "limit": {"4"}}
+	for {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/store/list?"+query.Encode(), nil)
+		server.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		page := []string{}
+		assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &page))
+		names = append(names, page...)
+		next := rr.Header().Get("X-Store-Next")
+		if next == "" {
+			break
+		}
+		assert.Len(t, page, 4)
+		query.Set("after", next)
+	}
+	assert.Equal(t, files, names)
+}
+
+func TestWordIndex(t *testing.T) {
+	defer cleanUp()
+
+	config := &database.Config{Path: "temp", TrashRetention: time.Hour}
+	db, err := database.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// more distinct words than the indexer applies at once
+	words := []string{}
+	for i := 0; i < 25000; i++ {
+		words = append(words, fmt.Sprintf("word%d", i))
+	}
+	files := map[string]string{
+		"one.txt":   "The quick brown fox",
+		"two.txt":   "the lazy DOG and the fox",
+		"three.txt": "the quick brown fox",
+		"words.txt": strings.Join(words, "\n"),
+		// long words and invalid UTF-8 are counted, and counting stops at a
+		// word too long for a bufio.Scanner
+		"five.txt": "Long " + strings.Repeat("y", 100) + " \xffbad",
+		"six.txt":  "first " + strings.Repeat("z", bufio.MaxScanTokenSize) + " last",
+	}
+	for name, data := range files {
+		if err := db.Add(name, nil, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Update("two.txt", nil, []byte("the lazy dog")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Trash("three.txt", "tester"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Remove("words.txt"); err != nil {
+		t.Fatal(err)
+	}
+	expected := map[string]int64{
+		"the":   2,
+		"quick": 1,
+		"brown": 1,
+		"fox":   1,
+		"lazy":  1,
+		"dog":   1,
+		"long":  1,
+		"first": 1,
+
+		strings.Repeat("y", 100): 1,
+		"\ufffdbad":              1,
+	}
+
+	check := func(db database.Store) {
+		count, err := db.WordCount()
+		assert.NoError(t, err)
+		assert.Equal(t, int64(11), count)
+		frequency, err := db.WordFrequency()
+		assert.NoError(t, err)
+		assert.Equal(t, expected, frequency)
+	}
+	check(db)
+
+	// the counts are kept when the store is opened again
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = database.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+
+	if err := db.RestoreTrash("three.txt", 0); err != nil {
+		t.Fatal(err)
+	}
+	expected["the"]++
+	expected["quick"]++
+	expected["brown"]++
+	expected["fox"]++
+	frequency, err := db.WordFrequency()
+	assert.NoError(t, err)
+	assert.Equal(t, expected, frequency)
+}
+
+func TestSearch(t *testing.T) {
+	defer cleanUp()
+
+	db, err := database.New(&database.Config{Diskless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	gin.SetMode(gin.TestMode)
+	server := gin.Default()
+	router.Store(server, db)
+
+	files := map[string]string{
+		"fox.txt":      "The quick brown fox jumps over the lazy dog.",
+		"dog.txt":      "A lazy dog sleeps. The dog is brown, the dog is lazy.",
+		"haystack.txt": strings.Repeat("hay ", 200) + "a needle in the haystack " + strings.Repeat("hay ", 200),
+		"copy/fox.txt": "The quick brown fox jumps over the lazy dog.",
+	}
+	for name, data := range files {
+		req, err := upload(http.MethodPost, name, nil, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusCreated, rr.Code, name)
+	}
+
+	search := func(query string) ([]database.SearchResult, int) {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/store/search?q="+url.QueryEscape(query), nil)
+		server.ServeHTTP(rr, req)
+		results := []database.SearchResult{}
+		if rr.Code == http.StatusOK {
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &results))
+		}
+		return results, rr.Code
+	}
+	names := func(results []database.SearchResult) []string {
+		list := []string{}
+		for _, result := range results {
+			list = append(list, result.Name)
+		}
+		return list
+	}
+
+	// files are indexed in the background
+	assert.Eventually(t, func() bool {
+		results, _ := search("needle")
+		return len(results) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	for _, test := range []struct {
+		query string
+		names []string
+	}{
+		{"fox", []string{"copy/fox.txt", "fox.txt"}},
+		{"LAZY dog", []string{"dog.txt", "copy/fox.txt", "fox.txt"}},
+		{"quick AND dog", []string{"copy/fox.txt", "fox.txt"}},
+		{"sleeps OR needle", []string{"dog.txt", "haystack.txt"}},
+		{`"lazy dog"`, []string{"copy/fox.txt", "dog.txt", "fox.txt"}},
+		{`"dog is lazy"`, []string{"dog.txt"}},
+		{`"dog lazy"`, []string{}},
+		{"cat", []string{}},
+	} {
+		results, code := search(test.query)
+		assert.Equal(t, http.StatusOK, code, test.query)
+		assert.Equal(t, test.names, names(results), test.query)
+	}
+
+	results, _ := search("needle")
+	SHA := sha256.Sum256([]byte(files["haystack.txt"]))
+	assert.Equal(t, hex.EncodeToString(SHA[:]), results[0].SHA)
+	assert.Contains(t, results[0].Snippet, "a needle in the haystack")
+	assert.Less(t, len(results[0].Snippet), 250)
+
+	for _, query := range []string{"", "fox OR", `"lazy dog`, "AND"} {
+		_, code := search(query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/store/search?q=fox&limit=1", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &results))
+	assert.Len(t, results, 1)
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/store/search?q=fox&limit=none", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// removed files drop out of the results
+	if err := db.Remove("copy/fox.txt"); err != nil {
+		t.Fatal(err)
+	}
+	results, _ = search("fox")
+	assert.Equal(t, []string{"fox.txt"}, names(results))
+	if err := db.Remove("fox.txt"); err != nil {
+		t.Fatal(err)
+	}
+	assert.Eventually(t, func() bool {
+		results, _ := search("fox")
+		return len(results) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestBackup(t *testing.T) {
+	defer cleanUp()
+
+	db, err := database.New(&database.Config{Path: "temp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	gin.SetMode(gin.TestMode)
+	server := gin.Default()
+	router.Admin(server, db, func(ctx *gin.Context) {})
+
+	backup := func(server *gin.Engine, since string) ([]byte, string) {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/backup?since="+since, nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		return rr.Body.Bytes(), rr.Result().Trailer.Get("X-Store-Version")
+	}
+	restore := func(server *gin.Engine, data []byte, incremental bool) {
+		rr := httptest.NewRecorder()
+		url := fmt.Sprintf("/admin/restore?incremental=%t", incremental)
+		server.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, url, bytes.NewReader(data)))
+		assert.Equal(t, http.StatusNoContent, rr.Code)
+	}
+
+	if err := db.Add("kept.txt", nil, []byte("this is kept data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Add("removed.txt", nil, []byte("this is removed data")); err != nil {
+		t.Fatal(err)
+	}
+	full, version := backup(server, "")
+	assert.NotEmpty(t, version)
+
+	// an incremental backup has the changes since the full one
+	if err := db.Remove("removed.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Add("added.txt", nil, []byte("this is added data")); err != nil {
+		t.Fatal(err)
+	}
+	incremental, next := backup(server, version)
+	assert.NotEqual(t, version, next)
+
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/admin/backup?since=last", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	// a full restore replaces the content of the store
+	restored, err := database.New(&database.Config{Diskless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	if err := restored.Add("junk.txt", nil, []byte("this is junk data")); err != nil {
+		t.Fatal(err)
+	}
+	other := gin.Default()
+	router.Admin(other, restored, func(ctx *gin.Context) {})
+
+	restore(other, full, false)
+	assert.False(t, restored.FileExists("junk.txt"))
+	assert.True(t, restored.FileExists("removed.txt"))
+	assert.False(t, restored.FileExists("added.txt"))
+
+	restore(other, incremental, true)
+	list, err := restored.List(database.ListOptions{Recursive: true})
+	assert.NoError(t, err)
+	if assert.Len(t, list.Files, 2) {
+		assert.Equal(t, "added.txt", list.Files[0].Name)
+		assert.Equal(t, "kept.txt", list.Files[1].Name)
+	}
+	data, err := restored.Get("added.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("this is added data"), data)
+	count, err := restored.WordCount()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(8), count)
+}
+
+func TestQuotas(t *testing.T) {
+	defer cleanUp()
+
+	db, err := database.New(&database.Config{Diskless: true, MaxFiles: 1, MaxFileSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	gin.SetMode(gin.TestMode)
+	server := gin.Default()
+	router.Store(server, db)
+
+	send := func(method string, name string, data []byte) *httptest.ResponseRecorder {
+		sum := sha256.Sum256(data)
+		req, err := upload(method, name, sum[:], data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := send(http.MethodPost, "large.txt", bytes.Repeat([]byte("large "), 200000))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+	assert.Equal(t, database.ErrFileTooLarge.Error(), rr.Body.String())
+
+	rr = send(http.MethodPost, "first.txt", []byte("this is the first file"))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	rr = send(http.MethodPut, "second.txt", []byte("this is one file too many"))
+	assert.Equal(t, http.StatusInsufficientStorage, rr.Code)
+	assert.Equal(t, database.ErrFileQuota.Error(), rr.Body.String())
+
+	rr = httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/store/usage", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	usage := database.Usage{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &usage))
+	assert.Equal(t, database.Quota{Used: 1, Limit: 1}, usage.Files)
+	assert.Equal(t, database.Quota{Used: 22}, usage.LogicalBytes)
+	assert.Equal(t, int64(1<<20), usage.MaxFileSize)
+}
+
+func TestExpiry(t *testing.T) {
+	defer cleanUp()
+
+	db, err := database.New(&database.Config{Diskless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	gin.SetMode(gin.TestMode)
+	server := gin.Default()
+	router.Store(server, db)
+
+	// the ttl field is sent before the file, like the client does
+	send := func(server *gin.Engine, method string, name string, ttl string) int {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		assert.NoError(t, writer.WriteField("name", name))
+		assert.NoError(t, writer.WriteField("ttl", ttl))
+		ioWriter, _ := writer.CreateFormFile("file", name)
+		_, err := io.WriteString(ioWriter, "this is the log of "+name)
+		assert.NoError(t, err)
+		assert.NoError(t, writer.Close())
+		req := httptest.NewRequest(method, "/store", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusCreated, send(server, http.MethodPost, "build.log", "24h"))
+	assert.Equal(t, http.StatusCreated, send(server, http.MethodPut, "test.log", "1h"))
+	assert.Equal(t, http.StatusBadRequest, send(server, http.MethodPost, "bad.log", "tomorrow"))
+	assert.Equal(t, http.StatusBadRequest, send(server, http.MethodPost, "bad.log", "-1h"))
+	assert.False(t, db.FileExists("bad.log"))
+
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/store/list?details=true", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var files []database.File
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &files))
+	if assert.Len(t, files, 2) && assert.NotNil(t, files[0].Expires) {
+		assert.WithinDuration(t, time.Now().Add(24*time.Hour), *files[0].Expires, time.Minute)
+	}
+
+	// backends without expiry refuse files with a ttl
+	memory, err := database.Open(&database.Config{Backend: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer memory.Close()
+	other := gin.Default()
+	router.Store(other, memory)
+	assert.Equal(t, http.StatusNotImplemented, send(other, http.MethodPost, "build.log", "24h"))
+	assert.Equal(t, http.StatusCreated, send(other, http.MethodPost, "build.log", ""))
+}
+
+func TestBuckets(t *testing.T) {
+	defer cleanUp()
+
+	db, err := database.New(&database.Config{Diskless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	gin.SetMode(gin.TestMode)
+	server := gin.Default()
+	router.Store(server, db)
+
+	serve := func(method string, target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest(method, target, nil))
+		return rr
+	}
+	add := func(store string, name string, data string) int {
+		req, err := upload(http.MethodPost, name, nil, []byte(data))
+		assert.NoError(t, err)
+		req.URL.Path = store
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPut, "/buckets/team-a").Code)
+	assert.Equal(t, http.StatusCreated, serve(http.MethodPut, "/buckets/team-b").Code)
+	assert.Equal(t, http.StatusConflict, serve(http.MethodPut, "/buckets/team-a").Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPut, "/buckets/Team").Code)
+
+	rr := serve(http.MethodGet, "/buckets")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var buckets []database.BucketInfo
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &buckets))
+	if assert.Len(t, buckets, 2) {
+		assert.Equal(t, "team-a", buckets[0].Name)
+		assert.Equal(t, "team-b", buckets[1].Name)
+	}
+
+	// the same name in each bucket and at the root
+	assert.Equal(t, http.StatusCreated, add("/buckets/team-a/store", "notes.txt", "alpha beta"))
+	assert.Equal(t, http.StatusCreated, add("/buckets/team-b/store", "notes.txt", "gamma"))
+	assert.Equal(t, http.StatusCreated, add("/store", "notes.txt", "delta delta delta"))
+	assert.Equal(t, http.StatusNotFound, add("/buckets/team-c/store", "notes.txt", "gamma"))
+
+	for _, test := range []struct {
+		store string
+		data  string
+		count string
+	}{
+		{"/buckets/team-a/store", "alpha beta", "2"},
+		{"/buckets/team-b/store", "gamma", "1"},
+		{"/store", "delta delta delta", "3"},
+	} {
+		rr := serve(http.MethodGet, test.store+"?file=notes.txt")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, test.data, rr.Body.String())
+		rr = serve(http.MethodGet, test.store+"/count")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, test.count, rr.Body.String())
+		rr = serve(http.MethodGet, test.store+"/list")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `["notes.txt"]`, rr.Body.String())
+	}
+
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodDelete, "/buckets/team-a").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodDelete, "/buckets/team-a").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/buckets/team-a/store?file=notes.txt").Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/buckets/team-b/store?file=notes.txt").Code)
+
+	// backends without buckets
+	memory, err := database.Open(&database.Config{Backend: "memory"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer memory.Close()
+	other := gin.Default()
+	router.Store(other, memory)
+	rr = httptest.NewRecorder()
+	other.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/buckets/team-a", nil))
+	assert.Equal(t, http.StatusNotImplemented, rr.Code)
+}
+
+func TestMove(t *testing.T) {
+	defer cleanUp()
+
+	db, err := database.New(&database.Config{Diskless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	gin.SetMode(gin.TestMode)
+	server := gin.Default()
+	router.Store(server, db)
+
+	assert.NoError(t, db.Add("a.txt", nil, []byte("this is moved data")))
+	assert.NoError(t, db.Add("b.txt", nil, []byte("this is other data")))
+
+	for _, test := range []struct {
+		target string
+		code   int
+	}{
+		{"/store/rename?file=a.txt&to=dir/a.txt", http.StatusOK},
+		{"/store/rename?file=a.txt&to=c.txt", http.StatusNotFound},
+		{"/store/rename?file=dir/a.txt&to=b.txt", http.StatusConflict},
+		{"/store/rename?file=dir/a.txt&to=../a.txt", http.StatusBadRequest},
+		{"/store/copy?file=dir/a.txt&to=copy.txt", http.StatusCreated},
+		{"/store/copy?file=dir/a.txt&to=b.txt", http.StatusConflict},
+		{"/store/copy?file=a.txt&to=d.txt", http.StatusNotFound},
+	} {
+		rr := httptest.NewRecorder()
+		server.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, test.target, nil))
+		assert.Equal(t, test.code, rr.Code, test.target)
+	}
+	list, err := db.List(database.ListOptions{Recursive: true})
+	assert.NoError(t, err)
+	if assert.Len(t, list.Files, 3) {
+		assert.Equal(t, "b.txt", list.Files[0].Name)
+		assert.Equal(t, "copy.txt", list.Files[1].Name)
+		assert.Equal(t, "dir/a.txt", list.Files[2].Name)
+	}
+	data, err := db.Get("copy.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "this is moved data", string(data))
+}
+
+func TestWatch(t *testing.T) {
+	defer cleanUp()
+
+	db, err := database.New(&database.Config{Diskless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	gin.SetMode(gin.TestMode)
+	server := gin.Default()
+	router.Store(server, db)
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	rr := httptest.NewRecorder()
+	server.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/store/watch?after=first", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	assert.NoError(t, db.Add("a.txt", nil, []byte("this is watched data")))
+	assert.NoError(t, db.Rename("a.txt", "b.txt"))
+
+	// a reconnecting client resumes after the last event it received
+	req, err := http.NewRequest(http.MethodGet, httpServer.URL+"/store/watch", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", "0")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	// events written once the stream is open are sent too
+	assert.NoError(t, db.Remove("b.txt"))
+	var lines []string
+	buf := make([]byte, 4096)
+	for strings.Count(strings.Join(lines, ""), "\n\n") < 3 {
+		n, err := res.Body.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, string(buf[:n]))
+	}
+	events := strings.Split(strings.TrimSpace(strings.Join(lines, "")), "\n\n")
+	if assert.Len(t, events, 3) {
+		assert.True(t, strings.HasPrefix(events[0], "id: 1\nevent: add\ndata: "))
+		assert.True(t, strings.HasPrefix(events[1], "id: 2\nevent: rename\ndata: "))
+		assert.True(t, strings.HasPrefix(events[2], "id: 3\nevent: remove\ndata: "))
+		var event database.Event
+		assert.NoError(t, json.Unmarshal([]byte(events[1][strings.Index(events[1], "data: ")+6:]), &event))
+		assert.Equal(t, "b.txt", event.Name)
+		assert.Equal(t, "a.txt", event.From)
+	}
+
+	// a client left behind the events kept, here by restoring a store whose
+	// events were pruned, is told to list the files again
+	config := &database.Config{Path: path.Join(t.TempDir(), "pruned")}
+	pruned, err := database.New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, pruned.Add(fmt.Sprintf("%d.txt", i), nil, []byte("this is pruned data")))
+	}
+	assert.NoError(t, pruned.Close())
+	config.EventRetention = time.Nanosecond
+	if pruned, err = database.New(config); err != nil {
+		t.Fatal(err)
+	}
+	defer pruned.Close()
+	assert.Eventually(t, func() bool {
+		last, err := pruned.LastEvent()
+		return err == nil && last.Name == ""
+	}, 5*time.Second, 50*time.Millisecond)
+	backup := &bytes.Buffer{}
+	_, err = pruned.Backup(backup, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, db.RestoreBackup(backup, false))
+	rest, err := io.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(rest), "event: reset\ndata: "), string(rest))
+	if assert.Equal(t, 1, strings.Count(string(rest), "\n\n")) {
+		var event database.Event
+		assert.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(string(rest)[len("event: reset\ndata: "):])), &event))
+		assert.Equal(t, uint64(3), event.Sequence)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	defer cleanUp()
+	gin.SetMode(gin.TestMode)
+
+	leader, err := database.New(&database.Config{Diskless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	leaderServer := gin.Default()
+	var blobs int32
+	leaderServer.Use(func(ctx *gin.Context) {
+		if ctx.Request.URL.Path == "/store/blob" {
+			atomic.AddInt32(&blobs, 1)
+		}
+	})
+	router.Store(leaderServer, leader)
+	conf, err := config.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Server.AdminToken = "secret"
+	router.Blob(leaderServer, leader, middleware.Admin(conf))
+	leaderHTTP := httptest.NewServer(leaderServer)
+	defer leaderHTTP.Close()
+
+	// data is only fetched with the admin token of the leader
+	SHA := sha256.Sum256([]byte("this is the first data"))
+	res, err := http.Get(leaderHTTP.URL + "/store/blob?sha=" + hex.EncodeToString(SHA[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, res.StatusCode)
+	atomic.StoreInt32(&blobs, 0)
+
+	assert.NoError(t, leader.Add("a.txt", nil, []byte("this is the first data")))
+	assert.NoError(t, leader.Add("dir/b.txt", nil, []byte("this is the second data")))
+
+	store, err := database.New(&database.Config{Diskless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	assert.NoError(t, store.Add("stale.txt", nil, []byte("this is not on the leader")))
+	follower, err := replication.NewFollower(leaderHTTP.URL, "secret", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	followerServer := gin.Default()
+	followerServer.Use(middleware.ReadOnly())
+	router.Store(followerServer, store)
+	router.Replication(followerServer, follower)
+
+	// the files of the follower are the same as the files of the leader
+	sameFiles := func() bool {
+		want, err := leader.List(database.ListOptions{Recursive: true, Details: true})
+		if err != nil {
+			return false
+		}
+		got, err := store.List(database.ListOptions{Recursive: true, Details: true})
+		if err != nil || len(got.Files) != len(want.Files) {
+			return false
+		}
+		for i := range want.Files {
+			if got.Files[i].Name != want.Files[i].Name || got.Files[i].SHA != want.Files[i].SHA {
+				return false
+			}
+		}
+		return true
+	}
+	assert.Eventually(t, sameFiles, 5*time.Second, 50*time.Millisecond)
+	assert.False(t, store.FileExists("stale.txt"))
+
+	// changes are followed, and data already on the follower is not fetched
+	assert.NoError(t, leader.Update("a.txt", nil, []byte("this is the updated data")))
+	assert.NoError(t, leader.Rename("dir/b.txt", "c.txt"))
+	assert.NoError(t, leader.Add("d.txt", nil, []byte("this is the updated data")))
+	assert.NoError(t, leader.Remove("a.txt"))
+	assert.Eventually(t, sameFiles, 5*time.Second, 50*time.Millisecond)
+	data, err := store.Get("d.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, "this is the updated data", string(data))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&blobs))
+
+	last, err := leader.LastEvent()
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		rr := httptest.NewRecorder()
+		followerServer.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/replication", nil))
+		var status replication.Status
+		if rr.Code != http.StatusOK || json.Unmarshal(rr.Body.Bytes(), &status) != nil {
+			return false
+		}
+		return status.Connected && status.Sequence == last.Sequence && status.LeaderSequence == last.Sequence && status.Lag == 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	// the follower serves reads only
+	rr := httptest.NewRecorder()
+	followerServer.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/store?file=c.txt", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "this is the second data", rr.Body.String())
+	req, err := upload(http.MethodPost, "e.txt", nil, []byte("this is written to the follower"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	followerServer.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	rr = httptest.NewRecorder()
+	followerServer.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, "/store?file=c.txt", nil))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	// files written to a bucket of the leader stay on the leader, and the
+	// buckets of the follower are not served
+	rr = httptest.NewRecorder()
+	leaderServer.ServeHTTP(rr, httptest.NewRequest(http.MethodPut, "/buckets/photos", nil))
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	req, err = upload(http.MethodPost, "g.txt", nil, []byte("this is written to a bucket"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.URL.Path = "/buckets/photos/store"
+	rr = httptest.NewRecorder()
+	leaderServer.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	assert.NoError(t, leader.Add("f.txt", nil, []byte("this is written after the bucket")))
+	assert.Eventually(t, sameFiles, 5*time.Second, 50*time.Millisecond)
+	assert.False(t, store.FileExists("g.txt"))
+	for _, target := range []string{"/buckets", "/buckets/photos/store?file=g.txt", "/buckets/photos/store/list"} {
+		rr = httptest.NewRecorder()
+		followerServer.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, target, nil))
+		assert.Equal(t, http.StatusNotImplemented, rr.Code, target)
+	}
+}
+
+func TestReplicationPruned(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	path := t.TempDir()
+	leader, err := database.New(&database.Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, leader.Add("a.txt", nil, []byte("this is the first data")))
+	assert.NoError(t, leader.Add("b.txt", nil, []byte("this is the second data")))
+	assert.NoError(t, leader.Close())
+
+	// the leader was idle for longer than the retention, so it has no events
+	// left when the follower starts
+	leader, err = database.New(&database.Config{Path: path, EventRetention: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	assert.Eventually(t, func() bool {
+		_, err := leader.Watch(context.Background(), 0)
+		return err == database.ErrEventsPruned
+	}, 5*time.Second, 50*time.Millisecond)
+	leaderServer := gin.Default()
+	router.Store(leaderServer, leader)
+	router.Blob(leaderServer, leader, func(ctx *gin.Context) {})
+	leaderHTTP := httptest.NewServer(leaderServer)
+	defer leaderHTTP.Close()
+
+	store, err := database.New(&database.Config{Diskless: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	follower, err := replication.NewFollower(leaderHTTP.URL, "", store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+
+	// the follower connects from the last sequence number of the leader, and
+	// follows the changes that come
+	assert.Eventually(t, func() bool {
+		status := follower.Status()
+		return status.Connected && status.Sequence == 2 && store.FileExists("b.txt")
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.NoError(t, leader.Add("c.txt", nil, []byte("this is written later")))
+	assert.Eventually(t, func() bool {
+		data, err := store.Get("c.txt")
+		return err == nil && string(data) == "this is written later"
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Equal(t, uint64(3), follower.Status().Sequence)
+	assert.Empty(t, follower.Status().Error)
+}
+
+func TestCluster(t *testing.T) {
+	defer cleanUp()
+	gin.SetMode(gin.TestMode)
+
+	// the servers are started first, so that the nodes know their URLs
+	const size = 3
+	engines := make([]*gin.Engine, size)
+	servers := make([]*httptest.Server, size)
+	peers := make([]cluster.Peer, size)
+	for i := range servers {
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			engines[i].ServeHTTP(w, r)
+		}))
+		defer servers[i].Close()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		address := listener.Addr().String()
+		listener.Close()
+		peers[i] = cluster.Peer{ID: fmt.Sprintf("node%d", i), Address: address, URL: servers[i].URL}
+	}
+	nodes := make([]*cluster.Node, size)
+	for i := range nodes {
+		db, err := database.New(&database.Config{Diskless: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes[i], err = cluster.New(&cluster.Config{
+			NodeID:   peers[i].ID,
+			Peers:    peers,
+			Path:     path.Join("temp", "cluster", peers[i].ID),
+			Replicas: 2,
+		}, db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer nodes[i].Close()
+		engines[i] = gin.Default()
+		engines[i].Use(middleware.Forward(nodes[i]))
+		router.Store(engines[i], nodes[i])
+		router.Blob(engines[i], nodes[i], func(ctx *gin.Context) {})
+		router.Cluster(engines[i], nodes[i], func(ctx *gin.Context) {})
+	}
+
+	// send a request to the server of a node, over HTTP so that it can be
+	// forwarded
+	send := func(i int, req *http.Request) *http.Response {
+		out, err := http.NewRequest(req.Method, servers[i].URL+req.URL.String(), req.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out.Header = req.Header
+		res, err := http.DefaultClient.Do(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res
+	}
+
+	// returns the index of the leader among the nodes still up
+	leader := func(up []int) int {
+		for _, i := range up {
+			if nodes[i].IsLeader() {
+				return i
+			}
+		}
+		return -1
+	}
+	up := []int{0, 1, 2}
+	assert.Eventually(t, func() bool { return leader(up) >= 0 }, 10*time.Second, 50*time.Millisecond)
+	first := leader(up)
+	if first < 0 {
+		t.FailNow()
+	}
+	other := (first + 1) % size
+
+	rr := httptest.NewRecorder()
+	engines[other].ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/cluster", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var status cluster.Status
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &status))
+	assert.Equal(t, peers[other].ID, status.ID)
+	assert.Equal(t, peers[first].ID, status.Leader)
+
+	// a write made on a follower is forwarded to the leader, and applied on
+	// every node
+	req, err := upload(http.MethodPost, "a.txt", nil, []byte("this is written to a follower"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusCreated, send(other, req).StatusCode)
+	hasFile := func(up []int, name string, data string) func() bool {
+		return func() bool {
+			for _, i := range up {
+				got, err := nodes[i].Get(name)
+				if err != nil || string(got) != data {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	assert.Eventually(t, hasFile(up, "a.txt", "this is written to a follower"), 10*time.Second, 50*time.Millisecond)
+
+	// the same file can not be added twice
+	req, err = upload(http.MethodPost, "a.txt", nil, []byte("this is written again"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusConflict, send(other, req).StatusCode)
+
+	// with the leader down, the others elect a leader and take writes
+	servers[first].Close()
+	assert.NoError(t, nodes[first].Close())
+	up = []int{other, (first + 2) % size}
+	assert.Eventually(t, func() bool { return leader(up) >= 0 }, 15*time.Second, 50*time.Millisecond)
+	req, err = upload(http.MethodPut, "a.txt", nil, []byte("this is written without the first leader"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, http.StatusOK, send(up[1], req).StatusCode)
+	req = httptest.NewRequest(http.MethodDelete, "/store?file=missing.txt", nil)
+	assert.Equal(t, http.StatusNotFound, send(up[0], req).StatusCode)
+	assert.Eventually(t, hasFile(up, "a.txt", "this is written without the first leader"), 10*time.Second, 50*time.Millisecond)
 }